@@ -1,46 +1,82 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"mime"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
 
 	"github.com/bmizerany/pat"
 )
 
 type api struct {
 	http.Handler
-	registry *registry
+	registry    *registry
+	logs        *logSet
+	maintenance *maintenance
 
 	enabled bool
 	sync.RWMutex
 }
 
-func newAPI(r *registry) *api {
+func newAPI(r *registry, logs *logSet) *api {
 	var (
 		mux = pat.New()
 		api = &api{
-			Handler:  mux,
-			registry: r,
+			Handler:     mux,
+			registry:    r,
+			logs:        logs,
+			maintenance: &maintenance{},
 		}
 	)
 
-	mux.Put("/containers/:id", http.HandlerFunc(api.handleCreate))
+	mux.Put("/containers/:id", api.whenEnabled(api.handleCreate))
 	mux.Get("/containers/:id", http.HandlerFunc(api.handleGet))
-	mux.Del("/containers/:id", http.HandlerFunc(api.handleDestroy))
+	mux.Get("/containers/:id/log", http.HandlerFunc(api.handleLog))
+	mux.Get("/containers/:id/log/archive", http.HandlerFunc(api.handleLogArchive))
+	mux.Get("/containers/:id/events", http.HandlerFunc(api.handleHistory))
+	mux.Get("/containers/:id/metrics", http.HandlerFunc(api.handleMetrics))
+	mux.Del("/containers/:id", api.whenEnabled(api.handleDestroy))
 	mux.Post("/containers/:id/heartbeat", http.HandlerFunc(api.handleHeartbeat))
-	mux.Post("/containers/:id/start", http.HandlerFunc(api.handleStart))
-	mux.Post("/containers/:id/stop", http.HandlerFunc(api.handleStop))
+	mux.Post("/containers/:id/start", api.whenEnabled(api.handleStart))
+	mux.Post("/containers/:id/stop", api.whenEnabled(api.handleStop))
+	mux.Post("/containers/:id/restart", api.whenEnabled(api.handleRestart))
+	mux.Post("/containers/:id/pause", api.whenEnabled(api.handlePause))
+	mux.Post("/containers/:id/resume", api.whenEnabled(api.handleResume))
+	mux.Post("/containers/:id/signal", api.whenEnabled(api.handleSignal))
+	mux.Post("/containers/:id/exec", api.whenEnabled(api.handleExec))
+	mux.Patch("/containers/:id/resources", api.whenEnabled(api.handleUpdateResources))
 	mux.Get("/containers", http.HandlerFunc(api.handleList))
 
 	mux.Get("/resources", http.HandlerFunc(api.handleResources))
+	mux.Get("/host", http.HandlerFunc(api.handleHost))
+	mux.Get("/version", http.HandlerFunc(api.handleVersion))
+	mux.Get("/artifacts", http.HandlerFunc(api.handleArtifacts))
+
+	mux.Get("/healthz", http.HandlerFunc(api.handleHealthz))
+	mux.Get("/readyz", http.HandlerFunc(api.handleReadyz))
+
+	// with an admin listener, maintenance windows are opened there
+	if *adminAddr == "" {
+		mux.Post("/maintenance", api.whenEnabled(api.handleBeginMaintenance))
+		mux.Del("/maintenance", api.whenEnabled(api.handleEndMaintenance))
+	}
 
 	return api
 }
@@ -52,6 +88,52 @@ func (a *api) Enable() {
 	a.enabled = true
 }
 
+// isEnabled returns true once the agent has recovered its containers and
+// accepts requests.
+func (a *api) isEnabled() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	return a.enabled
+}
+
+// whenEnabled rejects requests with 503 Service Unavailable until the agent
+// has recovered its containers, so that mutating requests don't act on an
+// incomplete registry. Retry-After tells clients when recovery should be
+// done.
+func (a *api) whenEnabled(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.isEnabled() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil((3 * maxHeartbeatInterval()).Seconds()))))
+			writeError(w, http.StatusServiceUnavailable, errors.Unavailable, "recovering containers")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// writeError answers with the error, as a JSON errors.Error.
+func writeError(w http.ResponseWriter, status int, code errors.Code, message string) {
+	errors.Write(w, status, errors.New(status, code, message))
+}
+
+// handleHealthz reports that the agent is alive.
+func (a *api) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the agent is ready, i.e. it has recovered the
+// containers of a previous run and accepts requests.
+func (a *api) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !a.isEnabled() {
+		writeError(w, http.StatusServiceUnavailable, errors.Unavailable, "recovering containers")
+		return
+	}
+
+	w.Write([]byte("ready\n"))
+}
+
 func (a *api) handleGet(w http.ResponseWriter, r *http.Request) {
 	var (
 		id = r.URL.Query().Get(":id")
@@ -59,13 +141,69 @@ func (a *api) handleGet(w http.ResponseWriter, r *http.Request) {
 
 	container, ok := a.registry.Get(id)
 	if !ok {
-		http.Error(w, "", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
 		return
 	}
 
 	buf, err := json.MarshalIndent(container, "", "  ")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
+		return
+	}
+
+	w.Write(buf)
+}
+
+// handleHistory returns the last events of a container, oldest first.
+func (a *api) handleHistory(w http.ResponseWriter, r *http.Request) {
+	var (
+		id = r.URL.Query().Get(":id")
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	buf, err := json.MarshalIndent(container.History(), "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
+		return
+	}
+
+	w.Write(buf)
+}
+
+// handleMetrics returns the last metrics samples of a container, oldest
+// first, optionally only those within the window query parameter, e.g. 10m.
+func (a *api) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var (
+		id     = r.URL.Query().Get(":id")
+		window = r.URL.Query().Get("window")
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	samples := container.Metrics()
+
+	if window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, errors.BadRequest, fmt.Sprintf("invalid window %q", window))
+			return
+		}
+
+		samples = since(samples, time.Now().Add(-d))
+	}
+
+	buf, err := json.MarshalIndent(samples, "", "  ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
 		return
 	}
 
@@ -76,21 +214,78 @@ func (a *api) handleCreate(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get(":id")
 
 	if id == "" {
-		http.Error(w, "no id specified", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errors.BadRequest, "no id specified")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	config, unknown, err := agent.DecodeContainerConfig(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	var problem string
+
+	switch {
+	case len(unknown) > 0:
+		problem = fmt.Sprintf("fields unknown to config schema version %d: %s", agent.ConfigSchemaVersion, strings.Join(unknown, ", "))
+	case config.SchemaVersion > agent.ConfigSchemaVersion:
+		problem = fmt.Sprintf("config schema version %d, newer than ours (%d)", config.SchemaVersion, agent.ConfigSchemaVersion)
+	}
+
+	if problem != "" {
+		if *strictConfig {
+			writeError(w, http.StatusBadRequest, errors.InvalidConfig, problem)
+			return
+		}
+
+		log.Printf("[%s] create: ignoring %s", id, problem)
+	}
+
+	if existing, ok := a.registry.Get(id); ok {
+		if conflict := diffConfigs(existing.requested, config); len(conflict) > 0 {
+			writeConfigConflict(w, conflict)
+			return
+		}
+
+		// a repeated PUT, e.g. a retry
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(existing.Instance())
+		return
+	}
+
+	for _, source := range config.Storage.Volumes {
+		if !host.hasVolume(source) {
+			writeError(w, http.StatusBadRequest, errors.InvalidConfig, fmt.Sprintf("volume %s not available on this host", source))
+			return
+		}
+	}
+
+	if problems := securityProblems(config.Security); len(problems) > 0 {
+		writeError(w, http.StatusBadRequest, errors.InvalidConfig, strings.Join(problems, "; "))
 		return
 	}
 
-	var config agent.ContainerConfig
+	if *maxContainers > 0 && a.registry.Len() >= *maxContainers {
+		writeError(w, http.StatusConflict, errors.ContainerLimit, fmt.Sprintf("agent is at its limit of %d containers", *maxContainers))
+		return
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := portConflicts(config, takenPorts(a.registry.Instances(), id)); err != nil {
+		writePortConflicts(w, err.(agent.PortConflicts))
 		return
 	}
 
 	container := newContainer(id, config)
 
 	if ok := a.registry.Register(container); !ok {
-		http.Error(w, "already exists", http.StatusConflict)
+		writeError(w, http.StatusConflict, errors.Conflict, "already exists")
 		return
 	}
 
@@ -100,6 +295,7 @@ func (a *api) handleCreate(w http.ResponseWriter, r *http.Request) {
 		err := container.Create()
 		if err != nil {
 			log.Printf("[%s] create: %s", id, err)
+			return
 		}
 		err = container.Start()
 		if err != nil {
@@ -120,13 +316,13 @@ func (a *api) handleStop(w http.ResponseWriter, r *http.Request) {
 
 	container, ok := a.registry.Get(id)
 	if !ok {
-		http.Error(w, "", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
 		return
 	}
 
 	timeout, err := strconv.Atoi(t)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
 		return
 	}
 
@@ -134,6 +330,240 @@ func (a *api) handleStop(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (a *api) handleRestart(w http.ResponseWriter, r *http.Request) {
+	var (
+		id = r.URL.Query().Get(":id")
+		t  = r.URL.Query().Get("t")
+	)
+
+	if t == "" {
+		t = "5"
+	}
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	timeout, err := strconv.Atoi(t)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	if err := container.Restart(time.Duration(timeout) * time.Second); err != nil {
+		writeError(w, http.StatusConflict, errors.Conflict, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *api) handlePause(w http.ResponseWriter, r *http.Request) {
+	var (
+		id = r.URL.Query().Get(":id")
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	if err := container.Pause(); err != nil {
+		writeError(w, http.StatusConflict, errors.Conflict, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *api) handleResume(w http.ResponseWriter, r *http.Request) {
+	var (
+		id = r.URL.Query().Get(":id")
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	if err := container.Resume(); err != nil {
+		writeError(w, http.StatusConflict, errors.Conflict, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *api) handleSignal(w http.ResponseWriter, r *http.Request) {
+	var (
+		id  = r.URL.Query().Get(":id")
+		sig = r.URL.Query().Get("signal")
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	signal, err := strconv.Atoi(sig)
+	if err != nil || signal <= 0 {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, fmt.Sprintf("invalid signal %q", sig))
+		return
+	}
+
+	if err := container.Signal(signal); err != nil {
+		writeError(w, http.StatusConflict, errors.Conflict, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *api) handleExec(w http.ResponseWriter, r *http.Request) {
+	var (
+		id      = r.URL.Query().Get(":id")
+		command agent.Command
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	if len(command.Exec) == 0 {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, "exec not specified")
+		return
+	}
+
+	// the pid was verified, but may have been reused since
+	process := container.Process()
+	pid := process.ContainerPID
+
+	if !containerProcess(id, process.SupervisorPID, pid) {
+		writeError(w, http.StatusConflict, errors.Conflict, "container process is not running")
+		return
+	}
+
+	// run the command in the container's namespaces
+	args := []string{"--target", strconv.Itoa(pid), "--mount", "--uts", "--ipc", "--pid"}
+	if command.WorkingDir != "" {
+		args = append(args, "--wd="+command.WorkingDir)
+	}
+
+	cmd := exec.Command("nsenter", append(append(args, "--"), command.Exec...)...)
+	dropInChild(cmd)
+
+	out, err := runTimeout(cmd, *execTimeout)
+	if err == errExecTimeout {
+		log.Printf("[%s] exec %v: %s", id, command.Exec, err)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write(out)
+		return
+	}
+
+	if err != nil {
+		log.Printf("[%s] exec %v: %s", id, command.Exec, err)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(out)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
+
+var errExecTimeout = fmt.Errorf("command timed out, and was killed")
+
+// runTimeout runs the command, and returns its combined output. Commands
+// which don't finish within the timeout are killed, along with the processes
+// they started, e.g. those nsenter forks into the container's PID namespace.
+func runTimeout(cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // the whole process group
+		<-done
+		return out.Bytes(), errExecTimeout
+	}
+}
+
+func (a *api) handleUpdateResources(w http.ResponseWriter, r *http.Request) {
+	var (
+		id        = r.URL.Query().Get(":id")
+		resources agent.Resources
+	)
+
+	container, ok := a.registry.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&resources); err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	if err := resources.Valid(); err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	if float64(resources.Memory) > containerMemory() || resources.CPUs > containerCPUs() {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, fmt.Sprintf("resources exceed host capacity (%.0f MB, %g CPUs)", containerMemory(), containerCPUs()))
+		return
+	}
+
+	// the reservations of the other containers stay
+	var reservedMem, reservedCPU float64
+
+	for _, instance := range a.registry.Instances() {
+		if instance.ID != id {
+			reservedMem += float64(instance.Config.Resources.Memory)
+			reservedCPU += instance.Config.Resources.CPUs
+		}
+	}
+
+	if freeMem, freeCPU := containerMemory()-reservedMem, containerCPUs()-reservedCPU; float64(resources.Memory) > freeMem || resources.CPUs > freeCPU {
+		writeError(w, http.StatusConflict, errors.NoCapacity, fmt.Sprintf("resources exceed what the host has left (%.0f MB, %g CPUs)", freeMem, freeCPU))
+		return
+	}
+
+	if err := container.UpdateResources(resources); err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (a *api) handleStart(w http.ResponseWriter, r *http.Request) {
 	var (
 		id = r.URL.Query().Get(":id")
@@ -141,12 +571,12 @@ func (a *api) handleStart(w http.ResponseWriter, r *http.Request) {
 
 	container, ok := a.registry.Get(id)
 	if !ok {
-		http.Error(w, "", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
 		return
 	}
 
 	if err := container.Start(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
 		return
 	}
 
@@ -158,14 +588,14 @@ func (a *api) handleDestroy(w http.ResponseWriter, r *http.Request) {
 
 	container, ok := a.registry.Get(id)
 	if !ok {
-		http.Error(w, "", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
 		return
 	}
 
 	if err := container.Destroy(); err != nil {
 		log.Printf("[%s] destroy: %s", id, err)
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
 		return
 	}
 
@@ -181,44 +611,253 @@ func (a *api) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	)
 
 	if err := json.NewDecoder(r.Body).Decode(&heartbeat); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
 		return
 	}
 
 	container, ok := a.registry.Get(id)
+	if !ok && !a.isEnabled() {
+		container, ok = a.adopt(id, heartbeat)
+	}
+
 	if !ok {
-		json.NewEncoder(w).Encode(&agent.HeartbeatReply{
-			Want: "EXIT",
-		})
+		json.NewEncoder(w).Encode(a.unknownContainerReply(heartbeat))
 		return
 	}
 
-	want := container.Heartbeat(heartbeat)
+	reply := container.Heartbeat(heartbeat)
+	reply.Interval = *heartbeatInterval
 
-	json.NewEncoder(w).Encode(&agent.HeartbeatReply{
-		Want: want,
-	})
+	json.NewEncoder(w).Encode(&reply)
+}
+
+// adopt registers the container of a supervisor which checked in while the
+// agent is recovering, if a previous agent left its run directory behind.
+func (a *api) adopt(id string, heartbeat agent.Heartbeat) (*container, bool) {
+	rundir := filepath.Join("/run/harpoon", id)
+
+	if _, err := os.Stat(rundir); err != nil {
+		return nil, false
+	}
+
+	c, recovered, err := a.registry.Recover(rundir, &heartbeat.ProcessInfo)
+	if err != nil {
+		log.Printf("[%s] unable to adopt checked-in container: %s", id, err)
+		return nil, false
+	}
+
+	if recovered {
+		log.Printf("[%s] adopted on heartbeat as %s", id, c.Status)
+	}
+
+	return c, true
+}
+
+// unknownContainerReply tells the supervisor of a container the agent doesn't
+// know to exit. While the agent is recovering, it may yet learn about it, so
+// the supervisor is told to hold instead. Supervisors which don't understand
+// HOLD get an error, which they also treat as a heartbeat to retry.
+func (a *api) unknownContainerReply(heartbeat agent.Heartbeat) *agent.HeartbeatReply {
+	reply := &agent.HeartbeatReply{
+		Version:  agent.HeartbeatVersion,
+		Want:     agent.WantExit,
+		Interval: *heartbeatInterval,
+	}
+
+	if a.isEnabled() {
+		return reply
+	}
+
+	reply.Want = agent.WantHold
+
+	if heartbeat.Version < 2 {
+		reply.Err = "agent is recovering containers"
+	}
+
+	return reply
 }
 
 func (a *api) handleList(w http.ResponseWriter, r *http.Request) {
-	e := json.NewEncoder(w)
+	filter, err := agent.ParseContainerFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, err.Error())
+		return
+	}
+
+	if !isStreamAccept(r.Header.Get("Accept")) {
+		json.NewEncoder(w).Encode(filter.Apply(a.registry.Instances()))
+		return
+	}
+
+	statec := make(chan agent.ContainerInstance)
 
-	e.Encode(a.registry.Instances().EventBody())
+	// Pagination makes no sense for a stream; only filter.
+	filter.Offset, filter.Limit = 0, 0
 
-	if isStreamAccept(r.Header.Get("Accept")) {
-		var (
-			statec = make(chan agent.ContainerInstance)
-		)
+	var (
+		snapshot = filter.Apply(a.registry.Instances())
+		events   = &eventWriter{w: w}
+	)
 
-		a.registry.Notify(statec)
-		defer a.registry.Stop(statec)
+	w.Header().Set("Content-Type", "text/event-stream")
 
-		for state := range statec {
-			e.Encode(state)
+	if err := events.write(snapshot); err != nil {
+		return
+	}
+
+	a.registry.Notify(statec)
+	defer a.registry.Stop(statec)
+
+	a.streamEvents(events, filter, snapshot, statec, wantsDeltas(r.Header.Get("Accept")))
+}
+
+// eventWriter writes container events as server-sent events, named by their
+// type and numbered from 1 within the stream.
+type eventWriter struct {
+	w  http.ResponseWriter
+	id uint64
+}
+
+func (e *eventWriter) write(event agent.ContainerEvent) error {
+	body := event.EventBody()
+
+	buf, err := json.Marshal(body.Self)
+	if err != nil {
+		return err
+	}
+
+	e.id++
+
+	if _, err := fmt.Fprintf(e.w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, body.Event, buf); err != nil {
+		return err
+	}
+
+	flush(e.w)
+
+	return nil
+}
+
+// streamEvents sends every change after the initial snapshot: as the full
+// ContainerInstance, or as a ContainerDelta if the client asked for deltas.
+// Delta streams get a full snapshot every -events.snapshot.interval, so
+// clients recover from anything they may have missed. All streams get a
+// StreamHeartbeat every -events.heartbeat.interval, and a LogMarker whenever
+// a matching container drops log lines.
+func (a *api) streamEvents(events *eventWriter, filter agent.ContainerFilter, snapshot agent.ContainerInstances, statec <-chan agent.ContainerInstance, deltas bool) {
+	var (
+		previous   = map[string]agent.ContainerInstance{}
+		snapshots  = make(chan agent.ContainerInstances, 1)
+		markerc    = make(chan agent.LogMarker, logStreamBuffer)
+		snapshotc  <-chan time.Time
+		heartbeatc <-chan time.Time
+		pending    = false
+	)
+
+	if deltas {
+		ticker := time.NewTicker(*eventsSnapshotInterval)
+		defer ticker.Stop()
+		snapshotc = ticker.C
+	}
+
+	if *eventsHeartbeatInterval > 0 {
+		ticker := time.NewTicker(*eventsHeartbeatInterval)
+		defer ticker.Stop()
+		heartbeatc = ticker.C
+	}
+
+	a.logs.subscribeMarkers(markerc)
+	defer a.logs.unsubscribeMarkers(markerc)
+
+	reset := func(snapshot agent.ContainerInstances) {
+		previous = map[string]agent.ContainerInstance{}
+
+		for _, instance := range snapshot {
+			previous[instance.ID] = instance
+		}
+	}
+
+	reset(snapshot)
+
+	for {
+		var event agent.ContainerEvent
+
+		select {
+		case state := <-statec:
+			if !filter.Match(state) {
+				continue
+			}
+
+			event = state
+
+			if deltas {
+				event = agent.NewContainerDelta(previous[state.ID], state)
+			}
+
+			if state.Status == agent.ContainerStatusDeleted {
+				delete(previous, state.ID)
+			} else {
+				previous[state.ID] = state
+			}
+
+		case marker := <-markerc:
+			if _, ok := previous[marker.ID]; !ok {
+				continue // container doesn't match the filter
+			}
+
+			event = marker
+
+		case t := <-heartbeatc:
+			event = agent.StreamHeartbeat{Time: t}
+
+		case <-snapshotc:
+			if pending {
+				continue
+			}
+
+			pending = true
+
+			// The registry may be waiting for us to receive a state
+			// update, so take the snapshot without blocking the stream.
+			go func() { snapshots <- filter.Apply(a.registry.Instances()) }()
+
+			continue
+
+		case snapshot := <-snapshots:
+			pending = false
+			event = snapshot
+			reset(snapshot)
+		}
+
+		if err := events.write(event); err != nil {
+			return
 		}
 	}
 }
 
+// wantsDeltas returns true if the client asked for a stream of container
+// deltas, with "Accept: text/event-stream; events=delta".
+func wantsDeltas(accept string) bool {
+	for _, a := range strings.Split(accept, ",") {
+		mediatype, params, err := mime.ParseMediaType(a)
+		if err != nil {
+			continue
+		}
+
+		if mediatype == "text/event-stream" && params[agent.DeltaEventsParam] == "delta" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flush pushes buffered stream data to the client, if the writer supports it.
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func isStreamAccept(accept string) bool {
 	for _, a := range strings.Split(accept, ",") {
 		mediatype, _, err := mime.ParseMediaType(a)
@@ -235,21 +874,99 @@ func isStreamAccept(accept string) bool {
 }
 
 func (a *api) handleResources(w http.ResponseWriter, r *http.Request) {
-	volumes := make([]string, 0, len(configuredVolumes))
+	until, unschedulable := a.maintenance.Until()
+	if !unschedulable {
+		until = time.Time{}
+	}
 
-	for vol := range configuredVolumes {
-		volumes = append(volumes, vol)
+	var reservedMem, reservedCPU float64
+
+	for _, instance := range a.registry.Instances() {
+		reservedMem += float64(instance.Config.Resources.Memory)
+		reservedCPU += instance.Config.Resources.CPUs
 	}
 
 	json.NewEncoder(w).Encode(&agent.HostResources{
 		Memory: agent.TotalReserved{
-			Total:    float64(agentTotalMem),
-			Reserved: 0, // TODO: enumerate created containers
+			Total:    containerMemory(),
+			Reserved: reservedMem,
 		},
 		CPUs: agent.TotalReserved{
-			Total:    float64(agentTotalCPU),
-			Reserved: 0, // TODO: enumerate created containers
+			Total:    containerCPUs(),
+			Reserved: reservedCPU,
+		},
+		Containers: agent.TotalReserved{
+			Total:    float64(*maxContainers),
+			Reserved: float64(a.registry.Len()),
 		},
-		Volumes: volumes,
+		Volumes:          host.Volumes(),
+		Labels:           host.Labels(),
+		Unschedulable:    unschedulable,
+		MaintenanceUntil: until,
 	})
 }
+
+func (a *api) handleHost(w http.ResponseWriter, r *http.Request) {
+	kernel, err := kernelVersion()
+	if err != nil {
+		log.Printf("unable to get kernel version: %s", err)
+	}
+
+	namespaces, err := kernelNamespaces()
+	if err != nil {
+		log.Printf("unable to list namespaces: %s", err)
+	}
+
+	json.NewEncoder(w).Encode(&agent.HostInfo{
+		Hostname:      hostname,
+		KernelVersion: kernel,
+		CgroupDriver:  "cgroupfs",
+		Namespaces:    namespaces,
+		AgentVersion:  version,
+		GoVersion:     runtime.Version(),
+		Labels:        host.Labels(),
+		Directories: map[string]string{
+			"run":       "/run/harpoon",
+			"log":       "/srv/harpoon/log",
+			"artifacts": artifactDir,
+		},
+	})
+}
+
+func (a *api) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	artifacts, err := cachedArtifacts()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, errors.Internal, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+func (a *api) handleVersion(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(&agent.VersionInfo{
+		Version:     version,
+		GitSHA:      gitSHA,
+		APIVersions: []string{agent.APIVersion},
+
+		ConfigSchemaVersion: agent.ConfigSchemaVersion,
+	})
+}
+
+func (a *api) handleBeginMaintenance(w http.ResponseWriter, r *http.Request) {
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || d <= 0 {
+		writeError(w, http.StatusBadRequest, errors.BadRequest, "duration must be a positive duration, e.g. 30m")
+		return
+	}
+
+	until := a.maintenance.Begin(d)
+
+	json.NewEncoder(w).Encode(map[string]time.Time{"maintenance_until": until})
+}
+
+func (a *api) handleEndMaintenance(w http.ResponseWriter, r *http.Request) {
+	a.maintenance.End()
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Artifacts are extracted by the agent binary itself, run as a helper with
+// the extractArtifactCommand argument, so extraction is limited by the helpers
+// cgroup. Entries are confined to the destination: names escaping it are
+// rejected, and so are entries beneath a symlink, which would write wherever
+// the symlink points. Symlinks themselves are created as they are, with any
+// target; they're resolved inside the container. Device nodes are skipped;
+// containers get theirs from libcontainer.
+
+// extractArtifactCommand is the first argument of an agent run to extract an
+// artifact.
+const extractArtifactCommand = "extract-artifact"
+
+// progressInterval is how often the progress of an extraction is logged.
+const progressInterval = 10 * time.Second
+
+var errArtifactTooLarge = errors.New("artifact exceeds -artifact.max.size")
+
+// extractArtifact extracts the .tar.gz from src to dst, which must exist. On
+// failure, dst is removed. Progress is logged, as the share of size read from
+// src; a size of -1 means unknown.
+func extractArtifact(src io.Reader, size int64, dst string) (err error) {
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dst)
+		}
+	}()
+
+	var (
+		stderr   bytes.Buffer
+		progress = &progressReader{r: src, size: size, name: dst, last: time.Now()}
+	)
+
+	cmd := exec.Command("/proc/self/exe", extractArtifactCommand, dst, strconv.FormatInt(*artifactMaxSize, 10))
+	cmd.Stdin = progress
+	cmd.Stderr = &stderr
+
+	if err := startHelper(cmd); err != nil {
+		return err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("extract %s: %s (%s)", dst, strings.TrimSpace(stderr.String()), err)
+	}
+
+	log.Printf("extracted %d bytes to %s", progress.n, dst)
+
+	return nil
+}
+
+// extractArtifactMain runs in the helper; it extracts the .tar.gz on stdin
+// to the destination in args, and returns the exit code.
+func extractArtifactMain(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s DESTINATION MAX-SIZE\n", extractArtifactCommand)
+		return 2
+	}
+
+	maxSize, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid max size %q\n", args[1])
+		return 2
+	}
+
+	gz, err := gzip.NewReader(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := untar(tar.NewReader(gz), args[0], maxSize); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+// untar extracts the archive to dst, stopping after maxSize bytes of file
+// contents (0 for unlimited).
+func untar(tr *tar.Reader, dst string, maxSize int64) error {
+	var extracted int64
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name, err := sanitizeEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		if name == "." {
+			continue
+		}
+
+		target := filepath.Join(dst, name)
+
+		// directories may exist already, and must not be symlinks either
+		checked := filepath.Dir(name)
+		if hdr.Typeflag == tar.TypeDir {
+			checked = name
+		}
+
+		if err := checkNoSymlinks(dst, checked); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, mode); err != nil && !os.IsExist(err) {
+				return err
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			if maxSize > 0 && extracted+hdr.Size > maxSize {
+				return errArtifactTooLarge
+			}
+
+			extracted += hdr.Size
+
+			if err := writeEntry(target, tr, mode); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			os.Remove(target)
+
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			linkname, err := sanitizeEntryName(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+
+			if err := checkNoSymlinks(dst, linkname); err != nil {
+				return err
+			}
+
+			os.Remove(target)
+
+			if err := os.Link(filepath.Join(dst, linkname), target); err != nil {
+				return err
+			}
+
+			continue // shares the owner and mode of what it links to
+
+		default:
+			// devices, fifos, and anything newer
+			continue
+		}
+
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+
+		// creating is subject to the umask, and chown clears setuid bits
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+}
+
+// sanitizeEntryName returns the entry name relative to the destination, or
+// an error if it would end up outside of it. Leading slashes are ignored, as
+// tar does.
+func sanitizeEntryName(name string) (string, error) {
+	cleaned := filepath.Clean(strings.TrimLeft(name, "/"))
+
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid entry %q: outside of the artifact", name)
+	}
+
+	return cleaned, nil
+}
+
+// checkNoSymlinks returns an error if any component of the relative path
+// inside dst is a symlink. Components which don't exist yet are fine.
+func checkNoSymlinks(dst, rel string) error {
+	path := dst
+
+	for _, component := range strings.Split(rel, "/") {
+		if component == "." || component == "" {
+			continue
+		}
+
+		path = filepath.Join(path, component)
+
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("invalid entry beneath symlink %s", strings.TrimPrefix(path, dst))
+		}
+	}
+
+	return nil
+}
+
+func writeEntry(target string, r io.Reader, mode os.FileMode) error {
+	os.Remove(target) // don't write through an existing symlink or hard link
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// progressReader counts the bytes read through it, and logs the progress
+// every progressInterval.
+type progressReader struct {
+	r    io.Reader
+	n    int64
+	size int64
+	name string
+	last time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+
+		if p.size > 0 {
+			log.Printf("extracting %s: %d of %d bytes (%d%%)", p.name, p.n, p.size, 100*p.n/p.size)
+		} else {
+			log.Printf("extracting %s: %d bytes", p.name, p.n)
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// Artifacts are cached in artifactDir, at a path derived from their URL; see
+// getArtifactPath. Once an artifact is completely extracted, a marker file
+// holding its redacted URL is written next to it, so the cache can be listed without
+// descending into the artifacts themselves.
+
+const (
+	artifactDir          = "/srv/harpoon/artifacts"
+	artifactCachedSuffix = ".cached"
+)
+
+// markArtifactCached records that the artifact at path, fetched from url, is
+// complete. Failures are logged; the artifact is only left out of the list.
+func markArtifactCached(path, url string) {
+	if err := ioutil.WriteFile(path+artifactCachedSuffix, []byte(redactURL(url)), 0644); err != nil {
+		log.Printf("unable to mark artifact %s cached: %s", path, err)
+	}
+}
+
+func isArtifactCached(path string) bool {
+	_, err := os.Stat(path + artifactCachedSuffix)
+	return err == nil
+}
+
+// cachedArtifacts lists the artifacts in the cache, sorted by URL.
+func cachedArtifacts() ([]agent.Artifact, error) {
+	artifacts := []agent.Artifact{}
+
+	err := filepath.Walk(artifactDir, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err) && path == artifactDir:
+			return filepath.SkipDir // nothing fetched yet
+
+		case err != nil:
+			return err
+
+		case info.IsDir() && path != artifactDir && isArtifactCached(path):
+			return filepath.SkipDir
+
+		case info.Mode().IsRegular() && strings.HasSuffix(path, artifactCachedSuffix):
+			url, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			artifacts = append(artifacts, agent.Artifact{
+				URL:     string(url),
+				Fetched: info.ModTime(),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(artifactsByURL(artifacts))
+
+	return artifacts, nil
+}
+
+type artifactsByURL []agent.Artifact
+
+func (a artifactsByURL) Len() int           { return len(a) }
+func (a artifactsByURL) Less(i, j int) bool { return a[i].URL < a[j].URL }
+func (a artifactsByURL) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeEntryName(t *testing.T) {
+	for _, testCase := range []struct {
+		name, expected string
+		invalid        bool
+	}{
+		{"bin/app", "bin/app", false},
+		{"./bin/app", "bin/app", false},
+		{"/etc/passwd", "etc/passwd", false},
+		{"//etc/../bin", "bin", false},
+		{".", ".", false},
+		{"..", "", true},
+		{"../evil", "", true},
+		{"bin/../../evil", "", true},
+		{"/../evil", "", true},
+		{"..evil", "..evil", false},
+	} {
+		got, err := sanitizeEntryName(testCase.name)
+		if invalid := err != nil; testCase.invalid != invalid {
+			t.Errorf("%q: expected invalid %v, got %v", testCase.name, testCase.invalid, err)
+			continue
+		}
+		if expected := testCase.expected; expected != got {
+			t.Errorf("%q: expected %q, got %q", testCase.name, expected, got)
+		}
+	}
+}
+
+func TestUntar(t *testing.T) {
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+		body     string
+	}
+	var (
+		dir = func(name string) entry { return entry{name: name, typeflag: tar.TypeDir} }
+		reg = func(name, body string) entry { return entry{name: name, typeflag: tar.TypeReg, body: body} }
+		sym = func(name, linkname string) entry {
+			return entry{name: name, typeflag: tar.TypeSymlink, linkname: linkname}
+		}
+		lnk = func(name, linkname string) entry {
+			return entry{name: name, typeflag: tar.TypeLink, linkname: linkname}
+		}
+	)
+
+	for _, testCase := range []struct {
+		name    string
+		entries []entry
+		maxSize int64
+		err     string   // substring of the expected error; empty for none
+		files   []string // expected to exist in the destination afterwards
+	}{
+		{"plain", []entry{dir("bin"), reg("bin/app", "app"), sym("bin/link", "app"), lnk("bin/hard", "bin/app")}, 0, "", []string{"bin/app", "bin/link", "bin/hard"}},
+		{"absolute names stay inside", []entry{reg("/etc/passwd", "root")}, 0, "", []string{"etc/passwd"}},
+		{"parent", []entry{reg("../evil", "x")}, 0, "outside of the artifact", nil},
+		{"nested parent", []entry{reg("bin/../../evil", "x")}, 0, "outside of the artifact", nil},
+		{"file beneath symlink", []entry{sym("etc", "/etc"), reg("etc/evil", "x")}, 0, "beneath symlink", nil},
+		{"dir beneath symlink", []entry{sym("up", ".."), dir("up/evil")}, 0, "beneath symlink", nil},
+		{"deep beneath symlink", []entry{dir("a"), sym("a/b", "/tmp"), reg("a/b/c/evil", "x")}, 0, "beneath symlink", nil},
+		{"hard link out of the tree", []entry{lnk("passwd", "../../etc/passwd")}, 0, "outside of the artifact", nil},
+		{"hard link through symlink", []entry{sym("etc", "/etc"), lnk("passwd", "etc/passwd")}, 0, "beneath symlink", nil},
+		{"absolute hard link stays inside", []entry{lnk("passwd", "/etc/passwd")}, 0, "no such file", nil},
+		{"within size limit", []entry{reg("a", "12345"), reg("b", "12345")}, 10, "", []string{"a", "b"}},
+		{"over size limit", []entry{reg("a", "12345"), reg("b", "123456")}, 10, errArtifactTooLarge.Error(), nil},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, e := range testCase.entries {
+			hdr := &tar.Header{
+				Name:     e.name,
+				Typeflag: e.typeflag,
+				Linkname: e.linkname,
+				Size:     int64(len(e.body)),
+				Mode:     0755,
+				Uid:      os.Getuid(),
+				Gid:      os.Getgid(),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		dst, err := ioutil.TempDir("", "harpoon-agent-untar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		err = untar(tar.NewReader(&buf), dst, testCase.maxSize)
+		switch {
+		case testCase.err == "" && err != nil:
+			t.Errorf("%s: expected no error, got %v", testCase.name, err)
+		case testCase.err != "" && (err == nil || !strings.Contains(err.Error(), testCase.err)):
+			t.Errorf("%s: expected error containing %q, got %v", testCase.name, testCase.err, err)
+		}
+		for _, file := range testCase.files {
+			if _, err := os.Lstat(filepath.Join(dst, file)); err != nil {
+				t.Errorf("%s: expected %s to be extracted, got %v", testCase.name, file, err)
+			}
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(dst), "evil")); err == nil {
+			t.Errorf("%s: extracted outside of the destination", testCase.name)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+// Artifacts are fetched over HTTP through a transport of their own, so
+// environments behind proxies can fetch them. The proxy is -artifact.proxy, or
+// else HTTPS_PROXY or HTTP_PROXY from the environment, by the scheme of the
+// request; hosts in -artifact.no.proxy, or else NO_PROXY, are fetched
+// directly. Artifact hosts may be resolved by the agent itself, with the
+// repeatable -artifact.host name=ip, like entries of /etc/hosts, for hosts
+// which the host's DNS doesn't resolve, or resolves differently. TLS is still
+// verified against the name.
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const artifactDialTimeout = 30 * time.Second
+
+// artifactClient does the HTTP requests of fetchers.
+type artifactClient struct {
+	client *http.Client
+	proxy  func(*http.Request) (*url.URL, error)
+	hosts  hostOverrides
+}
+
+func newArtifactClient(proxy, noProxy string, hosts hostOverrides) (*artifactClient, error) {
+	proxyFunc, err := newProxyFunc(proxy, noProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: proxyFunc,
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, hosts.resolve(addr), artifactDialTimeout)
+		},
+	}
+
+	return &artifactClient{
+		client: &http.Client{Transport: transport},
+		proxy:  proxyFunc,
+		hosts:  hosts,
+	}, nil
+}
+
+// get does the request, and returns the body of a successful response, and
+// its size, or -1 if unknown. Errors tell how the request was routed, and
+// leave out the URL, which may hold secrets.
+func (c *artifactClient) get(req *http.Request) (io.ReadCloser, int64, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err // without the URL
+		}
+
+		return nil, 0, fmt.Errorf("%s%s", err, c.route(req))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("%s%s", resp.Status, c.route(req))
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// route describes how the request reaches its host, unless directly.
+func (c *artifactClient) route(req *http.Request) string {
+	if proxy, err := c.proxy(req); err == nil && proxy != nil {
+		return fmt.Sprintf(" (via proxy %s)", redactURL(proxy.String()))
+	}
+
+	host := req.URL.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if ip, ok := c.hosts[host]; ok {
+		return fmt.Sprintf(" (%s resolved to %s by -artifact.host)", host, ip)
+	}
+
+	return ""
+}
+
+// newProxyFunc returns a function choosing the proxy of each request, as
+// described above.
+func newProxyFunc(proxy, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	proxies := map[string]string{"http": proxy, "https": proxy}
+
+	if proxy == "" {
+		proxies["http"] = getenvAny("HTTP_PROXY", "http_proxy")
+		proxies["https"] = getenvAny("HTTPS_PROXY", "https_proxy")
+
+		if proxies["https"] == "" {
+			proxies["https"] = proxies["http"]
+		}
+	}
+
+	if noProxy == "" {
+		noProxy = getenvAny("NO_PROXY", "no_proxy")
+	}
+
+	parsed := map[string]*url.URL{}
+
+	for scheme, p := range proxies {
+		if p == "" {
+			continue
+		}
+
+		u, err := url.Parse(p)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", redactURL(p))
+		}
+
+		parsed[scheme] = u
+	}
+
+	exempt := []string{}
+
+	for _, host := range strings.Split(noProxy, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			exempt = append(exempt, host)
+		}
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassesProxy(req.URL.Host, exempt) {
+			return nil, nil
+		}
+
+		return parsed[req.URL.Scheme], nil
+	}, nil
+}
+
+// bypassesProxy returns true if the host, with an optional port, is or is
+// beneath one of the exempt domains, or if any host is exempt with "*".
+func bypassesProxy(host string, exempt []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, domain := range exempt {
+		domain = strings.TrimPrefix(domain, ".")
+
+		if domain == "*" || host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// hostOverrides resolve host names to IPs, by name.
+type hostOverrides map[string]string
+
+func (*hostOverrides) String() string { return "" }
+
+func (h *hostOverrides) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+		return fmt.Errorf("host must be name=ip")
+	}
+
+	(*h)[parts[0]] = parts[1]
+
+	return nil
+}
+
+// resolve returns the address with its host replaced by the IP it's
+// overridden with, if any.
+func (h hostOverrides) resolve(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if ip, ok := h[host]; ok {
+		return net.JoinHostPort(ip, port)
+	}
+
+	return addr
+}
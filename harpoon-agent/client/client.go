@@ -0,0 +1,607 @@
+// Package client provides a language-native API wrapper around a remote
+// harpoon-agent, specified by URL. It satisfies the agent.Agent interface, so
+// the scheduler, harpoonctl and third-party tools can all drive agents
+// through it.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	herrors "github.com/soundcloud/harpoon/lib/errors"
+)
+
+// Paths of the agent API, relative to APIVersionPrefix.
+const (
+	APIVersionPrefix       = "/api/v0"
+	APIGetContainersPath   = "/containers/"
+	APIPutContainerPath    = "/containers/:id"
+	APIGetContainerPath    = "/containers/:id"
+	APIDeleteContainerPath = "/containers/:id"
+	APIPostContainerPath   = "/containers/:id/:action"
+	APIGetContainerLogPath = "/containers/:id/log"
+	APIGetHistoryPath      = "/containers/:id/events"
+	APIGetMetricsPath      = "/containers/:id/metrics"
+	APIGetResourcesPath    = "/resources/"
+	APIGetHostPath         = "/host"
+	APIGetVersionPath      = "/version"
+	APIGetArtifactsPath    = "/artifacts"
+)
+
+const (
+	maxUnavailableWait     = 30 * time.Second
+	defaultUnavailableWait = time.Second
+)
+
+// TransientError is returned when the agent is temporarily unable to serve a
+// request, e.g. while it recovers its containers after a restart.
+type TransientError struct{ error }
+
+// IsTransient reports whether err is a TransientError, i.e. whether the
+// request may succeed if it's made again later.
+func IsTransient(err error) bool {
+	_, ok := err.(TransientError)
+	return ok
+}
+
+// Client proxies for a remote endpoint that provides a v0 agent over HTTP.
+//
+// Agents gzip their responses, including event streams, when asked to. We
+// never set Accept-Encoding ourselves, so the default transport requests
+// gzip on our behalf and transparently decompresses response bodies.
+type Client struct {
+	url    url.URL
+	client *http.Client
+	ctx    context.Context
+}
+
+// Satisfaction guaranteed.
+var _ agent.Agent = &Client{}
+
+// New returns a client of the agent at endpoint, e.g. "http://host:3333". If
+// httpClient is nil, http.DefaultClient is used.
+func New(endpoint string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid agent endpoint %q", endpoint)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{url: *u, client: httpClient, ctx: context.Background()}, nil
+}
+
+// WithContext returns a copy of the client whose requests, including retries
+// and streams, are canceled when ctx is done.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// Endpoint returns the URL of the agent.
+func (c *Client) Endpoint() string {
+	return c.url.String()
+}
+
+// Containers implements the agent.Agent interface.
+func (c *Client) Containers() ([]agent.ContainerInstance, error) {
+	return c.FilterContainers(agent.ContainerFilter{})
+}
+
+// FilterContainers implements the agent.Agent interface.
+func (c *Client) FilterContainers(filter agent.ContainerFilter) ([]agent.ContainerInstance, error) {
+	var containerInstances []agent.ContainerInstance
+	if err := c.getJSON(c.path(APIGetContainersPath, "", ""), filter.Values().Encode(), &containerInstances); err != nil {
+		return []agent.ContainerInstance{}, err
+	}
+	return containerInstances, nil
+}
+
+// Events implements the agent.Agent interface.
+func (c *Client) Events() (<-chan agent.ContainerEvent, agent.Stopper, error) {
+	resp, stop, err := c.stream(c.path(APIGetContainersPath, "", ""), "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The stream goroutine owns the response body: closing it on stop is
+	// detected by the server, causing a stream termination, and by the reading
+	// goroutine below, which exits.
+	//
+	// This goroutine owns the containerEventChan.
+	//
+	// TODO(pb): distinguish requested-close from accidental-close, and
+	// manage accidental-closes so the client isn't inconvenienced.
+	containerEventChan, endpoint := make(chan agent.ContainerEvent), c.Endpoint()
+	go func() {
+		log.Printf("agent: %s: event stream reader started", endpoint)
+		defer log.Printf("agent: %s: event stream reader terminated", endpoint)
+
+		defer close(containerEventChan)
+
+		rd := bufio.NewReader(resp.Body)
+		for {
+			eventName, eventBody, err := readEvent(rd)
+			if err != nil {
+				log.Printf("agent: %s: read event: %s", endpoint, err)
+				return
+			}
+			event, err := decodeEvent(eventName, eventBody)
+			if err == errUnknownEvent {
+				continue // sent by a newer agent
+			} else if err != nil {
+				log.Printf("agent: %s: %s", endpoint, err)
+				return
+			}
+			select {
+			case containerEventChan <- event:
+			case <-stop:
+				log.Printf("agent: %s: received stop signal", endpoint)
+				return
+			}
+		}
+	}()
+
+	// The caller owns the stop chan.
+	return containerEventChan, stopperChan(stop), nil
+}
+
+// readEvent reads the next server-sent event from the stream, and returns its
+// name and data. Comments, and fields we don't use, like the ID, are skipped.
+func readEvent(rd *bufio.Reader) (string, []byte, error) {
+	var (
+		name string
+		data [][]byte
+	)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if data == nil {
+				name = "" // events without data aren't dispatched
+				continue
+			}
+			return name, bytes.Join(data, []byte("\n")), nil
+		}
+		field, value := line, []byte{}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], bytes.TrimPrefix(line[i+1:], []byte(" "))
+		}
+		switch string(field) {
+		case "event":
+			name = string(value)
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// errUnknownEvent is returned by decodeEvent for event types it doesn't know.
+var errUnknownEvent = errors.New("unknown event")
+
+// decodeEvent decodes the self object of an event, as the concrete type
+// named by the event.
+func decodeEvent(eventName string, eventBody []byte) (agent.ContainerEvent, error) {
+	var event agent.ContainerEvent
+	switch eventName {
+	case agent.ContainerInstancesEventName:
+		var e agent.ContainerInstances
+		if err := json.Unmarshal(eventBody, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal event body: %s", err)
+		}
+		event = e
+	case agent.ContainerInstanceEventName:
+		var e agent.ContainerInstance
+		if err := json.Unmarshal(eventBody, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal event body: %s", err)
+		}
+		event = e
+	case agent.ContainerDeltaEventName:
+		var e agent.ContainerDelta
+		if err := json.Unmarshal(eventBody, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal event body: %s", err)
+		}
+		event = e
+	case agent.StreamHeartbeatEventName:
+		var e agent.StreamHeartbeat
+		if err := json.Unmarshal(eventBody, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal event body: %s", err)
+		}
+		event = e
+	case agent.LogMarkerEventName:
+		var e agent.LogMarker
+		if err := json.Unmarshal(eventBody, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal event body: %s", err)
+		}
+		event = e
+	default:
+		return nil, errUnknownEvent
+	}
+	return event, nil
+}
+
+// Resources implements the agent.Agent interface.
+func (c *Client) Resources() (agent.HostResources, error) {
+	var resources agent.HostResources
+	if err := c.getJSON(c.path(APIGetResourcesPath, "", ""), "", &resources); err != nil {
+		return agent.HostResources{}, err
+	}
+	return resources, nil
+}
+
+// Host implements the agent.Agent interface.
+func (c *Client) Host() (agent.HostInfo, error) {
+	var info agent.HostInfo
+	if err := c.getJSON(c.path(APIGetHostPath, "", ""), "", &info); err != nil {
+		return agent.HostInfo{}, err
+	}
+	return info, nil
+}
+
+// Version implements the agent.Agent interface.
+func (c *Client) Version() (agent.VersionInfo, error) {
+	var info agent.VersionInfo
+	if err := c.getJSON(c.path(APIGetVersionPath, "", ""), "", &info); err != nil {
+		if e, ok := err.(statusError); ok {
+			return agent.VersionInfo{}, fmt.Errorf("agent doesn't report its version (HTTP %s)", e.status)
+		}
+		return agent.VersionInfo{}, err
+	}
+	return info, nil
+}
+
+// Artifacts implements the agent.Agent interface.
+func (c *Client) Artifacts() ([]agent.Artifact, error) {
+	var artifacts []agent.Artifact
+	if err := c.getJSON(c.path(APIGetArtifactsPath, "", ""), "", &artifacts); err != nil {
+		if e, ok := err.(statusError); ok {
+			return nil, fmt.Errorf("agent doesn't report its artifacts (HTTP %s)", e.status)
+		}
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// History implements the agent.Agent interface.
+func (c *Client) History(containerID string) ([]agent.ContainerHistoryEvent, error) {
+	var events []agent.ContainerHistoryEvent
+	if err := c.getJSON(c.path(APIGetHistoryPath, containerID, ""), "", &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Metrics implements the agent.Agent interface. A window of 0 returns all
+// samples the agent keeps.
+func (c *Client) Metrics(containerID string, window time.Duration) ([]agent.ContainerMetricsSample, error) {
+	var rawQuery string
+	if window > 0 {
+		rawQuery = url.Values{"window": []string{window.String()}}.Encode()
+	}
+	var samples []agent.ContainerMetricsSample
+	if err := c.getJSON(c.path(APIGetMetricsPath, containerID, ""), rawQuery, &samples); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// Put implements the agent.Agent interface.
+func (c *Client) Put(containerID string, containerConfig agent.ContainerConfig) error {
+	var body bytes.Buffer
+	if err := json.NewEncoder(&body).Encode(containerConfig); err != nil {
+		return fmt.Errorf("problem encoding container config (%s)", err)
+	}
+	// agents answer a repeated PUT of the same config with 200 OK
+	return c.mutate("PUT", c.path(APIPutContainerPath, containerID, ""), body.Bytes(), http.StatusAccepted, http.StatusOK)
+}
+
+// Get implements the agent.Agent interface.
+func (c *Client) Get(containerID string) (agent.ContainerInstance, error) {
+	var state agent.ContainerInstance
+	if err := c.getJSON(c.path(APIGetContainerPath, containerID, ""), "", &state); err != nil {
+		return agent.ContainerInstance{}, err
+	}
+	return state, nil
+}
+
+// Delete implements the agent.Agent interface.
+func (c *Client) Delete(containerID string) error {
+	return c.mutate("DELETE", c.path(APIDeleteContainerPath, containerID, ""), nil, http.StatusOK)
+}
+
+// Start implements the agent.Agent interface.
+func (c *Client) Start(containerID string) error {
+	return c.mutate("POST", c.path(APIPostContainerPath, containerID, "start"), nil, http.StatusAccepted)
+}
+
+// Stop implements the agent.Agent interface.
+func (c *Client) Stop(containerID string) error {
+	return c.mutate("POST", c.path(APIPostContainerPath, containerID, "stop"), nil, http.StatusAccepted)
+}
+
+// Restart implements the agent.Agent interface.
+func (c *Client) Restart(containerID string) error {
+	return c.mutate("POST", c.path(APIPostContainerPath, containerID, "restart"), nil, http.StatusAccepted)
+}
+
+// Replace implements the agent.Agent interface.
+func (c *Client) Replace(newContainerID, oldContainerID string) error {
+	return fmt.Errorf("replace is not implemented by the agent client")
+}
+
+// Log implements the agent.Agent interface.
+func (c *Client) Log(containerID string, history int) (<-chan string, agent.Stopper, error) {
+	resp, stop, err := c.stream(c.path(APIGetContainerLogPath, containerID, ""), fmt.Sprintf("history=%d", history))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+
+		rd := bufio.NewReader(resp.Body)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			select {
+			case lines <- line:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return lines, stopperChan(stop), nil
+}
+
+// path returns the API path, with the container ID and action filled in.
+func (c *Client) path(path, containerID, action string) string {
+	path = strings.Replace(APIVersionPrefix+path, ":id", containerID, 1)
+	return strings.Replace(path, ":action", action, 1)
+}
+
+func (c *Client) newRequest(method, path, rawQuery string, body []byte) (*http.Request, error) {
+	u := c.url
+	u.Path, u.RawQuery = path, rawQuery
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), rd)
+	if err != nil {
+		return nil, fmt.Errorf("problem constructing HTTP request (%s)", err)
+	}
+	return req, nil
+}
+
+// do performs the request, canceling it if the client's context is done
+// first.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := c.client.Do(req)
+		done <- result{resp, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("agent unavailable (%s)", r.err)
+		}
+		return r.resp, nil
+	case <-c.ctx.Done():
+		c.cancel(req)
+		if r := <-done; r.err == nil {
+			r.resp.Body.Close()
+		}
+		return nil, fmt.Errorf("agent unavailable (%s)", c.ctx.Err())
+	}
+}
+
+// cancel aborts the request, if the client's transport supports it.
+func (c *Client) cancel(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	transport := c.client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if tr, ok := transport.(canceler); ok {
+		tr.CancelRequest(req)
+	}
+}
+
+// getJSON performs a GET request and decodes a 200 OK response into v.
+func (c *Client) getJSON(path, rawQuery string, v interface{}) error {
+	req, err := c.newRequest("GET", path, rawQuery, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid agent response (%s)", err)
+	}
+	return nil
+}
+
+// mutate performs a mutating request, which succeeds with any of the expected
+// status codes.
+func (c *Client) mutate(method, path string, body []byte, expected ...int) error {
+	req, err := c.newRequest(method, path, "", body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.doTransient(req, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return responseError(resp)
+}
+
+// stream performs a GET request for an event stream. On success, the returned
+// chan stops the stream: closing it, or the client's context being done,
+// closes the response body.
+func (c *Client) stream(path, rawQuery string) (*http.Response, chan struct{}, error) {
+	req, err := c.newRequest("GET", path, rawQuery, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream; "+agent.DeltaEventsParam+"=delta")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Because we're streaming, we close the body in a different way.
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, nil, responseError(resp)
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-c.ctx.Done():
+		}
+		resp.Body.Close()
+	}()
+	return resp, stop, nil
+}
+
+// doTransient performs a mutating request. While the agent responds 503
+// Service Unavailable, the request is retried after the delay given by
+// Retry-After, for up to maxUnavailableWait. The body, if any, is resent with
+// every attempt.
+func (c *Client) doTransient(req *http.Request, body []byte) (*http.Response, error) {
+	var waited time.Duration
+	for {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, nil
+		}
+		resp.Body.Close()
+		wait := retryAfter(resp.Header.Get("Retry-After"))
+		if waited+wait > maxUnavailableWait {
+			return nil, TransientError{fmt.Errorf("agent unavailable (HTTP %s for %s)", resp.Status, waited)}
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return nil, fmt.Errorf("agent unavailable (%s)", c.ctx.Err())
+		}
+		waited += wait
+	}
+}
+
+// retryAfter parses the delay-seconds form of a Retry-After header. Missing,
+// invalid, or zero delays fall back to a default, so we never spin.
+func retryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return defaultUnavailableWait
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// errorResponse is the body of the agent's error responses.
+type errorResponse struct {
+	herrors.Error
+
+	// PortConflicts are set if the agent rejected a config for its ports.
+	PortConflicts agent.PortConflicts `json:"port_conflicts,omitempty"`
+
+	// ConfigConflict is set if the agent rejected a config for an existing
+	// container.
+	ConfigConflict agent.ConfigConflict `json:"config_conflict,omitempty"`
+}
+
+// statusError is returned for an unexpected response without an error body.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("invalid agent response (HTTP %s)", e.status)
+}
+
+// ErrorCode satisfies the errors.Coder interface.
+func (e statusError) ErrorCode() herrors.Code {
+	return herrors.ForStatus(e.code)
+}
+
+// responseError reads the error from an unexpected response. Errors of
+// agents which don't send codes get those of their HTTP status.
+func responseError(resp *http.Response) error {
+	var response errorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return statusError{resp.StatusCode, fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))}
+	}
+	if len(response.PortConflicts) > 0 {
+		return response.PortConflicts
+	}
+	if len(response.ConfigConflict) > 0 {
+		return response.ConfigConflict
+	}
+	if response.Code == "" {
+		response.Code = herrors.ForStatus(resp.StatusCode)
+	}
+	return &response.Error
+}
+
+type stopperChan chan struct{}
+
+// Stop implements the agent.Stopper interface.
+func (s stopperChan) Stop() { close(s) }
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":                              defaultUnavailableWait,
+		"0":                             defaultUnavailableWait,
+		"-3":                            defaultUnavailableWait,
+		"Fri, 31 Dec 1999 23:59:59 GMT": defaultUnavailableWait,
+		"7":                             7 * time.Second,
+	} {
+		if have := retryAfter(value); want != have {
+			t.Errorf("Retry-After %q: want %s, have %s", value, want, have)
+		}
+	}
+}
+
+func TestReadEvent(t *testing.T) {
+	rd := bufio.NewReader(strings.NewReader(": comment\n\nid: 1\nevent: containers\ndata: []\n\nevent: container\ndata: {\ndata: }\r\n\r\nid: 3\n"))
+
+	for _, want := range []struct{ name, data string }{
+		{"containers", "[]"},
+		{"container", "{\n}"},
+	} {
+		name, data, err := readEvent(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want.name != name || want.data != string(data) {
+			t.Errorf("want event %q with data %q, have %q with %q", want.name, want.data, name, data)
+		}
+	}
+
+	if _, _, err := readEvent(rd); err != io.EOF {
+		t.Errorf("want %v, have %v", io.EOF, err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+// PUTs of containers are idempotent: a client which retries a PUT, e.g.
+// because the first one timed out, gets the existing container back if it
+// PUTs the same config again. Configs are compared as they were PUT, not as
+// resolved on create, e.g. with allocated ports. A different config for an
+// existing ID is a conflict, and rejected with the top-level fields which
+// differ.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+// configConflictResponse is the body of the response rejecting a config for
+// an existing container. It has the fields of the scheduler's error
+// responses, so clients read it like those.
+type configConflictResponse struct {
+	errors.Error
+	ConfigConflict agent.ConfigConflict `json:"config_conflict"`
+}
+
+func writeConfigConflict(w http.ResponseWriter, conflict agent.ConfigConflict) {
+	errors.Write(w, http.StatusConflict, configConflictResponse{
+		Error:          *errors.New(http.StatusConflict, errors.ConfigConflict, conflict.Error()),
+		ConfigConflict: conflict,
+	})
+}
+
+// diffConfigs returns the top-level fields which differ between the configs,
+// sorted by name. Fields are compared by their JSON encoding, so empty and
+// omitted fields are equal.
+func diffConfigs(existing, requested agent.ContainerConfig) agent.ConfigConflict {
+	var (
+		existingFields  = configFields(existing)
+		requestedFields = configFields(requested)
+		conflict        = agent.ConfigConflict{}
+	)
+
+	for name := range existingFields {
+		requestedFields[name] = requestedFields[name] // fields omitted when empty
+	}
+
+	for name, value := range requestedFields {
+		if string(existingFields[name]) != string(value) {
+			conflict = append(conflict, agent.ConfigChange{
+				Field:     name,
+				Existing:  existingFields[name],
+				Requested: value,
+			})
+		}
+	}
+
+	sort.Sort(configChangesByField(conflict))
+
+	return conflict
+}
+
+func configFields(config agent.ContainerConfig) map[string]json.RawMessage {
+	m := map[string]json.RawMessage{}
+
+	buf, err := json.Marshal(config)
+	if err != nil {
+		return m
+	}
+
+	json.Unmarshal(buf, &m)
+
+	return m
+}
+
+type configChangesByField agent.ConfigConflict
+
+func (a configChangesByField) Len() int           { return len(a) }
+func (a configChangesByField) Less(i, j int) bool { return a[i].Field < a[j].Field }
+func (a configChangesByField) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -3,24 +3,23 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 
 	"github.com/docker/libcontainer"
 	"github.com/docker/libcontainer/cgroups"
-	"github.com/docker/libcontainer/devices"
 	"github.com/docker/libcontainer/mount"
 )
 
@@ -28,37 +27,139 @@ type container struct {
 	agent.ContainerInstance
 
 	config       *libcontainer.Config
+	dns          agent.DNS // with the agent's defaults
 	desired      string
 	downDeadline time.Time
 
+	// generation identifies the current desired state in the heartbeat
+	// protocol; acked is the last generation confirmed by the supervisor.
+	generation uint64
+	acked      uint64
+	signal     int
+
+	// escalated is true once a restart outlasted its grace period, and the
+	// supervisor was told to kill the process.
+	escalated bool
+
+	// process is reported by the supervisor, and lets the agent act on the
+	// container without its cooperation.
+	process agent.ProcessInfo
+	killc   <-chan time.Time
+
+	// exited is true while the supervisor reports the command as exited, so
+	// each exit is recorded once.
+	exited bool
+
+	// requested is the config as it was PUT, before create resolved it, so
+	// that a repeated PUT can be told from a conflicting one.
+	requested agent.ContainerConfig
+
+	// history keeps the last events of the container, and metrics its last
+	// metrics samples
+	history *history
+	metrics *metricsHistory
+
 	subscribers map[chan<- agent.ContainerInstance]struct{}
 
 	actionRequestc chan actionRequest
 	hbRequestc     chan heartbeatRequest
 	subc           chan chan<- agent.ContainerInstance
 	unsubc         chan chan<- agent.ContainerInstance
+	historyc       chan chan []agent.ContainerHistoryEvent
+	metricsc       chan chan []agent.ContainerMetricsSample
 	quitc          chan struct{}
 }
 
 func newContainer(id string, config agent.ContainerConfig) *container {
+	c := makeContainer(id, config)
+	c.requested = copyConfig(config)
+	c.history.add("", c.Status, "created")
+
+	go c.loop()
+
+	return c
+}
+
+// recoverContainer restores a container from the state left in its run
+// directory by a previous agent. Containers whose supervisor is still alive
+// are adopted as running; the rest are reported as finished. checkedIn, if
+// not nil, is the process info of a supervisor which just sent a heartbeat;
+// it's taken as far as verifyProcess vouches for it.
+func recoverContainer(rundir string, checkedIn *agent.ProcessInfo) (*container, error) {
+	var (
+		id        = filepath.Base(rundir)
+		config    agent.ContainerConfig
+		requested agent.ContainerConfig
+		process   agent.ProcessInfo
+	)
+
+	if err := readJSON(filepath.Join(rundir, "config.json"), &config); err != nil {
+		return nil, err
+	}
+
+	// containers created by older agents have no request.json
+	if err := readJSON(filepath.Join(rundir, "request.json"), &requested); os.IsNotExist(err) {
+		requested = copyConfig(config)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := readJSON(filepath.Join(rundir, "process.json"), &process); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// the previous agent only recorded verified supervisors, but the
+	// container process may have changed since
+	if process.SupervisorPID <= 1 {
+		process = agent.ProcessInfo{}
+	}
+
+	process = verifyProcess(id, agent.ProcessInfo{SupervisorPID: process.SupervisorPID}, process)
+
+	if checkedIn != nil {
+		process = verifyProcess(id, process, *checkedIn)
+	}
+
+	c := makeContainer(id, config)
+	c.requested = requested
+	c.process = process
+
+	if processAlive(process.SupervisorPID) {
+		c.Status = agent.ContainerStatusRunning
+		c.desired = agent.WantUp
+	} else {
+		c.Status = agent.ContainerStatusFinished
+		c.desired = agent.WantDown
+	}
+
+	c.history.add("", c.Status, "recovered by restarted agent")
+
+	go c.loop()
+
+	return c, nil
+}
+
+func makeContainer(id string, config agent.ContainerConfig) *container {
 	c := &container{
 		ContainerInstance: agent.ContainerInstance{
 			ID:     id,
 			Status: agent.ContainerStatusStarting,
 			Config: config,
 		},
+		history:        newHistory(*containerEvents),
+		metrics:        newMetricsHistory(*containerMetrics),
 		subscribers:    map[chan<- agent.ContainerInstance]struct{}{},
 		actionRequestc: make(chan actionRequest),
 		hbRequestc:     make(chan heartbeatRequest),
 		subc:           make(chan chan<- agent.ContainerInstance),
 		unsubc:         make(chan chan<- agent.ContainerInstance),
+		historyc:       make(chan chan []agent.ContainerHistoryEvent),
+		metricsc:       make(chan chan []agent.ContainerMetricsSample),
 		quitc:          make(chan struct{}),
 	}
 
 	c.buildContainerConfig()
 
-	go c.loop()
-
 	return c
 }
 
@@ -80,10 +181,10 @@ func (c *container) Destroy() error {
 	return <-req.res
 }
 
-func (c *container) Heartbeat(hb agent.Heartbeat) string {
+func (c *container) Heartbeat(hb agent.Heartbeat) agent.HeartbeatReply {
 	req := heartbeatRequest{
 		heartbeat: hb,
-		res:       make(chan string),
+		res:       make(chan agent.HeartbeatReply),
 	}
 	c.hbRequestc <- req
 	return <-req.res
@@ -93,6 +194,26 @@ func (c *container) Instance() agent.ContainerInstance {
 	return c.ContainerInstance
 }
 
+// History returns the last events of the container, oldest first.
+func (c *container) History() []agent.ContainerHistoryEvent {
+	ch := make(chan []agent.ContainerHistoryEvent)
+	c.historyc <- ch
+	return <-ch
+}
+
+// Metrics returns the last metrics samples of the container, oldest first.
+func (c *container) Metrics() []agent.ContainerMetricsSample {
+	ch := make(chan []agent.ContainerMetricsSample)
+	c.metricsc <- ch
+	return <-ch
+}
+
+// Process returns the processes and cgroup of the container, as far as they
+// were verified.
+func (c *container) Process() agent.ProcessInfo {
+	return c.process
+}
+
 func (c *container) Restart(t time.Duration) error {
 	req := actionRequest{
 		action:  containerRestart,
@@ -103,6 +224,44 @@ func (c *container) Restart(t time.Duration) error {
 	return <-req.res
 }
 
+func (c *container) Pause() error {
+	req := actionRequest{
+		action: containerPause,
+		res:    make(chan error),
+	}
+	c.actionRequestc <- req
+	return <-req.res
+}
+
+func (c *container) Resume() error {
+	req := actionRequest{
+		action: containerResume,
+		res:    make(chan error),
+	}
+	c.actionRequestc <- req
+	return <-req.res
+}
+
+func (c *container) Signal(sig int) error {
+	req := actionRequest{
+		action: containerSignal,
+		signal: sig,
+		res:    make(chan error),
+	}
+	c.actionRequestc <- req
+	return <-req.res
+}
+
+func (c *container) UpdateResources(resources agent.Resources) error {
+	req := actionRequest{
+		action:    containerUpdateResources,
+		resources: resources,
+		res:       make(chan error),
+	}
+	c.actionRequestc <- req
+	return <-req.res
+}
+
 func (c *container) Start() error {
 	req := actionRequest{
 		action: containerStart,
@@ -136,15 +295,28 @@ func (c *container) loop() {
 		case req := <-c.actionRequestc:
 			switch req.action {
 			case containerCreate:
-				req.res <- c.create()
+				err := c.create()
+				if err != nil {
+					c.ContainerInstance.Error = err.Error()
+					c.updateStatus(agent.ContainerStatusFailed, err.Error())
+				}
+				req.res <- err
 			case containerDestroy:
 				req.res <- c.destroy()
+			case containerPause:
+				req.res <- c.transition(agent.WantPause, 0)
 			case containerRestart:
-				req.res <- fmt.Errorf("not yet implemented")
+				req.res <- c.restart(req.timeout)
+			case containerResume:
+				req.res <- c.transition(agent.WantUp, 0)
+			case containerSignal:
+				req.res <- c.transition(c.desired, req.signal)
 			case containerStart:
 				req.res <- c.start()
 			case containerStop:
 				req.res <- c.stop(req.timeout)
+			case containerUpdateResources:
+				req.res <- c.updateResources(req.resources)
 			default:
 				panic("unknown action")
 			}
@@ -154,6 +326,12 @@ func (c *container) loop() {
 			c.subscribers[ch] = struct{}{}
 		case ch := <-c.unsubc:
 			delete(c.subscribers, ch)
+		case ch := <-c.historyc:
+			ch <- c.history.list()
+		case ch := <-c.metricsc:
+			ch <- c.metrics.list()
+		case <-c.killc:
+			c.kill()
 		case <-c.quitc:
 			return
 		}
@@ -163,12 +341,24 @@ func (c *container) loop() {
 func (c *container) buildContainerConfig() {
 	var (
 		env    = []string{}
+		rundir = filepath.Join("/run/harpoon", c.ID)
 		mounts = mount.Mounts{
 			{Type: "devtmpfs"},
-			{Type: "bind", Source: "/etc/resolv.conf", Destination: "/etc/resolv.conf", Private: true},
 		}
 	)
 
+	c.dns = containerDNS(c.Config.DNS)
+
+	if ownResolvConf(c.dns) {
+		mounts = append(mounts, mount.Mount{Type: "bind", Source: filepath.Join(rundir, "resolv.conf"), Destination: hostResolvConf, Private: true})
+	} else {
+		mounts = append(mounts, mount.Mount{Type: "bind", Source: hostResolvConf, Destination: hostResolvConf, Private: true})
+	}
+
+	if len(c.dns.Hosts) > 0 {
+		mounts = append(mounts, mount.Mount{Type: "bind", Source: filepath.Join(rundir, "hosts"), Destination: "/etc/hosts", Private: true})
+	}
+
 	if c.Config.Env == nil {
 		c.Config.Env = map[string]string{}
 	}
@@ -177,10 +367,21 @@ func (c *container) buildContainerConfig() {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
 
+	env = append(env,
+		fmt.Sprintf("HARPOON_ENV_FILE=%s", envFilePath),
+		fmt.Sprintf("HARPOON_CONFIG_FILE=%s", configFilePath),
+	)
+	mounts = append(mounts,
+		mount.Mount{Type: "bind", Source: filepath.Join(rundir, "env"), Destination: envFilePath, Private: true},
+		// the config as resolved on create, e.g. with allocated ports, and
+		// kept up to date with resource updates
+		mount.Mount{Type: "bind", Source: filepath.Join(rundir, "config.json"), Destination: configFilePath, Private: true},
+	)
+
 	for dest, source := range c.Config.Storage.Volumes {
-		if _, ok := configuredVolumes[source]; !ok {
-			// TODO: this needs to happen as a part of a validation step, so the
-			// container is rejected.
+		if !host.hasVolume(source) {
+			// unknown volumes and devices are rejected by the API on
+			// create, but the host config may have changed since
 			log.Printf("volume %s not configured", source)
 			continue
 		}
@@ -190,6 +391,8 @@ func (c *container) buildContainerConfig() {
 		})
 	}
 
+	allowedDevices := containerDevices(c.Config.Security)
+
 	c.config = &libcontainer.Config{
 		Hostname: hostname,
 		// daemon user and group; must be numeric as we make no assumptions about
@@ -205,17 +408,25 @@ func (c *container) buildContainerConfig() {
 		},
 		Cgroups: &cgroups.Cgroup{
 			Name:   c.ID,
-			Parent: "harpoon",
+			Parent: cgroupParent,
 
-			Memory: int64(c.Config.Resources.Memory * 1024 * 1024),
+			Memory:    int64(c.Config.Resources.Memory * 1024 * 1024),
+			CpuShares: cpuShares(c.Config.Resources.CPUs),
 
-			AllowedDevices: devices.DefaultAllowedDevices,
+			AllowedDevices: allowedDevices,
 		},
 		MountConfig: &libcontainer.MountConfig{
-			DeviceNodes: devices.DefaultAllowedDevices,
+			DeviceNodes: allowedDevices,
 			Mounts:      mounts,
 			ReadonlyFs:  true,
 		},
+		Context: map[string]string{
+			seccompContextKey: c.Config.Security.SeccompProfile(),
+		},
+	}
+
+	if c.Config.Egress != nil {
+		c.config.Context[netClsContextKey] = netClsCgroup(c.ID)
 	}
 }
 
@@ -233,9 +444,13 @@ func (c *container) create() error {
 		return fmt.Errorf("mkdir all %s: %s", logdir, err)
 	}
 
+	if err := writeJSON(filepath.Join(rundir, "request.json"), c.requested); err != nil {
+		return err
+	}
+
 	rootfs, err := c.fetchArtifact()
 	if err != nil {
-		return err
+		return fmt.Errorf("fetch artifact %s: %s", redactURL(c.Config.ArtifactURL), err)
 	}
 
 	if err := os.Symlink(rootfs, filepath.Join(rundir, "rootfs")); err != nil && !os.IsExist(err) {
@@ -248,15 +463,38 @@ func (c *container) create() error {
 
 	for name, port := range c.Config.Ports {
 		if port == 0 {
-			port = uint16(nextPort())
+			start, err := allocatePorts(agent.PortProtocolTCP, 1)
+			if err != nil {
+				return err
+			}
+
+			port = start
 		}
 
-		portName := fmt.Sprintf("PORT_%s", strings.ToUpper(name))
+		portName := agent.PortEnv(name)
 
 		c.Config.Ports[name] = port
 		c.Config.Env[portName] = strconv.Itoa(int(port))
 	}
 
+	for name, portRange := range c.Config.PortRanges {
+		if portRange.Start == 0 {
+			start, err := allocatePorts(portRange.Proto(), portRange.Size())
+			if err != nil {
+				return err
+			}
+
+			portRange.Start = start
+		}
+
+		portName := agent.PortEnv(name)
+
+		c.Config.PortRanges[name] = portRange
+		c.Config.Env[portName] = strconv.Itoa(int(portRange.Start))
+		c.Config.Env[portName+"_START"] = strconv.Itoa(int(portRange.Start))
+		c.Config.Env[portName+"_END"] = strconv.Itoa(int(portRange.End()))
+	}
+
 	// expand variable in command
 	command := c.Config.Command.Exec
 	for i, arg := range command {
@@ -265,6 +503,57 @@ func (c *container) create() error {
 		})
 	}
 
+	if err := validateCommand(rootfs, c.Config.Command, c.Config.Env["PATH"]); err != nil {
+		return err
+	}
+
+	if c.Config.Egress != nil {
+		if err := setupEgress(c.ID, c.Config.Egress); err != nil {
+			return fmt.Errorf("egress: %s", err)
+		}
+	}
+
+	return c.regenerate()
+}
+
+// regenerate rebuilds the libcontainer config from the current config, so
+// allocated ports, resource updates, and changes of the host config and DNS
+// flags take effect, and rewrites the files of the run directory the
+// container uses. The new config is validated before it replaces
+// container.json. Containers are regenerated on create, and before each
+// start and restart, so they never run with a stale config.
+func (c *container) regenerate() error {
+	rundir := filepath.Join("/run/harpoon", c.ID)
+
+	rootfs, err := filepath.EvalSymlinks(filepath.Join(rundir, "rootfs"))
+	if err != nil {
+		return err
+	}
+
+	for _, source := range c.Config.Storage.Volumes {
+		if !host.hasVolume(source) {
+			return fmt.Errorf("volume %s no longer configured", source)
+		}
+	}
+
+	c.buildContainerConfig()
+
+	if err := writeDNSFiles(rundir, rootfs, c.dns); err != nil {
+		return fmt.Errorf("dns: %s", err)
+	}
+
+	if err := writeEnvFile(filepath.Join(rundir, "env"), c.Config.Env, c.Config.EnvFile); err != nil {
+		return err
+	}
+
+	if err := writeJSON(filepath.Join(rundir, "config.json"), c.Config); err != nil {
+		return err
+	}
+
+	if err := validateContainerJSON(c.config); err != nil {
+		return fmt.Errorf("invalid container config: %s", err)
+	}
+
 	return c.writeContainerJSON(filepath.Join(rundir, "container.json"))
 }
 
@@ -275,7 +564,12 @@ func (c *container) destroy() error {
 
 	// TODO: validate that container is stopped
 
-	c.updateStatus(agent.ContainerStatusDeleted)
+	c.killc = nil
+	c.updateStatus(agent.ContainerStatusDeleted, "destroyed")
+
+	if c.Config.Egress != nil {
+		teardownEgress(c.ID)
+	}
 
 	err := os.RemoveAll(rundir)
 	if err != nil {
@@ -298,58 +592,307 @@ func (c *container) fetchArtifact() (string, error) {
 		artifactPath = getArtifactPath(artifactURL)
 	)
 
-	fmt.Fprintf(os.Stderr, "fetching url %s to %s\n", artifactURL, artifactPath)
+	fmt.Fprintf(os.Stderr, "fetching url %s to %s\n", redactURL(artifactURL), artifactPath)
 
 	if !strings.HasSuffix(artifactURL, ".tar.gz") {
 		return "", fmt.Errorf("artifact must be .tar.gz")
 	}
 
 	if _, err := os.Stat(artifactPath); err == nil {
+		// artifacts cached before they were marked are marked on first use
+		if !isArtifactCached(artifactPath) {
+			markArtifactCached(artifactPath, artifactURL)
+		}
+
 		return artifactPath, nil
 	}
 
-	if err := os.MkdirAll(artifactPath, 0755); err != nil {
+	body, size, err := fetch(artifactURL)
+	if err != nil {
 		return "", err
 	}
+	defer body.Close()
 
-	resp, err := http.Get(artifactURL)
-	if err != nil {
+	if err := os.MkdirAll(artifactPath, 0755); err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	if err := extractArtifact(resp.Body, artifactPath); err != nil {
+	if err := extractArtifact(body, size, artifactPath); err != nil {
 		return "", err
 	}
 
+	markArtifactCached(artifactPath, artifactURL)
+
 	return artifactPath, nil
 }
 
-func (c *container) heartbeat(hb agent.Heartbeat) string {
+// defaultPath is searched for commands if the container config doesn't set
+// PATH.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// validateCommand checks that the working directory exists in the rootfs, and
+// that the command resolves to an executable file, relative to the working
+// directory or on the PATH. Otherwise, the supervisor would fail to start it
+// with a much less helpful error.
+func validateCommand(rootfs string, command agent.Command, pathEnv string) error {
+	dir, err := resolveInRootfs(rootfs, command.WorkingDir)
+	if err != nil {
+		return fmt.Errorf("working directory %s: %s", command.WorkingDir, err)
+	}
+
+	if fi, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("working directory %s does not exist in the artifact", command.WorkingDir)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("working directory %s is not a directory", command.WorkingDir)
+	}
+
+	name := command.Exec[0]
+
+	if strings.Contains(name, "/") {
+		if !path.IsAbs(name) {
+			name = path.Join(command.WorkingDir, name)
+		}
+
+		return checkExecutable(rootfs, name, command.Exec[0])
+	}
+
+	if pathEnv == "" {
+		pathEnv = defaultPath
+	}
+
+	for _, dir := range filepath.SplitList(pathEnv) {
+		if !path.IsAbs(dir) {
+			dir = path.Join(command.WorkingDir, dir)
+		}
+
+		if checkExecutable(rootfs, path.Join(dir, name), name) == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("command %s not found in PATH %s in the artifact", name, pathEnv)
+}
+
+// checkExecutable checks that name, a path inside the rootfs, is an
+// executable file. As is the command it was resolved from, for errors.
+func checkExecutable(rootfs, name, as string) error {
+	p, err := resolveInRootfs(rootfs, name)
+	if err != nil {
+		return fmt.Errorf("command %s: %s", as, err)
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("command %s (%s) does not exist in the artifact", as, name)
+	}
+
+	if fi.IsDir() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("command %s (%s) is not an executable file", as, name)
+	}
+
+	return nil
+}
+
+// resolveInRootfs returns the host path of the absolute path p inside the
+// rootfs, following symlinks as the container would see them.
+func resolveInRootfs(rootfs, p string) (string, error) {
+	const maxLinks = 32
+
+	var (
+		resolved = "/"
+		rest     = strings.Split(path.Clean("/"+p), "/")
+		links    = 0
+	)
+
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+
+		if part == "" || part == "." {
+			continue
+		}
+
+		next := path.Join(resolved, part)
+
+		fi, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// missing components are left for the caller to report
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+
+		target, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	return filepath.Join(rootfs, resolved), nil
+}
+
+func (c *container) heartbeat(hb agent.Heartbeat) agent.HeartbeatReply {
+	if process := verifyProcess(c.ID, c.process, hb.ProcessInfo); process != c.process {
+		c.process = process
+
+		if err := writeJSON(filepath.Join("/run/harpoon", c.ID, "process.json"), c.process); err != nil {
+			log.Printf("[%s] unable to save process info: %s", c.ID, err)
+		}
+	}
+
+	if hb.ContainerMetrics != nil {
+		// copy, as instances are handed out to other goroutines
+		metrics := *hb.ContainerMetrics
+
+		if previous := c.ContainerInstance.Metrics; previous != nil && metrics.Restarts > previous.Restarts {
+			c.history.add(c.Status, c.Status, fmt.Sprintf("restarted by the supervisor (restart %d)", metrics.Restarts))
+
+			if c.desired == agent.WantRestart {
+				c.desired = agent.WantUp
+			}
+		}
+
+		c.ContainerInstance.Metrics = &metrics
+		c.ContainerInstance.Restarts = metrics.Restarts
+		c.metrics.add(metrics)
+	}
+
+	if hb.ResourcesError != c.ContainerInstance.ResourcesError {
+		if hb.ResourcesError != "" {
+			c.history.add(c.Status, c.Status, fmt.Sprintf("unable to apply resource limits: %s", hb.ResourcesError))
+		}
+
+		c.ContainerInstance.ResourcesError = hb.ResourcesError
+		c.updateStatus(c.Status, "")
+	}
+
+	exited := hb.Exited || hb.Signaled
+
+	if exited && !c.exited {
+		c.ContainerInstance.LastExit = &agent.ContainerExit{
+			ExitStatus: hb.ExitStatus,
+			Signal:     hb.Signal,
+			OOMed:      hb.OOMed,
+			Time:       time.Now(),
+		}
+
+		// let subscribers know, even if the supervisor restarts it
+		c.updateStatus(c.Status, exitReason(hb.ContainerProcessStatus))
+	}
+
+	c.exited = exited
+
+	if hb.Version >= 1 && hb.Ack > c.generation {
+		// the supervisor outlived a previous agent; continue numbering past
+		// what it has already applied
+		c.generation = hb.Ack
+	}
+
+	if hb.Version >= 1 && hb.Ack > c.acked {
+		c.acked = hb.Ack
+	}
+
+	if c.acked >= c.generation {
+		// one-shot parts of the desired state have been applied
+		c.signal = 0
+	}
+
+	// want may escalate the desired state, with a new generation
+	want := c.want(hb)
+
+	// copy, as the reply is handed out to the API goroutine
+	resources := c.Config.Resources
+
+	reply := agent.HeartbeatReply{
+		Version:    agent.HeartbeatVersion,
+		Want:       want,
+		Generation: c.generation,
+		Signal:     c.signal,
+		Resources:  &resources,
+	}
+
+	if hb.Version < 1 {
+		switch reply.Want {
+		case agent.WantRestart, agent.WantPause:
+			reply.Want = agent.WantUp
+			reply.Err = fmt.Sprintf("%s requires heartbeat protocol version 1", c.desired)
+		}
+	}
+
+	return reply
+}
+
+// want returns the state the supervisor should bring the container to, given
+// the state it reports. Stops and restarts which outlast their grace period
+// are escalated to a kill, with a new generation, as the supervisor applies
+// each generation once.
+func (c *container) want(hb agent.Heartbeat) string {
 	type state struct{ want, is string }
 
 	switch (state{c.desired, hb.Status}) {
-	case state{"UP", "UP"}:
-		return "UP"
-	case state{"UP", "EXITING"}:
-		c.updateStatus(agent.ContainerStatusFinished)
-		return "EXIT"
+	case state{agent.WantUp, agent.HeartbeatStatusUp}:
+		return agent.WantUp
+	case state{agent.WantUp, agent.HeartbeatStatusExiting}:
+		// the supervisor gave up on the container on its own
+		if hb.Err != "" || !hb.Succeeded() {
+			c.ContainerInstance.Error = hb.Err
+			reason := exitReason(hb.ContainerProcessStatus)
+			if hb.Err != "" {
+				reason += ": " + hb.Err
+			}
+			c.updateStatus(agent.ContainerStatusFailed, reason)
+		} else {
+			c.updateStatus(agent.ContainerStatusFinished, exitReason(hb.ContainerProcessStatus))
+		}
+
+		return agent.WantExit
 
-	case state{"DOWN", "UP"}:
+	case state{agent.WantDown, agent.HeartbeatStatusUp}:
 		if time.Now().After(c.downDeadline) {
-			return "EXIT"
+			c.desired = agent.WantExit
+			c.generation++
+			return agent.WantExit
 		}
 
-		return "DOWN"
-	case state{"DOWN", "EXITING"}:
-		c.updateStatus(agent.ContainerStatusFinished)
-		return "EXIT"
+		return agent.WantDown
+	case state{agent.WantDown, agent.HeartbeatStatusExiting}:
+		c.killc = nil
+		c.updateStatus(agent.ContainerStatusFinished, "stopped")
+		return agent.WantExit
+
+	case state{agent.WantExit, agent.HeartbeatStatusUp}:
+		return agent.WantExit
+	case state{agent.WantExit, agent.HeartbeatStatusExiting}:
+		c.updateStatus(agent.ContainerStatusFinished, exitReason(hb.ContainerProcessStatus))
+		return agent.WantExit
+
+	case state{agent.WantRestart, agent.HeartbeatStatusUp}:
+		if !c.escalated && time.Now().After(c.downDeadline) {
+			// kill the process; the supervisor still restarts it
+			c.escalated = true
+			c.signal = int(syscall.SIGKILL)
+			c.generation++
+		}
+
+		return agent.WantRestart
+	case state{agent.WantRestart, agent.HeartbeatStatusExiting}:
+		c.updateStatus(agent.ContainerStatusFinished, "exited while restarting: "+exitReason(hb.ContainerProcessStatus))
+		return agent.WantExit
 
-	case state{"EXIT", "UP"}:
-		return "EXIT"
-	case state{"EXIT", "EXITING"}:
-		c.updateStatus(agent.ContainerStatusFinished)
-		return "EXIT"
+	case state{agent.WantPause, agent.HeartbeatStatusUp}:
+		return agent.WantPause
+	case state{agent.WantPause, agent.HeartbeatStatusExiting}:
+		c.updateStatus(agent.ContainerStatusFinished, "exited while paused: "+exitReason(hb.ContainerProcessStatus))
+		return agent.WantExit
 	}
 
 	return "UNKNOWN"
@@ -358,12 +901,27 @@ func (c *container) heartbeat(hb agent.Heartbeat) string {
 func (c *container) start() error {
 	// TODO: validate that container is stopped
 
+	// a running container listens on its own ports
+	if c.ContainerInstance.Status != agent.ContainerStatusRunning {
+		if err := portConflicts(c.Config, nil); err != nil {
+			c.ContainerInstance.Error = err.Error()
+			c.updateStatus(agent.ContainerStatusFailed, err.Error())
+			return err
+		}
+	}
+
+	if err := c.regenerate(); err != nil {
+		c.ContainerInstance.Error = err.Error()
+		c.updateStatus(agent.ContainerStatusFailed, err.Error())
+		return err
+	}
+
 	var (
 		rundir = path.Join("/run/harpoon", c.ID)
 		logdir = filepath.Join("/srv/harpoon/log/", c.ID)
 	)
 
-	logPipe, err := startLogger(c.ID, logdir)
+	logPipe, err := startLogger(logdir)
 	if err != nil {
 		return err
 	}
@@ -377,41 +935,167 @@ func (c *container) start() error {
 	)
 
 	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, fmt.Sprintf(
-		"heartbeat_url=http://%s/containers/%s/heartbeat",
-		*addr,
-		c.ID,
-	))
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("heartbeat_url=http://%s/containers/%s/heartbeat", *addr, c.ID),
+		fmt.Sprintf("heartbeat_interval=%s", *heartbeatInterval),
+		fmt.Sprintf("heartbeat_jitter=%f", *heartbeatJitter),
+		fmt.Sprintf("restart_policy=%s", c.Config.Restart),
+		fmt.Sprintf("container_id=%s", c.ID),
+		fmt.Sprintf("log_addr=%s", logAddr),
+		fmt.Sprintf("log_rate_lines=%f", *logRateLines),
+		fmt.Sprintf("log_rate_bytes=%f", *logRateBytes),
+	)
+
+	if c.Config.Hooks != nil {
+		hooks, err := json.Marshal(c.Config.Hooks)
+		if err != nil {
+			return err
+		}
+
+		cmd.Env = append(cmd.Env, fmt.Sprintf("hooks=%s", hooks))
+	}
 
 	cmd.Stdout = logPipe
 	cmd.Stderr = logPipe
 	cmd.Dir = rundir
 
-	c.desired = "UP"
+	dropInChild(cmd)
+
+	c.desired = agent.WantUp
+	c.generation++
+	c.signal = 0
+	c.escalated = false
+	c.killc = nil
+	c.ContainerInstance.Error = ""
 
 	if err := cmd.Start(); err != nil {
 		// update state
 		return err
 	}
 
+	// heartbeats can't replace the supervisor the agent started
+	c.process = agent.ProcessInfo{SupervisorPID: cmd.Process.Pid}
+
+	if err := writeJSON(filepath.Join(rundir, "process.json"), c.process); err != nil {
+		log.Printf("[%s] unable to save process info: %s", c.ID, err)
+	}
+
 	// no zombies
 	go cmd.Wait()
 
 	// reflect state
-	c.updateStatus(agent.ContainerStatusRunning)
+	c.updateStatus(agent.ContainerStatusRunning, "started")
 
 	// start
 	return nil
 }
 
 func (c *container) stop(t time.Duration) error {
-	c.desired = "DOWN"
-	c.downDeadline = time.Now().Add(t).Add(heartbeatInterval)
+	c.desired = agent.WantDown
+	c.downDeadline = time.Now().Add(t).Add(maxHeartbeatInterval())
+	c.signal = 0
+	c.generation++
+
+	// if the supervisor hasn't reported the container as exited well after
+	// the deadline, it's not going to; kill it ourselves
+	if c.ContainerInstance.Status == agent.ContainerStatusRunning {
+		c.killc = time.After(c.downDeadline.Sub(time.Now()) + 3*maxHeartbeatInterval())
+	}
+
+	return nil
+}
+
+// kill forcibly terminates the container and its supervisor, using the pids
+// verified from heartbeats. The container process is checked again, as it may
+// have exited and its pid been reused since.
+func (c *container) kill() {
+	c.killc = nil
+
+	if c.ContainerInstance.Status != agent.ContainerStatusRunning {
+		return
+	}
+
+	log.Printf("[%s] supervisor unresponsive; killing %+v", c.ID, c.process)
+
+	pids := []int{c.process.SupervisorPID}
+
+	if containerProcess(c.ID, c.process.SupervisorPID, c.process.ContainerPID) {
+		pids = []int{c.process.ContainerPID, c.process.SupervisorPID}
+	}
+
+	for _, pid := range pids {
+		if pid <= 1 {
+			continue
+		}
+
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			log.Printf("[%s] kill %d: %s", c.ID, pid, err)
+		}
+	}
+
+	c.updateStatus(agent.ContainerStatusFinished, "killed after the supervisor didn't stop it")
+}
+
+func (c *container) restart(t time.Duration) error {
+	if c.ContainerInstance.Status != agent.ContainerStatusRunning {
+		return c.start()
+	}
+
+	// the supervisor restarts the process in place, with the container's
+	// init reading container.json anew; the grace period is enforced by the
+	// supervisor's own stop handling
+	if err := c.regenerate(); err != nil {
+		return err
+	}
+
+	c.downDeadline = time.Now().Add(t).Add(maxHeartbeatInterval())
+
+	return c.transition(agent.WantRestart, 0)
+}
+
+// transition changes the desired state of the container, to be picked up by
+// the supervisor on its next heartbeat. A nonzero signal is delivered once.
+func (c *container) transition(want string, signal int) error {
+	if c.ContainerInstance.Status != agent.ContainerStatusRunning {
+		return fmt.Errorf("container is %s, not %s", c.ContainerInstance.Status, agent.ContainerStatusRunning)
+	}
+
+	c.desired = want
+	c.signal = signal
+	c.escalated = false
+	c.generation++
 
 	return nil
 }
 
-func (c *container) updateStatus(status agent.ContainerStatus) {
+// updateResources changes the resource limits of the container. Running
+// containers pick up the new limits with the next heartbeat; others use them
+// when they are started.
+func (c *container) updateResources(resources agent.Resources) error {
+	c.Config.Resources = resources
+
+	if err := c.regenerate(); err != nil {
+		return err
+	}
+
+	if c.ContainerInstance.Status == agent.ContainerStatusRunning {
+		c.generation++
+	}
+
+	// reflect the new config
+	c.updateStatus(c.ContainerInstance.Status, "")
+
+	return nil
+}
+
+// updateStatus changes the status of the container, recording the change and
+// its reason in the history, and tells the subscribers. Subscribers are told
+// even if the status didn't change, e.g. to reflect a new config.
+func (c *container) updateStatus(status agent.ContainerStatus, reason string) {
+	if status != c.ContainerInstance.Status {
+		c.history.add(c.ContainerInstance.Status, status, reason)
+	}
+
 	c.ContainerInstance.Status = status
 
 	for subc := range c.subscribers {
@@ -419,8 +1103,8 @@ func (c *container) updateStatus(status agent.ContainerStatus) {
 	}
 }
 
-func (c *container) writeContainerJSON(dst string) error {
-	data, err := json.Marshal(c.config)
+func writeJSON(dst string, v interface{}) error {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
@@ -428,42 +1112,143 @@ func (c *container) writeContainerJSON(dst string) error {
 	return ioutil.WriteFile(dst, data, os.ModePerm)
 }
 
-type containerAction string
+// writeEnvFile writes the variables to dst, one NAME=value per line, in the
+// format of .env files. Variables in later maps take precedence.
+func writeEnvFile(dst string, vars ...map[string]string) error {
+	merged := map[string]string{}
+	for _, m := range vars {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
 
-const (
-	containerCreate  containerAction = "create"
-	containerDestroy                 = "destroy"
-	containerRestart                 = "restart"
-	containerStart                   = "start"
-	containerStop                    = "stop"
-)
+	names := make([]string, 0, len(merged))
+	for k := range merged {
+		names = append(names, k)
+	}
+	sort.Strings(names)
 
-type actionRequest struct {
-	action  containerAction
-	res     chan error
-	timeout time.Duration
+	var buf []byte
+	for _, k := range names {
+		v := merged[k]
+		if strings.ContainsAny(v, " \t\n\"'\\#$") {
+			v = strconv.Quote(v)
+		}
+
+		buf = append(buf, fmt.Sprintf("%s=%s\n", k, v)...)
+	}
+
+	return ioutil.WriteFile(dst, buf, 0644)
 }
 
-type heartbeatRequest struct {
-	heartbeat agent.Heartbeat
-	res       chan string
+// copyConfig returns a deep copy of the config, which shares no maps or
+// slices with it.
+func copyConfig(config agent.ContainerConfig) agent.ContainerConfig {
+	var copied agent.ContainerConfig
+
+	buf, err := json.Marshal(config)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := json.Unmarshal(buf, &copied); err != nil {
+		panic(err)
+	}
+
+	return copied
 }
 
-func extractArtifact(src io.Reader, dst string) (err error) {
-	defer func() {
-		if err != nil {
-			os.RemoveAll(dst)
+func readJSON(src string, v interface{}) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// cpuShares converts fractional CPUs to cgroup CPU shares, where 1024 shares
+// correspond to one CPU.
+func cpuShares(cpus float64) int64 {
+	return int64(cpus * 1024)
+}
+
+// processAlive reports whether a process with the given pid exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// validateContainerJSON checks the libcontainer config for what would keep the
+// container from starting, or have it start without what it asked for.
+func validateContainerJSON(config *libcontainer.Config) error {
+	if config.Cgroups == nil || config.MountConfig == nil {
+		return fmt.Errorf("no cgroups or mounts")
+	}
+
+	if config.Cgroups.Memory < 0 || config.Cgroups.CpuShares < 0 {
+		return fmt.Errorf("negative resource limits")
+	}
+
+	for _, m := range config.MountConfig.Mounts {
+		if m.Type != "bind" {
+			continue
 		}
-	}()
 
-	cmd := exec.Command("tar", "-C", dst, "-zx")
-	cmd.Stdin = src
+		if _, err := os.Stat(m.Source); err != nil {
+			return fmt.Errorf("mount of %s: %s", m.Destination, err)
+		}
+	}
 
-	if err := cmd.Run(); err != nil {
+	return nil
+}
+
+func (c *container) writeContainerJSON(dst string) error {
+	data, err := json.Marshal(c.config)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return ioutil.WriteFile(dst, data, os.ModePerm)
+}
+
+const (
+	// envFilePath is where the env file is mounted inside the container.
+	envFilePath = "/etc/harpoon.env"
+
+	// configFilePath is where the container's resolved config is mounted
+	// inside the container.
+	configFilePath = "/etc/harpoon.json"
+)
+
+type containerAction string
+
+const (
+	containerCreate          containerAction = "create"
+	containerDestroy                         = "destroy"
+	containerPause                           = "pause"
+	containerRestart                         = "restart"
+	containerResume                          = "resume"
+	containerSignal                          = "signal"
+	containerStart                           = "start"
+	containerStop                            = "stop"
+	containerUpdateResources                 = "update-resources"
+)
+
+type actionRequest struct {
+	action    containerAction
+	res       chan error
+	timeout   time.Duration
+	signal    int
+	resources agent.Resources
+}
+
+type heartbeatRequest struct {
+	heartbeat agent.Heartbeat
+	res       chan agent.HeartbeatReply
 }
 
 func getArtifactPath(artifactURL string) string {
@@ -472,27 +1257,16 @@ func getArtifactPath(artifactURL string) string {
 		panic(fmt.Sprintf("unable to parse url: %s", err))
 	}
 
+	host := parsed.Host
+
+	// other schemes get their own tree; no host name ends in a colon
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		host = filepath.Join(parsed.Scheme+":", host)
+	}
+
 	return filepath.Join(
-		"/srv/harpoon/artifacts",
-		parsed.Host,
+		artifactDir,
+		host,
 		strings.TrimSuffix(parsed.Path, ".tar.gz"),
 	)
 }
-
-// HACK
-var port = make(chan int)
-
-func init() {
-	go func() {
-		i := 30000
-
-		for {
-			port <- i
-			i++
-		}
-	}()
-}
-
-func nextPort() int {
-	return <-port
-}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/soundcloud/harpoon/lib/errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// adminHandler serves Prometheus metrics, the health and readiness checks,
+// the maintenance endpoints, and the debug handler, on the admin listener.
+func adminHandler(api *api) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.HandleFunc("/healthz", api.handleHealthz)
+	mux.HandleFunc("/readyz", api.handleReadyz)
+	mux.Handle("/debug/", debugHandler())
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			api.whenEnabled(api.handleBeginMaintenance)(w, r)
+		case "DELETE":
+			api.whenEnabled(api.handleEndMaintenance)(w, r)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			writeError(w, http.StatusMethodNotAllowed, errors.BadRequest, "method not allowed")
+		}
+	})
+
+	return mux
+}
+
+// debugHandler serves pprof profiles, expvars, and a dump of all goroutine
+// stacks. It's meant for a separate listener, not exposed to API clients.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/vars", handleExpvars)
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+
+	return mux
+}
+
+func handleExpvars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fmt.Fprintf(w, "{\n")
+
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+
+	fmt.Fprintf(w, "\n}\n")
+}
+
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
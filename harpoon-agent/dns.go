@@ -0,0 +1,178 @@
+package main
+
+// Containers get the host's resolv.conf, unless DNS servers or search domains
+// are configured: for all containers with -dns.server and -dns.search, or per
+// container with the dns object of its config, which takes precedence. Then
+// the agent writes a resolv.conf to the container's run directory, the host's
+// with its servers and search domains replaced, and mounts that instead.
+// Hosts entries, from -dns.host and the config, are added to the artifact's
+// /etc/hosts in another file in the run directory, mounted over it. The files
+// are written when the container is created, and rewritten before each start
+// and restart.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const hostResolvConf = "/etc/resolv.conf"
+
+// containerDNS returns the DNS settings of a container: those of its config,
+// with the agent's defaults where the config has none. Hosts are merged.
+func containerDNS(config *agent.DNS) agent.DNS {
+	dns := agent.DNS{
+		Servers: configuredDNSServers,
+		Search:  configuredDNSSearch,
+		Hosts:   map[string]string{},
+	}
+
+	for name, ip := range configuredDNSHosts {
+		dns.Hosts[name] = ip
+	}
+
+	if config == nil {
+		return dns
+	}
+
+	if len(config.Servers) > 0 {
+		dns.Servers = config.Servers
+	}
+
+	if len(config.Search) > 0 {
+		dns.Search = config.Search
+	}
+
+	for name, ip := range config.Hosts {
+		dns.Hosts[name] = ip
+	}
+
+	return dns
+}
+
+// ownResolvConf returns true if the container needs a resolv.conf of its own.
+func ownResolvConf(dns agent.DNS) bool {
+	return len(dns.Servers) > 0 || len(dns.Search) > 0
+}
+
+// writeDNSFiles writes the resolv.conf and hosts file of the container to
+// rundir, if it needs them.
+func writeDNSFiles(rundir, rootfs string, dns agent.DNS) error {
+	if ownResolvConf(dns) {
+		host, err := ioutil.ReadFile(hostResolvConf)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(rundir, "resolv.conf"), resolvConf(host, dns), 0644); err != nil {
+			return err
+		}
+	}
+
+	if len(dns.Hosts) > 0 {
+		p, err := resolveInRootfs(rootfs, "/etc/hosts")
+		if err != nil {
+			return err
+		}
+
+		artifact, err := ioutil.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(rundir, "hosts"), hostsFile(artifact, dns.Hosts), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolvConf returns the host's resolv.conf with its nameserver lines
+// replaced by the servers, and its search and domain lines by the search
+// domains, if given. Other options are kept.
+func resolvConf(host []byte, dns agent.DNS) []byte {
+	var (
+		buf     bytes.Buffer
+		scanner = bufio.NewScanner(bytes.NewReader(host))
+	)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if fields := strings.Fields(line); len(fields) > 0 {
+			switch fields[0] {
+			case "nameserver":
+				if len(dns.Servers) > 0 {
+					continue
+				}
+
+			case "search", "domain":
+				if len(dns.Search) > 0 {
+					continue
+				}
+			}
+		}
+
+		fmt.Fprintln(&buf, line)
+	}
+
+	for _, server := range dns.Servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", server)
+	}
+
+	if len(dns.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(dns.Search, " "))
+	}
+
+	return buf.Bytes()
+}
+
+// hostsFile returns the artifact's hosts file, or a minimal one, with the
+// hosts added, sorted by name.
+func hostsFile(artifact []byte, hosts map[string]string) []byte {
+	var buf bytes.Buffer
+
+	if len(artifact) > 0 {
+		buf.Write(artifact)
+
+		if !bytes.HasSuffix(artifact, []byte("\n")) {
+			buf.WriteString("\n")
+		}
+	} else {
+		buf.WriteString("127.0.0.1\tlocalhost\n::1\tlocalhost\n")
+	}
+
+	names := make([]string, 0, len(hosts))
+	for name := range hosts {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	buf.WriteString("# added by harpoon-agent\n")
+
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", hosts[name], name)
+	}
+
+	return buf.Bytes()
+}
+
+// dnsList is a repeatable flag, keeping the order of its values.
+type dnsList []string
+
+func (*dnsList) String() string { return "" }
+
+func (l *dnsList) Set(value string) error {
+	*l = append(*l, value)
+
+	return nil
+}
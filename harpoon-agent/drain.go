@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+// drainer tracks in-flight requests, so the agent can be shut down without
+// dropping operations midway. Once draining, new requests are refused.
+// Event and log streams never finish by themselves, so they aren't waited
+// for.
+type drainer struct {
+	sync.Mutex
+	draining bool
+	inflight int
+	idle     chan struct{} // closed once draining, with no requests in flight
+}
+
+func (d *drainer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracked := !isStreamAccept(r.Header.Get("Accept"))
+
+		if !d.enter(tracked) {
+			w.Header().Set("Connection", "close")
+			writeError(w, http.StatusServiceUnavailable, errors.Unavailable, "agent is shutting down")
+			return
+		}
+
+		if tracked {
+			defer d.leave()
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enter refuses the request if draining. Otherwise, it counts the request in
+// flight, if it's to be tracked.
+func (d *drainer) enter(tracked bool) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.draining {
+		return false
+	}
+
+	if tracked {
+		d.inflight++
+	}
+
+	return true
+}
+
+func (d *drainer) leave() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.inflight--
+
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// drain refuses new requests and waits for in-flight requests to complete,
+// up to the timeout. It returns false if the timeout expired first.
+func (d *drainer) drain(timeout time.Duration) bool {
+	d.Lock()
+
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+
+	idle := d.idle
+
+	d.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
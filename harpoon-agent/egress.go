@@ -0,0 +1,235 @@
+package main
+
+// Containers may declare an egress policy, allowing outbound traffic to
+// some networks only. Containers share the network of the host, so the
+// agent can't filter in a network namespace of their own. Instead, each such
+// container joins a net_cls cgroup with a class ID of its own, and the agent
+// adds a chain to the host's OUTPUT chain, with iptables and ip6tables,
+// which filters the packets of that class: replies to inbound connections
+// and traffic the policy allows are accepted, everything else is rejected.
+// This needs the cgroup match of iptables, and so Linux 3.14 or later.
+//
+// harpoon-container joins the cgroup in Init, before setting up the
+// container, so the container's processes inherit it. The supervisor itself
+// isn't restricted, so heartbeats and logs reach the agent.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	// netClsRoot holds the net_cls cgroups of containers with an egress
+	// policy.
+	netClsRoot = "/sys/fs/cgroup/net_cls/harpoon"
+
+	// netClsContextKey is the key of the net_cls cgroup in the context of
+	// the libcontainer config. harpoon-container reads it.
+	netClsContextKey = "net_cls"
+
+	// egressClassMajor is the major number of the class IDs of containers;
+	// the minor number tells them apart.
+	egressClassMajor = 0x0010
+)
+
+// egressMu serializes the allocation of class IDs.
+var egressMu sync.Mutex
+
+func netClsCgroup(id string) string {
+	return filepath.Join(netClsRoot, id)
+}
+
+func egressChain(classID uint32) string {
+	return fmt.Sprintf("harpoon-%08x", classID)
+}
+
+// setupEgress puts the container's egress policy in place. It's idempotent,
+// replacing the rules of a previous setup.
+func setupEgress(id string, egress *agent.Egress) error {
+	egressMu.Lock()
+	defer egressMu.Unlock()
+
+	classID, err := egressClassID(id)
+	if err != nil {
+		return err
+	}
+
+	cgroup := netClsCgroup(id)
+
+	if err := os.MkdirAll(cgroup, 0755); err != nil {
+		return fmt.Errorf("mkdir all %s: %s", cgroup, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(cgroup, "net_cls.classid"), []byte(strconv.FormatUint(uint64(classID), 10)), 0644); err != nil {
+		return err
+	}
+
+	chain := egressChain(classID)
+
+	for _, family := range []struct {
+		iptables string
+		ipv4     bool
+	}{
+		{"iptables", true},
+		{"ip6tables", false},
+	} {
+		// The chain may exist from a previous setup.
+		if err := iptables(family.iptables, "-N", chain); err != nil {
+			if err := iptables(family.iptables, "-F", chain); err != nil {
+				return err
+			}
+		}
+
+		rules := [][]string{
+			{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		}
+
+		for _, rule := range egress.Allow {
+			ip, _, err := net.ParseCIDR(rule.CIDR)
+			if err != nil {
+				return fmt.Errorf("egress rule %s: %s", rule.CIDR, err)
+			}
+
+			if (ip.To4() != nil) != family.ipv4 {
+				continue
+			}
+
+			args := []string{"-d", rule.CIDR}
+
+			if rule.Protocol != "" {
+				args = append(args, "-p", rule.Protocol)
+			}
+
+			if rule.Port != 0 {
+				args = append(args, "--dport", strconv.Itoa(int(rule.Port)))
+			}
+
+			rules = append(rules, append(args, "-j", "ACCEPT"))
+		}
+
+		rules = append(rules, []string{"-j", "REJECT"})
+
+		for _, rule := range rules {
+			if err := iptables(family.iptables, append([]string{"-A", chain}, rule...)...); err != nil {
+				return err
+			}
+		}
+
+		jump := []string{"OUTPUT", "-m", "cgroup", "--cgroup", strconv.FormatUint(uint64(classID), 10), "-j", chain}
+
+		if err := iptables(family.iptables, append([]string{"-C"}, jump...)...); err != nil {
+			if err := iptables(family.iptables, append([]string{"-I"}, jump...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// teardownEgress removes the container's egress policy, if any.
+func teardownEgress(id string) {
+	egressMu.Lock()
+	defer egressMu.Unlock()
+
+	cgroup := netClsCgroup(id)
+
+	classID, err := readClassID(cgroup)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[%s] egress: %s", id, err)
+		}
+		return
+	}
+
+	chain := egressChain(classID)
+
+	for _, binary := range []string{"iptables", "ip6tables"} {
+		iptables(binary, "-D", "OUTPUT", "-m", "cgroup", "--cgroup", strconv.FormatUint(uint64(classID), 10), "-j", chain)
+
+		if err := iptables(binary, "-F", chain); err != nil {
+			log.Printf("[%s] egress: %s", id, err)
+			continue
+		}
+
+		if err := iptables(binary, "-X", chain); err != nil {
+			log.Printf("[%s] egress: %s", id, err)
+		}
+	}
+
+	if err := os.Remove(cgroup); err != nil {
+		log.Printf("[%s] egress: %s", id, err)
+	}
+}
+
+// egressClassID returns the class ID of the container: the one it has
+// already, or an unused one derived from its ID.
+func egressClassID(id string) (uint32, error) {
+	if classID, err := readClassID(netClsCgroup(id)); err == nil && classID != 0 {
+		return classID, nil
+	}
+
+	cgroups, err := filepath.Glob(filepath.Join(netClsRoot, "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	used := map[uint32]bool{}
+
+	for _, cgroup := range cgroups {
+		if classID, err := readClassID(cgroup); err == nil {
+			used[classID] = true
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	minor := h.Sum32()
+
+	for i := 0; i < 0xffff; i++ {
+		classID := egressClassMajor<<16 | (minor+uint32(i))&0xffff
+
+		if classID&0xffff != 0 && !used[classID] {
+			return classID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no egress class IDs left")
+}
+
+func readClassID(cgroup string) (uint32, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(cgroup, "net_cls.classid"))
+	if err != nil {
+		return 0, err
+	}
+
+	classID, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(classID), nil
+}
+
+func iptables(binary string, args ...string) error {
+	cmd := exec.Command(binary, args...)
+	dropInChild(cmd)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s (%s)", binary, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
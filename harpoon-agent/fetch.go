@@ -0,0 +1,330 @@
+package main
+
+// Artifacts are fetched by the scheme of their URL. http and https artifacts
+// are fetched directly. s3 artifacts, s3://bucket/key, are fetched from the
+// S3 REST API, signed with the credentials configured for s3, if any. file
+// artifacts are read from beneath -artifact.file.root, for installations
+// without an artifact server; without it, file URLs are refused, as they'd
+// expose any archive on the host. Any other scheme, such as hdfs, is fetched
+// by the command configured for it with -artifact.fetcher scheme=command,
+// which is run as a helper with the URL as its argument, and writes the
+// artifact to stdout.
+//
+// Credentials are configured per scheme, in the JSON file given by
+// -artifact.credentials. http and https credentials are given per host, as
+// basic auth or a bearer token, and only sent to that host. Commands get
+// theirs as environment variables. Artifact URLs may carry secrets
+// themselves, e.g. short-lived signed URLs, so they're redacted wherever the
+// agent logs or lists them.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultS3Endpoint is used for s3 artifacts unless the s3 credentials name
+// another endpoint.
+const defaultS3Endpoint = "https://s3.amazonaws.com"
+
+// fetcher fetches artifacts of a scheme.
+type fetcher interface {
+	// fetch returns the artifact at u, and its size, or -1 if unknown. The
+	// caller closes it.
+	fetch(u *url.URL) (io.ReadCloser, int64, error)
+}
+
+// fetchCredentials are the credentials of a scheme.
+type fetchCredentials struct {
+	AccessKeyID     string            `json:"access_key_id,omitempty"`     // s3
+	SecretAccessKey string            `json:"secret_access_key,omitempty"` // s3
+	Endpoint        string            `json:"endpoint,omitempty"`          // s3
+	Env             map[string]string `json:"env,omitempty"`               // for commands
+
+	Hosts map[string]hostCredentials `json:"hosts,omitempty"` // http and https, by host[:port]
+}
+
+// hostCredentials authenticate requests to a host, with the token if any, or
+// else with basic auth.
+type hostCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// fetchers are the fetchers by scheme. They're set up once, before the API is
+// served.
+var fetchers = map[string]fetcher{}
+
+// setupFetchers sets up the fetchers, fetching over HTTP with client, with
+// the credentials in the file at credentialsPath, if any, and the commands
+// for other schemes.
+func setupFetchers(client *artifactClient, credentialsPath, fileRoot string, commands fetcherCommands) error {
+	credentials := map[string]fetchCredentials{}
+
+	if credentialsPath != "" {
+		buf, err := ioutil.ReadFile(credentialsPath)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(buf, &credentials); err != nil {
+			return fmt.Errorf("%s: %s", credentialsPath, err)
+		}
+	}
+
+	fetchers = map[string]fetcher{
+		"http":  httpFetcher{client: client, hosts: credentials["http"].Hosts},
+		"https": httpFetcher{client: client, hosts: credentials["https"].Hosts},
+		"s3":    s3Fetcher{client: client, credentials: credentials["s3"]},
+	}
+
+	if fileRoot != "" {
+		root, err := filepath.Abs(fileRoot)
+		if err != nil {
+			return err
+		}
+
+		if root, err = filepath.EvalSymlinks(root); err != nil {
+			return err
+		}
+
+		fetchers["file"] = fileFetcher{root: root}
+	}
+
+	for scheme, command := range commands {
+		fetchers[scheme] = commandFetcher{command: command, env: credentials[scheme].Env}
+	}
+
+	return nil
+}
+
+// fetch fetches the artifact with the fetcher of its scheme.
+func fetch(artifactURL string) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(artifactURL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, ok := fetchers[u.Scheme]
+	if !ok {
+		return nil, 0, fmt.Errorf("no fetcher for %s:// artifacts", u.Scheme)
+	}
+
+	return f.fetch(u)
+}
+
+type httpFetcher struct {
+	client *artifactClient
+	hosts  map[string]hostCredentials
+}
+
+func (f httpFetcher) fetch(u *url.URL) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c, ok := f.hosts[u.Host]; ok {
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		} else {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+	}
+
+	return f.client.get(req)
+}
+
+type s3Fetcher struct {
+	client      *artifactClient
+	credentials fetchCredentials
+}
+
+func (f s3Fetcher) fetch(u *url.URL) (io.ReadCloser, int64, error) {
+	endpoint := f.credentials.Endpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+
+	resource := "/" + u.Host + u.Path
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(endpoint, "/")+resource, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c := f.credentials; c.AccessKeyID != "" {
+		date := time.Now().UTC().Format(http.TimeFormat)
+		req.Header.Set("Date", date)
+		req.Header.Set("Authorization", fmt.Sprintf("AWS %s:%s", c.AccessKeyID, s3Signature(c.SecretAccessKey, "GET\n\n\n"+date+"\n"+resource)))
+	}
+
+	return f.client.get(req)
+}
+
+// s3Signature signs a request to the S3 REST API, as of signature version 2.
+func s3Signature(secret, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// fileFetcher fetches artifacts beneath root, which has no symlinks in it.
+// Symlinks in the path of an artifact are resolved before it's checked to be
+// beneath the root, so they can't lead out of it.
+type fileFetcher struct{ root string }
+
+func (f fileFetcher) fetch(u *url.URL) (io.ReadCloser, int64, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, 0, fmt.Errorf("file artifacts must be local, not on %s", u.Host)
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Clean(u.Path))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !strings.HasPrefix(path, f.root+string(filepath.Separator)) {
+		return nil, 0, fmt.Errorf("file artifacts must be beneath %s", f.root)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, fi.Size(), nil
+}
+
+type commandFetcher struct {
+	command string
+	env     map[string]string
+}
+
+func (f commandFetcher) fetch(u *url.URL) (io.ReadCloser, int64, error) {
+	cmd := exec.Command(f.command, u.String())
+
+	cmd.Env = os.Environ()
+	for k, v := range f.env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := &commandReader{ReadCloser: stdout, cmd: cmd}
+	cmd.Stderr = &r.stderr
+
+	if err := startHelper(cmd); err != nil {
+		return nil, 0, err
+	}
+
+	return r, -1, nil
+}
+
+// commandReader reads the stdout of a fetcher command. Once it's read, the
+// command's failure, if any, is returned instead of io.EOF.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	done   bool
+}
+
+func (r *commandReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if err != io.EOF {
+		return n, err
+	}
+
+	if err := r.wait(); err != nil {
+		return n, err
+	}
+
+	return n, io.EOF
+}
+
+func (r *commandReader) Close() error {
+	r.ReadCloser.Close()
+
+	return r.wait()
+}
+
+func (r *commandReader) wait() error {
+	if r.done {
+		return nil
+	}
+
+	r.done = true
+
+	if err := r.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %s (%s)", r.cmd.Path, strings.TrimSpace(r.stderr.String()), err)
+	}
+
+	return nil
+}
+
+// redactURL returns the URL with its user info and the values of its query
+// replaced, as they may hold secrets, such as the signature of a signed URL.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "(invalid URL)"
+	}
+
+	if u.User != nil {
+		u.User = url.User(redacted)
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for k := range query {
+			query[k] = []string{redacted}
+		}
+
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+const redacted = "REDACTED"
+
+// fetcherCommands are the commands fetching artifacts of other schemes, by
+// scheme.
+type fetcherCommands map[string]string
+
+func (*fetcherCommands) String() string { return "" }
+
+func (c *fetcherCommands) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("fetcher must be scheme=command")
+	}
+
+	(*c)[parts[0]] = parts[1]
+
+	return nil
+}
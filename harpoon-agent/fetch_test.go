@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileFetcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-agent-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		root   = filepath.Join(dir, "root")
+		inside = filepath.Join(root, "app.tar.gz")
+		secret = filepath.Join(dir, "secret")
+	)
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{inside, secret} {
+		if err := ioutil.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "evil.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("app.tar.gz", filepath.Join(root, "link.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	f := fileFetcher{root: root}
+
+	for _, testCase := range []struct {
+		path    string
+		invalid bool
+	}{
+		{inside, false},
+		{filepath.Join(root, "link.tar.gz"), false},
+		{filepath.Join(root, "evil.tar.gz"), true},
+		{filepath.Join(root, "..", "secret"), true},
+		{secret, true},
+	} {
+		rc, _, err := f.fetch(&url.URL{Scheme: "file", Path: testCase.path})
+		if invalid := err != nil; testCase.invalid != invalid {
+			t.Errorf("%s: expected invalid %v, got %v", testCase.path, testCase.invalid, err)
+		}
+		if rc != nil {
+			rc.Close()
+		}
+	}
+}
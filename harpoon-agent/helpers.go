@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os/exec"
+
+	"github.com/docker/libcontainer/cgroups"
+	"github.com/docker/libcontainer/cgroups/fs"
+)
+
+// The agent runs helper processes next to the containers: an svlogd for each
+// container, and tar to extract artifacts. Helpers run in a cgroup of their
+// own, limited to -helpers.mem and -helpers.cpu, and those are subtracted from
+// the resources the agent advertises, so a heavy extraction can't take what
+// containers were promised.
+
+// cfsPeriod is the CFS scheduling period of the helpers cgroup, in
+// microseconds. Its CPU quota is a multiple of it.
+const cfsPeriod = 100000
+
+// helpersCgroup is nil if helpers aren't limited.
+var helpersCgroup *cgroups.Cgroup
+
+// setupHelpers configures the cgroup for helpers from the flags. Limits of
+// zero leave the resource unlimited.
+func setupHelpers() {
+	if *helpersMem <= 0 && *helpersCPU <= 0 {
+		return
+	}
+
+	helpersCgroup = &cgroups.Cgroup{
+		Name:            "agent-helpers",
+		Parent:          cgroupParent,
+		AllowAllDevices: true,
+	}
+
+	if *helpersMem > 0 {
+		helpersCgroup.Memory = *helpersMem * 1024 * 1024
+	}
+
+	if *helpersCPU > 0 {
+		helpersCgroup.CpuQuota = int64(*helpersCPU * cfsPeriod)
+		helpersCgroup.CpuPeriod = cfsPeriod
+	}
+}
+
+// startHelper starts the command, and moves it to the helpers cgroup. Helpers
+// must not fork before they're moved, or their children escape the cgroup.
+// Failing to move them isn't fatal; they run unlimited then.
+func startHelper(cmd *exec.Cmd) error {
+	dropInChild(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if helpersCgroup == nil {
+		return nil
+	}
+
+	if _, err := fs.Apply(helpersCgroup, cmd.Process.Pid); err != nil {
+		log.Printf("unable to limit %s (pid %d): %s", cmd.Path, cmd.Process.Pid, err)
+	}
+
+	return nil
+}
+
+// containerMemory returns the memory in MB containers may reserve: what the
+// agent manages, less what helpers may use.
+func containerMemory() float64 {
+	return math.Max(0, float64(agentTotalMem-*helpersMem))
+}
+
+// containerCPUs returns the CPUs containers may reserve: what the agent
+// manages, less what helpers may use.
+func containerCPUs() float64 {
+	return math.Max(0, float64(agentTotalCPU)-*helpersCPU)
+}
@@ -0,0 +1,73 @@
+package main
+
+// Each container keeps a history of its last events: changes of its status,
+// with the time and reason, and restarts of its process by the supervisor,
+// which don't change its status. The history is served on GET
+// /containers/:id/events, so debugging a flapping container doesn't depend on
+// having been subscribed to the event stream at the right time. Histories
+// are kept in memory, up to -container.events per container, and are lost
+// when the container is destroyed or the agent restarts.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// history is a ring of the last events of a container. It's owned by the
+// container loop.
+type history struct {
+	events []agent.ContainerHistoryEvent
+	next   int // index of the oldest event, once the ring is full
+	size   int
+}
+
+func newHistory(size int) *history {
+	if size < 1 {
+		size = 1
+	}
+
+	return &history{size: size}
+}
+
+func (h *history) add(from, to agent.ContainerStatus, reason string) {
+	event := agent.ContainerHistoryEvent{
+		Time:   time.Now(),
+		From:   from,
+		To:     to,
+		Reason: reason,
+	}
+
+	if len(h.events) < h.size {
+		h.events = append(h.events, event)
+		return
+	}
+
+	h.events[h.next] = event
+	h.next = (h.next + 1) % h.size
+}
+
+// list returns the events, oldest first.
+func (h *history) list() []agent.ContainerHistoryEvent {
+	events := make([]agent.ContainerHistoryEvent, 0, len(h.events))
+	events = append(events, h.events[h.next:]...)
+	events = append(events, h.events[:h.next]...)
+
+	return events
+}
+
+// exitReason describes how the container's process exited, as reported by
+// its supervisor.
+func exitReason(s agent.ContainerProcessStatus) string {
+	switch {
+	case s.OOMed:
+		return "out of memory"
+	case s.Signaled:
+		return fmt.Sprintf("killed by signal %d", s.Signal)
+	case s.Exited:
+		return fmt.Sprintf("exited with status %d", s.ExitStatus)
+	}
+
+	return "exited"
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// hostConfig holds the parts of the agent configuration which may change at
+// runtime: the volumes containers may mount, the devices they may access, and
+// labels describing the host.
+// Values given as flags are always present; values from the host config file
+// are added on top, and are reloaded on SIGHUP.
+type hostConfig struct {
+	path string
+
+	volumes map[string]struct{}
+	devices map[string]struct{}
+	labels  map[string]string
+
+	sync.RWMutex
+}
+
+// hostConfigFile is the format of the host config file.
+type hostConfigFile struct {
+	Volumes []string          `json:"volumes"`
+	Devices []string          `json:"devices"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func newHostConfig(path string) (*hostConfig, error) {
+	h := &hostConfig{path: path}
+
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// reload rereads the host config file. On error, the previous configuration
+// stays in effect.
+func (h *hostConfig) reload() error {
+	var (
+		volumes = map[string]struct{}{}
+		devices = map[string]struct{}{}
+		labels  = map[string]string{}
+		file    hostConfigFile
+	)
+
+	if h.path != "" {
+		buf, err := ioutil.ReadFile(h.path)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(buf, &file); err != nil {
+			return fmt.Errorf("%s: %s", h.path, err)
+		}
+	}
+
+	for _, volume := range file.Volumes {
+		volumes[volume] = struct{}{}
+	}
+
+	for volume := range configuredVolumes {
+		volumes[volume] = struct{}{}
+	}
+
+	for _, device := range file.Devices {
+		devices[device] = struct{}{}
+	}
+
+	for device := range configuredDevices {
+		devices[device] = struct{}{}
+	}
+
+	for k, v := range file.Labels {
+		labels[k] = v
+	}
+
+	for k, v := range configuredLabels {
+		labels[k] = v
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.volumes, h.devices, h.labels = volumes, devices, labels
+
+	log.Printf("host config: volumes %v, devices %v, labels %v", sorted(volumes), sorted(devices), labels)
+
+	return nil
+}
+
+// hasVolume returns true if the host path may be mounted into containers.
+func (h *hostConfig) hasVolume(path string) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	_, ok := h.volumes[path]
+	return ok
+}
+
+// Volumes returns the sorted list of volumes.
+func (h *hostConfig) Volumes() []string {
+	h.RLock()
+	defer h.RUnlock()
+
+	return sorted(h.volumes)
+}
+
+// hasDevice returns true if containers may ask for access to the host
+// device.
+func (h *hostConfig) hasDevice(path string) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	_, ok := h.devices[path]
+	return ok
+}
+
+func sorted(set map[string]struct{}) []string {
+	values := make([]string, 0, len(set))
+
+	for value := range set {
+		values = append(values, value)
+	}
+
+	sort.Strings(values)
+
+	return values
+}
+
+// Labels returns a copy of the host labels.
+func (h *hostConfig) Labels() map[string]string {
+	h.RLock()
+	defer h.RUnlock()
+
+	labels := make(map[string]string, len(h.labels))
+
+	for k, v := range h.labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+type labels map[string]string
+
+func (*labels) String() string { return "" }
+
+func (l *labels) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("label must be key=value")
+	}
+
+	(*l)[parts[0]] = parts[1]
+
+	return nil
+}
@@ -1,10 +1,20 @@
 package agent
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/soundcloud/harpoon/lib/errors"
 )
 
 // Agent describes the agent API (v0) spec in the Go domain.
@@ -13,17 +23,48 @@ import (
 // as a stream. Clients are expected to stop the stream after enough log lines
 // have been received.
 type Agent interface {
-	Put(containerID string, containerConfig ContainerConfig) error       // PUT /containers/{id}
-	Get(containerID string) (ContainerInstance, error)                   // GET /containers/{id}
-	Start(containerID string) error                                      // POST /containers/{id}/start
-	Stop(containerID string) error                                       // POST /containers/{id}/stop
-	Restart(containerID string) error                                    // POST /containers/{id}/restart
-	Replace(newContainerID, oldContainerID string) error                 // PUT /containers/{newID}?replace={oldID}
-	Delete(containerID string) error                                     // DELETE /containers/{id}
-	Containers() ([]ContainerInstance, error)                            // GET /containers
-	Events() (<-chan ContainerEvent, Stopper, error)                     // GET /containers with request header Accept: text/event-stream
-	Log(containerID string, history int) (<-chan string, Stopper, error) // GET /containers/{id}/log?history=10
-	Resources() (HostResources, error)                                   // GET /resources
+	Put(containerID string, containerConfig ContainerConfig) error                      // PUT /containers/{id}
+	Get(containerID string) (ContainerInstance, error)                                  // GET /containers/{id}
+	Start(containerID string) error                                                     // POST /containers/{id}/start
+	Stop(containerID string) error                                                      // POST /containers/{id}/stop
+	Restart(containerID string) error                                                   // POST /containers/{id}/restart
+	Replace(newContainerID, oldContainerID string) error                                // PUT /containers/{newID}?replace={oldID}
+	Delete(containerID string) error                                                    // DELETE /containers/{id}
+	Containers() ([]ContainerInstance, error)                                           // GET /containers
+	FilterContainers(ContainerFilter) ([]ContainerInstance, error)                      // GET /containers?job=...&task=...&status=...&offset=0&limit=10
+	Events() (<-chan ContainerEvent, Stopper, error)                                    // GET /containers with request header Accept: text/event-stream
+	Log(containerID string, history int) (<-chan string, Stopper, error)                // GET /containers/{id}/log?history=10
+	History(containerID string) ([]ContainerHistoryEvent, error)                        // GET /containers/{id}/events
+	Metrics(containerID string, window time.Duration) ([]ContainerMetricsSample, error) // GET /containers/{id}/metrics?window=10m
+	Resources() (HostResources, error)                                                  // GET /resources
+	Host() (HostInfo, error)                                                            // GET /host
+	Version() (VersionInfo, error)                                                      // GET /version
+	Artifacts() ([]Artifact, error)                                                     // GET /artifacts
+}
+
+// APIVersion is the version of the agent API spoken by this package.
+const APIVersion = "v0"
+
+// VersionInfo describes a build of a harpoon component, and the versions of
+// the agent API it speaks.
+type VersionInfo struct {
+	Version     string   `json:"version"`
+	GitSHA      string   `json:"git_sha"`
+	APIVersions []string `json:"api_versions"`
+
+	// ConfigSchemaVersion is the newest ContainerConfig schema the component
+	// understands. Zero means it predates schema versioning, i.e. version 1.
+	ConfigSchemaVersion int `json:"config_schema_version,omitempty"`
+}
+
+// Supports returns true if the component speaks the given API version.
+func (v VersionInfo) Supports(apiVersion string) bool {
+	for _, candidate := range v.APIVersions {
+		if candidate == apiVersion {
+			return true
+		}
+	}
+	return false
 }
 
 // ContainerConfig describes the information necessary to start a container on
@@ -38,37 +79,370 @@ type ContainerConfig struct {
 	Resources   `json:"resources"`
 	Storage     `json:"storage"`
 	Grace       `json:"grace"`
+
+	// Priority of the job the container belongs to. Schedulers may preempt
+	// containers to make room for those with a higher priority.
+	Priority int `json:"priority,omitempty"`
+
+	// EnvFile holds variables which are only written to the container's env
+	// file, along with Env, and not set in the process environment. Useful
+	// for large values, and for apps which expect to read a .env file. The
+	// path of the env file is passed in HARPOON_ENV_FILE.
+	EnvFile map[string]string `json:"env_file,omitempty"`
+
+	// SchemaVersion is the version of the schema the config was written
+	// for. See ConfigSchemaVersion.
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	// Labels are free-form metadata, e.g. the owning team, environment, or
+	// cost center. They don't affect how the container is run.
+	Labels Labels `json:"labels,omitempty"`
+
+	// Restart is the restart policy of the container. Empty means
+	// RestartOnFailure.
+	Restart RestartPolicy `json:"restart,omitempty"`
+
+	// PortRanges are ports the container listens on beyond the single TCP
+	// ports in Ports: UDP ports, and ranges of contiguous ports, e.g. for
+	// RTP. Names are shared with Ports.
+	PortRanges map[string]PortRange `json:"port_ranges,omitempty"`
+
+	// Security restricts or extends what the container may do, within what
+	// the agent permits.
+	Security *Security `json:"security,omitempty"`
+
+	// Egress restricts the outbound connections of the container. Without
+	// it, the container may connect anywhere.
+	Egress *Egress `json:"egress,omitempty"`
+
+	// DNS configures name resolution in the container, beyond the agent's
+	// defaults. Without it, and without defaults, the container gets the
+	// host's resolv.conf.
+	DNS *DNS `json:"dns,omitempty"`
+
+	// Hooks are commands run in the container before each start of its
+	// command, and after each exit.
+	Hooks *Hooks `json:"hooks,omitempty"`
 }
 
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (c ContainerConfig) Valid() error {
-	var errs []string
+	var errs ValidationErrors
 	if c.JobName == "" {
-		errs = append(errs, "job name empty")
+		errs.Add("job_name", "empty")
 	}
 	if c.TaskName == "" {
-		errs = append(errs, "task name empty")
+		errs.Add("task_name", "empty")
 	}
 	if _, err := url.Parse(c.ArtifactURL); err != nil {
-		errs = append(errs, fmt.Sprintf("artifact URL %q invalid: %s", c.ArtifactURL, err))
+		errs.Add("artifact_url", "%q invalid: %s", c.ArtifactURL, err)
 	}
-	if err := c.Command.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("command invalid: %s", err))
+	for name := range c.EnvFile {
+		if name == "" || strings.ContainsAny(name, "=\n") {
+			errs.Add("env_file", "invalid variable name %q", name)
+		}
 	}
-	if err := c.Resources.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("resources invalid: %s", err))
+	errs.Nest("command", c.Command.Valid())
+	errs.Nest("resources", c.Resources.Valid())
+	errs.Nest("storage", c.Storage.Valid())
+	errs.Nest("grace", c.Grace.Valid())
+	errs.Nest("labels", c.Labels.Valid())
+	errs.Nest("restart", c.Restart.Valid())
+	for name, portRange := range c.PortRanges {
+		if _, ok := c.Ports[name]; ok {
+			errs.Add("port_ranges."+name, "name also used in ports")
+		}
+		errs.Nest("port_ranges."+name, portRange.Valid())
 	}
-	if err := c.Storage.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("storage invalid: %s", err))
+	if c.Security != nil {
+		errs.Nest("security", c.Security.Valid())
 	}
-	if err := c.Grace.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("grace periods invalid: %s", err))
+	if c.Egress != nil {
+		errs.Nest("egress", c.Egress.Valid())
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	if c.DNS != nil {
+		errs.Nest("dns", c.DNS.Valid())
 	}
-	return nil
+	if c.Hooks != nil {
+		errs.Nest("hooks", c.Hooks.Valid())
+	}
+	return errs.Err()
+}
+
+// Egress is the outbound network policy of a container: it may only open
+// connections, or send datagrams, which one of the rules allows. Replies to
+// inbound connections are always allowed.
+type Egress struct {
+	Allow []EgressRule `json:"allow"`
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (e Egress) Valid() error {
+	var errs ValidationErrors
+	for i, rule := range e.Allow {
+		errs.Nest(fmt.Sprintf("allow[%d]", i), rule.Valid())
+	}
+	return errs.Err()
+}
+
+// EgressRule allows traffic to a network, given in CIDR notation, e.g.
+// "10.1.0.0/16". It's limited to a protocol, and a port of that protocol, if
+// given.
+type EgressRule struct {
+	CIDR     string `json:"cidr"`
+	Protocol string `json:"protocol,omitempty"` // PortProtocolTCP or PortProtocolUDP; empty means any
+	Port     uint16 `json:"port,omitempty"`     // zero means any
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (r EgressRule) Valid() error {
+	var errs ValidationErrors
+	if _, _, err := net.ParseCIDR(r.CIDR); err != nil {
+		errs.Add("cidr", "%q is not in CIDR notation", r.CIDR)
+	}
+	switch r.Protocol {
+	case "", PortProtocolTCP, PortProtocolUDP:
+	default:
+		errs.Add("protocol", "%q must be %s or %s", r.Protocol, PortProtocolTCP, PortProtocolUDP)
+	}
+	if r.Port != 0 && r.Protocol == "" {
+		errs.Add("port", "requires a protocol")
+	}
+	return errs.Err()
+}
+
+// DNS configures the resolv.conf and /etc/hosts of a container. Servers and
+// search domains replace those of the host, if given. Hosts are added to the
+// /etc/hosts of the container's artifact.
+type DNS struct {
+	Servers []string          `json:"servers,omitempty"` // IP addresses
+	Search  []string          `json:"search,omitempty"`  // domains
+	Hosts   map[string]string `json:"hosts,omitempty"`   // name: IP address
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (d DNS) Valid() error {
+	var errs ValidationErrors
+	for i, server := range d.Servers {
+		if net.ParseIP(server) == nil {
+			errs.Add(fmt.Sprintf("servers[%d]", i), "%q is not an IP address", server)
+		}
+	}
+	for i, domain := range d.Search {
+		if domain == "" || strings.ContainsAny(domain, " \t\n") {
+			errs.Add(fmt.Sprintf("search[%d]", i), "invalid domain %q", domain)
+		}
+	}
+	for name, ip := range d.Hosts {
+		if name == "" || strings.ContainsAny(name, " \t\n#") {
+			errs.Add("hosts", "invalid name %q", name)
+		}
+		if net.ParseIP(ip) == nil {
+			errs.Add("hosts."+name, "%q is not an IP address", ip)
+		}
+	}
+	return errs.Err()
+}
+
+// Seccomp profiles, filtering the syscalls of a container.
+const (
+	// SeccompUnconfined filters nothing. It's the profile of containers
+	// which don't ask for one.
+	SeccompUnconfined = "unconfined"
+
+	// SeccompDefault denies syscalls which administer the host, like
+	// loading kernel modules, rebooting, or setting the clock.
+	SeccompDefault = "default"
+
+	// SeccompStrict denies what SeccompDefault does, and tracing or
+	// profiling other processes.
+	SeccompStrict = "strict"
+)
+
+// Security is the security profile of a container: the seccomp profile
+// filtering its syscalls, and host devices it may access, in addition to the
+// default ones. Agents only permit the profiles and devices they're
+// configured to.
+type Security struct {
+	Seccomp string   `json:"seccomp,omitempty"` // empty means SeccompUnconfined
+	Devices []string `json:"devices,omitempty"` // host device paths, e.g. "/dev/fuse"
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (s Security) Valid() error {
+	var errs ValidationErrors
+	switch s.Seccomp {
+	case "", SeccompUnconfined, SeccompDefault, SeccompStrict:
+	default:
+		errs.Add("seccomp", "unknown profile %q", s.Seccomp)
+	}
+	for _, device := range s.Devices {
+		if !strings.HasPrefix(device, "/dev/") || strings.Contains(device, "..") {
+			errs.Add("devices", "%q must be a path below /dev", device)
+		}
+	}
+	return errs.Err()
+}
+
+// SeccompProfile returns the seccomp profile, defaulting to
+// SeccompUnconfined.
+func (s *Security) SeccompProfile() string {
+	if s == nil || s.Seccomp == "" {
+		return SeccompUnconfined
+	}
+	return s.Seccomp
+}
+
+// Protocols of a PortRange.
+const (
+	PortProtocolTCP = "tcp"
+	PortProtocolUDP = "udp"
+)
+
+// PortEnv returns the environment variable in which the agent passes the
+// port with the name, or the first port of the range, to the container.
+func PortEnv(name string) string {
+	return "PORT_" + strings.ToUpper(name)
+}
+
+// PortRange is a range of contiguous ports a container listens on. A Start
+// of zero has the agent allocate the range. The agent passes the first and
+// last port of the range to the container as PORT_<NAME>_START and
+// PORT_<NAME>_END, and the first as PORT_<NAME>, like those in Ports.
+type PortRange struct {
+	Protocol string `json:"protocol,omitempty"` // PortProtocolTCP (default) or PortProtocolUDP
+	Start    uint16 `json:"start"`
+	Count    int    `json:"count,omitempty"` // zero means one port
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (r PortRange) Valid() error {
+	var errs ValidationErrors
+	switch r.Protocol {
+	case "", PortProtocolTCP, PortProtocolUDP:
+	default:
+		errs.Add("protocol", "%q must be %s or %s", r.Protocol, PortProtocolTCP, PortProtocolUDP)
+	}
+	if r.Count < 0 {
+		errs.Add("count", "%d must not be negative", r.Count)
+	}
+	if int(r.Start)+r.Size()-1 > 65535 {
+		errs.Add("count", "range from %d exceeds port 65535", r.Start)
+	}
+	return errs.Err()
+}
+
+// Proto returns the protocol of the range, defaulting to PortProtocolTCP.
+func (r PortRange) Proto() string {
+	if r.Protocol == "" {
+		return PortProtocolTCP
+	}
+	return r.Protocol
+}
+
+// Size returns the number of ports in the range.
+func (r PortRange) Size() int {
+	if r.Count <= 0 {
+		return 1
+	}
+	return r.Count
+}
+
+// End returns the last port of the range.
+func (r PortRange) End() uint16 {
+	return r.Start + uint16(r.Size()-1)
+}
+
+// RestartPolicy says whether a container is restarted after it exits. The
+// supervisor restarts the container in place; schedulers restart containers
+// whose supervisor gave up.
+type RestartPolicy string
+
+const (
+	// RestartAlways restarts the container however it exits. Long-running
+	// services, which are never supposed to exit, should use it.
+	RestartAlways RestartPolicy = "always"
+
+	// RestartOnFailure restarts the container if it exits with a nonzero
+	// return code, or is killed.
+	RestartOnFailure RestartPolicy = "on-failure"
+
+	// RestartNever leaves the container exited, successfully or not. One-off
+	// tasks should use it.
+	RestartNever RestartPolicy = "never"
+)
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (p RestartPolicy) Valid() error {
+	var errs ValidationErrors
+	switch p {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		errs.Add("", "%q invalid; must be %s, %s, or %s", p, RestartAlways, RestartOnFailure, RestartNever)
+	}
+	return errs.Err()
+}
+
+// Restarts returns true if the policy restarts a container which exited
+// successfully or not.
+func (p RestartPolicy) Restarts(success bool) bool {
+	switch p {
+	case RestartAlways:
+		return true
+	case RestartNever:
+		return false
+	default:
+		return !success
+	}
+}
+
+// Labels are key/value metadata attached to jobs, tasks, and containers.
+type Labels map[string]string
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible. Label names may be used in query
+// parameters, as name=value, so they mustn't contain "=".
+func (l Labels) Valid() error {
+	var errs ValidationErrors
+	for name := range l {
+		if name == "" || strings.ContainsAny(name, "=\n") {
+			errs.Add("", "invalid label name %q", name)
+		}
+	}
+	return errs.Err()
+}
+
+// Match returns true if l has all of the given labels, with the same values.
+func (l Labels) Match(labels Labels) bool {
+	for name, value := range labels {
+		if v, ok := l[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns the labels overlaid with the given labels, without modifying
+// either.
+func (l Labels) Merge(overlay Labels) Labels {
+	if len(l) == 0 && len(overlay) == 0 {
+		return nil
+	}
+	merged := Labels{}
+	for name, value := range l {
+		merged[name] = value
+	}
+	for name, value := range overlay {
+		merged[name] = value
+	}
+	return merged
 }
 
 // Command describes how to start a binary.
@@ -80,17 +454,58 @@ type Command struct {
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (c Command) Valid() error {
-	var errs []string
+	var errs ValidationErrors
 	if len(c.Exec) <= 0 {
-		errs = append(errs, "exec (command to run, as array) not specified")
+		errs.Add("exec", "command to run, as array, not specified")
 	}
 	if len(c.WorkingDir) <= 0 {
-		errs = append(errs, "working dir (string) not specified")
+		errs.Add("working_dir", "not specified")
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	return errs.Err()
+}
+
+// Hooks are commands run in the container around its command, in its root
+// filesystem and working directory, as its user, with its environment.
+// PreStart runs before each start of the command, which only starts if the
+// hook succeeds, e.g. to migrate a schema. PostStop runs after each exit of
+// the command, e.g. to deregister the instance; when the container is
+// stopped, it must finish within the shutdown grace period.
+type Hooks struct {
+	PreStart *Hook `json:"pre_start,omitempty"`
+	PostStop *Hook `json:"post_stop,omitempty"`
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (h Hooks) Valid() error {
+	var errs ValidationErrors
+	if h.PreStart != nil {
+		errs.Nest("pre_start", h.PreStart.Valid())
 	}
-	return nil
+	if h.PostStop != nil {
+		errs.Nest("post_stop", h.PostStop.Valid())
+	}
+	return errs.Err()
+}
+
+// Hook is a command, which is killed unless it finishes within Timeout
+// seconds.
+type Hook struct {
+	Exec    []string `json:"exec"`
+	Timeout int      `json:"timeout"`
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (h Hook) Valid() error {
+	var errs ValidationErrors
+	if len(h.Exec) <= 0 {
+		errs.Add("exec", "command to run, as array, not specified")
+	}
+	if h.Timeout <= 0 || h.Timeout > 600 {
+		errs.Add("timeout", "%d must be between 1 and 600", h.Timeout)
+	}
+	return errs.Err()
 }
 
 // Resources describes resource limits for a container.
@@ -102,17 +517,14 @@ type Resources struct {
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (r Resources) Valid() error {
-	var errs []string
+	var errs ValidationErrors
 	if r.Memory <= 0 {
-		errs = append(errs, "mem (integer MB) not specified or zero")
+		errs.Add("mem", "integer MB not specified or zero")
 	}
 	if r.CPUs <= 0.0 {
-		errs = append(errs, "cpus (floating point fractional CPUs) not specified or zero")
+		errs.Add("cpus", "floating point fractional CPUs not specified or zero")
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
-	}
-	return nil
+	return errs.Err()
 }
 
 // Storage describes storage requirements for a container.
@@ -140,17 +552,72 @@ type Grace struct {
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (g Grace) Valid() error {
-	var errs []string
+	var errs ValidationErrors
 	if g.Startup <= 0 || g.Startup > 30 {
-		errs = append(errs, fmt.Sprintf("startup (%d) must be between 1 and 30", g.Startup))
+		errs.Add("startup", "%d must be between 1 and 30", g.Startup)
 	}
 	if g.Shutdown <= 0 || g.Shutdown > 30 {
-		errs = append(errs, fmt.Sprintf("shutdown (%d) must be between 1 and 30", g.Shutdown))
+		errs.Add("shutdown", "%d must be between 1 and 30", g.Shutdown)
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	return errs.Err()
+}
+
+// PortConflict describes a port requested by a container config, which the
+// agent can't give it: because another container has it, or a process
+// outside of harpoon listens on it.
+type PortConflict struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Port     uint16 `json:"port"`
+	Reason   string `json:"reason"`
+}
+
+// PortConflicts collects the unavailable ports of a container config. Agents
+// reject configs with conflicting ports, and fail containers whose ports are
+// taken by the time they start. Clients which need more than the error
+// string may type-assert for it.
+type PortConflicts []PortConflict
+
+// Error satisfies the error interface.
+func (e PortConflicts) Error() string {
+	conflicts := make([]string, len(e))
+	for i, conflict := range e {
+		conflicts[i] = fmt.Sprintf("port %d/%s (%s): %s", conflict.Port, conflict.Protocol, conflict.Name, conflict.Reason)
 	}
-	return nil
+	return strings.Join(conflicts, "; ")
+}
+
+// ErrorCode satisfies the errors.Coder interface.
+func (e PortConflicts) ErrorCode() errors.Code {
+	return errors.PortConflict
+}
+
+// ConfigChange is a top-level field, by its JSON name, whose value differs
+// between the config of an existing container and a config PUT with its ID.
+type ConfigChange struct {
+	Field     string          `json:"field"`
+	Existing  json.RawMessage `json:"existing"`
+	Requested json.RawMessage `json:"requested"`
+}
+
+// ConfigConflict collects the changes of a config PUT with the ID of an
+// existing container. Agents reject such configs; PUTting the same config
+// again is fine. Clients which need more than the error string may
+// type-assert for it.
+type ConfigConflict []ConfigChange
+
+// Error satisfies the error interface.
+func (e ConfigConflict) Error() string {
+	fields := make([]string, len(e))
+	for i, change := range e {
+		fields[i] = change.Field
+	}
+	return fmt.Sprintf("container exists with a different config: %s differ", strings.Join(fields, ", "))
+}
+
+// ErrorCode satisfies the errors.Coder interface.
+func (e ConfigConflict) ErrorCode() errors.Code {
+	return errors.ConfigConflict
 }
 
 // HostResources are returned by agents and reflect their current state.
@@ -159,8 +626,52 @@ type HostResources struct {
 	CPUs    TotalReserved `json:"cpus"`    // whole CPUs
 	Storage TotalReserved `json:"storage"` // Bytes
 	Volumes []string      `json:"volumes"`
+
+	// Containers counts the containers on the agent. Total is the maximum the
+	// agent accepts, or zero if unlimited.
+	Containers TotalReserved `json:"containers"`
+
+	// Labels are arbitrary key-value pairs describing the host, e.g. its rack
+	// or hardware class. See FailureDomainLabel.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Unschedulable is set while the agent is in a maintenance window, which
+	// ends at MaintenanceUntil. Schedulers shouldn't place new containers on
+	// an unschedulable agent.
+	Unschedulable    bool      `json:"unschedulable,omitempty"`
+	MaintenanceUntil time.Time `json:"maintenance_until,omitempty"`
+}
+
+// HostInfo describes the host and agent software, for operators comparing
+// agents across a heterogeneous fleet.
+type HostInfo struct {
+	Hostname      string            `json:"hostname"`
+	KernelVersion string            `json:"kernel_version"`
+	CgroupDriver  string            `json:"cgroup_driver"`
+	Namespaces    []string          `json:"namespaces"` // supported by the kernel, e.g. "pid"
+	AgentVersion  string            `json:"agent_version"`
+	GoVersion     string            `json:"go_version"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Directories   map[string]string `json:"directories"` // purpose: path
 }
 
+// Artifact is an artifact the agent has fetched and extracted, and can start
+// containers from without fetching it again.
+type Artifact struct {
+	URL     string    `json:"url"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// FailureDomainLabel is the host label naming the failure domain of an agent,
+// e.g. its rack or zone. Schedulers spread the instances of a task across
+// failure domains.
+const FailureDomainLabel = "failure_domain"
+
+// ClusterLabel is the host label naming the cluster of an agent, e.g. its
+// region. Schedulers place the containers of jobs targeting a cluster only on
+// its agents.
+const ClusterLabel = "cluster"
+
 // TotalReserved encodes the total scalar amount of an arbitrary resource
 // (total) and the amount of it that's currently in-use (reserved).
 type TotalReserved struct {
@@ -168,6 +679,40 @@ type TotalReserved struct {
 	Reserved float64 `json:"reserved"`
 }
 
+// LogRecord is a line a container wrote. Time is taken when the container's
+// supervisor read the line, and never goes backwards within a container. Seq
+// numbers the lines of a supervisor, from 1, so gaps show lost lines. Lines
+// from supervisors which don't tag them have neither stream nor seq, and the
+// time they were received by the agent.
+type LogRecord struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream,omitempty"` // LogStreamStdout or LogStreamStderr
+	Seq    uint64    `json:"seq,omitempty"`
+	Line   string    `json:"line"`
+
+	// Dropped is the number of lines right before this one which exceeded the
+	// container's log rate limit. They're only in the logs on disk.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// LogDatagram is a log line, as sent by a container's supervisor to the
+// agent: JSON-encoded, in a UDP datagram of its own, of at most
+// MaxLogDatagramSize bytes.
+type LogDatagram struct {
+	ContainerID string `json:"container_id"`
+	LogRecord
+}
+
+// MaxLogDatagramSize is the largest log datagram agents receive. Supervisors
+// shorten lines which wouldn't fit.
+const MaxLogDatagramSize = 65507
+
+// Streams a container writes log lines to.
+const (
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+)
+
 // Stopper describes anything that can be stopped, such as an event stream.
 type Stopper interface {
 	Stop()
@@ -194,6 +739,24 @@ const (
 	// ContainerInstancesEventName helps to satisfy the ContainerEvent
 	// interface. for the ContainerInstances type.
 	ContainerInstancesEventName = "containers"
+
+	// ContainerDeltaEventName helps to satisfy the ContainerEvent interface
+	// for the ContainerDelta type.
+	ContainerDeltaEventName = "container_delta"
+
+	// StreamHeartbeatEventName helps to satisfy the ContainerEvent interface
+	// for the StreamHeartbeat type.
+	StreamHeartbeatEventName = "heartbeat"
+
+	// LogMarkerEventName helps to satisfy the ContainerEvent interface for
+	// the LogMarker type.
+	LogMarkerEventName = "log_marker"
+
+	// DeltaEventsParam is the Accept parameter with which clients ask for
+	// ContainerDelta events instead of full ContainerInstance events, i.e.
+	// "Accept: text/event-stream; events=delta". Agents which don't support
+	// deltas ignore it, so clients must handle both.
+	DeltaEventsParam = "events"
 )
 
 // ContainerInstance describes the state of an individual container running on
@@ -216,6 +779,34 @@ type ContainerInstance struct {
 	ID     string          `json:"container_id"`
 	Status ContainerStatus `json:"status"`
 	Config ContainerConfig `json:"config"`
+
+	// Metrics are the most recent metrics reported by the container's
+	// supervisor, if any.
+	Metrics *ContainerMetrics `json:"metrics,omitempty"`
+
+	// Error explains why the container failed to be created, if it did.
+	Error string `json:"error,omitempty"`
+
+	// LastExit describes the most recent exit of the container's command, if
+	// it exited since the agent started supervising the container.
+	LastExit *ContainerExit `json:"last_exit,omitempty"`
+
+	// Restarts counts the restarts of the container's command by its
+	// supervisor, following the restart policy.
+	Restarts uint64 `json:"restarts,omitempty"`
+
+	// ResourcesError explains why the resource limits of the config aren't
+	// applied to the running container, if they aren't.
+	ResourcesError string `json:"resources_error,omitempty"`
+}
+
+// ContainerExit describes an exit of a container's command: its exit status,
+// or the signal which killed it, and whether it ran out of memory.
+type ContainerExit struct {
+	ExitStatus int       `json:"exit_status"`
+	Signal     int       `json:"signal,omitempty"`
+	OOMed      bool      `json:"oomed,omitempty"`
+	Time       time.Time `json:"time"`
 }
 
 // EventBody satisfies the ContainerEvent interface.
@@ -245,6 +836,266 @@ func (e ContainerInstances) EventBody() ContainerEventBody {
 // EventName satisfies the ContainerEvent interface.
 func (e ContainerInstances) EventName() string { return ContainerInstancesEventName }
 
+// ContainerDelta describes a change to a container instance. It's sent
+// through the event stream in place of the full ContainerInstance, when the
+// client asks for deltas. Config is only set when it changed, or the first
+// time the container appears in the stream. Clients should treat a
+// ContainerInstances event as a full snapshot, replacing what they know.
+type ContainerDelta struct {
+	ID      string            `json:"container_id"`
+	Status  ContainerStatus   `json:"status"`
+	Config  *ContainerConfig  `json:"config,omitempty"`
+	Metrics *ContainerMetrics `json:"metrics,omitempty"`
+	Error   string            `json:"error,omitempty"`
+
+	ResourcesError string         `json:"resources_error,omitempty"`
+	LastExit       *ContainerExit `json:"last_exit,omitempty"`
+	Restarts       uint64         `json:"restarts,omitempty"`
+}
+
+// NewContainerDelta returns the delta which turns previous into current. If
+// previous is the zero value, the delta carries the whole config.
+func NewContainerDelta(previous, current ContainerInstance) ContainerDelta {
+	d := ContainerDelta{
+		ID:      current.ID,
+		Status:  current.Status,
+		Metrics: current.Metrics,
+		Error:   current.Error,
+
+		ResourcesError: current.ResourcesError,
+		LastExit:       current.LastExit,
+		Restarts:       current.Restarts,
+	}
+	if previous.ID == "" || !reflect.DeepEqual(previous.Config, current.Config) {
+		config := current.Config
+		d.Config = &config
+	}
+	return d
+}
+
+// Apply returns the container instance with the delta applied.
+func (d ContainerDelta) Apply(containerInstance ContainerInstance) ContainerInstance {
+	containerInstance.ID = d.ID
+	containerInstance.Status = d.Status
+	containerInstance.Error = d.Error
+	containerInstance.ResourcesError = d.ResourcesError
+	containerInstance.LastExit = d.LastExit
+	containerInstance.Restarts = d.Restarts
+	if d.Config != nil {
+		containerInstance.Config = *d.Config
+	}
+	if d.Metrics != nil {
+		containerInstance.Metrics = d.Metrics
+	}
+	return containerInstance
+}
+
+// ContainerTransition is posted to the agent's webhook, if it has one,
+// when a container changes status.
+type ContainerTransition struct {
+	Agent    string            `json:"agent"` // hostname of the agent
+	ID       string            `json:"container_id"`
+	From     ContainerStatus   `json:"from,omitempty"` // empty for new containers
+	To       ContainerStatus   `json:"to"`
+	Time     time.Time         `json:"time"`
+	Instance ContainerInstance `json:"instance"`
+}
+
+// ContainerHistoryEvent is an entry in the event history of a container: a
+// change of its status, or a restart of its process by the supervisor, in
+// which case From and To are both running.
+type ContainerHistoryEvent struct {
+	Time   time.Time       `json:"time"`
+	From   ContainerStatus `json:"from,omitempty"` // empty for new containers
+	To     ContainerStatus `json:"to"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+const (
+	// WebhookSignatureHeader holds the signature of webhook posts, see
+	// WebhookSignature.
+	WebhookSignatureHeader = "X-Harpoon-Signature"
+
+	// WebhookDeliveryHeader holds the sequence number of webhook posts,
+	// which retries of the same post share.
+	WebhookDeliveryHeader = "X-Harpoon-Delivery"
+)
+
+// WebhookSignature returns the signature of a webhook post's body:
+// "sha256=" and the hex-encoded HMAC-SHA256 of the body, keyed with the
+// webhook's secret. Receivers should compare signatures with hmac.Equal.
+func WebhookSignature(body, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// EventBody satisfies the ContainerEvent interface.
+func (d ContainerDelta) EventBody() ContainerEventBody {
+	return ContainerEventBody{
+		Event: d.EventName(),
+		Self:  d,
+	}
+}
+
+// EventName satisfies the ContainerEvent interface.
+func (d ContainerDelta) EventName() string { return ContainerDeltaEventName }
+
+// StreamHeartbeat is sent through the event stream periodically, so clients
+// can tell a quiet agent from a dead connection. It carries the agent's time.
+type StreamHeartbeat struct {
+	Time time.Time `json:"time"`
+}
+
+// EventBody satisfies the ContainerEvent interface.
+func (h StreamHeartbeat) EventBody() ContainerEventBody {
+	return ContainerEventBody{
+		Event: h.EventName(),
+		Self:  h,
+	}
+}
+
+// EventName satisfies the ContainerEvent interface.
+func (h StreamHeartbeat) EventName() string { return StreamHeartbeatEventName }
+
+// LogMarker is sent through the event stream when a container's log dropped
+// lines exceeding its rate limit. It marks the first line after the gap, by
+// its time and seq; the dropped lines are only in the logs on disk.
+type LogMarker struct {
+	ID      string    `json:"container_id"`
+	Time    time.Time `json:"time"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Dropped uint64    `json:"dropped"`
+}
+
+// EventBody satisfies the ContainerEvent interface.
+func (m LogMarker) EventBody() ContainerEventBody {
+	return ContainerEventBody{
+		Event: m.EventName(),
+		Self:  m,
+	}
+}
+
+// EventName satisfies the ContainerEvent interface.
+func (m LogMarker) EventName() string { return LogMarkerEventName }
+
+// ContainerFilter restricts the container instances returned by GET
+// /containers. Zero values match everything. Offset and Limit paginate the
+// filtered list; a Limit of zero means no limit. Pagination doesn't apply to
+// the event stream.
+type ContainerFilter struct {
+	JobName  string
+	TaskName string
+	Status   ContainerStatus
+	Labels   Labels // from repeated label=name=value parameters
+	Offset   int
+	Limit    int
+}
+
+// ParseContainerFilter reads a ContainerFilter from URL query parameters.
+func ParseContainerFilter(values url.Values) (ContainerFilter, error) {
+	f := ContainerFilter{
+		JobName:  values.Get("job"),
+		TaskName: values.Get("task"),
+		Status:   ContainerStatus(values.Get("status")),
+	}
+	var errs []string
+	for _, label := range values["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			errs = append(errs, fmt.Sprintf("label (%q) must be name=value", label))
+			continue
+		}
+		if f.Labels == nil {
+			f.Labels = Labels{}
+		}
+		f.Labels[parts[0]] = parts[1]
+	}
+	for name, dst := range map[string]*int{"offset": &f.Offset, "limit": &f.Limit} {
+		s := values.Get(name)
+		if s == "" {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			errs = append(errs, fmt.Sprintf("%s (%q) must be a non-negative integer", name, s))
+			continue
+		}
+		*dst = i
+	}
+	if len(errs) > 0 {
+		return ContainerFilter{}, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return f, nil
+}
+
+// Values encodes the filter as URL query parameters, suitable for GET
+// /containers.
+func (f ContainerFilter) Values() url.Values {
+	values := url.Values{}
+	if f.JobName != "" {
+		values.Set("job", f.JobName)
+	}
+	if f.TaskName != "" {
+		values.Set("task", f.TaskName)
+	}
+	if f.Status != "" {
+		values.Set("status", string(f.Status))
+	}
+	names := make([]string, 0, len(f.Labels))
+	for name := range f.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values.Add("label", name+"="+f.Labels[name])
+	}
+	if f.Offset > 0 {
+		values.Set("offset", strconv.Itoa(f.Offset))
+	}
+	if f.Limit > 0 {
+		values.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return values
+}
+
+// Match returns true if the container instance satisfies the job, task,
+// status, and label constraints of the filter.
+func (f ContainerFilter) Match(instance ContainerInstance) bool {
+	if f.JobName != "" && f.JobName != instance.Config.JobName {
+		return false
+	}
+	if f.TaskName != "" && f.TaskName != instance.Config.TaskName {
+		return false
+	}
+	if f.Status != "" && f.Status != instance.Status {
+		return false
+	}
+	if !instance.Config.Labels.Match(f.Labels) {
+		return false
+	}
+	return true
+}
+
+// Apply filters and paginates the container instances. Callers should sort
+// the instances first, if they want stable pages.
+func (f ContainerFilter) Apply(instances ContainerInstances) ContainerInstances {
+	matched := make(ContainerInstances, 0, len(instances))
+	for _, instance := range instances {
+		if f.Match(instance) {
+			matched = append(matched, instance)
+		}
+	}
+	if f.Offset >= len(matched) {
+		return ContainerInstances{}
+	}
+	matched = matched[f.Offset:]
+	if f.Limit > 0 && f.Limit < len(matched) {
+		matched = matched[:f.Limit]
+	}
+	return matched
+}
+
 // ContainerStatus describes the current state of a container in an agent. The
 // enumerated statuses, below, are a really quick first draft, and are
 // probably underspecified.
@@ -280,24 +1131,107 @@ const (
 	ContainerStatusDeleted = "deleted"
 )
 
-// Heartbeat TODO
+// HeartbeatVersion is the version of the heartbeat protocol spoken by this
+// package. Version 0 (the absent version) only understands the UP, DOWN, and
+// EXIT wants, and has no notion of generations. Version 1 doesn't understand
+// the HOLD want.
+const HeartbeatVersion = 2
+
+const (
+	// HeartbeatStatusUp is sent by a container supervisor while it's
+	// running, or trying to run, the container.
+	HeartbeatStatusUp = "UP"
+
+	// HeartbeatStatusExiting is sent by a container supervisor once the
+	// container has terminated and won't be restarted.
+	HeartbeatStatusExiting = "EXITING"
+)
+
+const (
+	// WantUp asks the supervisor to keep the container running, and to
+	// resume it if paused.
+	WantUp = "UP"
+
+	// WantDown asks the supervisor to gracefully stop the container.
+	WantDown = "DOWN"
+
+	// WantExit asks the supervisor to kill the container and exit.
+	WantExit = "EXIT"
+
+	// WantRestart asks the supervisor to gracefully stop the container and
+	// start it again. Requires heartbeat protocol version 1.
+	WantRestart = "RESTART"
+
+	// WantPause asks the supervisor to freeze the container's processes.
+	// Requires heartbeat protocol version 1.
+	WantPause = "PAUSE"
+
+	// WantHold asks the supervisor to keep the container as it is, and to
+	// check in again. Restarted agents send it to containers they don't know
+	// yet while recovering. Requires heartbeat protocol version 2.
+	WantHold = "HOLD"
+)
+
+// Heartbeat is sent periodically by a container supervisor (harpoon-container)
+// to its agent, reporting the state of the supervised container.
 type Heartbeat struct {
+	// Version is the heartbeat protocol version of the supervisor.
+	Version int `json:"version,omitempty"`
+
 	// Status will be one of "UP" or "EXITING".
 	Status    string    `json:"status"`
 	Err       string    `json:"err,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 
+	// Ack is the generation of the most recent reply the supervisor has
+	// applied.
+	Ack uint64 `json:"ack,omitempty"`
+
+	ProcessInfo            `json:"process"`
 	ContainerProcessStatus `json:"container_status"`
 }
 
-// HeartbeatReply TODO
+// ProcessInfo identifies the host processes and cgroup of a supervised
+// container, so the agent can act on them directly.
+type ProcessInfo struct {
+	SupervisorPID int    `json:"supervisor_pid,omitempty"` // harpoon-container
+	ContainerPID  int    `json:"container_pid,omitempty"`  // init process of the container; 0 when not running
+	CgroupPath    string `json:"cgroup_path,omitempty"`    // relative to each cgroup hierarchy mount
+}
+
+// HeartbeatReply is the agent's answer to a heartbeat, carrying the desired
+// state of the container.
 type HeartbeatReply struct {
-	// Want will be one of UP, DOWN, or EXIT.
+	// Version is the heartbeat protocol version of the agent.
+	Version int `json:"version,omitempty"`
+
+	// Want will be one of UP, DOWN, EXIT, RESTART, PAUSE, or HOLD.
 	Want string `json:"want"`
 	Err  string `json:"err,omitempty"`
+
+	// Generation increments whenever the agent changes the desired state of
+	// the container. Supervisors apply each generation exactly once, and
+	// acknowledge it in subsequent heartbeats, which makes one-shot
+	// transitions like RESTART and signal delivery safe to repeat in every
+	// reply.
+	Generation uint64 `json:"generation,omitempty"`
+
+	// Signal, if nonzero, should be delivered to the container once for this
+	// generation.
+	Signal int `json:"signal,omitempty"`
+
+	// Interval is the heartbeat interval the agent expects, in nanoseconds.
+	// Containers should adopt it, so both sides agree on when a container
+	// has gone missing. Zero means no change.
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// Resources are the limits the container should run with. Supervisors
+	// apply changed limits to the running container's cgroup.
+	Resources *Resources `json:"resources,omitempty"`
 }
 
-// ContainerProcessStatus TODO
+// ContainerProcessStatus describes the state of the supervised container
+// process, as reported in heartbeats.
 type ContainerProcessStatus struct {
 	Up bool `json:"up,omitempty"`
 
@@ -314,9 +1248,25 @@ type ContainerProcessStatus struct {
 	// OOMed is true if the container was killed for exceeding its memory limit.
 	OOMed bool `json:"oomed,omitempty"`
 
+	// ResourcesError explains why the supervisor failed to apply the most
+	// recent resource limits to the running container, if it did.
+	ResourcesError string `json:"resources_error,omitempty"`
+
 	*ContainerMetrics `json:"metrics"`
 }
 
+// Succeeded returns true if the container exited with a zero return code.
+func (s ContainerProcessStatus) Succeeded() bool {
+	return s.Exited && s.ExitStatus == 0
+}
+
+// ContainerMetricsSample is a sample of a container's metrics, taken when its
+// supervisor reported them.
+type ContainerMetricsSample struct {
+	Time time.Time `json:"time"`
+	ContainerMetrics
+}
+
 // ContainerMetrics TODO
 type ContainerMetrics struct {
 	Restarts    uint64 `json:"restarts"`     // counter of restarts
@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ConfigSchemaVersion is the version of the ContainerConfig schema spoken by
+// this package. Version 1 is the schema before versioning; configs without a
+// schema_version are version 1.
+//
+// Agents and schedulers run mixed versions. A scheduler talking to an agent
+// with an older schema downgrades configs before sending them, dropping the
+// fields the agent doesn't know. An agent receiving a config with an older
+// schema leaves the missing fields at their zero values.
+const ConfigSchemaVersion = 9
+
+// configFields lists the ContainerConfig fields introduced after version 1,
+// with the version that introduced them, and how to drop them.
+var configFields = []struct {
+	name    string
+	version int
+	drop    func(*ContainerConfig) bool // returns true if the field was set
+}{
+	{"schema_version", 2, func(c *ContainerConfig) bool {
+		c.SchemaVersion = 0
+		return false // implied by the version, not worth a warning
+	}},
+	{"priority", 2, func(c *ContainerConfig) bool {
+		set := c.Priority != 0
+		c.Priority = 0
+		return set
+	}},
+	{"env_file", 2, func(c *ContainerConfig) bool {
+		set := len(c.EnvFile) > 0
+		c.EnvFile = nil
+		return set
+	}},
+	{"labels", 3, func(c *ContainerConfig) bool {
+		set := len(c.Labels) > 0
+		c.Labels = nil
+		return set
+	}},
+	{"restart", 4, func(c *ContainerConfig) bool {
+		set := c.Restart != ""
+		c.Restart = ""
+		return set
+	}},
+	{"port_ranges", 5, func(c *ContainerConfig) bool {
+		set := len(c.PortRanges) > 0
+		c.PortRanges = nil
+		return set
+	}},
+	{"security", 6, func(c *ContainerConfig) bool {
+		set := c.Security != nil
+		c.Security = nil
+		return set
+	}},
+	{"egress", 7, func(c *ContainerConfig) bool {
+		set := c.Egress != nil
+		c.Egress = nil
+		return set
+	}},
+	{"dns", 8, func(c *ContainerConfig) bool {
+		set := c.DNS != nil
+		c.DNS = nil
+		return set
+	}},
+	{"hooks", 9, func(c *ContainerConfig) bool {
+		set := c.Hooks != nil
+		c.Hooks = nil
+		return set
+	}},
+}
+
+// securityFields are the fields which weaken the isolation of the container
+// when dropped. Configs setting them are never downgraded; see Undroppable.
+var securityFields = map[string]bool{
+	"security": true,
+	"egress":   true,
+}
+
+// Undroppable returns the names of the fields set in the config which an
+// agent speaking the given schema version doesn't know, and which may not be
+// dropped, as the container would run with less isolation than configured.
+// Such configs must not be sent to the agent.
+func (c ContainerConfig) Undroppable(version int) []string {
+	_, dropped := c.Downgrade(version)
+	var undroppable []string
+	for _, name := range dropped {
+		if securityFields[name] {
+			undroppable = append(undroppable, name)
+		}
+	}
+	return undroppable
+}
+
+// Downgrade returns the config translated to the given schema version, for
+// an agent which speaks that version, and the names of the fields which were
+// set but had to be dropped. Callers should warn about dropped fields.
+func (c ContainerConfig) Downgrade(version int) (ContainerConfig, []string) {
+	if version <= 0 {
+		version = 1
+	}
+	if version > ConfigSchemaVersion {
+		version = ConfigSchemaVersion
+	}
+	c.SchemaVersion = version
+	var dropped []string
+	for _, field := range configFields {
+		if field.version <= version {
+			continue
+		}
+		if field.drop(&c) {
+			dropped = append(dropped, field.name)
+		}
+	}
+	return c, dropped
+}
+
+// DecodeContainerConfig decodes a JSON ContainerConfig, and returns the
+// fields in it which this package doesn't know, e.g. because the config was
+// written for a newer schema. Unknown fields are otherwise ignored, as
+// encoding/json does.
+func DecodeContainerConfig(data []byte) (ContainerConfig, []string, error) {
+	var c ContainerConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return ContainerConfig{}, nil, err
+	}
+	return c, unknownFields("", data, reflect.TypeOf(c)), nil
+}
+
+// unknownFields walks the JSON document alongside the Go type it's decoded
+// into, and returns the paths of the object keys which have no corresponding
+// field.
+func unknownFields(prefix string, data json.RawMessage, t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil // e.g. null
+		}
+		known := jsonFields(t)
+		for key, value := range m {
+			fieldType, ok := lookupField(known, key)
+			if !ok {
+				unknown = append(unknown, prefix+key)
+				continue
+			}
+			unknown = append(unknown, unknownFields(prefix+key+".", value, fieldType)...)
+		}
+
+	case reflect.Map:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil
+		}
+		for key, value := range m {
+			unknown = append(unknown, unknownFields(prefix+key+".", value, t.Elem())...)
+		}
+
+	case reflect.Slice, reflect.Array:
+		var a []json.RawMessage
+		if err := json.Unmarshal(data, &a); err != nil {
+			return nil
+		}
+		for _, value := range a {
+			unknown = append(unknown, unknownFields(prefix, value, t.Elem())...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// jsonFields returns the JSON names of the fields of struct type t, as
+// encoding/json sees them, including those of untagged embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-":
+			continue
+		case name == "" && f.Anonymous && f.Type.Kind() == reflect.Struct:
+			for embeddedName, embeddedType := range jsonFields(f.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		case name == "":
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// lookupField matches keys to fields like encoding/json does: exactly, or
+// else case-insensitively.
+func lookupField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
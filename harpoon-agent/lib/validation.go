@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError describes a single validation problem. Field is the path of the
+// offending field, using JSON names, e.g. "tasks[0].resources.mem".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects all problems found by a Valid method. Clients
+// which need more than the error string may type-assert for it.
+type ValidationErrors []FieldError
+
+// Error satisfies the error interface.
+func (e ValidationErrors) Error() string {
+	errs := make([]string, len(e))
+	for i, fieldError := range e {
+		if fieldError.Field == "" {
+			errs[i] = fieldError.Message
+			continue
+		}
+		errs[i] = fmt.Sprintf("%s: %s", fieldError.Field, fieldError.Message)
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Add records a problem with the given field.
+func (e *ValidationErrors) Add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Nest records the result of validating a nested structure at the given
+// field. Field paths of nested ValidationErrors are prefixed; any other
+// error is recorded as a problem with the field itself.
+func (e *ValidationErrors) Nest(field string, err error) {
+	if err == nil {
+		return
+	}
+	nested, ok := err.(ValidationErrors)
+	if !ok {
+		e.Add(field, "%s", err)
+		return
+	}
+	for _, fieldError := range nested {
+		*e = append(*e, FieldError{Field: joinField(field, fieldError.Field), Message: fieldError.Message})
+	}
+}
+
+// Err returns the collected problems as an error, or nil if there are none.
+func (e ValidationErrors) Err() error {
+	if len(e) <= 0 {
+		return nil
+	}
+	return e
+}
+
+func joinField(prefix, field string) string {
+	switch {
+	case prefix == "":
+		return field
+	case field == "":
+		return prefix
+	case strings.HasPrefix(field, "["):
+		return prefix + field
+	}
+	return prefix + "." + field
+}
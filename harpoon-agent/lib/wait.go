@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+)
+
+// The functions below wait for containers to change status by watching the
+// agent's event stream, rather than by polling. They're meant for tests and
+// tools which drive an agent end-to-end.
+
+// WaitForStatus blocks until the container has one of the given statuses, and
+// returns it. It fails if the container reaches another terminal status
+// first, or if it takes longer than timeout.
+func WaitForStatus(a Agent, containerID string, timeout time.Duration, statuses ...ContainerStatus) (ContainerInstance, error) {
+	events, stopper, err := a.Events()
+	if err != nil {
+		return ContainerInstance{}, err
+	}
+	defer stopper.Stop()
+
+	return waitForStatus(events, containerID, time.After(timeout), statuses)
+}
+
+// PutAndWait creates the container and blocks until it's running. If the
+// container fails instead, the error carries the agent's reason.
+func PutAndWait(a Agent, containerID string, containerConfig ContainerConfig, timeout time.Duration) (ContainerInstance, error) {
+	return doAndWait(a, containerID, timeout, func() error {
+		return a.Put(containerID, containerConfig)
+	}, ContainerStatusRunning)
+}
+
+// StopAndWait stops the container and blocks until it has exited.
+func StopAndWait(a Agent, containerID string, timeout time.Duration) (ContainerInstance, error) {
+	return doAndWait(a, containerID, timeout, func() error {
+		return a.Stop(containerID)
+	}, ContainerStatusFinished, ContainerStatusFailed)
+}
+
+// doAndWait subscribes to the event stream before performing the action, so
+// no transition is missed. The initial snapshot predates the action, and is
+// skipped.
+func doAndWait(a Agent, containerID string, timeout time.Duration, action func() error, statuses ...ContainerStatus) (ContainerInstance, error) {
+	events, stopper, err := a.Events()
+	if err != nil {
+		return ContainerInstance{}, err
+	}
+	defer stopper.Stop()
+
+	deadline := time.After(timeout)
+
+	select {
+	case <-events:
+	case <-deadline:
+		return ContainerInstance{}, fmt.Errorf("%s: no initial event after %s", containerID, timeout)
+	}
+
+	if err := action(); err != nil {
+		return ContainerInstance{}, err
+	}
+
+	return waitForStatus(events, containerID, deadline, statuses)
+}
+
+func waitForStatus(events <-chan ContainerEvent, containerID string, deadline <-chan time.Time, statuses []ContainerStatus) (ContainerInstance, error) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return ContainerInstance{}, fmt.Errorf("%s: event stream closed while waiting for %v", containerID, statuses)
+			}
+
+			var containerInstances ContainerInstances
+
+			switch e := event.(type) {
+			case ContainerInstances:
+				containerInstances = e
+			case ContainerInstance:
+				containerInstances = ContainerInstances{e}
+			case ContainerDelta:
+				containerInstances = ContainerInstances{e.Apply(ContainerInstance{})}
+			}
+
+			for _, containerInstance := range containerInstances {
+				if containerInstance.ID != containerID {
+					continue
+				}
+
+				for _, status := range statuses {
+					if containerInstance.Status == status {
+						return containerInstance, nil
+					}
+				}
+
+				switch containerInstance.Status {
+				case ContainerStatusFailed, ContainerStatusFinished, ContainerStatusDeleted:
+					err := fmt.Errorf("%s: %s while waiting for %v", containerID, containerInstance.Status, statuses)
+					if containerInstance.Error != "" {
+						err = fmt.Errorf("%s: %s while waiting for %v: %s", containerID, containerInstance.Status, statuses, containerInstance.Error)
+					}
+					return containerInstance, err
+				}
+			}
+
+		case <-deadline:
+			return ContainerInstance{}, fmt.Errorf("%s: timeout while waiting for %v", containerID, statuses)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	herrors "github.com/soundcloud/harpoon/lib/errors"
+)
+
+// svlogd keeps the output of each container in its logdir: the file current,
+// and rotated files named after the time they were rotated, as @ followed by
+// a TAI64N label, e.g. @400000005432f19a2e8b7a3c.s. Every line is prefixed
+// with the UTC time it was written at (svlogd -tt).
+
+const (
+	logRoot = "/srv/harpoon/log"
+
+	// svlogdTimeLayout parses the timestamp svlogd -tt prefixes lines with.
+	svlogdTimeLayout = "2006-01-02_15:04:05.999999999"
+)
+
+// handleLogArchive streams the lines a container logged between the since and
+// until query parameters (RFC 3339, both optional), from the files svlogd
+// rotated to disk. Responses are cut off after -log.archive.max bytes; clients
+// should ask for shorter ranges then. Logs of deleted containers are served
+// as long as they remain on disk.
+func (a *api) handleLogArchive(w http.ResponseWriter, r *http.Request) {
+	var (
+		id    = r.URL.Query().Get(":id")
+		since time.Time
+		until time.Time
+		err   error
+	)
+
+	if id == "" || strings.Contains(id, "..") {
+		writeError(w, http.StatusBadRequest, herrors.BadRequest, fmt.Sprintf("invalid container ID %q", id))
+		return
+	}
+
+	if s := r.URL.Query().Get("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeError(w, http.StatusBadRequest, herrors.BadRequest, fmt.Sprintf("invalid since: %s", err))
+			return
+		}
+	}
+
+	if s := r.URL.Query().Get("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			writeError(w, http.StatusBadRequest, herrors.BadRequest, fmt.Sprintf("invalid until: %s", err))
+			return
+		}
+	}
+
+	files, err := archivedLogFiles(filepath.Join(logRoot, id))
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, herrors.NotFound, "no archived logs")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, herrors.Internal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	limited := &limitedWriter{w: w, n: *logArchiveMax}
+
+	if err := copyLogRange(limited, files, since, until); err != nil && err != errLimitReached {
+		log.Printf("%s: log archive: %s", id, err)
+	}
+}
+
+// archivedLogFiles returns the log files in the logdir, oldest first, and
+// the latest time each file may hold lines of. The current file may hold
+// lines of any time.
+func archivedLogFiles(logdir string) ([]archivedLogFile, error) {
+	names, err := readDirNames(logdir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []archivedLogFile{}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, "@") {
+			continue
+		}
+
+		rotated, ok := parseTAI64N(strings.TrimSuffix(strings.TrimSuffix(name[1:], ".s"), ".u"))
+		if !ok {
+			continue
+		}
+
+		files = append(files, archivedLogFile{filepath.Join(logdir, name), rotated})
+	}
+
+	// TAI64N labels sort in time order.
+	sort.Sort(archivedLogFilesByName(files))
+
+	return append(files, archivedLogFile{path: filepath.Join(logdir, "current")}), nil
+}
+
+// copyLogRange copies the lines of the files within the time range to w. A
+// zero since or until leaves that end of the range open. Lines without a
+// timestamp go with the line before them.
+func copyLogRange(w io.Writer, files []archivedLogFile, since, until time.Time) error {
+	var inRange bool
+
+	for _, file := range files {
+		if !file.rotated.IsZero() && file.rotated.Before(since) {
+			continue // all of it is older
+		}
+
+		f, err := os.Open(file.path)
+		if os.IsNotExist(err) {
+			continue // svlogd removed it meanwhile
+		} else if err != nil {
+			return err
+		}
+
+		rd := bufio.NewReader(f)
+
+		for {
+			line, err := rd.ReadString('\n')
+			if len(line) > 0 {
+				if t, ok := parseSvlogdTime(line); ok {
+					if !until.IsZero() && t.After(until) {
+						f.Close()
+						return nil // files are in time order; we're done
+					}
+
+					inRange = !t.Before(since)
+				}
+
+				if inRange {
+					if _, err := io.WriteString(w, line); err != nil {
+						f.Close()
+						return err
+					}
+				}
+			}
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		f.Close()
+	}
+
+	return nil
+}
+
+// parseSvlogdTime parses the timestamp svlogd -tt prefixes lines with.
+func parseSvlogdTime(line string) (time.Time, bool) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(svlogdTimeLayout, line[:i])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// parseTAI64N parses the hex-encoded TAI64N label of a rotated log file. TAI
+// is ahead of UTC by the leap seconds since 1970, so the result is slightly
+// late, which is fine for the upper bound of a file's lines.
+func parseTAI64N(label string) (time.Time, bool) {
+	if len(label) != 24 {
+		return time.Time{}, false
+	}
+
+	secs, err := strconv.ParseUint(label[:16], 16, 64)
+	if err != nil || secs < 1<<62 {
+		return time.Time{}, false
+	}
+
+	nsecs, err := strconv.ParseUint(label[16:], 16, 32)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(secs-1<<62), int64(nsecs)).UTC(), true
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
+
+type archivedLogFile struct {
+	path    string
+	rotated time.Time // zero for the current file
+}
+
+type archivedLogFilesByName []archivedLogFile
+
+func (a archivedLogFilesByName) Len() int           { return len(a) }
+func (a archivedLogFilesByName) Less(i, j int) bool { return a[i].path < a[j].path }
+func (a archivedLogFilesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+var errLimitReached = errors.New("size limit reached")
+
+// limitedWriter writes up to n bytes, and fails after.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errLimitReached
+	}
+
+	n, err := l.w.Write(p)
+	l.n -= int64(n)
+
+	return n, err
+}
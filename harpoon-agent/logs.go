@@ -1,11 +1,58 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+// Supervisors send each line their container writes to logAddr, as an
+// agent.LogDatagram. Older supervisors sent
+//
+//	container[<id>]:<stream>:<seq>:<unix nanoseconds>: <line>
+//
+// and the svlogd of supervisors started by older agents forwards the lines
+// as container[<id>]: <line>, without stream, seq, or time. The latest lines
+// of every container are kept in memory for the log API.
+//
+// Supervisors drop lines exceeding -log.rate.lines or -log.rate.bytes, and
+// tell so in the next line they send.
+
+var (
+	logLinesReceived        = expvar.NewInt("log_lines_received")
+	logLinesDropped         = expvar.NewInt("log_lines_dropped")
+	logNotificationsDropped = expvar.NewInt("log_notifications_dropped")
+)
+
+const (
+	// logAddr is where supervisors send log lines to.
+	logAddr = "127.0.0.1:3334"
+
+	// defaultLogHistory is the number of lines returned by the log API, unless
+	// the client asks for a different number.
+	defaultLogHistory = 10
+
+	// logStreamBuffer is the number of lines a log stream may fall behind the
+	// container, before it misses lines.
+	logStreamBuffer = 100
+
+	// legacyLogPrefix starts the datagrams of older supervisors.
+	legacyLogPrefix = "container["
 )
 
-func receiveLogs() {
+func receiveLogs(logs *logSet) {
 	laddr, err := net.ResolveUDPAddr("udp", ":3334")
 	if err != nil {
 		log.Fatal(err)
@@ -17,7 +64,7 @@ func receiveLogs() {
 	}
 	defer ln.Close()
 
-	var buf = make([]byte, 50000+256) // max line length + container id
+	var buf = make([]byte, agent.MaxLogDatagramSize)
 
 	for {
 		n, addr, err := ln.ReadFromUDP(buf)
@@ -26,6 +73,339 @@ func receiveLogs() {
 			return
 		}
 
-		log.Printf("LOG: %s : %s", addr, buf[:n])
+		id, record, ok := parseLogDatagram(buf[:n], time.Now())
+		if !ok {
+			log.Printf("LOGS: invalid datagram from %s", addr)
+			continue
+		}
+
+		logLinesDropped.Add(int64(record.Dropped))
+		logs.add(id, record)
+	}
+}
+
+// parseLogDatagram returns the container ID and log record sent in the
+// datagram.
+func parseLogDatagram(datagram []byte, received time.Time) (string, agent.LogRecord, bool) {
+	if !bytes.HasPrefix(datagram, []byte(legacyLogPrefix)) {
+		var d agent.LogDatagram
+
+		if err := json.Unmarshal(datagram, &d); err != nil || d.ContainerID == "" {
+			return "", agent.LogRecord{}, false
+		}
+
+		return d.ContainerID, d.LogRecord, true
+	}
+
+	return parseLegacyLogDatagram(string(bytes.TrimRight(datagram, "\n")), received)
+}
+
+// parseLegacyLogDatagram parses the datagrams of older supervisors. Untagged
+// lines are recorded at the time they were received.
+func parseLegacyLogDatagram(datagram string, received time.Time) (string, agent.LogRecord, bool) {
+	i := strings.Index(datagram, "]:")
+	if i < 0 {
+		return "", agent.LogRecord{}, false
+	}
+
+	var (
+		id     = datagram[len(legacyLogPrefix):i]
+		rest   = datagram[i+2:]
+		record = agent.LogRecord{Time: received, Line: strings.TrimPrefix(rest, " ")}
+	)
+
+	if id == "" {
+		return "", agent.LogRecord{}, false
+	}
+
+	// stream:seq:time: line
+	if fields := strings.SplitN(rest, ":", 4); len(fields) == 4 && strings.HasPrefix(fields[3], " ") {
+		seq, seqErr := strconv.ParseUint(fields[1], 10, 64)
+		nsec, timeErr := strconv.ParseInt(fields[2], 10, 64)
+
+		if (fields[0] == agent.LogStreamStdout || fields[0] == agent.LogStreamStderr) && seqErr == nil && timeErr == nil {
+			record = agent.LogRecord{
+				Time:   time.Unix(0, nsec),
+				Stream: fields[0],
+				Seq:    seq,
+				Line:   fields[3][1:],
+			}
+		}
+	}
+
+	return id, record, true
+}
+
+// logSet holds the logs of the containers in the registry. Logs are created
+// when containers are registered, and freed when they're removed; lines of
+// other containers are discarded.
+type logSet struct {
+	size int // lines kept per container
+
+	sync.Mutex
+	logs    map[string]*containerLog
+	markers map[chan<- agent.LogMarker]struct{}
+}
+
+func newLogSet(size int) *logSet {
+	return &logSet{
+		size:    size,
+		logs:    map[string]*containerLog{},
+		markers: map[chan<- agent.LogMarker]struct{}{},
+	}
+}
+
+// create adds an empty log for the container, unless it has one.
+func (s *logSet) create(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.logs[id]; !ok {
+		s.logs[id] = newContainerLog(s.size)
+	}
+}
+
+// remove frees the log of the container, ending its streams.
+func (s *logSet) remove(id string) {
+	s.Lock()
+	l, ok := s.logs[id]
+	delete(s.logs, id)
+	s.Unlock()
+
+	if ok {
+		l.close()
+	}
+}
+
+func (s *logSet) get(id string) (*containerLog, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	l, ok := s.logs[id]
+	return l, ok
+}
+
+func (s *logSet) add(id string, record agent.LogRecord) {
+	logLinesReceived.Add(1)
+
+	l, ok := s.get(id)
+	if !ok {
+		return
+	}
+
+	l.add(record)
+
+	if record.Dropped > 0 {
+		s.mark(agent.LogMarker{ID: id, Time: record.Time, Seq: record.Seq, Dropped: record.Dropped})
+	}
+}
+
+// mark sends the marker to the subscribers of log markers.
+func (s *logSet) mark(marker agent.LogMarker) {
+	s.Lock()
+	defer s.Unlock()
+
+	for c := range s.markers {
+		select {
+		case c <- marker:
+		default: // subscribers which don't keep up miss markers
+			logNotificationsDropped.Add(1)
+		}
+	}
+}
+
+// subscribeMarkers sends a LogMarker to c whenever a container drops lines,
+// until unsubscribeMarkers is called.
+func (s *logSet) subscribeMarkers(c chan<- agent.LogMarker) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.markers[c] = struct{}{}
+}
+
+func (s *logSet) unsubscribeMarkers(c chan<- agent.LogMarker) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.markers, c)
+}
+
+// containerLog keeps the latest lines of a container in a ring buffer, and
+// passes new lines on to subscribers. The buffer grows up to its size as
+// lines come in.
+type containerLog struct {
+	sync.Mutex
+	size        int
+	records     []agent.LogRecord
+	next        int // where the next record goes, once the buffer is full
+	closed      bool
+	subscribers map[chan<- agent.LogRecord]struct{}
+}
+
+func newContainerLog(size int) *containerLog {
+	return &containerLog{
+		size:        size,
+		subscribers: map[chan<- agent.LogRecord]struct{}{},
+	}
+}
+
+func (l *containerLog) add(record agent.LogRecord) {
+	l.Lock()
+	defer l.Unlock()
+
+	switch {
+	case len(l.records) < l.size:
+		l.records = append(l.records, record)
+
+	case l.size > 0:
+		l.records[l.next] = record
+		l.next = (l.next + 1) % l.size
+	}
+
+	for c := range l.subscribers {
+		select {
+		case c <- record:
+		default: // subscribers which don't keep up miss lines
+			logNotificationsDropped.Add(1)
+		}
+	}
+}
+
+// last returns up to the latest n records, oldest first.
+func (l *containerLog) last(n int) []agent.LogRecord {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.lastLocked(n)
+}
+
+func (l *containerLog) lastLocked(n int) []agent.LogRecord {
+	ordered := append(append([]agent.LogRecord{}, l.records[l.next:]...), l.records[:l.next]...)
+
+	if n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+
+	return ordered
+}
+
+// subscribe returns up to the latest n records, and sends every record added
+// after them to c, until unsubscribe is called, or the log is closed, which
+// closes c.
+func (l *containerLog) subscribe(n int, c chan<- agent.LogRecord) []agent.LogRecord {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		close(c)
+	} else {
+		l.subscribers[c] = struct{}{}
+	}
+
+	return l.lastLocked(n)
+}
+
+func (l *containerLog) unsubscribe(c chan<- agent.LogRecord) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.subscribers, c)
+}
+
+// close ends all subscriptions, and frees the records.
+func (l *containerLog) close() {
+	l.Lock()
+	defer l.Unlock()
+
+	for c := range l.subscribers {
+		close(c)
+		delete(l.subscribers, c)
+	}
+
+	l.closed = true
+	l.records, l.next = nil, 0
+}
+
+// handleLog returns the latest lines of a container, as plain text, or as
+// LogRecords with ?format=json. Clients accepting text/event-stream receive
+// the lines the container writes afterwards, too.
+func (a *api) handleLog(w http.ResponseWriter, r *http.Request) {
+	var (
+		id      = r.URL.Query().Get(":id")
+		history = defaultLogHistory
+		format  = r.URL.Query().Get("format")
+	)
+
+	l, ok := a.logs.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.NotFound, "container not found")
+		return
+	}
+
+	if s := r.URL.Query().Get("history"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.BadRequest, fmt.Sprintf("invalid history %q", s))
+			return
+		}
+
+		history = n
+	}
+
+	var write func(agent.LogRecord) error
+
+	switch format {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		write = func(record agent.LogRecord) error {
+			if record.Dropped > 0 {
+				if _, err := fmt.Fprintf(w, "[%d lines dropped by the log rate limit]\n", record.Dropped); err != nil {
+					return err
+				}
+			}
+
+			_, err := io.WriteString(w, record.Line+"\n")
+			return err
+		}
+
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+
+		e := json.NewEncoder(w)
+		write = func(record agent.LogRecord) error { return e.Encode(record) }
+
+	default:
+		writeError(w, http.StatusBadRequest, errors.BadRequest, fmt.Sprintf("invalid format %q", format))
+		return
+	}
+
+	if !isStreamAccept(r.Header.Get("Accept")) {
+		for _, record := range l.last(history) {
+			write(record)
+		}
+
+		return
+	}
+
+	recordc := make(chan agent.LogRecord, logStreamBuffer)
+
+	records := l.subscribe(history, recordc)
+	defer l.unsubscribe(recordc)
+
+	for _, record := range records {
+		if err := write(record); err != nil {
+			return
+		}
+	}
+
+	flush(w)
+
+	for record := range recordc {
+		if err := write(record); err != nil {
+			return
+		}
+
+		flush(w)
 	}
 }
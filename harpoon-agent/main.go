@@ -5,19 +5,73 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/soundcloud/harpoon/lib/middleware"
 )
 
 var (
-	heartbeatInterval = 3 * time.Second
+	heartbeatInterval = flag.Duration("heartbeat.interval", 3*time.Second, "how often containers should send heartbeats")
+	heartbeatJitter   = flag.Float64("heartbeat.jitter", 0.1, "random variation applied by containers to each heartbeat interval, as a fraction of it")
+
+	eventsSnapshotInterval  = flag.Duration("events.snapshot.interval", time.Minute, "how often to send a full snapshot in delta event streams")
+	eventsHeartbeatInterval = flag.Duration("events.heartbeat.interval", 15*time.Second, "how often to send a heartbeat in event streams (0 to disable)")
+	strictConfig            = flag.Bool("config.strict", false, "reject container configs with fields this agent doesn't know, instead of ignoring them")
 
 	addr              = flag.String("addr", ":3333", "address to listen on")
+	rateLimitRate     = flag.Float64("ratelimit.rate", 0, "mutating requests per second allowed per client (0 to disable)")
+	rateLimitBurst    = flag.Int("ratelimit.burst", 10, "mutating requests a client may make at once")
+	maxContainers     = flag.Int("max.containers", 0, "maximum number of containers on this agent (0 for unlimited)")
+	shutdownTimeout   = flag.Duration("shutdown.timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+	execTimeout       = flag.Duration("exec.timeout", time.Minute, "how long commands run in containers with POST /containers/:id/exec may take before they're killed")
+	hostConfigPath    = flag.String("host.config", "", "JSON file with additional volumes and labels, reloaded on SIGHUP")
+	adminAddr         = flag.String("admin.addr", "", "address to serve /metrics, /healthz, /readyz, /debug/, and /maintenance on, moving /maintenance off -addr (empty to disable)")
+	debugAddr         = flag.String("debug.addr", "", "deprecated alias of -admin.addr")
+	logArchiveMax     = flag.Int64("log.archive.max", 64<<20, "maximum size in bytes of a log archive response")
+	logLines          = flag.Int("log.lines", 10000, "number of log lines kept in memory per container")
+	containerEvents   = flag.Int("container.events", 100, "number of events kept in memory per container, for GET /containers/:id/events")
+	containerMetrics  = flag.Int("container.metrics", 1200, "number of metrics samples, one per heartbeat, kept in memory per container, for GET /containers/:id/metrics")
+	logRateLines      = flag.Float64("log.rate.lines", 1000, "log lines per second each container may send to the agent (0 for unlimited)")
+	logRateBytes      = flag.Float64("log.rate.bytes", 1<<20, "log bytes per second each container may send to the agent (0 for unlimited)")
+	helpersMem        = flag.Int64("helpers.mem", 256, "memory in MB reserved for helper processes like svlogd and artifact extraction (0 for unlimited)")
+	helpersCPU        = flag.Float64("helpers.cpu", 0.5, "CPUs reserved for helper processes like svlogd and artifact extraction (0 for unlimited)")
+	capsDrop          = flag.Bool("caps.drop", true, "have children drop all capabilities the agent and its containers' supervisors don't need from their bounding set")
+	artifactMaxSize   = flag.Int64("artifact.max.size", 4<<30, "maximum size in bytes of the files in an artifact (0 for unlimited)")
+	artifactCreds     = flag.String("artifact.credentials", "", "JSON file with credentials for fetching artifacts, by URL scheme")
+	artifactFileRoot  = flag.String("artifact.file.root", "", "directory file:// artifacts may be fetched from (empty to refuse file://)")
+	artifactProxy     = flag.String("artifact.proxy", "", "proxy URL for fetching artifacts over HTTP (empty to use HTTP_PROXY and HTTPS_PROXY)")
+	artifactNoProxy   = flag.String("artifact.no.proxy", "", "comma-separated hosts and domains to fetch artifacts from without the proxy (empty to use NO_PROXY)")
+	webhookURL        = flag.String("webhook.url", "", "URL to post container transitions to (empty to disable)")
+	webhookSecretPath = flag.String("webhook.secret.file", "", "file holding the secret to sign webhook posts with (empty to not sign)")
+	webhookRetries    = flag.Int("webhook.retries", 5, "how often to retry failed webhook posts")
+	webhookTimeout    = flag.Duration("webhook.timeout", 10*time.Second, "timeout of webhook posts")
+	seccompProfiles   = flag.String("seccomp.profiles", "unconfined,default,strict", "comma-separated seccomp profiles containers may ask for")
 	configuredVolumes = volumes{}
+	configuredDevices = volumes{}
+	configuredLabels  = labels{}
+
+	configuredFetchers      = fetcherCommands{}
+	configuredArtifactHosts = hostOverrides{}
+	configuredDNSServers    = dnsList{}
+	configuredDNSSearch     = dnsList{}
+	configuredDNSHosts      = hostOverrides{}
+	corsOrigins             = middleware.Origins{}
+
+	host *hostConfig
 
 	agentTotalMem int64
 	agentTotalCPU int64
 
 	hostname string
+
+	// version and gitSHA are set at build time, with -ldflags "-X main.version
+	// ...".
+	version = "unknown"
+	gitSHA  = "unknown"
 )
 
 func init() {
@@ -29,13 +83,69 @@ func init() {
 }
 
 func main() {
-	go receiveLogs()
+	if len(os.Args) > 1 && os.Args[1] == extractArtifactCommand {
+		os.Exit(extractArtifactMain(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == execDroppedCommand {
+		os.Exit(execDroppedMain(os.Args[2:]))
+	}
 
 	flag.Int64Var(&agentTotalCPU, "cpu", -1, "available cpu resources (-1 to use all cpus)")
 	flag.Int64Var(&agentTotalMem, "mem", -1, "available memory resources in MB (-1 to use all)")
 	flag.Var(&configuredVolumes, "v", "repeatable list of available volumes")
+	flag.Var(&configuredDevices, "device", "repeatable list of host devices containers may ask for")
+	flag.Var(&configuredLabels, "label", "repeatable list of key=value labels describing the host")
+	flag.Var(&configuredFetchers, "artifact.fetcher", "repeatable list of scheme=command fetching artifacts of other schemes to stdout")
+	flag.Var(&configuredArtifactHosts, "artifact.host", "repeatable list of name=ip resolving artifact hosts, like entries of /etc/hosts")
+	flag.Var(&configuredDNSServers, "dns.server", "repeatable list of DNS servers for containers, replacing the host's")
+	flag.Var(&configuredDNSSearch, "dns.search", "repeatable list of DNS search domains for containers, replacing the host's")
+	flag.Var(&configuredDNSHosts, "dns.host", "repeatable list of name=ip entries added to the /etc/hosts of containers")
+	flag.Var(&corsOrigins, "cors.origin", "repeatable list of origins allowed to make cross-origin requests (* for any)")
+	flag.Var(&corsOrigins, "cors.origins", "deprecated alias of -cors.origin")
 	flag.Parse()
 
+	if *heartbeatInterval <= 0 {
+		log.Fatal("heartbeat interval must be positive")
+	}
+
+	if *heartbeatJitter < 0 || *heartbeatJitter >= 1 {
+		log.Fatal("heartbeat jitter must be in the range [0, 1)")
+	}
+
+	if *adminAddr == "" {
+		*adminAddr = *debugAddr
+	}
+
+	if *helpersMem < 0 || *helpersCPU < 0 {
+		log.Fatal("helper resources must not be negative")
+	}
+
+	if err := containerDNS(nil).Valid(); err != nil {
+		log.Fatal("invalid DNS flags: ", err)
+	}
+
+	if missing := checkPrivileges(); len(missing) > 0 {
+		log.Fatalf("missing privileges: %s", strings.Join(missing, ", "))
+	}
+
+	if *capsDrop {
+		if _, err := lastCapability(); err != nil {
+			log.Fatal("unable to drop capabilities: ", err)
+		}
+	}
+
+	setupHelpers()
+
+	artifactClient, err := newArtifactClient(*artifactProxy, *artifactNoProxy, configuredArtifactHosts)
+	if err != nil {
+		log.Fatal("unable to set up artifact fetchers: ", err)
+	}
+
+	if err := setupFetchers(artifactClient, *artifactCreds, *artifactFileRoot, configuredFetchers); err != nil {
+		log.Fatal("unable to set up artifact fetchers: ", err)
+	}
+
 	if agentTotalCPU == -1 {
 		agentTotalCPU = systemCPUs()
 	}
@@ -49,29 +159,111 @@ func main() {
 		agentTotalMem = mem
 	}
 
+	h, err := newHostConfig(*hostConfigPath)
+	if err != nil {
+		log.Fatal("unable to load host config: ", err)
+	}
+
+	host = h
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		for _ = range hup {
+			if err := host.reload(); err != nil {
+				log.Printf("unable to reload host config: %s", err)
+			}
+		}
+	}()
+
 	var (
-		r   = newRegistry()
-		api = newAPI(r)
+		logs = newLogSet(*logLines)
+		r    = newRegistry(logs)
+		api  = newAPI(r, logs)
 	)
 
-	http.Handle("/", api)
+	go receiveLogs(logs)
+
+	var wh *webhook
+	if *webhookURL != "" {
+		if wh, err = newWebhook(*webhookURL, *webhookSecretPath, *webhookRetries, *webhookTimeout); err != nil {
+			log.Fatal("unable to set up webhook: ", err)
+		}
+	}
+
+	var limiter *middleware.RateLimiter
+	if *rateLimitRate > 0 {
+		limiter = middleware.NewRateLimiter(*rateLimitRate, *rateLimitBurst)
+	}
+
+	handler := middleware.CORS(corsOrigins, middleware.RateLimit(limiter, isHeartbeat, compress(api)))
 
 	go func() {
 		// recover our state from disk
 		recoverContainers(r)
 
+		if wh != nil {
+			wh.start(r)
+		}
+
 		// begin accepting runner updates
 		r.AcceptStateUpdates()
 
 		if r.Len() > 0 {
 			// wait for runners to check in
-			time.Sleep(3 * heartbeatInterval)
+			time.Sleep(3 * maxHeartbeatInterval())
 		}
 
 		api.Enable()
+
+		if err := sdNotify("READY=1"); err != nil {
+			log.Printf("unable to notify systemd: %s", err)
+		}
 	}()
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
+	if interval := watchdogInterval(); interval > 0 {
+		go watchdog(r, interval)
+	}
+
+	listener, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	drainer := &drainer{}
+
+	go http.Serve(listener, drainer.handler(handler))
+
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("admin listening on %s", *adminAddr)
+			log.Printf("admin listener: %s", http.ListenAndServe(*adminAddr, adminHandler(api)))
+		}()
+	}
+
+	// containers keep running without us, and are recovered on restart
+	log.Printf("received %s; shutting down", <-interrupt())
+
+	sdNotify("STOPPING=1")
+
+	listener.Close()
+
+	if !drainer.drain(*shutdownTimeout) {
+		log.Printf("in-flight requests didn't finish within %s", *shutdownTimeout)
+	}
+}
+
+func interrupt() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	return c
+}
+
+// maxHeartbeatInterval is the longest a well-behaved container may wait
+// between heartbeats.
+func maxHeartbeatInterval() time.Duration {
+	return time.Duration(float64(*heartbeatInterval) * (1 + *heartbeatJitter))
 }
 
 type volumes map[string]struct{}
@@ -79,5 +271,26 @@ type volumes map[string]struct{}
 func (*volumes) String() string           { return "" }
 func (v *volumes) Set(value string) error { (*v)[value] = struct{}{}; return nil }
 
-// not implemented yet
-func recoverContainers(r *registry) {}
+// recoverContainers registers the containers found in the run directory,
+// adopting those whose supervisors survived a previous agent.
+func recoverContainers(r *registry) {
+	rundirs, err := filepath.Glob("/run/harpoon/*")
+	if err != nil {
+		log.Printf("unable to recover containers: %s", err)
+		return
+	}
+
+	for _, rundir := range rundirs {
+		c, recovered, err := r.Recover(rundir, nil)
+		if err != nil {
+			log.Printf("unable to recover container %s: %s", filepath.Base(rundir), err)
+			continue
+		}
+
+		if !recovered {
+			continue // adopted when its supervisor checked in
+		}
+
+		log.Printf("[%s] recovered as %s", c.ID, c.Status)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// maintenance tracks the agent's maintenance window. While it's open, the
+// agent reports itself as unschedulable. The window closes by itself.
+type maintenance struct {
+	until time.Time
+	timer *time.Timer
+
+	sync.Mutex
+}
+
+// Begin opens a maintenance window of duration d, replacing any open window.
+func (m *maintenance) Begin(d time.Duration) time.Time {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+
+	m.until = time.Now().Add(d)
+	m.timer = time.AfterFunc(d, func() {
+		log.Printf("maintenance window over; accepting containers again")
+		m.End()
+	})
+
+	log.Printf("maintenance window open until %s", m.until.Format(time.RFC3339))
+
+	return m.until
+}
+
+// End closes the maintenance window, if open.
+func (m *maintenance) End() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+
+	m.until = time.Time{}
+}
+
+// Until returns the end of the open maintenance window, and whether one is
+// open.
+func (m *maintenance) Until() (time.Time, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.until, time.Now().Before(m.until)
+}
@@ -0,0 +1,65 @@
+package main
+
+// Each container keeps its last metrics samples, one per heartbeat of its
+// supervisor, and serves them on GET /containers/:id/metrics, optionally
+// limited to the last ?window=10m, so dashboards can draw sparklines of a
+// container's memory and CPU usage without a metrics pipeline. Samples are
+// kept in memory, up to -container.metrics per container, and are lost when
+// the container is destroyed or the agent restarts.
+
+import (
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// metricsHistory is a ring of the last metrics samples of a container. It's
+// owned by the container loop.
+type metricsHistory struct {
+	samples []agent.ContainerMetricsSample
+	next    int // index of the oldest sample, once the ring is full
+	size    int
+}
+
+func newMetricsHistory(size int) *metricsHistory {
+	if size < 1 {
+		size = 1
+	}
+
+	return &metricsHistory{size: size}
+}
+
+func (h *metricsHistory) add(metrics agent.ContainerMetrics) {
+	sample := agent.ContainerMetricsSample{
+		Time:             time.Now(),
+		ContainerMetrics: metrics,
+	}
+
+	if len(h.samples) < h.size {
+		h.samples = append(h.samples, sample)
+		return
+	}
+
+	h.samples[h.next] = sample
+	h.next = (h.next + 1) % h.size
+}
+
+// list returns the samples, oldest first.
+func (h *metricsHistory) list() []agent.ContainerMetricsSample {
+	samples := make([]agent.ContainerMetricsSample, 0, len(h.samples))
+	samples = append(samples, h.samples[h.next:]...)
+	samples = append(samples, h.samples[:h.next]...)
+
+	return samples
+}
+
+// since returns the samples taken after t, oldest first.
+func since(samples []agent.ContainerMetricsSample, t time.Time) []agent.ContainerMetricsSample {
+	for i, sample := range samples {
+		if sample.Time.After(t) {
+			return samples[i:]
+		}
+	}
+
+	return []agent.ContainerMetricsSample{}
+}
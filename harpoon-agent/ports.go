@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+// Containers share the network of the host, so the ports their configs ask
+// for may be taken by other containers, or by processes outside of harpoon.
+// The agent rejects configs asking for ports which are taken, and checks
+// again right before starting a container, failing it if a port was taken in
+// the meantime. Ports of zero are allocated by the agent, and not checked.
+
+// portKey identifies a port of a protocol.
+type portKey struct {
+	protocol string
+	port     uint16
+}
+
+// configPorts returns the ports of the config, TCP ports and port ranges
+// alike, by name, as ranges. Ranges which are still to be allocated start at
+// zero.
+func configPorts(config agent.ContainerConfig) map[string]agent.PortRange {
+	ranges := map[string]agent.PortRange{}
+
+	for name, port := range config.Ports {
+		ranges[name] = agent.PortRange{Protocol: agent.PortProtocolTCP, Start: port}
+	}
+
+	for name, portRange := range config.PortRanges {
+		ranges[name] = portRange
+	}
+
+	return ranges
+}
+
+// takenPorts returns the ports of the containers, except the one with the
+// given ID, with the ID of the container which has them.
+func takenPorts(instances agent.ContainerInstances, except string) map[portKey]string {
+	taken := map[portKey]string{}
+
+	for _, instance := range instances {
+		if instance.ID == except {
+			continue
+		}
+
+		for _, portRange := range configPorts(instance.Config) {
+			if portRange.Start == 0 {
+				continue
+			}
+
+			for port := int(portRange.Start); port <= int(portRange.End()); port++ {
+				taken[portKey{portRange.Proto(), uint16(port)}] = instance.ID
+			}
+		}
+	}
+
+	return taken
+}
+
+// portConflicts returns agent.PortConflicts for the ports of the config which
+// are taken by other containers, or can't be bound, or nil if there are none.
+// Only the first conflicting port of each range is reported.
+func portConflicts(config agent.ContainerConfig, taken map[portKey]string) error {
+	var (
+		ranges    = configPorts(config)
+		names     = make([]string, 0, len(ranges))
+		conflicts = agent.PortConflicts{}
+	)
+
+	for name := range ranges {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		portRange := ranges[name]
+
+		if portRange.Start == 0 {
+			continue
+		}
+
+		if port, reason, ok := rangeConflict(portRange, taken); ok {
+			conflicts = append(conflicts, agent.PortConflict{Name: name, Protocol: portRange.Proto(), Port: port, Reason: reason})
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflicts
+	}
+
+	return nil
+}
+
+// rangeConflict returns the first port of the range which is taken or can't
+// be bound, and why.
+func rangeConflict(portRange agent.PortRange, taken map[portKey]string) (uint16, string, bool) {
+	for port := int(portRange.Start); port <= int(portRange.End()); port++ {
+		if id, ok := taken[portKey{portRange.Proto(), uint16(port)}]; ok {
+			return uint16(port), fmt.Sprintf("in use by container %s", id), true
+		}
+
+		if err := bindTest(portRange.Proto(), uint16(port)); err != nil {
+			return uint16(port), err.Error(), true
+		}
+	}
+
+	return 0, "", false
+}
+
+// bindTest returns an error unless the port may be bound.
+func bindTest(protocol string, port uint16) error {
+	addr := fmt.Sprintf(":%d", port)
+
+	if protocol == agent.PortProtocolUDP {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return ln.Close()
+}
+
+const (
+	// firstAllocatedPort is where the agent starts allocating ports.
+	firstAllocatedPort = 30000
+
+	// maxPortAllocations is how many ranges the agent tries, before giving
+	// up allocating one which can be bound.
+	maxPortAllocations = 100
+)
+
+var (
+	nextPortMtx sync.Mutex
+	nextPort    = firstAllocatedPort
+)
+
+// allocatePorts returns the start of a range of count contiguous ports of the
+// protocol, which can all be bound. Ports are handed out in order, and never
+// twice.
+func allocatePorts(protocol string, count int) (uint16, error) {
+	for i := 0; i < maxPortAllocations; i++ {
+		nextPortMtx.Lock()
+		start := nextPort
+		nextPort += count
+		nextPortMtx.Unlock()
+
+		if start+count-1 > 65535 {
+			return 0, fmt.Errorf("no ports left to allocate")
+		}
+
+		portRange := agent.PortRange{Protocol: protocol, Start: uint16(start), Count: count}
+
+		if _, _, conflict := rangeConflict(portRange, nil); !conflict {
+			return portRange.Start, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free range of %d %s port(s) after %d attempts", count, protocol, maxPortAllocations)
+}
+
+// portConflictResponse is the body of the response rejecting a config with
+// conflicting ports. It has the fields of the scheduler's error responses,
+// so clients read it like those.
+type portConflictResponse struct {
+	errors.Error
+	PortConflicts agent.PortConflicts `json:"port_conflicts"`
+}
+
+func writePortConflicts(w http.ResponseWriter, conflicts agent.PortConflicts) {
+	errors.Write(w, http.StatusConflict, portConflictResponse{
+		Error:         *errors.New(http.StatusConflict, errors.PortConflict, fmt.Sprintf("port conflict: %s", conflicts)),
+		PortConflicts: conflicts,
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The agent needs root, or at least the capabilities below, to create
+// containers: harpoon-container, which it starts as a child, enters
+// namespaces, mounts the rootfs, creates device nodes, and switches to the
+// container's user. On startup, the agent checks that it has those, and the
+// directories it writes to, and reports what's missing.
+//
+// With -caps.drop, every child of the agent drops all other capabilities from
+// its bounding set before it execs, so that neither harpoon-container nor the
+// helpers nor the containers can ever regain them. The bounding set belongs
+// to a thread, not a process, so the agent can't drop them for itself and
+// have its children inherit that: a child forked by any other thread would
+// keep them all. Instead, children are started through the agent binary with
+// the execDroppedCommand argument, which drops them on the thread it then
+// execs the child from.
+
+// capability is a Linux capability, see capabilities(7).
+type capability struct {
+	name  string
+	value uint
+}
+
+// agentCapabilities are the capabilities the agent keeps.
+var agentCapabilities = []capability{
+	{"CAP_CHOWN", 0},
+	{"CAP_DAC_OVERRIDE", 1},
+	{"CAP_DAC_READ_SEARCH", 2},
+	{"CAP_FOWNER", 3},
+	{"CAP_FSETID", 4},
+	{"CAP_KILL", 5},
+	{"CAP_SETGID", 6},
+	{"CAP_SETUID", 7},
+	{"CAP_SETPCAP", 8},
+	{"CAP_NET_BIND_SERVICE", 10},
+	{"CAP_NET_ADMIN", 12}, // iptables, for egress policies
+	{"CAP_NET_RAW", 13},
+	{"CAP_SYS_CHROOT", 18},
+	{"CAP_SYS_PTRACE", 19}, // nsenter, to exec in containers of other users
+	{"CAP_SYS_ADMIN", 21},
+	{"CAP_SYS_RESOURCE", 24},
+	{"CAP_MKNOD", 27},
+}
+
+// agentDirectories are the directories the agent must be able to write to.
+var agentDirectories = []string{
+	"/run/harpoon",
+	"/srv/harpoon/log",
+	"/srv/harpoon/artifacts",
+}
+
+const prCapBSetDrop = 24 // PR_CAPBSET_DROP, see prctl(2)
+
+// execDroppedCommand is the first argument of an agent run to drop
+// capabilities and exec another command.
+const execDroppedCommand = "exec-dropped"
+
+// checkPrivileges returns the privileges the agent is missing, if any.
+func checkPrivileges() []string {
+	var missing []string
+
+	effective, err := effectiveCapabilities()
+	if err != nil {
+		missing = append(missing, fmt.Sprintf("unable to read capabilities: %s", err))
+	}
+
+	for _, c := range agentCapabilities {
+		if err == nil && effective&(1<<c.value) == 0 {
+			missing = append(missing, c.name)
+		}
+	}
+
+	for _, dir := range agentDirectories {
+		if err := checkWritable(dir); err != nil {
+			missing = append(missing, fmt.Sprintf("write access to %s (%s)", dir, err))
+		}
+	}
+
+	return missing
+}
+
+// effectiveCapabilities returns the effective capability set of the agent,
+// as a bit mask.
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		if line := s.Text(); strings.HasPrefix(line, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".harpoon-agent-check")
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// dropInChild has the command drop all but the agent's capabilities from its
+// bounding set before it execs, if -caps.drop is set.
+func dropInChild(cmd *exec.Cmd) {
+	if !*capsDrop {
+		return
+	}
+
+	cmd.Args = append([]string{"/proc/self/exe", execDroppedCommand, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/proc/self/exe"
+}
+
+// execDroppedMain runs in the child; it drops the capabilities and execs the
+// command in args, and only returns the exit code if that fails.
+func execDroppedMain(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s PATH [ARG...]\n", execDroppedCommand)
+		return 2
+	}
+
+	// drop and exec on the same thread
+	runtime.LockOSThread()
+
+	if err := dropCapabilities(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := syscall.Exec(args[0], args, os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "exec %s: %s\n", args[0], err)
+		return 1
+	}
+
+	return 0
+}
+
+// dropCapabilities removes all but the agent's capabilities from the
+// bounding set of the calling thread.
+func dropCapabilities() error {
+	last, err := lastCapability()
+	if err != nil {
+		return err
+	}
+
+	keep := map[uint]bool{}
+
+	for _, c := range agentCapabilities {
+		keep[c.value] = true
+	}
+
+	for value := uint(0); value <= last; value++ {
+		if keep[value] {
+			continue
+		}
+
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBSetDrop, uintptr(value), 0); errno != 0 {
+			return fmt.Errorf("drop capability %d: %s", value, errno)
+		}
+	}
+
+	return nil
+}
+
+// lastCapability returns the highest capability the kernel knows.
+func lastCapability() (uint, error) {
+	buf, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 0, err
+	}
+
+	last, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(last), nil
+}
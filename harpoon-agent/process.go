@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// cgroupParent is the cgroup below which each container gets one of its own,
+// named after its ID.
+const cgroupParent = "harpoon"
+
+// verifyProcess returns the process info to keep for a container, given what
+// was verified so far and what a heartbeat reported. Heartbeats aren't
+// authenticated, so reported pids are only taken when the host vouches for
+// them: the container process must be in the container's cgroup, and a child
+// of the supervisor. A supervisor only becomes known this way if the agent
+// didn't start it itself. A verified supervisor is never replaced, nor is a
+// verified container process while it's still alive.
+func verifyProcess(id string, known, reported agent.ProcessInfo) agent.ProcessInfo {
+	verified := known
+
+	if known.ContainerPID > 0 && containerProcess(id, known.SupervisorPID, known.ContainerPID) {
+		return verified
+	}
+
+	verified.ContainerPID = 0
+
+	supervisor := known.SupervisorPID
+	if supervisor <= 0 {
+		supervisor = reported.SupervisorPID
+	}
+
+	if supervisor <= 1 || reported.SupervisorPID != supervisor {
+		return verified
+	}
+
+	if !containerProcess(id, supervisor, reported.ContainerPID) {
+		return verified
+	}
+
+	verified.SupervisorPID = supervisor
+	verified.ContainerPID = reported.ContainerPID
+	verified.CgroupPath = path.Join(cgroupParent, id)
+
+	return verified
+}
+
+// containerProcess reports whether pid is a process in the cgroup of the
+// container, started by its supervisor.
+func containerProcess(id string, supervisor, pid int) bool {
+	if pid <= 1 || supervisor <= 1 {
+		return false
+	}
+
+	return inCgroup(pid, path.Join(cgroupParent, id)) && parentPID(pid) == supervisor
+}
+
+// inCgroup reports whether the process with the given pid is in the cgroup,
+// relative to the hierarchy mounts, in any of the hierarchies.
+func inCgroup(pid int, cgroup string) bool {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/cgroup")
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		// hierarchy-ID:subsystems:path
+		parts := strings.SplitN(s.Text(), ":", 3)
+
+		if len(parts) == 3 && strings.HasSuffix(parts[2], "/"+cgroup) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parentPID returns the pid of the parent of a process, or 0 if it can't be
+// read.
+func parentPID(pid int) int {
+	buf, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+
+	// pid (comm) state ppid ...; comm may contain spaces and parentheses
+	stat := string(buf)
+
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 2 {
+		return 0
+	}
+
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0
+	}
+
+	return ppid
+}
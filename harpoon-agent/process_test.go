@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestParentPID(t *testing.T) {
+	if expected, got := os.Getppid(), parentPID(os.Getpid()); expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+}
+
+func TestVerifyProcess(t *testing.T) {
+	var (
+		self   = os.Getpid()
+		parent = os.Getppid()
+	)
+
+	for _, testCase := range []struct {
+		name            string
+		known, reported agent.ProcessInfo
+		expected        agent.ProcessInfo
+	}{
+		{"init", agent.ProcessInfo{}, agent.ProcessInfo{SupervisorPID: 1, ContainerPID: 1}, agent.ProcessInfo{}},
+		{"outside of the cgroup", agent.ProcessInfo{}, agent.ProcessInfo{SupervisorPID: parent, ContainerPID: self}, agent.ProcessInfo{}},
+		{"other supervisor", agent.ProcessInfo{SupervisorPID: 42}, agent.ProcessInfo{SupervisorPID: parent, ContainerPID: self}, agent.ProcessInfo{SupervisorPID: 42}},
+		{"exited container", agent.ProcessInfo{SupervisorPID: parent, ContainerPID: self}, agent.ProcessInfo{SupervisorPID: parent}, agent.ProcessInfo{SupervisorPID: parent}},
+	} {
+		if expected, got := testCase.expected, verifyProcess("test", testCase.known, testCase.reported); expected != got {
+			t.Errorf("%s: expected %+v, got %+v", testCase.name, expected, got)
+		}
+	}
+}
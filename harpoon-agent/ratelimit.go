@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isHeartbeat returns true for the heartbeats of container supervisors, which
+// are never rate limited: a limited supervisor would lose track of what the
+// agent wants.
+func isHeartbeat(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+
+	parts := strings.Split(r.URL.Path, "/") // "", "containers", id, "heartbeat"
+
+	return len(parts) == 4 && parts[0] == "" && parts[1] == "containers" && parts[2] != "" && parts[3] == "heartbeat"
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/soundcloud/harpoon/lib/errors"
+	"github.com/soundcloud/harpoon/lib/middleware"
+)
+
+func TestRateLimitHeartbeats(t *testing.T) {
+	h := middleware.RateLimit(middleware.NewRateLimiter(1, 1), isHeartbeat, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, testCase := range []struct {
+		method, path string
+		expected     int
+	}{
+		{"POST", "/containers/web-0/stop", http.StatusOK},
+		{"POST", "/containers/web-0/heartbeat", http.StatusOK},
+		{"POST", "/containers/web-1/heartbeat", http.StatusOK},
+		{"POST", "/containers/web-0/stop", errors.StatusTooManyRequests},
+		{"PUT", "/containers/web-0/heartbeat", errors.StatusTooManyRequests},
+		{"POST", "/maintenance/heartbeat", errors.StatusTooManyRequests},
+		{"POST", "/containers//heartbeat", errors.StatusTooManyRequests},
+		{"POST", "/containers/web-0/exec/heartbeat", errors.StatusTooManyRequests},
+		{"GET", "/containers/web-0", http.StatusOK},
+	} {
+		r, _ := http.NewRequest(testCase.method, testCase.path, nil)
+		r.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if expected, got := testCase.expected, w.Code; expected != got {
+			t.Errorf("%d: %s %s: expected %d, got %d", i, testCase.method, testCase.path, expected, got)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
@@ -9,18 +12,26 @@ import (
 type registry struct {
 	m           map[string]*container
 	statec      chan agent.ContainerInstance
+	pingc       chan chan struct{}
 	subscribers map[chan<- agent.ContainerInstance]struct{}
+	logs        *logSet
 
 	acceptUpdates bool
 
+	recovering sync.Mutex // serializes Recover
+
 	sync.RWMutex
 }
 
-func newRegistry() *registry {
+// newRegistry returns a registry which keeps the logs of its containers in
+// the log set.
+func newRegistry(logs *logSet) *registry {
 	r := &registry{
 		m:           map[string]*container{},
 		statec:      make(chan agent.ContainerInstance),
+		pingc:       make(chan chan struct{}),
 		subscribers: map[chan<- agent.ContainerInstance]struct{}{},
+		logs:        logs,
 	}
 
 	go r.loop()
@@ -33,6 +44,7 @@ func (r *registry) Remove(id string) {
 	defer r.Unlock()
 
 	delete(r.m, id)
+	r.logs.remove(id)
 }
 
 func (r *registry) Get(id string) (*container, bool) {
@@ -52,6 +64,7 @@ func (r *registry) Register(c *container) bool {
 	}
 
 	r.m[c.ID] = c
+	r.logs.create(c.ID)
 
 	go func(c *container, outc chan agent.ContainerInstance) {
 		var (
@@ -74,6 +87,27 @@ func (r *registry) Register(c *container) bool {
 	return true
 }
 
+// Recover registers the container recovered from the run directory, unless
+// it's registered already, and returns it. recovered is false if it was
+// registered already. checkedIn is passed on to recoverContainer.
+func (r *registry) Recover(rundir string, checkedIn *agent.ProcessInfo) (c *container, recovered bool, err error) {
+	r.recovering.Lock()
+	defer r.recovering.Unlock()
+
+	if c, ok := r.Get(filepath.Base(rundir)); ok {
+		return c, false, nil
+	}
+
+	c, err = recoverContainer(rundir, checkedIn)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.Register(c)
+
+	return c, true, nil
+}
+
 func (r *registry) Len() int {
 	r.RLock()
 	defer r.RUnlock()
@@ -91,6 +125,9 @@ func (r *registry) Instances() agent.ContainerInstances {
 		list = append(list, container.Instance())
 	}
 
+	// sort by ID, so clients can paginate
+	sort.Sort(instancesByID(list))
+
 	return list
 }
 
@@ -115,14 +152,44 @@ func (r *registry) Stop(c chan<- agent.ContainerInstance) {
 	delete(r.subscribers, c)
 }
 
+// ping returns true if the registry loop answers within the timeout.
+func (r *registry) ping(timeout time.Duration) bool {
+	c := make(chan struct{}, 1)
+
+	select {
+	case r.pingc <- c:
+	case <-time.After(timeout):
+		return false
+	}
+
+	select {
+	case <-c:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (r *registry) loop() {
-	for state := range r.statec {
-		r.RLock()
+	for {
+		select {
+		case state := <-r.statec:
+			r.RLock()
 
-		for subc := range r.subscribers {
-			subc <- state
-		}
+			for subc := range r.subscribers {
+				subc <- state
+			}
+
+			r.RUnlock()
 
-		r.RUnlock()
+		case c := <-r.pingc:
+			c <- struct{}{}
+		}
 	}
 }
+
+type instancesByID agent.ContainerInstances
+
+func (a instancesByID) Len() int           { return len(a) }
+func (a instancesByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a instancesByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
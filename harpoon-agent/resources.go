@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"strings"
 )
 
 func systemCPUs() int64 {
@@ -24,3 +26,28 @@ func systemMemoryMB() (int64, error) {
 
 	return kb / 1024, nil
 }
+
+func kernelVersion() (string, error) {
+	buf, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// kernelNamespaces returns the namespaces supported by the kernel, as listed
+// in /proc/self/ns.
+func kernelNamespaces() ([]string, error) {
+	infos, err := ioutil.ReadDir("/proc/self/ns")
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := make([]string, 0, len(infos))
+	for _, info := range infos {
+		namespaces = append(namespaces, info.Name())
+	}
+
+	return namespaces, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+// Containers may ask for a security profile: a seccomp profile filtering
+// their syscalls, and host devices they may access in addition to
+// devices.DefaultAllowedDevices. The agent permits the seccomp profiles given
+// by -seccomp.profiles, and the devices given by -device or in the host
+// config file.
+//
+// The vendored libcontainer knows nothing about seccomp, so the profile is
+// passed to harpoon-container in the context of the libcontainer config, and
+// harpoon-container installs the filter itself, before it sets up the
+// container.
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/libcontainer/devices"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// seccompContextKey is the key of the seccomp profile in the context of the
+// libcontainer config. harpoon-container reads it.
+const seccompContextKey = "seccomp"
+
+// securityProblems returns the parts of the security profile the agent
+// doesn't permit.
+func securityProblems(security *agent.Security) []string {
+	if security == nil {
+		return nil
+	}
+
+	var problems []string
+
+	if profile := security.SeccompProfile(); !seccompPermitted(profile) {
+		problems = append(problems, fmt.Sprintf("seccomp profile %q not permitted on this agent", profile))
+	}
+
+	for _, device := range security.Devices {
+		if !host.hasDevice(device) {
+			problems = append(problems, fmt.Sprintf("device %s not available on this host", device))
+		}
+	}
+
+	return problems
+}
+
+func seccompPermitted(profile string) bool {
+	for _, permitted := range strings.Split(*seccompProfiles, ",") {
+		if strings.TrimSpace(permitted) == profile {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containerDevices returns the devices the container may access: the
+// default ones, and those of its security profile the host still permits,
+// skipping others as buildContainerConfig skips volumes.
+func containerDevices(security *agent.Security) []*devices.Device {
+	allowed := make([]*devices.Device, len(devices.DefaultAllowedDevices))
+	copy(allowed, devices.DefaultAllowedDevices)
+
+	if security == nil {
+		return allowed
+	}
+
+	for _, path := range security.Devices {
+		if !host.hasDevice(path) {
+			log.Printf("device %s not configured", path)
+			continue
+		}
+
+		device, err := devices.GetDevice(path, "rwm")
+		if err != nil {
+			log.Printf("device %s: %s", path, err)
+			continue
+		}
+
+		allowed = append(allowed, device)
+	}
+
+	return allowed
+}
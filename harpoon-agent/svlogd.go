@@ -22,16 +22,6 @@ n50
 t1800
 # ignore runner log lines
 -harpoon-container: *
-`
-
-	// send container logs over UDP
-	udpLogConfig = `
-# forward to UDP
-U%s
-# prefix with container id
-pcontainer[%s]:
-# ignore runner log lines
--harpoon-container: *
 `
 
 	// persist runner log lines to disk
@@ -50,8 +40,7 @@ t1800
 `
 )
 
-func startLogger(name, logdir string) (io.WriteCloser, error) {
-	os.Mkdir(path.Join(logdir, "udp"), os.ModePerm)
+func startLogger(logdir string) (io.WriteCloser, error) {
 	os.Mkdir(path.Join(logdir, "runner"), os.ModePerm)
 
 	{
@@ -65,17 +54,6 @@ func startLogger(name, logdir string) (io.WriteCloser, error) {
 		}
 	}
 
-	{
-		config, err := os.Create(path.Join(logdir, "udp", "config"))
-		if err != nil {
-			return nil, err
-		}
-
-		if _, err := fmt.Fprintf(config, udpLogConfig, "0.0.0.0:3334", name); err != nil {
-			return nil, err
-		}
-	}
-
 	{
 		config, err := os.Create(path.Join(logdir, "runner", "config"))
 		if err != nil {
@@ -97,13 +75,12 @@ func startLogger(name, logdir string) (io.WriteCloser, error) {
 		"-l", "50000", // max line length
 		"-b", "50001", // buffer size for reading/writing
 		path.Join(logdir),
-		path.Join(logdir, "udp"),
 		path.Join(logdir, "runner"),
 	)
 	logger.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 	logger.Stdin = pr
 
-	if err := logger.Start(); err != nil {
+	if err := startHelper(logger); err != nil {
 		pw.Close()
 		return nil, err
 	}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The agent integrates with systemd, when systemd starts it: it accepts API
+// connections on a socket passed by socket activation (see sd_listen_fds(3)),
+// reports readiness once it recovered its containers, and pings the watchdog
+// while its registry loop is responsive (see sd_notify(3)). Without systemd,
+// it listens on -addr, and none of this happens.
+
+const (
+	// sdListenFDsStart is the first file descriptor passed by systemd.
+	sdListenFDsStart = 3
+
+	// registryPingTimeout is how long the registry loop may take to answer a
+	// ping, before the agent stops pinging the watchdog.
+	registryPingTimeout = 5 * time.Second
+)
+
+// listen returns the socket passed by systemd, if any, or else listens on
+// addr. Containers are still told to send heartbeats to -addr, so it should
+// name the address of the socket.
+func listen(addr string) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return net.Listen("tcp", addr)
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return net.Listen("tcp", addr)
+	}
+
+	// don't pass the sockets on to our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	if n > 1 {
+		log.Printf("systemd passed %d sockets; using the first", n)
+	}
+
+	f := os.NewFile(sdListenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %s", err)
+	}
+
+	log.Printf("listening on %s, passed by systemd", ln.Addr())
+
+	return ln, nil
+}
+
+// sdNotify sends the state, e.g. "READY=1", to systemd. It does nothing
+// unless systemd asked for notifications.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects watchdog pings, or zero
+// if it doesn't.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings the systemd watchdog twice per interval, as long as the
+// registry loop answers pings. If it hangs, e.g. on a stuck subscriber, the
+// pings stop, and systemd restarts the agent.
+func watchdog(r *registry, interval time.Duration) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for _ = range ticker.C {
+		if !r.ping(registryPingTimeout) {
+			log.Printf("registry loop unresponsive; not pinging the watchdog")
+			continue
+		}
+
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("watchdog: %s", err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+// The agent may post container transitions to a webhook, so external
+// systems like inventories or alerting can follow container lifecycles
+// without holding an event stream open. Every change of a container's
+// status is posted as an agent.ContainerTransition, in order. Posts carry a
+// sequence number and, with a secret, an HMAC signature of their body.
+// Failed posts are retried with exponential backoff; once the retries are
+// used up, or while the queue is full, transitions are dropped and logged.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+const (
+	webhookQueueSize      = 1024
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = time.Minute
+)
+
+type webhook struct {
+	url     string
+	secret  []byte
+	retries int
+	client  *http.Client
+
+	queue chan agent.ContainerTransition
+	seq   uint64
+}
+
+// newWebhook returns a webhook posting to the URL. The secret, if any, is
+// read from secretPath.
+func newWebhook(url, secretPath string, retries int, timeout time.Duration) (*webhook, error) {
+	var secret []byte
+
+	if secretPath != "" {
+		buf, err := ioutil.ReadFile(secretPath)
+		if err != nil {
+			return nil, err
+		}
+
+		secret = bytes.TrimSpace(buf)
+	}
+
+	return &webhook{
+		url:     url,
+		secret:  secret,
+		retries: retries,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan agent.ContainerTransition, webhookQueueSize),
+	}, nil
+}
+
+// start posts transitions of the registry's containers. Containers already
+// known to the registry aren't posted until they change.
+func (wh *webhook) start(r *registry) {
+	statuses := map[string]agent.ContainerStatus{}
+
+	for _, instance := range r.Instances() {
+		statuses[instance.ID] = instance.Status
+	}
+
+	statec := make(chan agent.ContainerInstance)
+	r.Notify(statec)
+
+	go wh.watch(statec, statuses)
+	go wh.deliver()
+}
+
+func (wh *webhook) watch(statec <-chan agent.ContainerInstance, statuses map[string]agent.ContainerStatus) {
+	for instance := range statec {
+		from, ok := statuses[instance.ID]
+		if ok && from == instance.Status {
+			continue
+		}
+
+		if instance.Status == agent.ContainerStatusDeleted {
+			delete(statuses, instance.ID)
+		} else {
+			statuses[instance.ID] = instance.Status
+		}
+
+		transition := agent.ContainerTransition{
+			Agent:    hostname,
+			ID:       instance.ID,
+			From:     from,
+			To:       instance.Status,
+			Time:     time.Now(),
+			Instance: instance,
+		}
+
+		select {
+		case wh.queue <- transition:
+		default:
+			log.Printf("webhook: queue full; dropping %s transition of %s", transition.To, transition.ID)
+		}
+	}
+}
+
+func (wh *webhook) deliver() {
+	for transition := range wh.queue {
+		wh.seq++
+
+		body, err := json.Marshal(transition)
+		if err != nil {
+			log.Printf("webhook: %s", err)
+			continue
+		}
+
+		backoff := webhookInitialBackoff
+
+		for attempt := 0; ; attempt++ {
+			err := wh.post(body)
+			if err == nil {
+				break
+			}
+
+			if attempt >= wh.retries {
+				log.Printf("webhook: dropping %s transition of %s after %d attempts: %s", transition.To, transition.ID, attempt+1, err)
+				break
+			}
+
+			log.Printf("webhook: %s transition of %s: %s; retrying in %s", transition.To, transition.ID, err, backoff)
+
+			time.Sleep(backoff)
+
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		}
+	}
+}
+
+func (wh *webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(agent.WebhookDeliveryHeader, strconv.FormatUint(wh.seq, 10))
+
+	if len(wh.secret) > 0 {
+		req.Header.Set(agent.WebhookSignatureHeader, agent.WebhookSignature(body, wh.secret))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("HTTP %s (%s)", resp.Status, strings.TrimSpace(string(buf)))
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// collector periodically removes the artifacts no container on the agents
+// uses. Artifacts stored within the grace period are kept, so they may be
+// uploaded ahead of their deploy. A round is skipped if any agent can't be
+// asked, as its containers may use any artifact.
+type collector struct {
+	store  *store
+	agents []string // endpoints
+	grace  time.Duration
+}
+
+func (c *collector) loop(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if err := c.collect(); err != nil {
+			log.Printf("garbage collection skipped: %s", err)
+		}
+	}
+}
+
+func (c *collector) collect() error {
+	// anything stored after this may be in use by a container started since
+	// the agents were asked
+	started := time.Now()
+
+	referenced, err := c.referenced()
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := c.store.list()
+	if err != nil {
+		return err
+	}
+
+	for _, artifact := range artifacts {
+		if referenced[artifact.SHA256] || started.Sub(artifact.Modified) < c.grace {
+			continue
+		}
+
+		if err := c.store.remove(artifact.SHA256, started.Add(-c.grace)); err != nil {
+			log.Printf("garbage collection: %s", err)
+			continue
+		}
+
+		log.Printf("garbage collection: removed %s (%d bytes)", artifact.SHA256, artifact.Size)
+	}
+
+	return nil
+}
+
+// referenced returns the digests of the artifacts used by containers on the
+// agents.
+func (c *collector) referenced() (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	for _, endpoint := range c.agents {
+		instances, err := agentContainers(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("agent %s: %s", endpoint, err)
+		}
+
+		for _, instance := range instances {
+			u, err := url.Parse(instance.Config.ArtifactURL)
+			if err != nil {
+				continue
+			}
+
+			if digest, err := parseName(path.Base(u.Path)); err == nil {
+				referenced[digest] = true
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// agentContainers returns the containers on the agent.
+func agentContainers(endpoint string) ([]agent.ContainerInstance, error) {
+	resp, err := http.Get(strings.TrimRight(endpoint, "/") + "/api/" + agent.APIVersion + "/containers")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	var body struct {
+		Self []agent.ContainerInstance `json:"self"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	return body.Self, nil
+}
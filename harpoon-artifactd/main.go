@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func main() {
+	var (
+		listen     = flag.String("listen", ":3335", "HTTP listen address")
+		dir        = flag.String("dir", "/srv/harpoon-artifactd", "directory artifacts are stored in")
+		publicURL  = flag.String("url", "", "base URL agents fetch artifacts from (default from the Host of each upload)")
+		peers      = flag.String("peers", "", "comma-separated base URLs of other harpoon-artifactd to replicate uploads to, and fetch missing artifacts from")
+		agents     = flag.String("agents", "", "comma-separated agent endpoints whose containers' artifacts are kept by garbage collection")
+		gcInterval = flag.Duration("gc.interval", 0, "how often to remove artifacts no container uses (0 to disable)")
+		gcGrace    = flag.Duration("gc.grace", 24*time.Hour, "how long artifacts are kept after their last upload, even if unused")
+	)
+	flag.Parse()
+
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.Lmicroseconds)
+
+	store, err := newStore(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *gcInterval > 0 {
+		if *agents == "" {
+			log.Fatal("-gc.interval requires -agents, or every artifact would be collected")
+		}
+
+		c := &collector{
+			store:  store,
+			agents: splitList(*agents),
+			grace:  *gcGrace,
+		}
+
+		go c.loop(*gcInterval)
+	}
+
+	api := &api{
+		store:      store,
+		replicator: &replicator{store: store, peers: splitList(*peers)},
+		publicURL:  *publicURL,
+	}
+
+	r := httprouter.New()
+	r.POST("/artifacts", api.handleUpload)
+	r.GET("/artifacts", api.handleList)
+	r.PUT("/artifacts/:file", api.handleUpload)
+	r.GET("/artifacts/:file", api.handleDownload)
+	r.HEAD("/artifacts/:file", api.handleDownload)
+	r.GET("/healthz", func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	log.Printf("listening on %s, storing artifacts in %s", *listen, *dir)
+	log.Fatal(http.ListenAndServe(*listen, r))
+}
+
+type api struct {
+	store      *store
+	replicator *replicator
+	publicURL  string
+}
+
+// handleUpload stores the artifact in the body. POSTed artifacts are named
+// after storing them; PUT artifacts must match the digest in their name, so
+// uploads can be retried, and replicated, without duplicates.
+func (a *api) handleUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var want string
+
+	if file := p.ByName("file"); file != "" {
+		digest, err := parseName(file)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		want = digest
+	}
+
+	digest, err := a.store.put(r.Body, want)
+	switch {
+	case err == errDigestMismatch:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if r.Header.Get(replicaHeader) == "" {
+		a.replicator.push(digest)
+	}
+
+	base := a.publicURL
+	if base == "" {
+		base = "http://" + r.Host
+	}
+	url := artifactURL(base, digest)
+
+	log.Printf("stored %s", digest)
+
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploadResponse{SHA256: digest, URL: url})
+}
+
+// handleDownload serves the artifact, fetching it from the peers first if it
+// isn't here. The ETag is the digest, as the contents never change.
+func (a *api) handleDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	digest, err := parseName(p.ByName("file"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if !a.store.has(digest) && r.Header.Get(replicaHeader) == "" {
+		a.replicator.fetch(digest)
+	}
+
+	f, err := a.store.open(digest)
+	switch {
+	case os.IsNotExist(err):
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", digest))
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-gzip")
+	w.Header().Set("ETag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+func (a *api) handleList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	artifacts, err := a.store.list()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{
+		StatusCode: code,
+		StatusText: http.StatusText(code),
+		Error:      err.Error(),
+	})
+}
+
+// splitList splits a comma-separated flag value, ignoring empty elements.
+func splitList(s string) []string {
+	var list []string
+
+	for _, elem := range strings.Split(s, ",") {
+		if elem = strings.TrimSpace(elem); elem != "" {
+			list = append(list, elem)
+		}
+	}
+
+	return list
+}
+
+type uploadResponse struct {
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+type errorResponse struct {
+	StatusCode int    `json:"status_code"`
+	StatusText string `json:"status_text"`
+	Error      string `json:"error"`
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// replicaHeader marks requests between peers, so replicas aren't pushed on,
+// and misses aren't fetched from further peers.
+const replicaHeader = "X-Harpoon-Replica"
+
+// replicator pushes new artifacts to the peers, and fetches artifacts missing
+// here from them.
+type replicator struct {
+	store *store
+	peers []string // base URLs
+}
+
+// push copies the artifact to every peer which doesn't have it, in the
+// background. Failures are logged; the peer will fetch the artifact when it's
+// asked for it.
+func (r *replicator) push(digest string) {
+	for _, peer := range r.peers {
+		go func(peer string) {
+			if err := r.pushTo(peer, digest); err != nil {
+				log.Printf("replicate %s to %s: %s", digest, peer, err)
+			}
+		}(peer)
+	}
+}
+
+func (r *replicator) pushTo(peer, digest string) error {
+	url := artifactURL(peer, digest)
+
+	if resp, err := http.Head(url); err == nil {
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+
+	f, err := r.store.open(digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", url, f)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = fi.Size()
+	req.Header.Set(replicaHeader, "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	return nil
+}
+
+// fetch copies the artifact from the first peer which has it, and returns
+// true if one did.
+func (r *replicator) fetch(digest string) bool {
+	for _, peer := range r.peers {
+		if err := r.fetchFrom(peer, digest); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("fetch %s from %s: %s", digest, peer, err)
+			}
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func (r *replicator) fetchFrom(peer, digest string) error {
+	req, err := http.NewRequest("GET", artifactURL(peer, digest), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(replicaHeader, "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	default:
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	_, err = r.store.put(resp.Body, digest)
+	return err
+}
+
+// artifactURL returns the URL of the artifact on the server with the base URL.
+func artifactURL(base, digest string) string {
+	return strings.TrimRight(base, "/") + "/artifacts/" + digest + artifactSuffix
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifactSuffix ends the names of all artifacts; agents only fetch
+// .tar.gz artifacts.
+const artifactSuffix = ".tar.gz"
+
+var (
+	errInvalidName    = errors.New("artifacts are named by the hex sha256 of their contents, followed by .tar.gz")
+	errDigestMismatch = errors.New("contents don't match the sha256 in the name")
+
+	digestRE = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// store keeps artifacts in a directory, as files named by the sha256 of
+// their contents. Artifacts are written to a temporary file first, and
+// renamed once complete, so readers never see partial artifacts.
+type store struct {
+	dir string
+
+	sync.Mutex // serializes removal against writes of the same artifact
+}
+
+// artifactInfo describes a stored artifact.
+type artifactInfo struct {
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+func newStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &store{dir: dir}, nil
+}
+
+// parseName returns the digest of the artifact with the given name.
+func parseName(name string) (string, error) {
+	digest := strings.TrimSuffix(name, artifactSuffix)
+
+	if !strings.HasSuffix(name, artifactSuffix) || !digestRE.MatchString(digest) {
+		return "", errInvalidName
+	}
+
+	return digest, nil
+}
+
+func (s *store) path(digest string) string {
+	return filepath.Join(s.dir, digest+artifactSuffix)
+}
+
+// put stores the contents of r, and returns their digest. If want isn't
+// empty, the contents must have that digest.
+func (s *store) put(r io.Reader, want string) (string, error) {
+	tmp, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	h := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if want != "" && digest != want {
+		return "", errDigestMismatch
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err := os.Rename(tmp.Name(), s.path(digest)); err != nil {
+		return "", err
+	}
+
+	// uploading an artifact again counts as using it, for the collector
+	now := time.Now()
+	os.Chtimes(s.path(digest), now, now)
+
+	return digest, nil
+}
+
+// open returns the artifact, or an error satisfying os.IsNotExist.
+func (s *store) open(digest string) (*os.File, error) {
+	return os.Open(s.path(digest))
+}
+
+func (s *store) has(digest string) bool {
+	_, err := os.Stat(s.path(digest))
+	return err == nil
+}
+
+// list returns the stored artifacts, sorted by digest.
+func (s *store) list() ([]artifactInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := []artifactInfo{}
+
+	for _, info := range infos {
+		digest, err := parseName(info.Name())
+		if err != nil {
+			continue // temporary files
+		}
+
+		artifacts = append(artifacts, artifactInfo{
+			SHA256:   digest,
+			Size:     info.Size(),
+			Modified: info.ModTime(),
+		})
+	}
+
+	sort.Sort(artifactsByDigest(artifacts))
+
+	return artifacts, nil
+}
+
+// remove deletes the artifact, unless it was stored again since the given
+// time.
+func (s *store) remove(digest string, notModifiedSince time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	info, err := os.Stat(s.path(digest))
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().After(notModifiedSince) {
+		return fmt.Errorf("%s was stored again", digest)
+	}
+
+	return os.Remove(s.path(digest))
+}
+
+type artifactsByDigest []artifactInfo
+
+func (a artifactsByDigest) Len() int           { return len(a) }
+func (a artifactsByDigest) Less(i, j int) bool { return a[i].SHA256 < a[j].SHA256 }
+func (a artifactsByDigest) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -2,6 +2,9 @@ package configstore
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -9,86 +12,346 @@ import (
 )
 
 // ConfigStore defines read and write behavior expected from a config store.
+// Get resolves the config for the environment, or returns the base config for
+// the empty environment.
 type ConfigStore interface {
-	Get(jobConfigRef string) (JobConfig, error)
+	Get(jobConfigRef, environment string) (JobConfig, error)
 	Put(JobConfig) (jobConfigRef string, err error)
 }
 
+// Lister is implemented by config stores which can list the current configs
+// of all jobs, e.g. for the scheduler's declarative mode.
+type Lister interface {
+	List(environment string) ([]StoredConfig, error)
+}
+
+// StoredConfig is a config, as listed by a store, with its ref.
+type StoredConfig struct {
+	Ref string `json:"ref"`
+	JobConfig
+}
+
+// JobConfigSchemaVersion is the version of the JobConfig schema spoken by
+// this package. Version 1 is the schema before versioning; configs without a
+// schema_version are version 1. Version 2 introduced requires, version 3
+// artifact_url and environments, and version 4 desired.
+const JobConfigSchemaVersion = 4
+
+// Desired states of jobs, which the scheduler's declarative mode converges
+// the jobs to. Jobs without a desired state are scheduled by hand.
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
 // JobConfig defines a config for a given job (collection of tasks).
 // JobConfig is declared by the user and stored in the config store, probably with version semantics.
 // Combining a JobConfig with certain types of runtime config (e.g. scale) can produce a job definition.
 // That runtime state is maintained (persisted, etc.) by the scheduler.
 type JobConfig struct {
-	JobName      string            `json:"job_name"`      // job.Name, to which this cfg applies
-	Env          map[string]string `json:"env"`           // exported first, to all tasks
-	HealthChecks []HealthCheck     `json:"health_checks"` // applied to all tasks
+	JobName      string            `json:"job_name"`            // job.Name, to which this cfg applies
+	Namespace    string            `json:"namespace,omitempty"` // team owning the job; empty for the default namespace
+	Env          map[string]string `json:"env"`                 // exported first, to all tasks
+	HealthChecks []HealthCheck     `json:"health_checks"`       // applied to all tasks
 	Tasks        []TaskConfig      `json:"tasks"`
+	Priority     int               `json:"priority,omitempty"` // higher priority jobs may preempt lower ones
+	Labels       agent.Labels      `json:"labels,omitempty"`   // applied to all tasks; task labels take precedence
+	Depends      Depends           `json:"depends,omitempty"`  // tasks which must run before others
+	Requires     Requires          `json:"requires,omitempty"` // jobs which must be scheduled and healthy first
+	Contact                        // who owns the job, and where to notify them
+	CanaryJudge  string            `json:"canary_judge,omitempty"` // http(s) webhook deciding whether migrations proceed
+	Clusters     []string          `json:"clusters,omitempty"`     // clusters to run the tasks in, each at full scale; empty for any agent
+	Concurrency  int               `json:"concurrency,omitempty"`  // container operations run at once when (un)scheduling; 0 for the scheduler's default
+	ArtifactURL  string            `json:"artifact_url,omitempty"` // artifact of all tasks, unless given when scheduling
+	Desired      string            `json:"desired,omitempty"`      // running or stopped, for declarative mode; empty to schedule by hand
+
+	Environments  map[string]Overlay `json:"environments,omitempty"`   // environment name: deltas, applied by Resolve
+	SchemaVersion int                `json:"schema_version,omitempty"` // see JobConfigSchemaVersion
 }
 
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (c JobConfig) Valid() error {
-	var errs []string
+	var errs agent.ValidationErrors
 	if c.JobName == "" {
-		errs = append(errs, "job name not set")
+		errs.Add("job_name", "not set")
+	}
+	if c.Namespace != "" && !ValidNamespace(c.Namespace) {
+		errs.Add("namespace", "%q must be lowercase letters, digits, and dashes", c.Namespace)
 	}
 	if len(c.Tasks) <= 0 {
-		errs = append(errs, "no tasks defined")
+		errs.Add("tasks", "no tasks defined")
+	}
+	errs.Nest("labels", c.Labels.Valid())
+	errs.Nest("", c.Contact.Valid())
+	if c.CanaryJudge != "" {
+		u, err := url.Parse(c.CanaryJudge)
+		switch {
+		case err != nil:
+			errs.Add("canary_judge", "%q invalid: %s", c.CanaryJudge, err)
+		case u.Scheme != "http" && u.Scheme != "https":
+			errs.Add("canary_judge", "%q must be an http or https URL", c.CanaryJudge)
+		case u.Host == "":
+			errs.Add("canary_judge", "%q has no host", c.CanaryJudge)
+		}
 	}
+	errs.Nest("clusters", ValidClusters(c.Clusters))
+	if c.Concurrency < 0 {
+		errs.Add("concurrency", "%d must not be negative", c.Concurrency)
+	}
+	taskNames := make([]string, len(c.Tasks))
 	for i, taskConfig := range c.Tasks {
-		if err := taskConfig.Valid(); err != nil {
-			errs = append(errs, fmt.Sprintf("task %d: %s", i, err))
+		errs.Nest(fmt.Sprintf("tasks[%d]", i), taskConfig.Valid())
+		taskNames[i] = taskConfig.TaskName
+	}
+	errs.Nest("depends", c.Depends.Valid(taskNames))
+	errs.Nest("requires", c.Requires.Valid(NamespacedJobName(c.Namespace, c.JobName)))
+	errs.Nest("artifact_url", validArtifactURL(c.ArtifactURL))
+	errs.Nest("desired", validDesired(c.Desired))
+	for _, environment := range sortedEnvironments(c.Environments) {
+		if environment == "" {
+			errs.Add("environments", "empty environment name")
 		}
+		errs.Nest(fmt.Sprintf("environments[%s]", environment), c.Environments[environment].Valid(taskNames))
+	}
+	return errs.Err()
+}
+
+// NamespaceLabel is the label carrying the namespace of a job on its
+// containers, so they can be filtered by namespace.
+const NamespaceLabel = "namespace"
+
+var namespaceRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// ValidNamespace reports whether the namespace name is valid. Namespaces
+// don't contain dots, so namespaced job names can be split unambiguously.
+func ValidNamespace(namespace string) bool {
+	return namespaceRE.MatchString(namespace)
+}
+
+// NamespacedJobName returns the name a job in the namespace is scheduled
+// under, and which its container IDs start with. Jobs in the default
+// namespace keep their name, so teams sharing a scheduler can reuse job names
+// without colliding.
+func NamespacedJobName(namespace, jobName string) string {
+	if namespace == "" {
+		return jobName
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	return namespace + "." + jobName
+}
+
+// ValidClusters checks that the cluster names are non-empty and distinct.
+func ValidClusters(clusters []string) error {
+	var (
+		errs agent.ValidationErrors
+		seen = map[string]bool{}
+	)
+	for i, cluster := range clusters {
+		switch {
+		case cluster == "":
+			errs.Add(fmt.Sprintf("[%d]", i), "empty cluster name")
+		case seen[cluster]:
+			errs.Add(fmt.Sprintf("[%d]", i), "duplicate cluster %q", cluster)
+		}
+		seen[cluster] = true
 	}
-	return nil
+	return errs.Err()
+}
+
+// Depends maps task names to the names of the tasks which must be running
+// before them, e.g. a local proxy the task talks through.
+type Depends map[string][]string
+
+// Valid performs a validation check against the task names of the job. Tasks
+// may only depend on tasks of the same job, and not, however indirectly, on
+// themselves.
+func (d Depends) Valid(taskNames []string) error {
+	var (
+		errs  agent.ValidationErrors
+		known = map[string]bool{}
+	)
+	for _, taskName := range taskNames {
+		known[taskName] = true
+	}
+	for _, taskName := range sortedKeys(d) {
+		if !known[taskName] {
+			errs.Add(taskName, "unknown task")
+		}
+		for _, dependency := range d[taskName] {
+			if !known[dependency] {
+				errs.Add(taskName, "depends on unknown task %q", dependency)
+			}
+		}
+	}
+	if _, err := d.Stages(taskNames); err != nil {
+		errs.Add("", "%s", err)
+	}
+	return errs.Err()
+}
+
+// Requires lists the names of other jobs, including their namespace, which
+// must be scheduled and healthy before a job is scheduled, e.g. the queue
+// consumer of an app.
+type Requires []string
+
+// Valid performs a validation check against the name of the requiring job.
+// Jobs may not require themselves.
+func (r Requires) Valid(jobName string) error {
+	var (
+		errs agent.ValidationErrors
+		seen = map[string]bool{}
+	)
+	for i, required := range r {
+		field := fmt.Sprintf("[%d]", i)
+		switch {
+		case required == "":
+			errs.Add(field, "empty job name")
+		case required == jobName:
+			errs.Add(field, "job may not require itself")
+		case seen[required]:
+			errs.Add(field, "duplicate job %q", required)
+		}
+		seen[required] = true
+	}
+	return errs.Err()
+}
+
+// Stages orders the tasks so that every task comes after the tasks it
+// depends on. The tasks of a stage don't depend on each other, and are sorted
+// by name. Dependencies on tasks which aren't given are ignored. Stages fails
+// if the dependencies form a cycle.
+func (d Depends) Stages(taskNames []string) ([][]string, error) {
+	var (
+		remaining = map[string]bool{}
+		stages    = [][]string{}
+	)
+	for _, taskName := range taskNames {
+		remaining[taskName] = true
+	}
+	for len(remaining) > 0 {
+		stage := []string{}
+		for taskName := range remaining {
+			ready := true
+			for _, dependency := range d[taskName] {
+				ready = ready && !remaining[dependency]
+			}
+			if ready {
+				stage = append(stage, taskName)
+			}
+		}
+		if len(stage) <= 0 {
+			cycle := make([]string, 0, len(remaining))
+			for taskName := range remaining {
+				cycle = append(cycle, taskName)
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("dependency cycle among tasks %s", strings.Join(cycle, ", "))
+		}
+		sort.Strings(stage)
+		for _, taskName := range stage {
+			delete(remaining, taskName)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+func sortedKeys(d Depends) []string {
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Contact says who owns a job, and where the scheduler sends notifications
+// about it, e.g. when it's scheduled or its containers keep failing.
+type Contact struct {
+	Owner  string `json:"owner,omitempty"`  // e.g. team name
+	Notify string `json:"notify,omitempty"` // http(s) webhook URL, or mailto: URL
+}
+
+// Valid performs a validation check, to ensure invalid structures may be
+// detected as early as possible.
+func (c Contact) Valid() error {
+	var errs agent.ValidationErrors
+	if c.Notify != "" {
+		u, err := url.Parse(c.Notify)
+		switch {
+		case err != nil:
+			errs.Add("notify", "%q invalid: %s", c.Notify, err)
+		case u.Scheme == "http", u.Scheme == "https":
+			if u.Host == "" {
+				errs.Add("notify", "%q has no host", c.Notify)
+			}
+		case u.Scheme == "mailto":
+			if u.Opaque == "" {
+				errs.Add("notify", "%q has no address", c.Notify)
+			}
+		default:
+			errs.Add("notify", "%q must be an http, https, or mailto URL", c.Notify)
+		}
+	}
+	return errs.Err()
 }
 
 // TaskConfig defines relatively static, configured dimensions of a task.
 // TaskConfig + jobName + artifact URL can fully define an agent.ContainerConfig.
 // TaskConfig + jobName + artifact URL + scale can fully define a scheduler.Job.
 type TaskConfig struct {
-	TaskName     string            `json:"task_name"`     // task.Name
-	Scale        int               `json:"scale"`         // task.Scale
-	HealthChecks []HealthCheck     `json:"health_checks"` // task.HealthChecks
-	Ports        map[string]uint16 `json:"ports"`         // task.ContainerConfig.Ports
-	Env          map[string]string `json:"env"`           // task.ContainerConfig.Env
-	Command      agent.Command     `json:"command"`       // task.ContainerConfig.Command
-	Resources    agent.Resources   `json:"resources"`     // task.ContainerConfig.Resources
-	Storage      agent.Storage     `json:"storage"`       // task.ContainerConfig.Storage
-	Grace        agent.Grace       `json:"grace"`         // task.ContainerConfig.Grace
+	TaskName     string              `json:"task_name"`               // task.Name
+	Scale        int                 `json:"scale"`                   // task.Scale
+	MaxPerAgent  int                 `json:"max_per_agent,omitempty"` // task.MaxPerAgent
+	MinDomains   int                 `json:"min_domains,omitempty"`   // task.MinDomains
+	HealthChecks []HealthCheck       `json:"health_checks"`           // task.HealthChecks
+	Ports        map[string]uint16   `json:"ports"`                   // task.ContainerConfig.Ports
+	Env          map[string]string   `json:"env"`                     // task.ContainerConfig.Env
+	EnvFile      map[string]string   `json:"env_file,omitempty"`      // task.ContainerConfig.EnvFile
+	Command      agent.Command       `json:"command"`                 // task.ContainerConfig.Command
+	Resources    agent.Resources     `json:"resources"`               // task.ContainerConfig.Resources
+	Storage      agent.Storage       `json:"storage"`                 // task.ContainerConfig.Storage
+	Grace        agent.Grace         `json:"grace"`                   // task.ContainerConfig.Grace
+	Labels       agent.Labels        `json:"labels,omitempty"`        // task.ContainerConfig.Labels
+	Restart      agent.RestartPolicy `json:"restart,omitempty"`       // task.ContainerConfig.Restart
+
+	PortRanges map[string]agent.PortRange `json:"port_ranges,omitempty"` // task.ContainerConfig.PortRanges
+	Security   *agent.Security            `json:"security,omitempty"`    // task.ContainerConfig.Security
+	Egress     *agent.Egress              `json:"egress,omitempty"`      // task.ContainerConfig.Egress
 }
 
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (c TaskConfig) Valid() error {
-	var errs []string
+	var errs agent.ValidationErrors
 	if c.TaskName == "" {
-		errs = append(errs, fmt.Sprintf("task name not set"))
+		errs.Add("task_name", "not set")
 	}
-	if err := c.Command.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("command invalid: %s", err))
+	if c.MaxPerAgent < 0 {
+		errs.Add("max_per_agent", "%d must not be negative", c.MaxPerAgent)
 	}
-	if err := c.Resources.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("resources invalid: %s", err))
+	if c.MinDomains < 0 || c.MinDomains > c.Scale {
+		errs.Add("min_domains", "%d must be between 0 and scale (%d)", c.MinDomains, c.Scale)
 	}
-	if err := c.Storage.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("storage invalid: %s", err))
+	errs.Nest("command", c.Command.Valid())
+	errs.Nest("resources", c.Resources.Valid())
+	errs.Nest("storage", c.Storage.Valid())
+	errs.Nest("grace", c.Grace.Valid())
+	errs.Nest("labels", c.Labels.Valid())
+	errs.Nest("restart", c.Restart.Valid())
+	for name, portRange := range c.PortRanges {
+		errs.Nest("port_ranges."+name, portRange.Valid())
 	}
-	if err := c.Grace.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("grace invalid: %s", err))
+	if c.Security != nil {
+		errs.Nest("security", c.Security.Valid())
 	}
-	for i, healthCheck := range c.HealthChecks {
-		if err := healthCheck.Valid(); err != nil {
-			errs = append(errs, fmt.Sprintf("health check %d: %s", i, err))
-		}
+	if c.Egress != nil {
+		errs.Nest("egress", c.Egress.Valid())
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	for i, healthCheck := range c.HealthChecks {
+		errs.Nest(fmt.Sprintf("health_checks[%d]", i), healthCheck.Valid())
 	}
-	return nil
+	return errs.Err()
 }
 
 // MakeContainerConfig produces an agent.ContainerConfig from a TaskConfig by
@@ -100,10 +363,16 @@ func (c TaskConfig) MakeContainerConfig(jobName, artifactURL string) agent.Conta
 		ArtifactURL: artifactURL,
 		Ports:       c.Ports,
 		Env:         c.Env,
+		EnvFile:     c.EnvFile,
 		Command:     c.Command,
 		Resources:   c.Resources,
 		Storage:     c.Storage,
 		Grace:       c.Grace,
+		Labels:      c.Labels,
+		Restart:     c.Restart,
+		PortRanges:  c.PortRanges,
+		Security:    c.Security,
+		Egress:      c.Egress,
 	}
 }
 
@@ -137,38 +406,35 @@ const (
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (c HealthCheck) Valid() error {
-	var errs []string
+	var errs agent.ValidationErrors
 
 	switch c.Protocol {
 	case protocolHTTP, protocolTCP:
 		break
 	default:
-		errs = append(errs, fmt.Sprintf("invalid protocol %q", c.Protocol))
+		errs.Add("protocol", "invalid protocol %q", c.Protocol)
 	}
 
 	if c.InitialDelay.Duration > maxInitialDelay {
-		errs = append(errs, fmt.Sprintf("initial delay (%s) too large (max %s)", c.InitialDelay, maxInitialDelay))
+		errs.Add("initial_delay", "%s too large (max %s)", c.InitialDelay, maxInitialDelay)
 	}
 	if c.Timeout.Duration > maxTimeout {
-		errs = append(errs, fmt.Sprintf("timeout (%s) too large (max %s)", c.Timeout, maxTimeout))
+		errs.Add("timeout", "%s too large (max %s)", c.Timeout, maxTimeout)
 	}
 	if c.Interval.Duration > maxInterval {
-		errs = append(errs, fmt.Sprintf("interval (%s) too large (max %s)", c.Interval, maxInterval))
+		errs.Add("interval", "%s too large (max %s)", c.Interval, maxInterval)
 	}
 
 	if c.Protocol == protocolHTTP {
 		if c.HTTPPath == "" {
-			errs = append(errs, "protocol HTTP requires http_path")
+			errs.Add("http_path", "required by protocol HTTP")
 		}
 		if len(c.HTTPAcceptableResponses) <= 0 {
-			errs = append(errs, "protocol HTTP requires http_acceptable_responses (array of integers)")
+			errs.Add("http_acceptable_responses", "array of integers required by protocol HTTP")
 		}
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
-	}
-	return nil
+	return errs.Err()
 }
 
 type jsonDuration struct{ time.Duration }
@@ -0,0 +1,314 @@
+package configstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitStore keeps job configs in a git repository, one JSON file per job, at
+// NAMESPACE/JOB.json, or JOB.json in the default namespace. Every Put is a
+// commit, and the ref of a config is the sha of its commit, so the history of
+// the repository is the history of the configs: older configs can be got
+// again to roll back, and changes may go through the usual review workflows,
+// as long as every commit touches a single config.
+//
+// The store works on a clone of the repository of its own. With a remote,
+// the clone is reset to the remote's branch every fetch interval, whenever a
+// webhook, served by ServeHTTP, asks for a refresh, e.g. on pushes to the
+// remote, and before every Put and List. Get fetches if it doesn't know the
+// ref. Put pushes every commit, failing if the remote moved on. A Put which
+// fails leaves the clone as it was. The committer identity is taken from the
+// git config.
+type GitStore struct {
+	mu      sync.Mutex
+	dir     string
+	remote  string
+	branch  string
+	refresh chan struct{}
+	quit    chan chan struct{}
+}
+
+// NewGitStore returns a store on the clone in dir. If remote isn't empty,
+// the store pushes to, and fetches from, the branch of the remote, fetching
+// every fetchInterval, if it's positive, and on webhook requests.
+func NewGitStore(dir, remote, branch string, fetchInterval time.Duration) (*GitStore, error) {
+	s := &GitStore{
+		dir:     dir,
+		remote:  remote,
+		branch:  branch,
+		refresh: make(chan struct{}, 1),
+		quit:    make(chan chan struct{}),
+	}
+	if _, err := s.git("rev-parse", "--git-dir"); err != nil {
+		return nil, err
+	}
+	if remote != "" {
+		if err := s.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	go s.loop(fetchInterval)
+	return s, nil
+}
+
+// Get returns the config committed with the ref, resolved for the
+// environment. Refs the clone doesn't have, e.g. of configs pushed to the
+// remote since the last fetch, are fetched.
+func (s *GitStore) Get(jobConfigRef, environment string) (JobConfig, error) {
+	if strings.HasPrefix(jobConfigRef, "-") {
+		return JobConfig{}, fmt.Errorf("invalid ref %q", jobConfigRef)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.git("cat-file", "-e", jobConfigRef+"^{commit}"); err != nil && s.remote != "" {
+		if err := s.fetch(); err != nil {
+			return JobConfig{}, err
+		}
+	}
+
+	out, err := s.git("diff-tree", "-z", "--no-commit-id", "--name-only", "-r", "--root", jobConfigRef)
+	if err != nil {
+		return JobConfig{}, err
+	}
+	var jsonPaths []string
+	for _, path := range paths(out) {
+		if filepath.Ext(path) == ".json" {
+			jsonPaths = append(jsonPaths, path)
+		}
+	}
+	if len(jsonPaths) != 1 {
+		return JobConfig{}, fmt.Errorf("commit %s changes %d job configs, not 1", jobConfigRef, len(jsonPaths))
+	}
+
+	buf, err := s.git("show", jobConfigRef+":"+jsonPaths[0])
+	if err != nil {
+		return JobConfig{}, err
+	}
+	var c JobConfig
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return JobConfig{}, fmt.Errorf("%s at %s: %s", jsonPaths[0], jobConfigRef, err)
+	}
+	return c.Resolve(environment)
+}
+
+// Put commits the config, and pushes it to the remote, if any. Putting a
+// config which is already committed returns the ref of the last commit of
+// its file.
+func (s *GitStore) Put(c JobConfig) (ref string, err error) {
+	if err := c.Valid(); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(c.JobName, `/\`) || strings.HasPrefix(c.JobName, ".") {
+		return "", fmt.Errorf("job name %q can't be a file name", c.JobName)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remote != "" {
+		if err := s.fetch(); err != nil {
+			return "", err
+		}
+	}
+
+	buf, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	var (
+		path    = filepath.Join(c.Namespace, c.JobName+".json")
+		head, _ = s.git("rev-parse", "--verify", "-q", "HEAD") // empty in a new repository
+	)
+	defer func() {
+		if err != nil {
+			s.rollback(strings.TrimSpace(string(head)), path)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(s.dir, c.Namespace), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.dir, path), append(buf, '\n'), 0644); err != nil {
+		return "", err
+	}
+	if _, err := s.git("add", path); err != nil {
+		return "", err
+	}
+
+	if _, err := s.git("diff", "--cached", "--quiet", "--", path); err == nil {
+		out, err := s.git("log", "-1", "--format=%H", "--", path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil // unchanged
+	}
+
+	message := fmt.Sprintf("Put %s", NamespacedJobName(c.Namespace, c.JobName))
+	if _, err := s.git("commit", "-m", message, "--", path); err != nil {
+		return "", err
+	}
+	if s.remote != "" {
+		if _, err := s.git("push", s.remote, "HEAD:"+s.branch); err != nil {
+			return "", err
+		}
+	}
+	out, err := s.git("rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// List returns the current config of every job in the repository, resolved
+// for the environment, after fetching from the remote, if any. Configs
+// without an overlay for the environment aren't deployed to it, and left
+// out, as are configs which can't be read, which are logged.
+func (s *GitStore) List(environment string) ([]StoredConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remote != "" {
+		if err := s.fetch(); err != nil {
+			return nil, err
+		}
+	}
+
+	out, err := s.git("ls-files", "-z", "--", "*.json")
+	if err != nil {
+		return nil, err
+	}
+	configs := []StoredConfig{}
+	for _, path := range paths(out) {
+		ref, err := s.git("log", "-1", "--format=%H", "--", path)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(s.dir, path))
+		if err != nil {
+			return nil, err
+		}
+		var c JobConfig
+		if err := json.Unmarshal(buf, &c); err != nil {
+			log.Printf("configstore: %s: %s", path, err)
+			continue
+		}
+		if _, ok := c.Environments[environment]; !ok && environment != "" {
+			continue
+		}
+		if c, err = c.Resolve(environment); err != nil {
+			log.Printf("configstore: %s: %s", path, err)
+			continue
+		}
+		configs = append(configs, StoredConfig{Ref: strings.TrimSpace(string(ref)), JobConfig: c})
+	}
+	return configs, nil
+}
+
+// ServeHTTP asks the store to fetch from the remote, e.g. from the webhook of
+// a git host on pushes. The fetch happens in the background.
+func (s *GitStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case s.refresh <- struct{}{}:
+	default: // a refresh is pending already
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Stop stops fetching from the remote.
+func (s *GitStore) Stop() {
+	q := make(chan struct{})
+	s.quit <- q
+	<-q
+}
+
+func (s *GitStore) loop(fetchInterval time.Duration) {
+	var tick <-chan time.Time
+	if s.remote != "" && fetchInterval > 0 {
+		ticker := time.NewTicker(fetchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-s.refresh:
+		case q := <-s.quit:
+			close(q)
+			return
+		}
+		if s.remote == "" {
+			continue
+		}
+		s.mu.Lock()
+		if err := s.fetch(); err != nil {
+			log.Printf("configstore: %s", err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// rollback leaves the clone at head, undoing what a failed Put wrote to the
+// path, committed or not, as List reads the work tree. It must be called with
+// the lock held.
+func (s *GitStore) rollback(head, path string) {
+	if head != "" {
+		if _, err := s.git("reset", "-q", "--hard", head); err != nil {
+			log.Printf("configstore: %s", err)
+		}
+	} else if _, err := s.git("rm", "-q", "--cached", "--ignore-unmatch", "--", path); err != nil {
+		log.Printf("configstore: %s", err)
+	}
+	if _, err := s.git("clean", "-q", "-f", "--", path); err != nil {
+		log.Printf("configstore: %s", err)
+	}
+}
+
+// fetch resets the clone to the branch of the remote. It must be called with
+// the lock held.
+func (s *GitStore) fetch() error {
+	if _, err := s.git("fetch", s.remote, s.branch); err != nil {
+		return err
+	}
+	_, err := s.git("reset", "--hard", "FETCH_HEAD")
+	return err
+}
+
+func (s *GitStore) git(args ...string) ([]byte, error) {
+	var (
+		cmd    = exec.Command("git", args...)
+		stderr bytes.Buffer
+	)
+	cmd.Dir = s.dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s (%s)", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// paths splits the NUL-terminated paths output by git with -z.
+func paths(out []byte) []string {
+	var paths []string
+	for _, path := range strings.Split(string(out), "\x00") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
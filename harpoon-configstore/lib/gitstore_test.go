@@ -0,0 +1,259 @@
+package configstore
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestGitStore(t *testing.T) {
+	dir := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewGitStore(dir, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	alpha := testJobConfig("alpha")
+	ref, err := s.Put(alpha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(ref, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := alpha; !reflect.DeepEqual(expected.Tasks, got.Tasks) || expected.JobName != got.JobName {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if again, err := s.Put(alpha); err != nil || again != ref {
+		t.Errorf("expected the unchanged config to keep ref %s, got %s (%v)", ref, again, err)
+	}
+	if expected, got := []string{"alpha@" + ref}, listed(t, s); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestGitStorePutFailedCommit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir := tempRepo(t)
+	defer os.RemoveAll(dir)
+
+	s, err := NewGitStore(dir, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	ref, err := s.Put(testJobConfig("alpha"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook(t, dir, "pre-commit")
+	changed := testJobConfig("alpha")
+	changed.Env = map[string]string{"CHANGED": "1"}
+	if _, err := s.Put(changed); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if _, err := s.Put(testJobConfig("beta")); err == nil {
+		t.Fatal("expected error, got none")
+	}
+
+	if expected, got := []string{"alpha@" + ref}, listed(t, s); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if status := git(t, dir, "status", "--porcelain"); status != "" {
+		t.Errorf("expected a clean clone, got %q", status)
+	}
+}
+
+func TestGitStorePutFailedPush(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "harpoon-configstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		remote = filepath.Join(dir, "remote.git")
+		seed   = filepath.Join(dir, "seed")
+		clone  = filepath.Join(dir, "clone")
+	)
+	git(t, dir, "init", "-q", "--bare", remote)
+	git(t, dir, "clone", "-q", remote, seed)
+	identify(t, seed)
+	git(t, seed, "commit", "-q", "--allow-empty", "-m", "Initial commit")
+	git(t, seed, "push", "-q", "origin", "HEAD:master")
+	git(t, dir, "clone", "-q", remote, clone)
+	identify(t, clone)
+
+	s, err := NewGitStore(clone, "origin", "master", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	ref, err := s.Put(testJobConfig("alpha"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ref, git(t, remote, "rev-parse", "master"); expected != got {
+		t.Errorf("expected the remote at %s, got %s", expected, got)
+	}
+
+	hook(t, remote, "pre-receive")
+	if _, err := s.Put(testJobConfig("beta")); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if expected, got := ref, git(t, clone, "rev-parse", "HEAD"); expected != got {
+		t.Errorf("expected the clone at %s, got %s", expected, got)
+	}
+	if expected, got := []string{"alpha@" + ref}, listed(t, s); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestGitStoreFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-configstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		remote = filepath.Join(dir, "remote.git")
+		other  = filepath.Join(dir, "other")
+		clone  = filepath.Join(dir, "clone")
+	)
+	git(t, dir, "init", "-q", "--bare", remote)
+	git(t, dir, "clone", "-q", remote, other)
+	identify(t, other)
+	git(t, other, "commit", "-q", "--allow-empty", "-m", "Initial commit")
+	git(t, other, "push", "-q", "origin", "HEAD:master")
+	git(t, dir, "clone", "-q", remote, clone)
+	identify(t, clone)
+
+	s, err := NewGitStore(clone, "origin", "master", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	o, err := NewGitStore(other, "origin", "master", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Stop()
+
+	// a ref pushed elsewhere is fetched by Get
+	ref, err := o.Put(testJobConfig("alpha"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ref, ""); err != nil || got.JobName != "alpha" {
+		t.Errorf("expected alpha, got %v (%v)", got, err)
+	}
+
+	// and on webhook requests
+	ref, err = o.Put(testJobConfig("beta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, &http.Request{Method: "POST"})
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.mu.Lock()
+		head := git(t, clone, "rev-parse", "HEAD")
+		s.mu.Unlock()
+		if head == ref {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the clone at %s, got %s", ref, head)
+		}
+	}
+}
+
+func testJobConfig(jobName string) JobConfig {
+	return JobConfig{
+		JobName: jobName,
+		Tasks: []TaskConfig{{
+			TaskName:  "web",
+			Scale:     1,
+			Command:   agent.Command{WorkingDir: "/srv/" + jobName, Exec: []string{"./" + jobName}},
+			Resources: agent.Resources{Memory: 64, CPUs: 1},
+			Grace:     agent.Grace{Startup: 1, Shutdown: 1},
+		}},
+	}
+}
+
+// listed returns the configs the store lists, as job@ref.
+func listed(t *testing.T, s *GitStore) []string {
+	configs, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range configs {
+		got = append(got, c.JobName+"@"+c.Ref)
+	}
+	return got
+}
+
+func tempRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "harpoon-configstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	git(t, dir, "init", "-q")
+	identify(t, dir)
+	return dir
+}
+
+func identify(t *testing.T, dir string) {
+	git(t, dir, "config", "user.name", "harpoon")
+	git(t, dir, "config", "user.email", "harpoon@example.com")
+}
+
+// hook installs a git hook which fails.
+func hook(t *testing.T, dir, name string) {
+	hooks := filepath.Join(dir, ".git", "hooks")
+	if _, err := os.Stat(filepath.Join(dir, "hooks")); err == nil {
+		hooks = filepath.Join(dir, "hooks") // bare
+	}
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(hooks, name), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s (%s)", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,252 @@
+package configstore
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// Linting applies best-practice rules to job configs, beyond what Valid
+// requires. Findings are errors, for configs which would fail at deploy
+// time, e.g. health checks of ports the task doesn't have, or warnings, for
+// configs which work but likely aren't what was meant. Stores wrapped with
+// Linted reject configs with errors at Put time. Rules are expected to
+// evolve; tools should show warnings, and not fail on them.
+
+// Severities of lint findings.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Bounds of task resources outside of which the linter warns.
+const (
+	minSaneMemory = 32        // MB
+	maxSaneMemory = 64 * 1024 // MB
+	minSaneCPUs   = 0.05
+	maxSaneCPUs   = 32.0
+
+	minShutdownGrace = 5 // seconds
+)
+
+// Finding is a problem found by a lint rule.
+type Finding struct {
+	Rule     string `json:"rule"`
+	Field    string `json:"field,omitempty"` // JSON path, e.g. "tasks[0].grace.shutdown"
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Findings collects the problems found by the lint rules.
+type Findings []Finding
+
+// Error satisfies the error interface.
+func (f Findings) Error() string {
+	problems := make([]string, len(f))
+	for i, finding := range f {
+		if finding.Field == "" {
+			problems[i] = fmt.Sprintf("%s: %s", finding.Rule, finding.Message)
+			continue
+		}
+		problems[i] = fmt.Sprintf("%s: %s: %s", finding.Rule, finding.Field, finding.Message)
+	}
+	return strings.Join(problems, "; ")
+}
+
+// Errors returns the findings with severity error.
+func (f Findings) Errors() Findings {
+	return f.withSeverity(SeverityError)
+}
+
+// Warnings returns the findings with severity warning.
+func (f Findings) Warnings() Findings {
+	return f.withSeverity(SeverityWarning)
+}
+
+func (f Findings) withSeverity(severity string) Findings {
+	filtered := Findings{}
+	for _, finding := range f {
+		if finding.Severity == severity {
+			filtered = append(filtered, finding)
+		}
+	}
+	return filtered
+}
+
+// Err returns the findings with severity error as an error, or nil if there
+// are none.
+func (f Findings) Err() error {
+	if errs := f.Errors(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (f *Findings) add(severity, field, format string, args ...interface{}) {
+	*f = append(*f, Finding{Field: field, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// LintRule checks job configs for one kind of problem.
+type LintRule struct {
+	Name  string
+	Check func(JobConfig) Findings
+}
+
+// LintRules are the rules applied by Lint, in order.
+var LintRules = []LintRule{
+	{"valid", lintValid},
+	{"schema", lintSchema},
+	{"grace", lintGrace},
+	{"health_checks", lintHealthChecks},
+	{"resources", lintResources},
+}
+
+// Lint applies the lint rules to the config, and returns their findings.
+func Lint(c JobConfig) Findings {
+	findings := Findings{}
+	for _, rule := range LintRules {
+		for _, finding := range rule.Check(c) {
+			finding.Rule = rule.Name
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// lintValid reports the problems found by Valid as errors.
+func lintValid(c JobConfig) Findings {
+	var findings Findings
+	if err := c.Valid(); err != nil {
+		if errs, ok := err.(agent.ValidationErrors); ok {
+			for _, fieldError := range errs {
+				findings.add(SeverityError, fieldError.Field, "%s", fieldError.Message)
+			}
+		} else {
+			findings.add(SeverityError, "", "%s", err)
+		}
+	}
+	return findings
+}
+
+// lintSchema rejects configs written for a newer schema, which may hold
+// fields this package drops, and warns about those written for an older
+// one, which are stored in the current schema.
+func lintSchema(c JobConfig) Findings {
+	var findings Findings
+	version := c.SchemaVersion
+	if version <= 0 {
+		version = 1
+	}
+	switch {
+	case version > JobConfigSchemaVersion:
+		findings.add(SeverityError, "schema_version", "%d is newer than the supported schema version %d", version, JobConfigSchemaVersion)
+	case version < JobConfigSchemaVersion:
+		findings.add(SeverityWarning, "schema_version", "%d is older than the current schema version %d, to which the config is migrated when stored", version, JobConfigSchemaVersion)
+	}
+	return findings
+}
+
+// lintGrace warns about startup grace periods which end before the health
+// checks start, so instances count as started before anything is known about
+// their health, and about shutdown grace periods too short to drain.
+func lintGrace(c JobConfig) Findings {
+	var findings Findings
+	for i, taskConfig := range c.Tasks {
+		field := fmt.Sprintf("tasks[%d].grace", i)
+		for _, healthCheck := range healthChecks(c, taskConfig) {
+			if delay := int(math.Ceil(healthCheck.InitialDelay.Seconds())); taskConfig.Grace.Startup > 0 && taskConfig.Grace.Startup < delay {
+				findings.add(SeverityWarning, field+".startup", "%ds ends before the health check initial delay of %s", taskConfig.Grace.Startup, healthCheck.InitialDelay)
+				break
+			}
+		}
+		if taskConfig.Grace.Shutdown > 0 && taskConfig.Grace.Shutdown < minShutdownGrace {
+			findings.add(SeverityWarning, field+".shutdown", "%ds leaves little time to drain; consider at least %ds", taskConfig.Grace.Shutdown, minShutdownGrace)
+		}
+	}
+	return findings
+}
+
+// lintHealthChecks rejects health checks of ports the task doesn't have, and
+// warns about tasks which listen on ports, e.g. HTTP services, but have no
+// health checks.
+func lintHealthChecks(c JobConfig) Findings {
+	var findings Findings
+	for i, taskConfig := range c.Tasks {
+		if len(taskConfig.Ports) > 0 && len(healthChecks(c, taskConfig)) <= 0 {
+			findings.add(SeverityWarning, fmt.Sprintf("tasks[%d].health_checks", i), "task listens on ports, but has no health checks")
+		}
+		for j, healthCheck := range taskConfig.HealthChecks {
+			if !hasPort(taskConfig, healthCheck.Port) {
+				findings.add(SeverityError, fmt.Sprintf("tasks[%d].health_checks[%d].port", i, j), "%q isn't a port of the task", healthCheck.Port)
+			}
+		}
+		for j, healthCheck := range c.HealthChecks {
+			if !hasPort(taskConfig, healthCheck.Port) {
+				findings.add(SeverityError, fmt.Sprintf("health_checks[%d].port", j), "%q isn't a port of task %q", healthCheck.Port, taskConfig.TaskName)
+			}
+		}
+	}
+	return findings
+}
+
+// healthChecks returns the health checks of the task, including those of the
+// job.
+func healthChecks(c JobConfig, taskConfig TaskConfig) []HealthCheck {
+	all := make([]HealthCheck, 0, len(c.HealthChecks)+len(taskConfig.HealthChecks))
+	all = append(all, c.HealthChecks...)
+	return append(all, taskConfig.HealthChecks...)
+}
+
+// hasPort returns true if the task has the port, by its name in ports, or by
+// the name of its environment variable, e.g. PORT_HTTP for http.
+func hasPort(taskConfig TaskConfig, port string) bool {
+	for name := range taskConfig.Ports {
+		if strings.EqualFold(name, port) || strings.EqualFold("PORT_"+name, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// lintResources warns about resources outside of sane bounds, which are
+// usually typos, e.g. memory given in GB rather than MB.
+func lintResources(c JobConfig) Findings {
+	var findings Findings
+	for i, taskConfig := range c.Tasks {
+		var (
+			field     = fmt.Sprintf("tasks[%d].resources", i)
+			resources = taskConfig.Resources
+		)
+		if resources.Memory > 0 && resources.Memory < minSaneMemory {
+			findings.add(SeverityWarning, field+".mem", "%d MB is below %d MB; memory is given in MB", resources.Memory, minSaneMemory)
+		}
+		if resources.Memory > maxSaneMemory {
+			findings.add(SeverityWarning, field+".mem", "%d MB is above %d MB", resources.Memory, maxSaneMemory)
+		}
+		if resources.CPUs > 0 && resources.CPUs < minSaneCPUs {
+			findings.add(SeverityWarning, field+".cpus", "%g is below %g", resources.CPUs, minSaneCPUs)
+		}
+		if resources.CPUs > maxSaneCPUs {
+			findings.add(SeverityWarning, field+".cpus", "%g is above %g", resources.CPUs, maxSaneCPUs)
+		}
+	}
+	return findings
+}
+
+// Linted wraps the store, so that Put rejects configs with lint errors, and
+// stores configs in the current schema version.
+func Linted(store ConfigStore) ConfigStore {
+	return lintedStore{store}
+}
+
+type lintedStore struct{ ConfigStore }
+
+func (s lintedStore) Put(c JobConfig) (string, error) {
+	if err := Lint(c).Err(); err != nil {
+		return "", err
+	}
+	c.SchemaVersion = JobConfigSchemaVersion
+	return s.ConfigStore.Put(c)
+}
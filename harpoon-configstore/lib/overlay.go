@@ -0,0 +1,125 @@
+package configstore
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// A job config may hold overlays for the environments it's deployed to, e.g.
+// staging and production, so that one config drives all of them. An overlay
+// holds only the deltas: env variables, set on every task, scales of tasks,
+// the artifact URL, and the desired state. Config stores resolve a config for
+// an environment on Get, applying its overlay to the base config.
+
+// Overlay holds the deltas of a job config for one environment.
+type Overlay struct {
+	Env         map[string]string `json:"env,omitempty"`          // set on all tasks, overriding their env
+	Scale       map[string]int    `json:"scale,omitempty"`        // task name: scale
+	ArtifactURL string            `json:"artifact_url,omitempty"` // replaces the job's artifact URL
+	Desired     string            `json:"desired,omitempty"`      // replaces the job's desired state
+}
+
+// Valid performs a validation check against the task names of the job.
+func (o Overlay) Valid(taskNames []string) error {
+	var (
+		errs  agent.ValidationErrors
+		known = map[string]bool{}
+	)
+	for _, taskName := range taskNames {
+		known[taskName] = true
+	}
+	if _, ok := o.Env[""]; ok {
+		errs.Add("env", "empty variable name")
+	}
+	for _, taskName := range sortedScaleNames(o.Scale) {
+		if !known[taskName] {
+			errs.Add("scale", "unknown task %q", taskName)
+		}
+		if o.Scale[taskName] <= 0 {
+			errs.Add("scale", "%s: %d must be greater than zero", taskName, o.Scale[taskName])
+		}
+	}
+	errs.Nest("artifact_url", validArtifactURL(o.ArtifactURL))
+	errs.Nest("desired", validDesired(o.Desired))
+	return errs.Err()
+}
+
+// Resolve returns the config for the environment: the base config with the
+// environment's overlay applied, and without overlays. The empty environment
+// resolves to the base config. The config isn't modified.
+func (c JobConfig) Resolve(environment string) (JobConfig, error) {
+	overlay, ok := c.Environments[environment]
+	if !ok && environment != "" {
+		return JobConfig{}, fmt.Errorf("%s has no environment %q", c.JobName, environment)
+	}
+
+	resolved := c
+	resolved.Environments = nil
+	if overlay.ArtifactURL != "" {
+		resolved.ArtifactURL = overlay.ArtifactURL
+	}
+	if overlay.Desired != "" {
+		resolved.Desired = overlay.Desired
+	}
+	resolved.Tasks = make([]TaskConfig, len(c.Tasks))
+	for i, taskConfig := range c.Tasks {
+		if scale, ok := overlay.Scale[taskConfig.TaskName]; ok {
+			taskConfig.Scale = scale
+		}
+		if len(overlay.Env) > 0 {
+			env := make(map[string]string, len(taskConfig.Env)+len(overlay.Env))
+			for name, value := range taskConfig.Env {
+				env[name] = value
+			}
+			for name, value := range overlay.Env {
+				env[name] = value
+			}
+			taskConfig.Env = env
+		}
+		resolved.Tasks[i] = taskConfig
+	}
+	return resolved, nil
+}
+
+func validArtifactURL(artifactURL string) error {
+	if artifactURL == "" {
+		return nil
+	}
+	u, err := url.Parse(artifactURL)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%q invalid: %s", artifactURL, err)
+	case u.Scheme == "":
+		return fmt.Errorf("%q has no scheme", artifactURL)
+	}
+	return nil
+}
+
+func validDesired(desired string) error {
+	switch desired {
+	case "", DesiredRunning, DesiredStopped:
+		return nil
+	}
+	return fmt.Errorf("%q must be %s or %s", desired, DesiredRunning, DesiredStopped)
+}
+
+func sortedScaleNames(scale map[string]int) []string {
+	names := make([]string, 0, len(scale))
+	for name := range scale {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedEnvironments(environments map[string]Overlay) []string {
+	names := make([]string, 0, len(environments))
+	for name := range environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
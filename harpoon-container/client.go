@@ -31,29 +31,29 @@ func newClient(url string) *client {
 	}
 }
 
-func (c *client) sendHeartbeat(hb agent.Heartbeat) (string, error) {
+func (c *client) sendHeartbeat(hb agent.Heartbeat) (agent.HeartbeatReply, error) {
 	c.buf.Reset()
 
 	hb.Timestamp = time.Now()
 
 	if err := c.enc.Encode(&hb); err != nil {
-		return "", err
+		return agent.HeartbeatReply{}, err
 	}
 
 	resp, err := c.client.Post(c.url, "application/json", c.buf)
 	if err != nil {
-		return "", err
+		return agent.HeartbeatReply{}, err
 	}
 	defer resp.Body.Close()
 
 	var reply agent.HeartbeatReply
 	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
-		return "", err
+		return agent.HeartbeatReply{}, err
 	}
 
 	if reply.Err != "" {
-		return "", errors.New(reply.Err)
+		return agent.HeartbeatReply{}, errors.New(reply.Err)
 	}
 
-	return reply.Want, nil
+	return reply, nil
 }
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/libcontainer"
+	"github.com/docker/libcontainer/cgroups"
 	"github.com/docker/libcontainer/cgroups/fs"
 	"github.com/docker/libcontainer/namespaces"
 
@@ -40,15 +46,133 @@ func commandBuilder(cmd **exec.Cmd) namespaces.CreateCommand {
 	}
 }
 
+const (
+	defaultHeartbeatInterval = 3 * time.Second
+	defaultHeartbeatJitter   = 0.1
+)
+
 type Container struct {
 	err       error
 	container *libcontainer.Config
+
+	interval int64   // heartbeat interval in nanoseconds; accessed atomically
+	jitter   float64 // fraction of the interval
+	acked    uint64  // last applied reply generation; accessed atomically
+	pid      int64   // pid of the container's init process; accessed atomically
+
+	restart agent.RestartPolicy
+
+	stdout, stderr *os.File // the container's output streams
+}
+
+// updateResources applies changed resource limits to the container's cgroup,
+// so they take effect without a restart.
+func (c *Container) updateResources(resources agent.Resources) error {
+	var (
+		memory = int64(resources.Memory * 1024 * 1024)
+		shares = int64(resources.CPUs * 1024)
+		cg     = c.container.Cgroups
+	)
+
+	if memory != cg.Memory {
+		if err := writeCgroup(cg, "memory", "memory.limit_in_bytes", memory); err != nil {
+			return err
+		}
+
+		cg.Memory = memory
+	}
+
+	if shares != cg.CpuShares {
+		if err := writeCgroup(cg, "cpu", "cpu.shares", shares); err != nil {
+			return err
+		}
+
+		cg.CpuShares = shares
+	}
+
+	return nil
+}
+
+func writeCgroup(cg *cgroups.Cgroup, subsystem, file string, value int64) error {
+	dir, err := fs.GetSubsystemPath(cg, subsystem)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(strconv.FormatInt(value, 10)), 0700)
+}
+
+// processInfo describes the supervisor, container process, and cgroup, for
+// the agent.
+func (c *Container) processInfo() agent.ProcessInfo {
+	info := agent.ProcessInfo{
+		SupervisorPID: os.Getpid(),
+		ContainerPID:  int(atomic.LoadInt64(&c.pid)),
+	}
+
+	if c.container != nil && c.container.Cgroups != nil {
+		info.CgroupPath = filepath.Join(c.container.Cgroups.Parent, c.container.Cgroups.Name)
+	}
+
+	return info
+}
+
+// acknowledged returns the generation of the last heartbeat reply which was
+// applied to the container.
+func (c *Container) acknowledged() uint64 {
+	return atomic.LoadUint64(&c.acked)
+}
+
+func (c *Container) acknowledge(generation uint64) {
+	atomic.StoreUint64(&c.acked, generation)
+}
+
+// setHeartbeat configures the heartbeat interval and jitter from their string
+// representations, as passed by the agent. Invalid or missing values fall back
+// to the defaults.
+func (c *Container) setHeartbeat(interval, jitter string) {
+	c.setInterval(defaultHeartbeatInterval)
+	c.jitter = defaultHeartbeatJitter
+
+	if d, err := time.ParseDuration(interval); err == nil {
+		c.setInterval(d)
+	} else if interval != "" {
+		log.Printf("invalid heartbeat interval %q: %s", interval, err)
+	}
+
+	if f, err := strconv.ParseFloat(jitter, 64); err == nil && f >= 0 && f < 1 {
+		c.jitter = f
+	} else if jitter != "" {
+		log.Printf("invalid heartbeat jitter %q", jitter)
+	}
+}
+
+// setInterval adopts the heartbeat interval requested by the agent. Zero
+// leaves the interval unchanged.
+func (c *Container) setInterval(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	atomic.StoreInt64(&c.interval, int64(d))
+}
+
+// nextHeartbeat returns a channel which fires after the heartbeat interval,
+// randomly varied by up to the jitter in either direction, so heartbeats from
+// many containers on one host don't arrive in lockstep.
+func (c *Container) nextHeartbeat() <-chan time.Time {
+	var (
+		interval = float64(atomic.LoadInt64(&c.interval))
+		jitter   = (2*rand.Float64() - 1) * c.jitter * interval
+	)
+
+	return time.After(time.Duration(interval + jitter))
 }
 
 // Start starts the container and keeps it running. The container status is
 // sent on the return channel when the process state changes or when the
 // metrics are updated.
-func (c *Container) Start(transition <-chan string) <-chan agent.ContainerProcessStatus {
+func (c *Container) Start(transition <-chan agent.HeartbeatReply) <-chan agent.ContainerProcessStatus {
 	var statusc = make(chan agent.ContainerProcessStatus)
 
 	go c.start(statusc, transition)
@@ -56,14 +180,17 @@ func (c *Container) Start(transition <-chan string) <-chan agent.ContainerProces
 	return statusc
 }
 
-func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition <-chan string) {
+func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition <-chan agent.HeartbeatReply) {
 	var (
-		tick = time.Tick(3 * time.Second)
+		tick = c.nextHeartbeat()
 
 		desired string
+		paused  bool
 		status  agent.ContainerProcessStatus
 		metrics = &agent.ContainerMetrics{}
 
+		resourcesErr string // the cgroup config is kept across restarts, and so its failure
+
 		cmd *exec.Cmd
 	)
 
@@ -83,6 +210,7 @@ func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition
 			started = make(chan struct{})
 			exited  = make(chan error, 1)
 			restart <-chan time.Time
+			oomed   bool
 		)
 
 		startCallback := func() {
@@ -90,6 +218,7 @@ func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition
 				log.Print("unable to set up oom notifications: ", err)
 			}
 
+			atomic.StoreInt64(&c.pid, int64(cmd.Process.Pid))
 			started <- struct{}{}
 		}
 
@@ -97,8 +226,8 @@ func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition
 			_, err := namespaces.Exec(
 				c.container,
 				os.Stdin,
-				os.Stdout,
-				os.Stderr,
+				c.stdout,
+				c.stderr,
 				"",     // no console
 				"", "", // rootfs and datapath handled elsewhere
 				os.Args[1:],
@@ -118,6 +247,7 @@ func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition
 		c.updateMetrics(metrics)
 		status = agent.ContainerProcessStatus{
 			Up:               true,
+			ResourcesError:   resourcesErr,
 			ContainerMetrics: metrics,
 		}
 		statusc <- status // emit current status
@@ -126,48 +256,110 @@ func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition
 		for {
 			select {
 			case <-tick:
+				tick = c.nextHeartbeat()
 				c.updateMetrics(metrics)
 				statusc <- status
 
-			case desired = <-transition:
-				if (desired == "DOWN" || desired == "EXIT") && !status.Up {
+			case reply := <-transition:
+				if reply.Want == agent.WantHold {
+					continue // the agent is recovering; keep things as they are
+				}
+
+				if reply.Generation != 0 && reply.Generation <= c.acknowledged() {
+					continue // already applied
+				}
+
+				desired = reply.Want
+
+				if (desired == agent.WantDown || desired == agent.WantExit) && !status.Up {
+					c.acknowledge(reply.Generation)
 					return
 				}
 
+				if paused && desired != agent.WantPause {
+					// frozen processes can't handle signals
+					if err := fs.Freeze(c.container.Cgroups, cgroups.Thawed); err != nil {
+						log.Print("unable to resume container: ", err)
+					}
+					paused = false
+				}
+
+				if reply.Resources != nil && status.Up {
+					if err := c.updateResources(*reply.Resources); err != nil {
+						log.Print("unable to update resources: ", err)
+						resourcesErr = err.Error()
+					} else {
+						resourcesErr = ""
+					}
+					status.ResourcesError = resourcesErr // reported with the acknowledgement
+				}
+
+				if reply.Signal > 0 && status.Up {
+					cmd.Process.Signal(syscall.Signal(reply.Signal))
+				}
+
 				switch desired {
-				case "DOWN":
+				case agent.WantDown:
 					cmd.Process.Signal(syscall.SIGTERM)
 
-				case "EXIT":
+				case agent.WantExit:
 					cmd.Process.Signal(syscall.SIGKILL)
+
+				case agent.WantRestart:
+					if status.Up {
+						cmd.Process.Signal(syscall.SIGTERM)
+					} else {
+						restart = time.After(0)
+					}
+
+				case agent.WantPause:
+					if status.Up && !paused {
+						if err := fs.Freeze(c.container.Cgroups, cgroups.Frozen); err != nil {
+							log.Print("unable to pause container: ", err)
+						} else {
+							paused = true
+						}
+					}
 				}
 
+				c.acknowledge(reply.Generation)
+				statusc <- status // report the acknowledgement
+
 			case <-exited:
+				atomic.StoreInt64(&c.pid, 0)
 				ws := cmd.ProcessState.Sys().(syscall.WaitStatus)
 
-				// TODO: handle OOM case
 				switch {
 				case ws.Exited():
 					status = agent.ContainerProcessStatus{
 						Exited:           true,
 						ExitStatus:       ws.ExitStatus(),
+						OOMed:            oomed,
 						ContainerMetrics: metrics,
 					}
 				case ws.Signaled():
 					status = agent.ContainerProcessStatus{
 						Signaled:         true,
 						Signal:           int(ws.Signal()),
+						OOMed:            oomed,
 						ContainerMetrics: metrics,
 					}
 				}
 
 				// we've been asked to shut down, don't restart
-				if desired == "DOWN" || desired == "EXIT" {
+				if desired == agent.WantDown || desired == agent.WantExit {
 					return
 				}
 
-				// container exited 0, don't restart it
-				if status.Exited && status.ExitStatus == 0 {
+				// we've been asked to restart, do so right away
+				if desired == agent.WantRestart {
+					restart = time.After(0)
+					statusc <- status
+					continue
+				}
+
+				// container exited, and its policy says to leave it be
+				if !c.restart.Restarts(status.Succeeded()) {
 					return
 				}
 
@@ -181,9 +373,14 @@ func (c *Container) start(statusc chan agent.ContainerProcessStatus, transition
 				}
 
 				metrics.OOMs += 1
+				oomed = true
 				statusc <- status
 
 			case <-restart:
+				if desired == agent.WantRestart {
+					desired = agent.WantUp
+				}
+
 				metrics.Restarts += 1
 				break supervise
 
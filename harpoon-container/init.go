@@ -3,9 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
 
 	"github.com/docker/libcontainer"
 	"github.com/docker/libcontainer/namespaces"
@@ -28,10 +31,25 @@ func Init() error {
 		log.Fatal("load ./container.json:", err)
 	}
 
+	// The container's processes inherit the net_cls cgroup, whose class
+	// the agent's egress rules match.
+	if cgroup := container.Context["net_cls"]; cgroup != "" {
+		if err := ioutil.WriteFile(filepath.Join(cgroup, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			return fmt.Errorf("unable to join net_cls cgroup: %s", err)
+		}
+	}
+
+	// Init runs with the agent's privileges, so the filter needs no
+	// PR_SET_NO_NEW_PRIVS, which would break setuid binaries. It only applies
+	// to this locked thread, which is the one exec'ing the command.
+	if err := applySeccomp(container.Context["seccomp"]); err != nil {
+		return fmt.Errorf("unable to apply seccomp profile: %s", err)
+	}
+
 	syncPipe, err := syncpipe.NewSyncPipeFromFd(0, uintptr(3))
 	if err != nil {
 		return fmt.Errorf("unable to create sync pipe: %s", err)
 	}
 
-	return namespaces.Init(container, "./rootfs", "", syncPipe, os.Args[1:])
+	return namespaces.Init(container, "./rootfs", "", syncPipe, injectInit(container, os.Getenv("hooks"), os.Args[1:]))
 }
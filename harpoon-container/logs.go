@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// maxLogLine matches the line length svlogd is started with by the agent.
+const maxLogLine = 50000
+
+var errLogDatagramTooLarge = errors.New("log datagram too large")
+
+// logForwarder reads what the container writes to stdout and stderr through
+// separate pipes. Every line is passed on unchanged to our stdout, which the
+// agent's svlogd writes to disk, and sent to the agent over UDP, as an
+// agent.LogDatagram tagged with its stream, a sequence number, and the time
+// it was read. Sending is best effort; the lines on disk are complete.
+//
+// Lines exceeding the rate limit aren't sent, so a container logging heavily
+// doesn't flood the agent. The next line sent tells how many were dropped.
+type logForwarder struct {
+	id    string
+	conn  net.Conn // nil if lines aren't sent to the agent
+	out   io.Writer
+	limit logLimit
+
+	sync.Mutex // serializes lines of both streams
+	seq        uint64
+	last       time.Time
+
+	// token buckets of the rate limit
+	lineTokens float64
+	byteTokens float64
+	refilled   time.Time
+	dropped    uint64
+}
+
+// logLimit is the rate at which lines are sent to the agent. Zero disables
+// either limit.
+type logLimit struct {
+	lines float64 // per second
+	bytes float64 // per second
+}
+
+// parseLogLimit reads the limit from its string representations, as passed by
+// the agent. Invalid or missing values disable the limit.
+func parseLogLimit(lineRate, byteRate string) logLimit {
+	var limit logLimit
+
+	if f, err := strconv.ParseFloat(lineRate, 64); err == nil && f >= 0 {
+		limit.lines = f
+	} else if lineRate != "" {
+		log.Printf("invalid log line rate %q", lineRate)
+	}
+
+	if f, err := strconv.ParseFloat(byteRate, 64); err == nil && f >= 0 {
+		limit.bytes = f
+	} else if byteRate != "" {
+		log.Printf("invalid log byte rate %q", byteRate)
+	}
+
+	return limit
+}
+
+func newLogForwarder(id, addr string, out io.Writer, limit logLimit) *logForwarder {
+	f := &logForwarder{id: id, out: out, limit: limit}
+
+	f.lineTokens, f.byteTokens = f.burst()
+
+	if id == "" || addr == "" {
+		return f
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Printf("unable to send logs to %s: %s", addr, err)
+		return f
+	}
+
+	f.conn = conn
+
+	return f
+}
+
+// pipe returns the file the container should write the stream to. The file
+// is shared by all runs of the container. If no pipe can be created, the
+// container writes to our stdout directly, and its lines aren't tagged.
+func (f *logForwarder) pipe(stream string) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("unable to create %s pipe: %s", stream, err)
+		return os.Stdout
+	}
+
+	go f.copy(r, stream)
+
+	return w
+}
+
+func (f *logForwarder) copy(r io.ReadCloser, stream string) {
+	defer r.Close()
+
+	rd := bufio.NewReaderSize(r, maxLogLine)
+
+	for {
+		// longer lines are cut, as svlogd would
+		line, err := rd.ReadSlice('\n')
+		if len(line) > 0 {
+			f.forward(stream, line)
+		}
+
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+func (f *logForwarder) forward(stream string, line []byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	// keep lines in order, even if the clock is stepped back
+	now := time.Now()
+	if !now.After(f.last) {
+		now = f.last.Add(time.Nanosecond)
+	}
+
+	f.last = now
+	f.seq++
+
+	f.out.Write(line)
+
+	if f.conn == nil {
+		return
+	}
+
+	if !f.allow(now, len(line)) {
+		f.dropped++
+		return
+	}
+
+	datagram, err := encodeLogDatagram(agent.LogDatagram{
+		ContainerID: f.id,
+		LogRecord: agent.LogRecord{
+			Time:    now,
+			Stream:  stream,
+			Seq:     f.seq,
+			Line:    string(bytes.TrimRight(line, "\n")),
+			Dropped: f.dropped,
+		},
+	})
+	if err != nil {
+		return
+	}
+
+	f.dropped = 0
+	f.conn.Write(datagram)
+}
+
+// allow takes a line of the given size from the token buckets, and returns
+// false if there aren't enough tokens.
+func (f *logForwarder) allow(now time.Time, size int) bool {
+	if f.limit.lines <= 0 && f.limit.bytes <= 0 {
+		return true
+	}
+
+	var (
+		elapsed              = now.Sub(f.refilled).Seconds()
+		lineBurst, byteBurst = f.burst()
+	)
+
+	f.refilled = now
+	f.lineTokens = math.Min(lineBurst, f.lineTokens+elapsed*f.limit.lines)
+	f.byteTokens = math.Min(byteBurst, f.byteTokens+elapsed*f.limit.bytes)
+
+	if (f.limit.lines > 0 && f.lineTokens < 1) || (f.limit.bytes > 0 && f.byteTokens < float64(size)) {
+		return false
+	}
+
+	f.lineTokens--
+	f.byteTokens -= float64(size)
+
+	return true
+}
+
+// burst returns the capacity of the token buckets: a second's worth of lines
+// and bytes, but at least one line of the maximum length.
+func (f *logForwarder) burst() (float64, float64) {
+	return math.Max(f.limit.lines, 1), math.Max(f.limit.bytes, maxLogLine)
+}
+
+// encodeLogDatagram encodes the datagram, shortening the line until it fits
+// into agent.MaxLogDatagramSize bytes. Escaping makes JSON lines longer than
+// the lines they encode.
+func encodeLogDatagram(d agent.LogDatagram) ([]byte, error) {
+	for {
+		buf, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(buf) <= agent.MaxLogDatagramSize {
+			return buf, nil
+		}
+
+		if d.Line == "" {
+			return nil, errLogDatagramTooLarge
+		}
+
+		excess := len(buf) - agent.MaxLogDatagramSize
+		if excess > len(d.Line) {
+			excess = len(d.Line)
+		}
+
+		d.Line = d.Line[:len(d.Line)-excess]
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"time"
 
@@ -14,6 +15,10 @@ func main() {
 	log.SetFlags(0)
 	log.SetPrefix("harpoon-container: ")
 
+	if os.Args[0] == containerInitPath {
+		os.Exit(initMain(os.Args[1:]))
+	}
+
 	if os.Getpid() == 1 {
 		if err := Init(); err != nil {
 			log.Fatal("failed to initialize container:", err)
@@ -29,13 +34,30 @@ func main() {
 
 		c = &Container{}
 
-		transitionc = make(chan string, 1)
-		transition  chan string
+		transitionc = make(chan agent.HeartbeatReply, 1)
+		transition  chan agent.HeartbeatReply
 
 		statusc   <-chan agent.ContainerProcessStatus
-		desired   string
-		heartbeat = agent.Heartbeat{Status: "UP"}
+		desired   agent.HeartbeatReply
+		heartbeat = agent.Heartbeat{
+			Version: agent.HeartbeatVersion,
+			Status:  agent.HeartbeatStatusUp,
+		}
+	)
+
+	// containers started together must not share a jitter sequence
+	rand.Seed(time.Now().UnixNano() ^ int64(os.Getpid()))
+	c.setHeartbeat(os.Getenv("heartbeat_interval"), os.Getenv("heartbeat_jitter"))
+	c.restart = agent.RestartPolicy(os.Getenv("restart_policy"))
+
+	logs := newLogForwarder(
+		os.Getenv("container_id"),
+		os.Getenv("log_addr"),
+		os.Stdout,
+		parseLogLimit(os.Getenv("log_rate_lines"), os.Getenv("log_rate_bytes")),
 	)
+	c.stdout = logs.pipe(agent.LogStreamStdout)
+	c.stderr = logs.pipe(agent.LogStreamStderr)
 
 	f, err := os.Open("./container.json")
 	if err != nil {
@@ -58,17 +80,20 @@ func main() {
 			}
 
 			heartbeat.ContainerProcessStatus = status
+			heartbeat.ProcessInfo = c.processInfo()
+			heartbeat.Ack = c.acknowledged()
 
 			buf, _ := json.Marshal(status)
 			log.Printf("container status: %s", buf)
 
-			want, err := client.sendHeartbeat(heartbeat)
+			reply, err := client.sendHeartbeat(heartbeat)
 			if err != nil {
 				log.Println("unable to send heartbeat: ", err)
 				continue
 			}
 
-			desired = want
+			c.setInterval(reply.Interval)
+			desired = reply
 			transition = transitionc
 
 		case transition <- desired:
@@ -78,7 +103,9 @@ func main() {
 
 sync:
 
-	heartbeat.Status = "EXITING"
+	heartbeat.Status = agent.HeartbeatStatusExiting
+	heartbeat.ProcessInfo = c.processInfo()
+	heartbeat.Ack = c.acknowledged()
 
 	if c.err != nil {
 		heartbeat.Err = c.err.Error()
@@ -87,10 +114,10 @@ sync:
 
 	// container has exited; make sure that we're synchronized with the host
 	// agent.
-	for desired = ""; desired != "EXIT"; {
-		want, err := client.sendHeartbeat(heartbeat)
+	for want := ""; want != agent.WantExit; {
+		reply, err := client.sendHeartbeat(heartbeat)
 		if err == nil {
-			desired = want
+			want = reply.Want
 			continue
 		}
 
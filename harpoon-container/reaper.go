@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/docker/libcontainer"
+	"github.com/docker/libcontainer/mount"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// The command would run as PID 1 of the container's PID namespace, which
+// must reap the orphaned processes the kernel reparents to it; commands
+// rarely do, so orphans would pile up as zombies. Instead, Init injects this
+// binary into the container, at containerInitPath, and runs it as PID 1 in
+// place of the command. As such, it starts the command in a process group of
+// its own, forwards the signals it gets to that group, reaps every child, and
+// exits with the command's exit status once the command exits. The remaining
+// processes of the container are killed with it, by the kernel.
+//
+// The init also runs the container's hooks, which the agent passes in the
+// hooks environment variable: the pre-start hook before the command, which
+// only starts if the hook succeeds, and the post-stop hook after it exits.
+// Hooks run like the command, and are killed with their process group when
+// they time out. The exit status stays the command's, whatever the post-stop
+// hook's.
+
+// containerInitPath is where the init is mounted in the container. Run with
+// it as argv[0], harpoon-container is the init.
+const containerInitPath = "/.harpoon-init"
+
+// injectInit adds the bind mount of this binary to the container, and
+// returns the args running the command under it, with the JSON-encoded hooks.
+// If the binary can't be found, the command runs as PID 1 itself, without
+// hooks.
+func injectInit(container *libcontainer.Config, hooks string, args []string) []string {
+	exe, err := os.Readlink("/proc/self/exe")
+	if err != nil || container.MountConfig == nil {
+		log.Printf("unable to inject init, running the command as PID 1: %v", err)
+
+		if hooks != "" {
+			log.Printf("hooks won't run without the init")
+		}
+
+		return args
+	}
+
+	container.MountConfig.Mounts = append(container.MountConfig.Mounts, mount.Mount{
+		Type:        "bind",
+		Source:      exe,
+		Destination: containerInitPath,
+		Private:     true,
+	})
+
+	return append([]string{containerInitPath, hooks}, args...)
+}
+
+// initMain runs the hooks and the command in args, which follow the hooks,
+// as children of PID 1, and returns the exit code.
+func initMain(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "harpoon-init: no command")
+		return 127
+	}
+
+	var hooks agent.Hooks
+
+	if args[0] != "" {
+		if err := json.Unmarshal([]byte(args[0]), &hooks); err != nil {
+			fmt.Fprintf(os.Stderr, "harpoon-init: invalid hooks: %s\n", err)
+			return 127
+		}
+	}
+
+	signals := make(chan os.Signal, 32)
+	signal.Notify(signals)
+
+	if hook := hooks.PreStart; hook != nil {
+		code, terminated := run(signals, nil, hook.Exec, hookTimeout(hook))
+		if code != 0 {
+			fmt.Fprintf(os.Stderr, "harpoon-init: pre-start hook exited with %d\n", code)
+			return code
+		}
+
+		if terminated {
+			// stopped while preparing, so don't start
+			return 128 + int(syscall.SIGTERM)
+		}
+	}
+
+	code, _ := run(signals, os.Stdin, args[1:], 0)
+
+	if hook := hooks.PostStop; hook != nil {
+		if hookCode, _ := run(signals, nil, hook.Exec, hookTimeout(hook)); hookCode != 0 {
+			fmt.Fprintf(os.Stderr, "harpoon-init: post-stop hook exited with %d\n", hookCode)
+		}
+	}
+
+	return code
+}
+
+// run starts the command in a process group of its own, forwarding the
+// signals to it, and returns its exit code once it exits, and whether it was
+// asked to terminate meanwhile. Commands killed by a signal exit with 128 plus
+// the signal, as in shells, since PID 1 can't be killed by the signal itself.
+// Unless the timeout is 0, the process group is killed once it passes.
+func run(signals <-chan os.Signal, stdin io.Reader, args []string, timeout time.Duration) (int, bool) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "harpoon-init: %s\n", err)
+		return 127, false
+	}
+
+	var (
+		pid        = cmd.Process.Pid
+		terminated = false
+		expired    <-chan time.Time
+	)
+
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGCHLD:
+				if status, ok := reap(pid); ok {
+					return exitCode(status), terminated
+				}
+
+			case syscall.SIGURG:
+				// used by the Go runtime itself
+
+			case syscall.SIGTERM, syscall.SIGINT:
+				terminated = true
+				syscall.Kill(-pid, sig.(syscall.Signal))
+
+			default:
+				syscall.Kill(-pid, sig.(syscall.Signal))
+			}
+
+		case <-expired:
+			fmt.Fprintf(os.Stderr, "harpoon-init: %s timed out after %s\n", args[0], timeout)
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	}
+}
+
+func hookTimeout(hook *agent.Hook) time.Duration {
+	return time.Duration(hook.Timeout) * time.Second
+}
+
+// reap waits for all exited children, and returns the status of the child
+// with the pid, if it's among them.
+func reap(pid int) (syscall.WaitStatus, bool) {
+	var (
+		exited syscall.WaitStatus
+		found  bool
+	)
+
+	for {
+		var status syscall.WaitStatus
+
+		wpid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err != nil || wpid <= 0 {
+			return exited, found
+		}
+
+		if wpid == pid {
+			exited, found = status, true
+		}
+	}
+}
+
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return status.ExitStatus()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// The vendored libcontainer can't filter syscalls, so Init installs the
+// seccomp filter itself, before namespaces.Init sets up the container. The
+// filter survives the exec of the container's command. As it applies to
+// namespaces.Init too, profiles must not deny the syscalls needed to set up
+// the container, like mount, pivot_root, setuid, or capset.
+
+const (
+	prSetSeccomp      = 22 // PR_SET_SECCOMP
+	seccompModeFilter = 2  // SECCOMP_MODE_FILTER
+
+	seccompRetKill  = 0x00000000 // SECCOMP_RET_KILL
+	seccompRetErrno = 0x00050000 // SECCOMP_RET_ERRNO
+	seccompRetAllow = 0x7fff0000 // SECCOMP_RET_ALLOW
+
+	// offsets into struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// x32SyscallBit is set in the numbers of x32 syscalls, which amd64
+	// kernels report with the amd64 arch.
+	x32SyscallBit = 0x40000000 // __X32_SYSCALL_BIT
+)
+
+// auditArches maps GOARCH to the AUDIT_ARCH_* value the kernel reports for
+// native syscalls.
+var auditArches = map[string]uint32{
+	"amd64": 0xc000003e,
+	"386":   0x40000003,
+	"arm":   0x40000028,
+}
+
+var (
+	// defaultDenied are syscalls administering the host.
+	defaultDenied = []uintptr{
+		syscall.SYS_ACCT,
+		syscall.SYS_ADD_KEY,
+		syscall.SYS_ADJTIMEX,
+		syscall.SYS_CLOCK_SETTIME,
+		syscall.SYS_DELETE_MODULE,
+		syscall.SYS_INIT_MODULE,
+		syscall.SYS_KEXEC_LOAD,
+		syscall.SYS_KEYCTL,
+		syscall.SYS_LOOKUP_DCOOKIE,
+		syscall.SYS_QUOTACTL,
+		syscall.SYS_REBOOT,
+		syscall.SYS_REQUEST_KEY,
+		syscall.SYS_SETTIMEOFDAY,
+		syscall.SYS_SWAPOFF,
+		syscall.SYS_SWAPON,
+		syscall.SYS_VHANGUP,
+	}
+
+	// strictDenied are syscalls tracing or profiling other processes, in
+	// addition to defaultDenied.
+	strictDenied = []uintptr{
+		syscall.SYS_PERF_EVENT_OPEN,
+		syscall.SYS_PERSONALITY,
+		syscall.SYS_PTRACE,
+	}
+)
+
+// applySeccomp installs the filter of the seccomp profile, which denies its
+// syscalls with EPERM. Syscalls of other architectures kill the process, as
+// their numbers differ, and so do x32 syscalls on amd64, which would
+// otherwise get past the deny list with the x32 bit set.
+func applySeccomp(profile string) error {
+	var denied []uintptr
+
+	switch profile {
+	case "", agent.SeccompUnconfined:
+		return nil
+	case agent.SeccompDefault:
+		denied = defaultDenied
+	case agent.SeccompStrict:
+		denied = append(append(denied, defaultDenied...), strictDenied...)
+	default:
+		return fmt.Errorf("unknown seccomp profile %q", profile)
+	}
+
+	arch, ok := auditArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp not supported on %s", runtime.GOARCH)
+	}
+
+	filter := []syscall.SockFilter{
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, arch, 1, 0),
+		bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKill),
+		bpfStmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+	}
+
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKill),
+		)
+	}
+
+	for _, nr := range denied {
+		filter = append(filter,
+			bpfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, uint32(nr), 0, 1),
+			bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetErrno|uint32(syscall.EPERM)),
+		)
+	}
+
+	filter = append(filter, bpfStmt(syscall.BPF_RET|syscall.BPF_K, seccompRetAllow))
+
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_SECCOMP): %s", errno)
+	}
+
+	return nil
+}
+
+func bpfStmt(code uint16, k uint32) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+	return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// layoutDirs are the directories agents mount filesystems on. The rootfs is
+// mounted read-only, so they must exist in the artifact.
+var layoutDirs = []struct {
+	name string
+	mode os.FileMode
+}{
+	{"/dev", 0755},
+	{"/etc", 0755},
+	{"/proc", 0555},
+	{"/sys", 0555},
+	{"/tmp", os.ModeSticky | 0777},
+}
+
+// layoutFiles are the files agents bind-mount host files on.
+var layoutFiles = []string{
+	"/etc/harpoon.env",
+	"/etc/resolv.conf",
+}
+
+var errUnsupportedFile = errors.New("only directories, regular files, and symlinks can be packaged")
+
+// artifactWriter writes entries of the artifact, owned by root, and each
+// only once.
+type artifactWriter struct {
+	*tar.Writer
+	modTime time.Time
+	written map[string]bool
+}
+
+// writeArtifact writes the artifact as .tar.gz to w: the base, if any, the
+// directories and files agents expect, and the binary or directory at the
+// path given by the manifest.
+func writeArtifact(w io.Writer, source string, isDir bool, m manifest) error {
+	gz := gzip.NewWriter(w)
+
+	aw := &artifactWriter{
+		Writer:  tar.NewWriter(gz),
+		modTime: time.Now(),
+		written: map[string]bool{},
+	}
+
+	if m.Base != "" {
+		if err := aw.copyBase(m.Base); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range layoutDirs {
+		if err := aw.dir(dir.name, dir.mode); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range m.Dirs {
+		if err := aw.dir(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range layoutFiles {
+		if err := aw.file(file, 0644, 0, strings.NewReader("")); err != nil {
+			return err
+		}
+	}
+
+	if err := aw.source(source, isDir, m.Path); err != nil {
+		return err
+	}
+
+	if err := aw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// copyBase copies the entries of the .tar.gz base rootfs as they are.
+func (aw *artifactWriter) copyBase(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			aw.written[name] = true
+		}
+
+		if err := aw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(aw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// dir writes the directory, and its parents, unless they were written.
+func (aw *artifactWriter) dir(name string, mode os.FileMode) error {
+	name = path.Clean(name)
+
+	if name == "/" || aw.written[name] {
+		return nil
+	}
+
+	if err := aw.dir(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	aw.written[name] = true
+
+	return aw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(name, "/") + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     tarMode(mode),
+		ModTime:  aw.modTime,
+	})
+}
+
+func (aw *artifactWriter) file(name string, mode os.FileMode, size int64, r io.Reader) error {
+	if err := aw.dir(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	if err := aw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(path.Clean(name), "/"),
+		Typeflag: tar.TypeReg,
+		Mode:     tarMode(mode),
+		Size:     size,
+		ModTime:  aw.modTime,
+	}); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(aw, r)
+	return err
+}
+
+func (aw *artifactWriter) symlink(name, target string) error {
+	if err := aw.dir(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	return aw.WriteHeader(&tar.Header{
+		Name:     strings.TrimPrefix(path.Clean(name), "/"),
+		Typeflag: tar.TypeSymlink,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  aw.modTime,
+	})
+}
+
+// source writes the binary or directory to dst. Files are readable by
+// everyone, and executable by everyone if they were executable by anyone, as
+// containers run as an unprivileged user.
+func (aw *artifactWriter) source(source string, isDir bool, dst string) error {
+	if !isDir {
+		return aw.hostFile(source, dst, 0755)
+	}
+
+	return filepath.Walk(source, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(dst, filepath.ToSlash(rel))
+
+		switch {
+		case fi.IsDir():
+			return aw.dir(name, 0755)
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+
+			return aw.symlink(name, target)
+
+		case fi.Mode().IsRegular():
+			mode := os.FileMode(0644)
+			if fi.Mode()&0111 != 0 {
+				mode = 0755
+			}
+
+			return aw.hostFile(p, name, mode)
+
+		default:
+			return &os.PathError{Op: "package", Path: p, Err: errUnsupportedFile}
+		}
+	})
+}
+
+func (aw *artifactWriter) hostFile(filename, name string, mode os.FileMode) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return aw.file(name, mode, fi.Size(), f)
+}
+
+// tarMode converts the permission bits and sticky bit to the tar header mode.
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode.Perm())
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
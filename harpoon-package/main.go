@@ -0,0 +1,139 @@
+// harpoon-package builds a harpoon artifact, a rootfs .tar.gz, from a binary
+// or directory, and optionally uploads it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	var (
+		manifestPath = flag.String("manifest", "", "JSON manifest describing the artifact (optional)")
+		output       = flag.String("o", "", "file to write the artifact to (default NAME.tar.gz)")
+		uploadURL    = flag.String("upload", "", "URL to PUT the artifact to, e.g. on an artifact store (empty to only write it)")
+		storeURL     = flag.String("store", "", "base URL of a harpoon-artifactd to upload the artifact to, named by its sha256 (empty to only write it)")
+	)
+
+	log.SetFlags(0)
+	log.SetPrefix("harpoon-package: ")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] BINARY|DIRECTORY\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source := flag.Arg(0)
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m, err := loadManifest(*manifestPath)
+	if err != nil {
+		log.Fatalf("unable to load manifest: %s", err)
+	}
+
+	name := strings.TrimSuffix(filepath.Base(source), filepath.Ext(source))
+	m.defaults(name, fi.IsDir())
+
+	if err := m.valid(); err != nil {
+		log.Fatalf("invalid manifest: %s", err)
+	}
+
+	if *output == "" {
+		*output = name + ".tar.gz"
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := writeArtifact(f, source, fi.IsDir(), m); err != nil {
+		f.Close()
+		os.Remove(*output)
+		log.Fatalf("unable to write artifact: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %s, with the %s at %s", *output, kind(fi.IsDir()), m.Path)
+
+	switch {
+	case *storeURL != "":
+		url, err := upload(*output, "POST", strings.TrimRight(*storeURL, "/")+"/artifacts")
+		if err != nil {
+			log.Fatalf("unable to upload %s: %s", *output, err)
+		}
+
+		fmt.Println(url)
+
+	case *uploadURL != "":
+		if _, err := upload(*output, "PUT", *uploadURL); err != nil {
+			log.Fatalf("unable to upload %s: %s", *output, err)
+		}
+
+		if !strings.HasSuffix(*uploadURL, ".tar.gz") {
+			log.Printf("warning: agents only fetch artifact URLs ending in .tar.gz")
+		}
+
+		fmt.Println(*uploadURL)
+	}
+}
+
+func kind(isDir bool) string {
+	if isDir {
+		return "directory"
+	}
+	return "binary"
+}
+
+// upload sends the file to the URL, and returns the Location of the
+// uploaded artifact, if the server names it.
+func upload(path, method, url string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(method, url, f)
+	if err != nil {
+		return "", err
+	}
+
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	return resp.Header.Get("Location"), nil
+}
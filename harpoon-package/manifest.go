@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// manifest describes how the artifact is laid out. All fields are optional.
+type manifest struct {
+	// Path is where the binary or directory goes in the rootfs. Binaries go
+	// to /bin/NAME, and directories to /srv/NAME by default.
+	Path string `json:"path"`
+
+	// Base is a .tar.gz rootfs the artifact is built upon, e.g. busybox, for
+	// a shell and the usual tools. Relative to the manifest.
+	Base string `json:"base"`
+
+	// Dirs are additional empty directories, e.g. where volumes are mounted.
+	Dirs []string `json:"dirs"`
+}
+
+// loadManifest reads the manifest from the file. An empty path returns an
+// empty manifest.
+func loadManifest(filename string) (manifest, error) {
+	var m manifest
+
+	if filename == "" {
+		return m, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return m, err
+	}
+
+	if m.Base != "" && !filepath.IsAbs(m.Base) {
+		m.Base = filepath.Join(filepath.Dir(filename), m.Base)
+	}
+
+	return m, nil
+}
+
+// defaults fills in the path of the binary or directory with the given name.
+func (m *manifest) defaults(name string, isDir bool) {
+	if m.Path != "" {
+		return
+	}
+
+	if isDir {
+		m.Path = path.Join("/srv", name)
+	} else {
+		m.Path = path.Join("/bin", name)
+	}
+}
+
+func (m manifest) valid() error {
+	if !path.IsAbs(m.Path) || path.Clean(m.Path) == "/" {
+		return fmt.Errorf("path %q must be absolute, and not the root", m.Path)
+	}
+
+	for _, dir := range m.Dirs {
+		if !path.IsAbs(dir) {
+			return fmt.Errorf("dir %q must be absolute", dir)
+		}
+	}
+
+	return nil
+}
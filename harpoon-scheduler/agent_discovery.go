@@ -1,5 +1,7 @@
 package main
 
+import "sort"
+
 // agentDiscovery allows components to find out about the set of agent
 // endpoints available in a scheduling domain.
 type agentDiscovery interface {
@@ -13,3 +15,44 @@ type staticAgentDiscovery []string
 func (d staticAgentDiscovery) endpoints() []string    { return []string(d) }
 func (d staticAgentDiscovery) notify(chan<- []string) { return }
 func (d staticAgentDiscovery) stop(chan<- []string)   { return }
+
+// clusterDiscovery is implemented by agent discoveries which put the agents
+// they find in clusters, rather than leaving it to the agents' cluster label.
+type clusterDiscovery interface {
+	clusters() map[string]string // endpoint: cluster
+}
+
+// discoveredClusters returns the clusters the discovery put agents in, if
+// any.
+func discoveredClusters(d agentDiscovery) map[string]string {
+	if cd, ok := d.(clusterDiscovery); ok {
+		return cd.clusters()
+	}
+	return map[string]string{}
+}
+
+// staticClusterDiscovery is a static set of agents, some of which are put in
+// a cluster. Agents with an empty cluster are in the cluster of their label.
+type staticClusterDiscovery map[string]string // endpoint: cluster
+
+func (d staticClusterDiscovery) endpoints() []string {
+	endpoints := make([]string, 0, len(d))
+	for endpoint := range d {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+func (d staticClusterDiscovery) clusters() map[string]string {
+	m := map[string]string{}
+	for endpoint, cluster := range d {
+		if cluster != "" {
+			m[endpoint] = cluster
+		}
+	}
+	return m
+}
+
+func (d staticClusterDiscovery) notify(chan<- []string) { return }
+func (d staticClusterDiscovery) stop(chan<- []string)   { return }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+)
+
+// agentQueue runs the transformer's operations against one agent, so they
+// don't interleave badly, e.g. a start racing a delete of the same container.
+// Operations run in the order they were queued, at most concurrency at a
+// time, and never more than one per container. An operation which is already
+// queued or running for its container isn't queued again.
+type agentQueue struct {
+	sync.Mutex
+	endpoint string
+	pending  []agentOp
+	running  map[string]operationKind // container ID: operation
+	run      func(agentOp)
+
+	wake chan struct{}
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// agentOp is an operation on one container, run by an agentQueue.
+type agentOp struct {
+	containerID string
+	taskSpec    taskSpec
+	kind        operationKind
+	source      *moveSource // for moves: where the container runs now, if anywhere
+}
+
+// moveSource is the agent a container is moved away from.
+type moveSource struct {
+	taskSpec     taskSpec
+	stateMachine *stateMachine
+}
+
+// opRestart restarts an exited container in place. It's not tracked by the
+// registry, which only knows about schedules, unschedules, and moves.
+const opRestart operationKind = "restart"
+
+func newAgentQueue(endpoint string, concurrency int, run func(agentOp)) *agentQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	q := &agentQueue{
+		endpoint: endpoint,
+		running:  map[string]operationKind{},
+		run:      run,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	q.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go q.work()
+	}
+	setAgentQueueDepth(endpoint, 0)
+	return q
+}
+
+// push queues the operation, unless the same operation is already queued or
+// running for the container. It returns true if the operation was queued.
+func (q *agentQueue) push(op agentOp) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if kind, ok := q.running[op.containerID]; ok && kind == op.kind {
+		return false
+	}
+	for _, pending := range q.pending {
+		if pending.containerID == op.containerID && pending.kind == op.kind {
+			return false
+		}
+	}
+	q.pending = append(q.pending, op)
+	setAgentQueueDepth(q.endpoint, len(q.pending))
+	q.signal()
+	return true
+}
+
+// signal wakes up a waiting worker. It must be called with the lock held.
+func (q *agentQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the first queued operation whose container has no
+// operation running.
+func (q *agentQueue) next() (agentOp, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, op := range q.pending {
+		if _, ok := q.running[op.containerID]; ok {
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.running[op.containerID] = op.kind
+		setAgentQueueDepth(q.endpoint, len(q.pending))
+		if len(q.pending) > 0 {
+			q.signal() // there may be more for other workers
+		}
+		return op, true
+	}
+	return agentOp{}, false
+}
+
+func (q *agentQueue) done(op agentOp) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.running, op.containerID)
+	if len(q.pending) > 0 {
+		q.signal() // the next operation on the container may run now
+	}
+}
+
+func (q *agentQueue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.wake:
+			for {
+				op, ok := q.next()
+				if !ok {
+					break
+				}
+				q.run(op)
+				q.done(op)
+
+				select {
+				case <-q.quit:
+					return
+				default:
+				}
+			}
+
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// stop waits for running operations to finish, and returns the operations
+// which were still queued.
+func (q *agentQueue) stop() []agentOp {
+	close(q.quit)
+	q.wg.Wait()
+
+	q.Lock()
+	defer q.Unlock()
+	dropped := q.pending
+	q.pending = nil
+	setAgentQueueDepth(q.endpoint, 0)
+	return dropped
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgentQueue(t *testing.T) {
+	var (
+		started = make(chan agentOp)
+		release = make(chan struct{})
+	)
+	q := newAgentQueue("http://nowhere", 2, func(op agentOp) {
+		started <- op
+		<-release
+	})
+
+	var (
+		aSchedule   = agentOp{containerID: "a", kind: opSchedule}
+		aUnschedule = agentOp{containerID: "a", kind: opUnschedule}
+		bSchedule   = agentOp{containerID: "b", kind: opSchedule}
+	)
+	for _, op := range []agentOp{aSchedule, aUnschedule, bSchedule} {
+		if !q.push(op) {
+			t.Fatalf("%s %s not queued", op.kind, op.containerID)
+		}
+	}
+	if q.push(aSchedule) {
+		t.Errorf("duplicate operation queued")
+	}
+
+	next := func() agentOp {
+		select {
+		case op := <-started:
+			return op
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for an operation to start")
+		}
+		panic("unreachable")
+	}
+	key := func(op agentOp) string { return op.containerID + " " + string(op.kind) }
+
+	// Two at once, but the unschedule of a waits for its schedule.
+	first := map[string]bool{key(next()): true, key(next()): true}
+	if !first[key(aSchedule)] || !first[key(bSchedule)] {
+		t.Fatalf("expected the schedules of a and b to run first, got %v", first)
+	}
+	select {
+	case op := <-started:
+		t.Fatalf("%s %s started beyond the concurrency limit", op.kind, op.containerID)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	release <- struct{}{}
+	release <- struct{}{}
+	if op := next(); key(op) != key(aUnschedule) {
+		t.Errorf("expected the unschedule of a, got %s %s", op.kind, op.containerID)
+	}
+	release <- struct{}{}
+
+	if dropped := q.stop(); len(dropped) != 0 {
+		t.Errorf("dropped %v", dropped)
+	}
+}
@@ -8,14 +8,21 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 
+	"github.com/soundcloud/harpoon/harpoon-agent/client"
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
 )
 
 func TestMockAgent(t *testing.T) {
@@ -31,15 +38,18 @@ func TestMockAgent(t *testing.T) {
 		method, path string
 		count        *int32
 	}{
-		{"GET", apiVersionPrefix + r.Replace(apiGetContainersPath), &mockAgent.getContainersCount},
-		{"PUT", apiVersionPrefix + r.Replace(apiPutContainerPath), &mockAgent.putContainerCount},
-		{"GET", apiVersionPrefix + r.Replace(apiGetContainerPath), &mockAgent.getContainerCount},
-		{"DELETE", apiVersionPrefix + r.Replace(apiDeleteContainerPath), &mockAgent.deleteContainerCount},
-		{"POST", apiVersionPrefix + strings.Replace(r.Replace(apiPostContainerPath), ":action", "start", 1), &mockAgent.postContainerCount},
-		{"POST", apiVersionPrefix + strings.Replace(r.Replace(apiPostContainerPath), ":action", "stop", 1), &mockAgent.postContainerCount},
-		{"POST", apiVersionPrefix + strings.Replace(r.Replace(apiPostContainerPath), ":action", "restart", 1), &mockAgent.postContainerCount},
-		{"GET", apiVersionPrefix + r.Replace(apiGetContainerLogPath), &mockAgent.getContainerLogCount},
-		{"GET", apiVersionPrefix + r.Replace(apiGetResourcesPath), &mockAgent.getResourcesCount},
+		{"GET", client.APIVersionPrefix + r.Replace(client.APIGetContainersPath), &mockAgent.getContainersCount},
+		{"PUT", client.APIVersionPrefix + r.Replace(client.APIPutContainerPath), &mockAgent.putContainerCount},
+		{"GET", client.APIVersionPrefix + r.Replace(client.APIGetContainerPath), &mockAgent.getContainerCount},
+		{"DELETE", client.APIVersionPrefix + r.Replace(client.APIDeleteContainerPath), &mockAgent.deleteContainerCount},
+		{"POST", client.APIVersionPrefix + strings.Replace(r.Replace(client.APIPostContainerPath), ":action", "start", 1), &mockAgent.postContainerCount},
+		{"POST", client.APIVersionPrefix + strings.Replace(r.Replace(client.APIPostContainerPath), ":action", "stop", 1), &mockAgent.postContainerCount},
+		{"POST", client.APIVersionPrefix + strings.Replace(r.Replace(client.APIPostContainerPath), ":action", "restart", 1), &mockAgent.postContainerCount},
+		{"GET", client.APIVersionPrefix + r.Replace(client.APIGetContainerLogPath), &mockAgent.getContainerLogCount},
+		{"GET", client.APIVersionPrefix + r.Replace(client.APIGetResourcesPath), &mockAgent.getResourcesCount},
+		{"GET", client.APIVersionPrefix + client.APIGetHostPath, &mockAgent.getHostCount},
+		{"GET", client.APIVersionPrefix + client.APIGetVersionPath, &mockAgent.getVersionCount},
+		{"GET", client.APIVersionPrefix + client.APIGetArtifactsPath, &mockAgent.getArtifactsCount},
 	} {
 		method, path, count := tuple.method, tuple.path, tuple.count
 		pre := atomic.LoadInt32(count)
@@ -62,6 +72,102 @@ func TestMockAgent(t *testing.T) {
 	}
 }
 
+func TestRemoteAgentFilterContainers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	for id, config := range map[string]agent.ContainerConfig{
+		"a1": agent.ContainerConfig{JobName: "alpha", TaskName: "web", Labels: agent.Labels{"env": "prod", "team": "a"}},
+		"a2": agent.ContainerConfig{JobName: "alpha", TaskName: "web", Labels: agent.Labels{"env": "dev"}},
+		"a3": agent.ContainerConfig{JobName: "alpha", TaskName: "worker"},
+		"b1": agent.ContainerConfig{JobName: "beta", TaskName: "web"},
+	} {
+		mockAgent.instances[id] = agent.ContainerInstance{ID: id, Status: agent.ContainerStatusRunning, Config: config}
+	}
+
+	remoteAgent, err := newRemoteAgent(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tuple := range []struct {
+		filter   agent.ContainerFilter
+		expected []string
+	}{
+		{agent.ContainerFilter{}, []string{"a1", "a2", "a3", "b1"}},
+		{agent.ContainerFilter{JobName: "alpha"}, []string{"a1", "a2", "a3"}},
+		{agent.ContainerFilter{JobName: "alpha", TaskName: "web"}, []string{"a1", "a2"}},
+		{agent.ContainerFilter{TaskName: "web", Offset: 1, Limit: 1}, []string{"a2"}},
+		{agent.ContainerFilter{Status: agent.ContainerStatusFinished}, []string{}},
+		{agent.ContainerFilter{Offset: 10}, []string{}},
+		{agent.ContainerFilter{Labels: agent.Labels{"env": "prod"}}, []string{"a1"}},
+		{agent.ContainerFilter{Labels: agent.Labels{"env": "prod", "team": "b"}}, []string{}},
+	} {
+		containerInstances, err := remoteAgent.FilterContainers(tuple.filter)
+		if err != nil {
+			t.Errorf("%+v: %s", tuple.filter, err)
+			continue
+		}
+		got := []string{}
+		for _, containerInstance := range containerInstances {
+			got = append(got, containerInstance.ID)
+		}
+		if !reflect.DeepEqual(tuple.expected, got) {
+			t.Errorf("%+v: expected %v, got %v", tuple.filter, tuple.expected, got)
+		}
+	}
+}
+
+func TestParseContainerFilterLabels(t *testing.T) {
+	filter, err := agent.ParseContainerFilter(url.Values{"label": {"env=prod", "owner=a=b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := (agent.Labels{"env": "prod", "owner": "a=b"}), filter.Labels; !reflect.DeepEqual(want, have) {
+		t.Errorf("want labels %v, have %v", want, have)
+	}
+	if want, have := "label=env%3Dprod&label=owner%3Da%3Db", filter.Values().Encode(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	if _, err := agent.ParseContainerFilter(url.Values{"label": {"env"}}); err == nil {
+		t.Errorf("expected error for label without value, got none")
+	}
+}
+
+func TestLabelsValid(t *testing.T) {
+	if err := (agent.Labels{"team": "a", "cost-center": ""}).Valid(); err != nil {
+		t.Errorf("expected valid labels, got %s", err)
+	}
+	for _, name := range []string{"", "a=b", "a\nb"} {
+		if err := (agent.Labels{name: "x"}).Valid(); err == nil {
+			t.Errorf("%q: expected error, got none", name)
+		}
+	}
+}
+
+func TestStateMachineAPIVersion(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	stateMachine, err := newStateMachine(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.stop()
+
+	mockAgent.apiVersions = []string{"v1"}
+	if _, err := newStateMachine(s.URL); err == nil {
+		t.Fatal("expected error for agent speaking an unknown API version, got none")
+	}
+}
+
 type mockAgent struct {
 	*httprouter.Router
 
@@ -70,7 +176,11 @@ type mockAgent struct {
 	changesIn  chan map[string]agent.ContainerInstance
 	changesOut map[string]chan map[string]agent.ContainerInstance
 
-	getContainersCount, putContainerCount, getContainerCount, deleteContainerCount, postContainerCount, getContainerLogCount, getResourcesCount int32
+	apiVersions         []string
+	configSchemaVersion int
+	lastPort            uint16
+
+	getContainersCount, putContainerCount, getContainerCount, deleteContainerCount, postContainerCount, getContainerLogCount, getResourcesCount, getHostCount, getVersionCount, getArtifactsCount int32
 }
 
 func newMockAgent() *mockAgent {
@@ -79,15 +189,21 @@ func newMockAgent() *mockAgent {
 		instances:  map[string]agent.ContainerInstance{},
 		changesIn:  make(chan map[string]agent.ContainerInstance),
 		changesOut: map[string]chan map[string]agent.ContainerInstance{},
+
+		apiVersions:         []string{agent.APIVersion},
+		configSchemaVersion: agent.ConfigSchemaVersion,
 	}
 	go demux(c.changesIn, &c.RWMutex, c.changesOut)
-	c.Router.GET(apiVersionPrefix+apiGetContainersPath, c.getContainers)
-	c.Router.PUT(apiVersionPrefix+apiPutContainerPath, c.putContainer)
-	c.Router.GET(apiVersionPrefix+apiGetContainerPath, c.getContainer)
-	c.Router.DELETE(apiVersionPrefix+apiDeleteContainerPath, c.deleteContainer)
-	c.Router.POST(apiVersionPrefix+apiPostContainerPath, c.postContainer)
-	c.Router.GET(apiVersionPrefix+apiGetContainerLogPath, c.getContainerLog)
-	c.Router.GET(apiVersionPrefix+apiGetResourcesPath, c.getResources)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetContainersPath, c.getContainers)
+	c.Router.PUT(client.APIVersionPrefix+client.APIPutContainerPath, c.putContainer)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetContainerPath, c.getContainer)
+	c.Router.DELETE(client.APIVersionPrefix+client.APIDeleteContainerPath, c.deleteContainer)
+	c.Router.POST(client.APIVersionPrefix+client.APIPostContainerPath, c.postContainer)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetContainerLogPath, c.getContainerLog)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetResourcesPath, c.getResources)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetHostPath, c.getHost)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetVersionPath, c.getVersion)
+	c.Router.GET(client.APIVersionPrefix+client.APIGetArtifactsPath, c.getArtifacts)
 	return c
 }
 
@@ -122,7 +238,14 @@ func (c *mockAgent) getContainers(w http.ResponseWriter, r *http.Request, p http
 		c.getContainerEvents(w, r, p)
 		return
 	}
-	json.NewEncoder(w).Encode(c.getContainerInstances())
+	filter, err := agent.ParseContainerFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	containerInstances := c.getContainerInstances()
+	sort.Sort(containerInstancesByID(containerInstances))
+	json.NewEncoder(w).Encode(filter.Apply(containerInstances))
 }
 
 func (c *mockAgent) getContainerEvents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -134,7 +257,7 @@ func (c *mockAgent) getContainerEvents(w http.ResponseWriter, r *http.Request, p
 		panic("ResponseWriter not Flusher")
 	}
 
-	if err := mockWriteContainerStreamEvent(w, agent.ContainerInstancesEventName, c.getContainerInstances()); err != nil {
+	if err := mockWriteContainerStreamEvent(w, c.getContainerInstances()); err != nil {
 		log.Printf("mockAgent getContainerEvents: encountered error when writing first event: %s", err)
 		return
 	}
@@ -162,7 +285,7 @@ func (c *mockAgent) getContainerEvents(w http.ResponseWriter, r *http.Request, p
 		select {
 		case change := <-changes:
 			for _, containerInstance := range change {
-				if err := mockWriteContainerStreamEvent(w, agent.ContainerInstanceEventName, containerInstance); err != nil {
+				if err := mockWriteContainerStreamEvent(w, containerInstance); err != nil {
 					log.Printf("mockAgent getContainerEvents: encountered error when writing event: %s", err)
 					return
 				}
@@ -175,17 +298,13 @@ func (c *mockAgent) getContainerEvents(w http.ResponseWriter, r *http.Request, p
 	}
 }
 
-func mockWriteContainerStreamEvent(w io.Writer, eventName string, v interface{}) error {
-	if _, err := fmt.Fprintf(w, "%s\n", eventName); err != nil {
+func mockWriteContainerStreamEvent(w io.Writer, event agent.ContainerEvent) error {
+	buf, err := json.Marshal(event.EventBody().Self)
+	if err != nil {
 		return err
 	}
-	if err := json.NewEncoder(w).Encode(v); err != nil {
-		return err
-	}
-	if _, err := fmt.Fprintf(w, "\n"); err != nil {
-		return err
-	}
-	return nil
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.EventName(), buf)
+	return err
 }
 
 func (c *mockAgent) putContainer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -207,23 +326,56 @@ func (c *mockAgent) putContainer(w http.ResponseWriter, r *http.Request, p httpr
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	instance := agent.ContainerInstance{
-		ID:     id,
-		Status: agent.ContainerStatusRunning,
-		Config: config,
-	}
 
 	// Just PUT, don't start.
-	func() {
+	instance := func() agent.ContainerInstance {
 		c.Lock()
 		defer c.Unlock()
-		c.instances[id] = instance
+		c.resolvePorts(&config)
+		c.instances[id] = agent.ContainerInstance{
+			ID:     id,
+			Status: agent.ContainerStatusRunning,
+			Config: config,
+		}
+		return c.instances[id]
 	}()
 	c.changesIn <- map[string]agent.ContainerInstance{id: instance}
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// resolvePorts allocates the ports and port ranges which the config leaves
+// to the agent, and passes them in the environment, like agents do.
+func (c *mockAgent) resolvePorts(config *agent.ContainerConfig) {
+	allocate := func(count int) uint16 {
+		if c.lastPort == 0 {
+			c.lastPort = 30000
+		}
+		start := c.lastPort + 1
+		c.lastPort += uint16(count)
+		return start
+	}
+	if config.Env == nil && (len(config.Ports) > 0 || len(config.PortRanges) > 0) {
+		config.Env = map[string]string{}
+	}
+	for name, port := range config.Ports {
+		if port == 0 {
+			port = allocate(1)
+		}
+		config.Ports[name] = port
+		config.Env[agent.PortEnv(name)] = strconv.Itoa(int(port))
+	}
+	for name, portRange := range config.PortRanges {
+		if portRange.Start == 0 {
+			portRange.Start = allocate(portRange.Size())
+		}
+		config.PortRanges[name] = portRange
+		config.Env[agent.PortEnv(name)] = strconv.Itoa(int(portRange.Start))
+		config.Env[agent.PortEnv(name)+"_START"] = strconv.Itoa(int(portRange.Start))
+		config.Env[agent.PortEnv(name)+"_END"] = strconv.Itoa(int(portRange.End()))
+	}
+}
+
 func (c *mockAgent) getContainer(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	defer atomic.AddInt32(&c.getContainerCount, 1)
 	id := p.ByName("id")
@@ -276,7 +428,17 @@ func (c *mockAgent) postContainer(w http.ResponseWriter, r *http.Request, p http
 	}
 	switch action := p.ByName("action"); action {
 	case "start":
-		writeError(w, http.StatusNotImplemented, fmt.Errorf("start not yet implemented"))
+		c.Lock()
+		defer c.Unlock()
+		containerInstance, ok := c.instances[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%q unknown; can't start", id))
+			return
+		}
+		containerInstance.Status = agent.ContainerStatusRunning
+		c.instances[id] = containerInstance
+		w.WriteHeader(http.StatusAccepted)
+		go func() { c.changesIn <- map[string]agent.ContainerInstance{id: containerInstance} }()
 
 	case "stop":
 		c.Lock()
@@ -320,3 +482,559 @@ func (c *mockAgent) getResources(w http.ResponseWriter, r *http.Request, p httpr
 		Volumes: []string{"/data/analytics-kibana", "/data/mysql000", "/data/mysql001"},
 	})
 }
+
+func (c *mockAgent) getHost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&c.getHostCount, 1)
+	json.NewEncoder(w).Encode(agent.HostInfo{
+		Hostname:      "mock",
+		KernelVersion: "3.16.0",
+		CgroupDriver:  "cgroupfs",
+		Namespaces:    []string{"ipc", "mnt", "net", "pid", "uts"},
+		AgentVersion:  "mock",
+	})
+}
+
+func (c *mockAgent) getVersion(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&c.getVersionCount, 1)
+	json.NewEncoder(w).Encode(agent.VersionInfo{
+		Version:             "mock",
+		APIVersions:         c.apiVersions,
+		ConfigSchemaVersion: c.configSchemaVersion,
+	})
+}
+
+// getArtifacts reports the artifacts of the containers as cached.
+func (c *mockAgent) getArtifacts(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	defer atomic.AddInt32(&c.getArtifactsCount, 1)
+	c.RLock()
+	defer c.RUnlock()
+	artifacts := []agent.Artifact{}
+	for _, containerInstance := range c.instances {
+		if containerInstance.Config.ArtifactURL != "" {
+			artifacts = append(artifacts, agent.Artifact{URL: containerInstance.Config.ArtifactURL})
+		}
+	}
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+// fail makes the container fail, as if its process had crashed.
+func (c *mockAgent) fail(id string) {
+	c.Lock()
+	containerInstance := c.instances[id]
+	containerInstance.Status = agent.ContainerStatusFailed
+	c.instances[id] = containerInstance
+	c.Unlock()
+	c.changesIn <- map[string]agent.ContainerInstance{id: containerInstance}
+}
+
+type containerInstancesByID []agent.ContainerInstance
+
+func (a containerInstancesByID) Len() int           { return len(a) }
+func (a containerInstancesByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a containerInstancesByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func TestRemoteAgentRetriesUnavailable(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var config agent.ContainerConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil || config.JobName != "foo" {
+			t.Errorf("request %d: bad body (%v, %q)", atomic.LoadInt32(&requests)+1, err, config.JobName)
+		}
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "recovering containers", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer s.Close()
+
+	remoteAgent, err := newRemoteAgent(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteAgent.Put("foo-bar-baz", agent.ContainerConfig{JobName: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := int32(2), atomic.LoadInt32(&requests); want != have {
+		t.Errorf("want %d requests, have %d", want, have)
+	}
+}
+
+func TestRemoteAgentPutExisting(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	conflict := agent.ConfigConflict{{
+		Field:     "artifact_url",
+		Existing:  json.RawMessage(`"http://a/1.tar.gz"`),
+		Requested: json.RawMessage(`"http://a/2.tar.gz"`),
+	}}
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/same") {
+			json.NewEncoder(w).Encode(agent.ContainerInstance{ID: "same"})
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status_code":     http.StatusConflict,
+			"status_text":     http.StatusText(http.StatusConflict),
+			"error":           conflict.Error(),
+			"config_conflict": conflict,
+		})
+	}))
+	defer s.Close()
+
+	remoteAgent, err := newRemoteAgent(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteAgent.Put("same", agent.ContainerConfig{JobName: "foo"}); err != nil {
+		t.Errorf("want repeated PUT to succeed, have %v", err)
+	}
+	have, ok := remoteAgent.Put("different", agent.ContainerConfig{JobName: "foo"}).(agent.ConfigConflict)
+	if !ok {
+		t.Fatalf("want %T", conflict)
+	}
+	if want := conflict; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestRemoteAgentErrorCodes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/coded") {
+			errors.Write(w, http.StatusConflict, errors.New(http.StatusConflict, errors.ContainerLimit, "too many containers"))
+			return
+		}
+		http.Error(w, "gone", http.StatusNotFound) // agents without codes
+	}))
+	defer s.Close()
+
+	remoteAgent, err := newRemoteAgent(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = remoteAgent.Put("coded", agent.ContainerConfig{JobName: "foo"})
+	if _, ok := err.(*errors.Error); !ok {
+		t.Fatalf("want %T, have %T", &errors.Error{}, err)
+	}
+	if want, have := errors.ContainerLimit, errors.CodeOf(err); want != have {
+		t.Errorf("want code %q, have %q", want, have)
+	}
+	if want, have := "too many containers", err.Error(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+
+	_, err = remoteAgent.Get("uncoded")
+	if want, have := errors.NotFound, errors.CodeOf(err); want != have {
+		t.Errorf("want code %q, have %q", want, have)
+	}
+}
+
+func TestAgentWaitHelpers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	s := httptest.NewServer(newMockAgent())
+	defer s.Close()
+
+	remoteAgent, err := newRemoteAgent(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	containerInstance, err := agent.PutAndWait(remoteAgent, "foo", agent.ContainerConfig{JobName: "foo"}, time.Second)
+	if err != nil {
+		t.Fatalf("PutAndWait: %s", err)
+	}
+	if want, have := agent.ContainerStatus(agent.ContainerStatusRunning), containerInstance.Status; want != have {
+		t.Errorf("PutAndWait: want %s, have %s", want, have)
+	}
+
+	if containerInstance, err = agent.StopAndWait(remoteAgent, "foo", time.Second); err != nil {
+		t.Fatalf("StopAndWait: %s", err)
+	}
+	if want, have := agent.ContainerStatus(agent.ContainerStatusFinished), containerInstance.Status; want != have {
+		t.Errorf("StopAndWait: want %s, have %s", want, have)
+	}
+
+	// The initial snapshot already has the finished container.
+	if _, err := agent.WaitForStatus(remoteAgent, "foo", time.Second, agent.ContainerStatusFinished); err != nil {
+		t.Errorf("WaitForStatus: %s", err)
+	}
+	if _, err := agent.WaitForStatus(remoteAgent, "foo", time.Second, agent.ContainerStatusRunning); err == nil {
+		t.Errorf("WaitForStatus: want error for finished container, have none")
+	}
+	if _, err := agent.WaitForStatus(remoteAgent, "bar", 10*time.Millisecond, agent.ContainerStatusRunning); err == nil {
+		t.Errorf("WaitForStatus: want timeout for unknown container, have none")
+	}
+}
+
+func TestStateMachineDeltas(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		router = httprouter.New()
+		accept = make(chan string, 1)
+	)
+	router.GET(client.APIVersionPrefix+client.APIGetVersionPath, newMockAgent().getVersion)
+	router.GET(client.APIVersionPrefix+client.APIGetContainersPath, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		accept <- r.Header.Get("Accept")
+		for _, event := range []agent.ContainerEvent{
+			agent.ContainerInstances{{ID: "a", Status: agent.ContainerStatusRunning, Config: agent.ContainerConfig{JobName: "alpha"}}},
+			agent.ContainerDelta{ID: "a", Status: agent.ContainerStatusFailed},
+			agent.ContainerDelta{ID: "a", Status: agent.ContainerStatusRunning}, // config known from before it failed
+			agent.ContainerDelta{ID: "b", Status: agent.ContainerStatusRunning}, // config unknown
+			agent.StreamHeartbeat{Time: time.Now()},
+			agent.ContainerDelta{ID: "a", Status: agent.ContainerStatusRunning, LastExit: &agent.ContainerExit{ExitStatus: 1}, Restarts: 1},
+			agent.LogMarker{ID: "a", Time: time.Now(), Dropped: 3},
+			agent.ContainerDelta{ID: "c", Status: agent.ContainerStatusRunning, Config: &agent.ContainerConfig{JobName: "gamma"}},
+		} {
+			mockWriteContainerStreamEvent(w, event)
+		}
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	})
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	stateMachine, err := newStateMachine(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateMachine.stop()
+
+	if header := <-accept; !strings.Contains(header, agent.DeltaEventsParam+"=delta") {
+		t.Errorf("event stream requested with Accept %q, which doesn't ask for deltas", header)
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		if _, ok := stateMachine.containerInstances()["c"]; ok {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for the last delta")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	containerInstances := stateMachine.containerInstances()
+	if want, have := "alpha", containerInstances["a"].Config.JobName; want != have {
+		t.Errorf("a: want job %q, have %q", want, have)
+	}
+	if exit := containerInstances["a"].LastExit; exit == nil || exit.ExitStatus != 1 {
+		t.Errorf("a: want last exit with status 1, have %+v", exit)
+	}
+	if want, have := uint64(1), containerInstances["a"].Restarts; want != have {
+		t.Errorf("a: want %d restarts, have %d", want, have)
+	}
+	if _, ok := containerInstances["b"]; ok {
+		t.Errorf("b: delta without config for an unknown container was applied")
+	}
+	if !stateMachine.dirty() {
+		t.Errorf("state machine should be dirty after an unusable delta")
+	}
+}
+
+func TestStateMachineContainerInstancesCopy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	mockAgent.instances["a"] = agent.ContainerInstance{ID: "a", Status: agent.ContainerStatusRunning, Metrics: &agent.ContainerMetrics{Restarts: 1}}
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	stateMachine, err := newStateMachine(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateMachine.stop()
+	for !stateMachine.synced() {
+		time.Sleep(time.Millisecond)
+	}
+
+	containerInstances := stateMachine.containerInstances()
+	containerInstances["a"].Metrics.Restarts = 99
+	delete(containerInstances, "a")
+	containerInstances["b"] = agent.ContainerInstance{ID: "b"}
+
+	containerInstances = stateMachine.containerInstances()
+	if _, ok := containerInstances["b"]; ok {
+		t.Errorf("changes to the returned map leaked into the state machine")
+	}
+	if containerInstance, ok := containerInstances["a"]; !ok || containerInstance.Metrics.Restarts != 1 {
+		t.Errorf("changes to the returned instances leaked into the state machine: %+v", containerInstance)
+	}
+}
+
+func TestStateMachineUnknownStatus(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	mockAgent.instances["a"] = agent.ContainerInstance{ID: "a", Status: "paused"}
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	before := expvarUnknownContainerStatuses.Value()
+	stateMachine, err := newStateMachine(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateMachine.stop()
+	for !stateMachine.synced() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := stateMachine.containerInstances()["a"]; !ok {
+		t.Errorf("container of unknown status isn't tracked, and would look missing")
+	}
+	if want, have := before+1, expvarUnknownContainerStatuses.Value(); want != have {
+		t.Errorf("want %d unknown statuses counted, have %d", want, have)
+	}
+}
+
+func BenchmarkStateMachineContainerInstances1k(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("container-%d", i)
+		mockAgent.instances[id] = agent.ContainerInstance{ID: id, Status: agent.ContainerStatusRunning, Metrics: &agent.ContainerMetrics{}}
+	}
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	stateMachine, err := newStateMachine(s.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stateMachine.stop()
+	for len(stateMachine.containerInstances()) < 1000 {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stateMachine.containerInstances()
+	}
+}
+
+func TestContainerConfigDowngrade(t *testing.T) {
+	config := agent.ContainerConfig{
+		JobName:       "foo",
+		Priority:      3,
+		SchemaVersion: agent.ConfigSchemaVersion,
+	}
+
+	downgraded, dropped := config.Downgrade(agent.ConfigSchemaVersion)
+	if !reflect.DeepEqual(config, downgraded) || len(dropped) > 0 {
+		t.Errorf("downgrade to the current version changed the config: %+v, dropped %v", downgraded, dropped)
+	}
+
+	downgraded, dropped = config.Downgrade(0) // agent predates versioning
+	if want, have := []string{"priority"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.Priority != 0 || downgraded.SchemaVersion != 0 || downgraded.JobName != "foo" {
+		t.Errorf("bad version 1 config: %+v", downgraded)
+	}
+	if config.Priority != 3 {
+		t.Errorf("downgrade modified the original config")
+	}
+
+	config.Labels = agent.Labels{"team": "a"}
+	downgraded, dropped = config.Downgrade(2) // agent predates labels
+	if want, have := []string{"labels"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.Labels != nil || downgraded.Priority != 3 {
+		t.Errorf("bad version 2 config: %+v", downgraded)
+	}
+
+	config.Restart = agent.RestartAlways
+	downgraded, dropped = config.Downgrade(3) // agent predates restart policies
+	if want, have := []string{"restart"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.Restart != "" || downgraded.Labels == nil {
+		t.Errorf("bad version 3 config: %+v", downgraded)
+	}
+
+	config.PortRanges = map[string]agent.PortRange{"rtp": {Protocol: agent.PortProtocolUDP, Count: 100}}
+	downgraded, dropped = config.Downgrade(4) // agent predates port ranges
+	if want, have := []string{"port_ranges"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.PortRanges != nil || downgraded.Restart == "" {
+		t.Errorf("bad version 4 config: %+v", downgraded)
+	}
+
+	config.Security = &agent.Security{Seccomp: agent.SeccompStrict}
+	downgraded, dropped = config.Downgrade(5) // agent predates security profiles
+	if want, have := []string{"security"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.Security != nil || downgraded.PortRanges == nil {
+		t.Errorf("bad version 5 config: %+v", downgraded)
+	}
+
+	config.Egress = &agent.Egress{Allow: []agent.EgressRule{{CIDR: "10.0.0.0/8"}}}
+	downgraded, dropped = config.Downgrade(6) // agent predates egress policies
+	if want, have := []string{"egress"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.Egress != nil || downgraded.Security == nil {
+		t.Errorf("bad version 6 config: %+v", downgraded)
+	}
+
+	config.DNS = &agent.DNS{Servers: []string{"10.0.0.2"}}
+	downgraded, dropped = config.Downgrade(7) // agent predates DNS settings
+	if want, have := []string{"dns"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.DNS != nil || downgraded.Egress == nil {
+		t.Errorf("bad version 7 config: %+v", downgraded)
+	}
+
+	config.Hooks = &agent.Hooks{PreStart: &agent.Hook{Exec: []string{"./migrate"}, Timeout: 60}}
+	downgraded, dropped = config.Downgrade(8) // agent predates hooks
+	if want, have := []string{"hooks"}, dropped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want dropped %v, have %v", want, have)
+	}
+	if downgraded.Hooks != nil || downgraded.DNS == nil {
+		t.Errorf("bad version 8 config: %+v", downgraded)
+	}
+}
+
+func TestHooksValid(t *testing.T) {
+	for _, tuple := range []struct {
+		hooks agent.Hooks
+		valid bool
+	}{
+		{agent.Hooks{}, true},
+		{agent.Hooks{PreStart: &agent.Hook{Exec: []string{"./migrate"}, Timeout: 300}, PostStop: &agent.Hook{Exec: []string{"./deregister"}, Timeout: 5}}, true},
+		{agent.Hooks{PreStart: &agent.Hook{Timeout: 10}}, false},
+		{agent.Hooks{PostStop: &agent.Hook{Exec: []string{"./deregister"}}}, false},
+		{agent.Hooks{PostStop: &agent.Hook{Exec: []string{"./deregister"}, Timeout: 601}}, false},
+	} {
+		if err := tuple.hooks.Valid(); tuple.valid != (err == nil) {
+			t.Errorf("%+v: want valid %v, have %v", tuple.hooks, tuple.valid, err)
+		}
+	}
+}
+
+func TestDNSValid(t *testing.T) {
+	for _, tuple := range []struct {
+		dns   agent.DNS
+		valid bool
+	}{
+		{agent.DNS{}, true},
+		{agent.DNS{Servers: []string{"10.0.0.2", "2001:db8::53"}, Search: []string{"svc.example.com"}, Hosts: map[string]string{"db": "10.1.2.3"}}, true},
+		{agent.DNS{Servers: []string{"ns1.example.com"}}, false},
+		{agent.DNS{Search: []string{"a b"}}, false},
+		{agent.DNS{Hosts: map[string]string{"db": "db.example.com"}}, false},
+		{agent.DNS{Hosts: map[string]string{"db #": "10.1.2.3"}}, false},
+	} {
+		if err := tuple.dns.Valid(); tuple.valid != (err == nil) {
+			t.Errorf("%+v: want valid %v, have %v", tuple.dns, tuple.valid, err)
+		}
+	}
+}
+
+func TestEgressValid(t *testing.T) {
+	for _, tuple := range []struct {
+		rule  agent.EgressRule
+		valid bool
+	}{
+		{agent.EgressRule{CIDR: "10.1.0.0/16"}, true},
+		{agent.EgressRule{CIDR: "2001:db8::/32", Protocol: agent.PortProtocolUDP, Port: 53}, true},
+		{agent.EgressRule{CIDR: "10.1.0.1"}, false},
+		{agent.EgressRule{CIDR: "10.1.0.0/16", Protocol: "icmp"}, false},
+		{agent.EgressRule{CIDR: "10.1.0.0/16", Port: 443}, false},
+	} {
+		err := agent.Egress{Allow: []agent.EgressRule{tuple.rule}}.Valid()
+		if tuple.valid != (err == nil) {
+			t.Errorf("%+v: want valid %v, have %v", tuple.rule, tuple.valid, err)
+		}
+	}
+}
+
+func TestSecurityValid(t *testing.T) {
+	for _, tuple := range []struct {
+		security agent.Security
+		valid    bool
+	}{
+		{agent.Security{}, true},
+		{agent.Security{Seccomp: agent.SeccompDefault, Devices: []string{"/dev/fuse"}}, true},
+		{agent.Security{Seccomp: "permissive"}, false},
+		{agent.Security{Devices: []string{"/etc/shadow"}}, false},
+		{agent.Security{Devices: []string{"/dev/../etc/shadow"}}, false},
+	} {
+		if err := tuple.security.Valid(); tuple.valid != (err == nil) {
+			t.Errorf("%+v: want valid %v, have %v", tuple.security, tuple.valid, err)
+		}
+	}
+
+	var security *agent.Security
+	if want, have := agent.SeccompUnconfined, security.SeccompProfile(); want != have {
+		t.Errorf("want profile %q, have %q", want, have)
+	}
+}
+
+func TestPortRangeValid(t *testing.T) {
+	for _, tuple := range []struct {
+		config agent.ContainerConfig
+		valid  bool
+	}{
+		{agent.ContainerConfig{PortRanges: map[string]agent.PortRange{"rtp": {Protocol: agent.PortProtocolUDP, Start: 10000, Count: 100}}}, true},
+		{agent.ContainerConfig{PortRanges: map[string]agent.PortRange{"dns": {Protocol: agent.PortProtocolUDP}}}, true},
+		{agent.ContainerConfig{PortRanges: map[string]agent.PortRange{"rtp": {Protocol: "sctp"}}}, false},
+		{agent.ContainerConfig{PortRanges: map[string]agent.PortRange{"rtp": {Start: 65500, Count: 100}}}, false},
+		{agent.ContainerConfig{PortRanges: map[string]agent.PortRange{"rtp": {Count: -1}}}, false},
+		{agent.ContainerConfig{Ports: map[string]uint16{"http": 0}, PortRanges: map[string]agent.PortRange{"http": {}}}, false},
+	} {
+		var errs agent.ValidationErrors
+		if err := tuple.config.Valid(); err != nil {
+			errs = err.(agent.ValidationErrors)
+		}
+		portErrs := 0
+		for _, fieldError := range errs {
+			if strings.HasPrefix(fieldError.Field, "port_ranges.") {
+				portErrs++
+			}
+		}
+		if valid := portErrs == 0; tuple.valid != valid {
+			t.Errorf("%+v: want valid %v, have %v", tuple.config.PortRanges, tuple.valid, errs)
+		}
+	}
+
+	if want, have := uint16(10099), (agent.PortRange{Start: 10000, Count: 100}).End(); want != have {
+		t.Errorf("want end %d, have %d", want, have)
+	}
+}
+
+func TestDecodeContainerConfig(t *testing.T) {
+	config, unknown, err := agent.DecodeContainerConfig([]byte(`{
+		"job_name": "foo",
+		"Task_Name": "bar",
+		"frobnicate": true,
+		"resources": {"mem": 64, "gpus": 1},
+		"storage": {"tmp": {"/tmp": -1}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.JobName != "foo" || config.TaskName != "bar" {
+		t.Errorf("bad config: %+v", config)
+	}
+	if want, have := []string{"frobnicate", "resources.gpus"}, unknown; !reflect.DeepEqual(want, have) {
+		t.Errorf("want unknown fields %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Operators annotate jobs and containers with a note, e.g. who investigates
+// what, and optionally a silence: until it ends, the transformer doesn't
+// restart exited containers of the job, or the container, so humans can
+// investigate a crashing instance where it failed, without the scheduler
+// restarting it all the time. Failures are still recorded, and the container
+// is restarted once the silence ends, or is cleared. Annotations are shown on
+// GET /jobs and GET /jobs/:name/containers, and kept in memory; container
+// annotations go away with the container.
+
+const (
+	annotationJob       = "job"
+	annotationContainer = "container"
+)
+
+type annotation struct {
+	Note          string    `json:"note,omitempty"`
+	SilencedUntil time.Time `json:"silenced_until"` // zero if not silenced
+	Remote        string    `json:"remote"`         // address of the client
+	Time          time.Time `json:"time"`
+}
+
+func (a annotation) silenced(now time.Time) bool {
+	return now.Before(a.SilencedUntil)
+}
+
+// annotationRequest is the body of annotation PUTs. Silence is a duration,
+// e.g. "2h".
+type annotationRequest struct {
+	Note    string `json:"note"`
+	Silence string `json:"silence"`
+}
+
+// annotations are the annotations of jobs and containers, by kind and name.
+type annotations struct {
+	sync.RWMutex
+	m map[string]map[string]annotation
+}
+
+func newAnnotations() *annotations {
+	return &annotations{m: map[string]map[string]annotation{
+		annotationJob:       map[string]annotation{},
+		annotationContainer: map[string]annotation{},
+	}}
+}
+
+func (a *annotations) set(kind, name string, an annotation) {
+	a.Lock()
+	defer a.Unlock()
+	a.m[kind][name] = an
+}
+
+func (a *annotations) clear(kind, name string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.m[kind], name)
+}
+
+func (a *annotations) get(kind, name string) (annotation, bool) {
+	a.RLock()
+	defer a.RUnlock()
+	an, ok := a.m[kind][name]
+	return an, ok
+}
+
+// silenced returns true if the container, or its job, is silenced.
+func (a *annotations) silenced(containerID, jobName string, now time.Time) bool {
+	a.RLock()
+	defer a.RUnlock()
+	return a.m[annotationContainer][containerID].silenced(now) || a.m[annotationJob][jobName].silenced(now)
+}
+
+// list returns a copy of all annotations, by kind and name.
+func (a *annotations) list() map[string]map[string]annotation {
+	a.RLock()
+	defer a.RUnlock()
+	m := make(map[string]map[string]annotation, len(a.m))
+	for kind, annotations := range a.m {
+		m[kind] = make(map[string]annotation, len(annotations))
+		for name, an := range annotations {
+			m[kind][name] = an
+		}
+	}
+	return m
+}
+
+// parseAnnotation reads an annotation request. Requests must have a note, a
+// silence, or both.
+func parseAnnotation(r *http.Request, now time.Time) (annotation, error) {
+	var req annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return annotation{}, err
+	}
+	an := annotation{Note: req.Note, Remote: r.RemoteAddr, Time: now}
+	if req.Silence != "" {
+		d, err := time.ParseDuration(req.Silence)
+		if err != nil {
+			return annotation{}, fmt.Errorf("invalid silence: %s", err)
+		}
+		if d <= 0 {
+			return annotation{}, fmt.Errorf("silence %s must be positive", d)
+		}
+		an.SilencedUntil = now.Add(d)
+	}
+	if an.Note == "" && an.SilencedUntil.IsZero() {
+		return annotation{}, fmt.Errorf("annotation needs a note or a silence")
+	}
+	return an, nil
+}
+
+// handleAnnotate sets or, with DELETE, clears the annotation of the job or
+// container named by the name or id parameter. Clients must be authorized
+// for the namespace it runs in.
+func handleAnnotate(a *annotations, kind string, agentStater agentStater, namespaces *namespaces) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		name, namespace := ps.ByName("name"), ""
+		if kind == annotationContainer {
+			name = ps.ByName("id")
+			namespace = containerNamespace(name, agentStater)
+		} else {
+			namespace = jobNamespace(name, agentStater)
+		}
+		if !namespaces.authorized(w, r, namespace) {
+			return
+		}
+		if r.Method == "DELETE" {
+			a.clear(kind, name)
+			log.Printf("annotations: %s %s cleared by %s", kind, name, r.RemoteAddr)
+			writeSuccess(w, fmt.Sprintf("annotation of %s %s cleared", kind, name))
+			return
+		}
+		defer r.Body.Close()
+		an, err := parseAnnotation(r, time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.set(kind, name, an)
+		log.Printf("annotations: %s %s annotated by %s: %q, silenced until %s", kind, name, an.Remote, an.Note, an.SilencedUntil)
+		writeSuccess(w, fmt.Sprintf("%s %s annotated", kind, name))
+	}
+}
+
+// handleAnnotations lists all annotations, by kind and name.
+func handleAnnotations(a *annotations) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.list())
+	}
+}
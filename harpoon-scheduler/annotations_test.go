@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAnnotation(t *testing.T) {
+	now := time.Now()
+	for body, expected := range map[string]annotation{
+		`{"note": "looking into it"}`:             {Note: "looking into it", Time: now},
+		`{"silence": "2h"}`:                       {SilencedUntil: now.Add(2 * time.Hour), Time: now},
+		`{"note": "heap dump", "silence": "30m"}`: {Note: "heap dump", SilencedUntil: now.Add(30 * time.Minute), Time: now},
+		`{}`:                                     {},
+		`{"note": "bad", "silence": "forever"}`:  {},
+		`{"note": "negative", "silence": "-1h"}`: {},
+	} {
+		r, _ := http.NewRequest("PUT", "/jobs/alpha/annotation", strings.NewReader(body))
+		got, err := parseAnnotation(r, now)
+		if expected.Time.IsZero() {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", body, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", body, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("%s: expected %+v, got %+v", body, expected, got)
+		}
+	}
+}
+
+func TestAnnotationsSilenced(t *testing.T) {
+	var (
+		a   = newAnnotations()
+		now = time.Now()
+	)
+	a.set(annotationJob, "alpha", annotation{SilencedUntil: now.Add(time.Hour)})
+	a.set(annotationJob, "beta", annotation{Note: "no silence"})
+	a.set(annotationContainer, "gamma-1", annotation{SilencedUntil: now.Add(time.Minute)})
+
+	for _, tuple := range []struct {
+		containerID, jobName string
+		at                   time.Time
+		expected             bool
+	}{
+		{"alpha-1", "alpha", now, true},
+		{"alpha-1", "alpha", now.Add(2 * time.Hour), false}, // expired
+		{"beta-1", "beta", now, false},
+		{"gamma-1", "gamma", now, true},
+		{"gamma-2", "gamma", now, false},
+	} {
+		if got := a.silenced(tuple.containerID, tuple.jobName, tuple.at); tuple.expected != got {
+			t.Errorf("%s of %s at %s: expected silenced %v, got %v", tuple.containerID, tuple.jobName, tuple.at, tuple.expected, got)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The audit log records decisions of the scheduler's policies which
+// operators may have to account for later, such as emergency overrides of
+// deploy windows. Entries are appended to a file, one JSON object per line.
+
+const (
+	auditBlocked    = "blocked"
+	auditOverridden = "overridden"
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"` // e.g. schedule or rollback
+	JobName   string    `json:"job_name"`
+	Namespace string    `json:"namespace,omitempty"`
+	Remote    string    `json:"remote"`           // address of the client
+	Outcome   string    `json:"outcome"`          // blocked or overridden
+	Policy    string    `json:"policy"`           // what the policy objected to
+	Reason    string    `json:"reason,omitempty"` // given by the client
+}
+
+// auditLog appends entries to the file at path. A nil auditLog, or one
+// without a path, only logs them.
+type auditLog struct {
+	path string
+	sync.Mutex
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit: %s", err)
+		return
+	}
+	log.Printf("audit: %s", buf)
+	if a == nil || a.path == "" {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("audit: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		log.Printf("audit: %s: %s", a.path, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// Jobs may name a canary judge: a webhook asked, during a migration, whether
+// the new config is good. Once the first new instance of a task runs, its
+// metadata is POSTed to the judge, which answers with a verdict: proceed with
+// the migration, abort it, leaving it interrupted for an operator to resume
+// or roll back, or roll it back. Judges which fail to answer abort the
+// migration, as nobody vouched for the new config.
+
+// Canary verdicts.
+const (
+	verdictProceed  = "proceed"
+	verdictAbort    = "abort"
+	verdictRollback = "rollback"
+)
+
+// canaryRequest is POSTed to the judge.
+type canaryRequest struct {
+	JobName     string                `json:"job_name"`
+	TaskName    string                `json:"task_name"`
+	ContainerID string                `json:"container_id"`
+	Endpoint    string                `json:"agent"`
+	Config      agent.ContainerConfig `json:"config"`
+	Started     time.Time             `json:"started"`
+}
+
+// canaryVerdict is the judge's answer, and recorded with the migration.
+type canaryVerdict struct {
+	TaskName string    `json:"task_name"`
+	Verdict  string    `json:"verdict"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// canaryJudge asks judges for their verdicts. A nil canaryJudge asks nobody,
+// and every migration proceeds.
+type canaryJudge struct {
+	timeout time.Duration // judges may take their time to analyze the canary
+}
+
+// isCanary reports whether the step schedules the first new instance of its
+// task, which is judged.
+func (r migrationRecord) isCanary(index int) bool {
+	step := r.Steps[index]
+	if step.Op != stepSchedule {
+		return false
+	}
+	for _, earlier := range r.Steps[:index] {
+		if earlier.Op == stepSchedule && earlier.Config.TaskName == step.Config.TaskName {
+			return false
+		}
+	}
+	return true
+}
+
+// judge returns the verdict on the canary scheduled by the step.
+func (j *canaryJudge) judge(judgeURL, jobName string, step migrationStep) canaryVerdict {
+	if j == nil || judgeURL == "" {
+		return canaryVerdict{TaskName: step.Config.TaskName, Verdict: verdictProceed, Time: time.Now()}
+	}
+	verdict, err := j.ask(judgeURL, canaryRequest{
+		JobName:     jobName,
+		TaskName:    step.Config.TaskName,
+		ContainerID: step.ContainerID,
+		Endpoint:    step.Endpoint,
+		Config:      step.Config,
+		Started:     time.Now(),
+	})
+	if err != nil {
+		log.Printf("scheduler: migrate: canary judge %s: %s", judgeURL, err)
+		verdict = canaryVerdict{Verdict: verdictAbort, Reason: fmt.Sprintf("judge failed: %s", err)}
+	}
+	verdict.TaskName, verdict.Time = step.Config.TaskName, time.Now()
+	return verdict
+}
+
+func (j *canaryJudge) ask(judgeURL string, req canaryRequest) (canaryVerdict, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return canaryVerdict{}, err
+	}
+	client := &http.Client{Timeout: j.timeout}
+	resp, err := client.Post(judgeURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return canaryVerdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return canaryVerdict{}, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	var verdict canaryVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return canaryVerdict{}, fmt.Errorf("invalid response (%s)", err)
+	}
+	switch verdict.Verdict {
+	case verdictProceed, verdictAbort, verdictRollback:
+		return verdict, nil
+	}
+	return canaryVerdict{}, fmt.Errorf("unknown verdict %q", verdict.Verdict)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestMigrationIsCanary(t *testing.T) {
+	var (
+		web    = agent.ContainerConfig{TaskName: "web"}
+		worker = agent.ContainerConfig{TaskName: "worker"}
+		record = migrationRecord{Steps: []migrationStep{
+			{Op: stepSchedule, ContainerID: "web-new-0", Config: web},
+			{Op: stepUnschedule, ContainerID: "web-old-0", Config: web},
+			{Op: stepSchedule, ContainerID: "web-new-1", Config: web},
+			{Op: stepUnschedule, ContainerID: "worker-old-0", Config: worker},
+			{Op: stepSchedule, ContainerID: "worker-new-0", Config: worker},
+		}}
+	)
+
+	for i, expected := range []bool{true, false, false, false, true} {
+		if got := record.isCanary(i); expected != got {
+			t.Errorf("step %d (%s %s): expected %v, got %v", i, record.Steps[i].Op, record.Steps[i].ContainerID, expected, got)
+		}
+	}
+}
+
+func TestCanaryJudge(t *testing.T) {
+	var response string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req canaryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ContainerID != "web-new-0" {
+			http.Error(w, fmt.Sprintf("bad request %+v (%v)", req, err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, response)
+	}))
+	defer s.Close()
+
+	var (
+		judge = &canaryJudge{timeout: time.Second}
+		step  = migrationStep{Op: stepSchedule, ContainerID: "web-new-0", Config: agent.ContainerConfig{TaskName: "web"}}
+	)
+
+	for _, tuple := range []struct {
+		response string
+		expected string
+	}{
+		{`{"verdict": "proceed"}`, verdictProceed},
+		{`{"verdict": "rollback", "reason": "error rate"}`, verdictRollback},
+		{`{"verdict": "abort"}`, verdictAbort},
+		{`{"verdict": "maybe"}`, verdictAbort},
+		{`nonsense`, verdictAbort},
+	} {
+		response = tuple.response
+		verdict := judge.judge(s.URL, "alpha", step)
+		if expected, got := tuple.expected, verdict.Verdict; expected != got {
+			t.Errorf("%s: expected %q, got %q", tuple.response, expected, got)
+		}
+		if expected, got := "web", verdict.TaskName; expected != got {
+			t.Errorf("%s: expected task %q, got %q", tuple.response, expected, got)
+		}
+	}
+
+	if expected, got := verdictProceed, (*canaryJudge)(nil).judge(s.URL, "alpha", step).Verdict; expected != got {
+		t.Errorf("nil judge: expected %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// Agents are grouped into clusters, e.g. regions, by their cluster label, or
+// by the discovery which found them. Jobs may target clusters: each of their
+// tasks then runs at full scale in each cluster, and nowhere else. Containers
+// are never moved between clusters.
+
+// clusterStatus summarizes the agents of a cluster.
+type clusterStatus struct {
+	Agents        int                 `json:"agents"`
+	Dirty         int                 `json:"dirty"`         // agents whose reports can't be trusted
+	Unschedulable int                 `json:"unschedulable"` // agents in maintenance
+	Memory        agent.TotalReserved `json:"mem"`           // MB
+	CPUs          agent.TotalReserved `json:"cpus"`
+	Containers    int                 `json:"containers"`
+	Jobs          []string            `json:"jobs"` // with containers in the cluster
+}
+
+// clusterStatuses summarizes the agents of each cluster, by cluster name.
+// Agents in no cluster are summarized under the empty name.
+func clusterStatuses(agentStates map[string]agentState) map[string]clusterStatus {
+	var (
+		m    = map[string]clusterStatus{}
+		jobs = map[string]map[string]struct{}{} // cluster: job names
+	)
+	for _, state := range agentStates {
+		var (
+			cluster = agentCluster(state)
+			status  = m[cluster]
+		)
+		if jobs[cluster] == nil {
+			jobs[cluster] = map[string]struct{}{}
+		}
+		status.Agents++
+		if state.dirty {
+			status.Dirty++
+		}
+		if state.unschedulable {
+			status.Unschedulable++
+		}
+		status.Memory.Total += state.hostResources.Memory.Total
+		status.Memory.Reserved += state.hostResources.Memory.Reserved
+		status.CPUs.Total += state.hostResources.CPUs.Total
+		status.CPUs.Reserved += state.hostResources.CPUs.Reserved
+		status.Containers += len(state.containerInstances)
+		for _, containerInstance := range state.containerInstances {
+			jobs[cluster][containerInstance.Config.JobName] = struct{}{}
+		}
+		m[cluster] = status
+	}
+	for cluster, status := range m {
+		status.Jobs = make([]string, 0, len(jobs[cluster]))
+		for jobName := range jobs[cluster] {
+			status.Jobs = append(status.Jobs, jobName)
+		}
+		sort.Strings(status.Jobs)
+		m[cluster] = status
+	}
+	return m
+}
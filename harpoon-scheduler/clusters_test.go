@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestPlaceJobClusters(t *testing.T) {
+	var (
+		inCluster = func(cluster string) agentState {
+			return agentState{hostResources: agent.HostResources{Labels: map[string]string{agent.ClusterLabel: cluster}}}
+		}
+		agentStates = map[string]agentState{
+			"http://eu:1":   inCluster("eu"),
+			"http://eu:2":   inCluster("eu"),
+			"http://us:1":   inCluster("us"),
+			"http://none:1": {},
+			"http://ap:1":   {cluster: "ap"}, // discovered in a cluster
+		}
+		task = scheduler.Task{
+			TaskName:        "web",
+			Scale:           2,
+			Clusters:        []string{"eu", "us", "ap"},
+			ContainerConfig: agent.ContainerConfig{JobName: "alpha", TaskName: "web"},
+		}
+		job = scheduler.Job{JobName: "alpha", Tasks: map[string]scheduler.Task{"web": task}}
+	)
+
+	if expected, got := 6, task.Instances(); expected != got {
+		t.Fatalf("expected %d instances, got %d", expected, got)
+	}
+
+	taskSpecMap, err := placeJob(job, randomNonDirty(agentStates))
+	if err != nil {
+		t.Fatal(err)
+	}
+	perCluster := map[string]int{}
+	for _, taskSpec := range taskSpecMap {
+		perCluster[agentCluster(agentStates[taskSpec.endpoint])]++
+	}
+	for _, cluster := range task.Clusters {
+		if expected, got := task.Scale, perCluster[cluster]; expected != got {
+			t.Errorf("cluster %s: expected %d instances, got %d", cluster, expected, got)
+		}
+	}
+	if got := perCluster[""]; got != 0 {
+		t.Errorf("expected no instances outside the clusters, got %d", got)
+	}
+
+	task.Clusters = []string{"sa"}
+	if _, err := randomNonDirty(agentStates)("", instanceTask(task, 0)); err == nil {
+		t.Errorf("expected error for a cluster without agents, got none")
+	}
+
+	statuses := clusterStatuses(agentStates)
+	if expected, got := 2, statuses["eu"].Agents; expected != got {
+		t.Errorf("expected %d agents in eu, got %d", expected, got)
+	}
+	if expected, got := 1, statuses[""].Agents; expected != got {
+		t.Errorf("expected %d agent in no cluster, got %d", expected, got)
+	}
+}
+
+func TestPlanRebalanceClusters(t *testing.T) {
+	agentWith := func(cluster string, memory int) agentState {
+		state := agentState{
+			hostResources:      agent.HostResources{Memory: agent.TotalReserved{Total: 1000}, Labels: map[string]string{agent.ClusterLabel: cluster}},
+			containerInstances: map[string]agent.ContainerInstance{},
+		}
+		if memory > 0 {
+			config := agent.ContainerConfig{JobName: "a", TaskName: "t", Resources: agent.Resources{Memory: memory}}
+			state.containerInstances["a"] = agent.ContainerInstance{ID: "a", Status: agent.ContainerStatusRunning, Config: config}
+			state.hostResources.Memory.Reserved = float64(memory)
+		}
+		return state
+	}
+
+	// The only idle agent is in another cluster.
+	moves := planRebalance(map[string]agentState{
+		"http://eu:1": agentWith("eu", 800),
+		"http://us:1": agentWith("us", 0),
+	}, 0.2, 1)
+	if len(moves) != 0 {
+		t.Errorf("expected no moves between clusters, got %v", moves)
+	}
+}
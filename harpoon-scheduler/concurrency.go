@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// Scheduling or unscheduling a job starts or stops its containers a few at a
+// time, so large jobs don't saturate the agents. Each job may run its
+// concurrency in container operations at once, or the scheduler's default;
+// all jobs together never run more than the global limit, if any. Operations
+// beyond the limits queue. The progress of the most recent operation of each
+// job is kept, and may be read while it runs.
+
+// errNoJobOperation is returned when asking for the progress of a job which
+// wasn't scheduled or unscheduled since the scheduler started.
+var errNoJobOperation = errors.New("job wasn't scheduled or unscheduled since the scheduler started")
+
+// concurrencyLimits bounds the container operations run by job schedules and
+// unschedules. It's safe for concurrent use.
+type concurrencyLimits struct {
+	job   int           // default operations per job
+	slots chan struct{} // global slots; nil for no global limit
+
+	sync.Mutex
+	progress map[string]*operationProgress // job name: most recent operation
+}
+
+// operationProgress reports how far a job operation got.
+type operationProgress struct {
+	JobName     string     `json:"job_name"`
+	Operation   string     `json:"operation"` // schedule or unschedule
+	Concurrency int        `json:"concurrency"`
+	Total       int        `json:"total"`
+	Queued      int        `json:"queued"`
+	Running     int        `json:"running"`
+	Done        int        `json:"done"`
+	Failed      int        `json:"failed"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// newConcurrencyLimits returns limits of job operations per job by default,
+// and global operations overall (0 for unlimited).
+func newConcurrencyLimits(job, global int) *concurrencyLimits {
+	if job < 1 {
+		job = 1
+	}
+	l := &concurrencyLimits{
+		job:      job,
+		progress: map[string]*operationProgress{},
+	}
+	if global > 0 {
+		l.slots = make(chan struct{}, global)
+	}
+	return l
+}
+
+// concurrency returns how many container operations of the job may run at
+// once: its own concurrency if set, else the default, never more than the
+// global limit.
+func (l *concurrencyLimits) concurrency(job scheduler.Job) int {
+	n := l.job
+	if job.Concurrency > 0 {
+		n = job.Concurrency
+	}
+	if l.slots != nil && n > cap(l.slots) {
+		n = cap(l.slots)
+	}
+	return n
+}
+
+// start begins tracking an operation on total containers of the job. Limits
+// may be nil, in which case containers are operated on one at a time.
+func (l *concurrencyLimits) start(job scheduler.Job, what string, total int) *jobOperation {
+	if l == nil {
+		return nil
+	}
+	p := &operationProgress{
+		JobName:     job.JobName,
+		Operation:   what,
+		Concurrency: l.concurrency(job),
+		Total:       total,
+		Queued:      total,
+		Started:     time.Now(),
+	}
+	l.Lock()
+	l.progress[job.JobName] = p
+	l.Unlock()
+	return &jobOperation{limits: l, progress: p}
+}
+
+// get returns a copy of the progress of the job's most recent operation.
+func (l *concurrencyLimits) get(jobName string) (operationProgress, bool) {
+	if l == nil {
+		return operationProgress{}, false
+	}
+	l.Lock()
+	defer l.Unlock()
+	p, ok := l.progress[jobName]
+	if !ok {
+		return operationProgress{}, false
+	}
+	return *p, true
+}
+
+// jobOperation is a tracked schedule or unschedule of a job. A nil
+// jobOperation runs one container operation at a time, and tracks nothing.
+type jobOperation struct {
+	limits   *concurrencyLimits
+	progress *operationProgress // guarded by the limits
+}
+
+func (o *jobOperation) concurrency() int {
+	if o == nil {
+		return 1
+	}
+	return o.progress.Concurrency
+}
+
+// acquire waits for a global slot, and marks a container operation running.
+func (o *jobOperation) acquire() {
+	if o == nil {
+		return
+	}
+	if o.limits.slots != nil {
+		o.limits.slots <- struct{}{}
+	}
+	o.update(func(p *operationProgress) { p.Queued--; p.Running++ })
+}
+
+// release frees the global slot of a container operation, and counts its
+// outcome.
+func (o *jobOperation) release(err error) {
+	if o == nil {
+		return
+	}
+	if o.limits.slots != nil {
+		<-o.limits.slots
+	}
+	var p operationProgress
+	o.update(func(progress *operationProgress) {
+		progress.Running--
+		if err != nil {
+			progress.Failed++
+		} else {
+			progress.Done++
+		}
+		p = *progress
+	})
+	log.Printf("scheduler: %s %s: %d/%d done, %d failed, %d running, %d queued", p.Operation, p.JobName, p.Done, p.Total, p.Failed, p.Running, p.Queued)
+}
+
+// finish records the outcome of the operation. Containers which never ran,
+// because an earlier one failed, are no longer queued.
+func (o *jobOperation) finish(err error) {
+	if o == nil {
+		return
+	}
+	o.update(func(p *operationProgress) {
+		now := time.Now()
+		p.Finished = &now
+		p.Queued = 0
+		if err != nil {
+			p.Error = err.Error()
+		}
+	})
+}
+
+func (o *jobOperation) update(f func(*operationProgress)) {
+	o.limits.Lock()
+	defer o.limits.Unlock()
+	f(o.progress)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestConcurrencyLimits(t *testing.T) {
+	limits := newConcurrencyLimits(2, 3)
+	for _, tc := range []struct {
+		concurrency int
+		expected    int
+	}{
+		{0, 2}, // the default
+		{1, 1},
+		{3, 3},
+		{10, 3}, // the global limit
+	} {
+		if got := limits.concurrency(scheduler.Job{Concurrency: tc.concurrency}); tc.expected != got {
+			t.Errorf("job concurrency %d: expected %d, got %d", tc.concurrency, tc.expected, got)
+		}
+	}
+}
+
+func TestXschedConcurrency(t *testing.T) {
+	var (
+		mu              sync.Mutex
+		running, peak   int
+		limits          = newConcurrencyLimits(1, 4)
+		job             = scheduler.Job{JobName: "big", Concurrency: 8}
+		taskSpecMap     = map[string]taskSpec{}
+		apply, noRevert = func(containerID string, _ taskSpec, c chan schedulingSignalWithContext) error {
+			mu.Lock()
+			if running++; running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			go func() {
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				c <- schedulingSignalWithContext{schedulingSignal: signalScheduleSuccessful}
+			}()
+			return nil
+		}, func(string, taskSpec, chan schedulingSignalWithContext) error { return nil }
+	)
+	for i := 0; i < 20; i++ {
+		taskSpecMap[fmt.Sprintf("big-%d", i)] = taskSpec{ContainerConfig: agent.ContainerConfig{Grace: agent.Grace{Startup: 1}}}
+	}
+
+	op := limits.start(job, "schedule", len(taskSpecMap))
+	err := xsched("schedule", signalScheduleSuccessful, apply, noRevert, taskSpecMap, func(g agent.Grace) time.Duration { return time.Second }, op)
+	op.finish(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 4, peak; expected != got {
+		t.Errorf("expected at most %d containers at once (the global limit), got %d", expected, got)
+	}
+	progress, ok := limits.get("big")
+	if !ok {
+		t.Fatal("expected progress of job big")
+	}
+	if expected, got := (operationProgress{JobName: "big", Operation: "schedule", Concurrency: 4, Total: 20, Done: 20}), progress; expected.Done != got.Done || expected.Total != got.Total || expected.Concurrency != got.Concurrency || got.Running != 0 || got.Queued != 0 || got.Finished == nil {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestXschedUndoesAfterFailure(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		applied     = map[string]bool{}
+		taskSpecMap = map[string]taskSpec{}
+		apply       = func(containerID string, _ taskSpec, c chan schedulingSignalWithContext) error {
+			if containerID == "job-3" {
+				return errors.New("no")
+			}
+			mu.Lock()
+			applied[containerID] = true
+			mu.Unlock()
+			go func() { c <- schedulingSignalWithContext{schedulingSignal: signalScheduleSuccessful} }()
+			return nil
+		}
+		revert = func(containerID string, _ taskSpec, _ chan schedulingSignalWithContext) error {
+			mu.Lock()
+			delete(applied, containerID)
+			mu.Unlock()
+			return nil
+		}
+		limits = newConcurrencyLimits(3, 0)
+		op     = limits.start(scheduler.Job{JobName: "job"}, "schedule", 6)
+	)
+	for i := 0; i < 6; i++ {
+		taskSpecMap[fmt.Sprintf("job-%d", i)] = taskSpec{}
+	}
+
+	if err := xsched("schedule", signalScheduleSuccessful, apply, revert, taskSpecMap, func(agent.Grace) time.Duration { return time.Second }, op); err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if len(applied) != 0 {
+		t.Errorf("expected all applied containers to be reverted, got %v", applied)
+	}
+	if progress, _ := limits.get("job"); progress.Failed != 1 {
+		t.Errorf("expected 1 failed container, got %+v", progress)
+	}
+}
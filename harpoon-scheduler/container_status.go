@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// statusClass groups container statuses by how the scheduler treats them.
+// New statuses are supported by adding them to containerStatusClasses; the
+// state machine and transformer only ever look at the class.
+type statusClass int
+
+const (
+	// statusUnknown is the class of statuses the scheduler doesn't know,
+	// e.g. because the agent is newer. Such containers are tracked, so
+	// they're not scheduled again, but otherwise left alone.
+	statusUnknown statusClass = iota
+
+	// statusActive containers are starting or running. Nothing to do.
+	statusActive
+
+	// statusExited containers are no longer running, but still exist on
+	// their agent, and may be restarted per their restart policy.
+	statusExited
+
+	// statusGone containers no longer exist on their agent.
+	statusGone
+)
+
+var containerStatusClasses = map[agent.ContainerStatus]statusClass{
+	agent.ContainerStatusStarting: statusActive,
+	agent.ContainerStatusRunning:  statusActive,
+	agent.ContainerStatusFailed:   statusExited,
+	agent.ContainerStatusFinished: statusExited,
+	agent.ContainerStatusDeleted:  statusGone,
+}
+
+func (c statusClass) String() string {
+	switch c {
+	case statusActive:
+		return "active"
+	case statusExited:
+		return "exited"
+	case statusGone:
+		return "gone"
+	}
+	return "unknown"
+}
+
+// classify returns the class of the status.
+func classify(status agent.ContainerStatus) statusClass {
+	return containerStatusClasses[status] // statusUnknown if missing
+}
+
+// classifyReported returns the class of a status reported by an agent.
+// Unknown statuses are logged and counted, as they mean the agent speaks
+// something the scheduler doesn't understand.
+func classifyReported(endpoint, containerID string, status agent.ContainerStatus) statusClass {
+	class := classify(status)
+	if class == statusUnknown {
+		log.Printf("state machine: %s: %q: unknown container status %q, leaving it be", endpoint, containerID, status)
+		incUnknownContainerStatuses(1)
+	}
+	return class
+}
+
+// terminated returns true if the container process has exited, for good or
+// bad.
+func terminated(status agent.ContainerStatus) bool {
+	return classify(status) == statusExited
+}
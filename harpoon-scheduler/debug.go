@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// adminHandler serves Prometheus metrics, the health and readiness checks,
+// and the debug handler, on the admin listener.
+func adminHandler(registry *registry, watchdog *watchdog, transformer *transformer) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler())
+	mux.Handle("/healthz", handleHealthz(watchdog))
+	mux.Handle("/readyz", handleReadyz(transformer))
+	mux.Handle("/debug/", debugHandler(registry))
+	return mux
+}
+
+// debugHandler serves pprof profiles, expvars, a dump of all goroutine
+// stacks, and a snapshot of the registry. It's meant for a separate listener,
+// not exposed to API clients.
+func debugHandler(registry *registry) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/vars", handleExpvars)
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	mux.HandleFunc("/debug/registry", handleRegistrySnapshot(registry))
+	return mux
+}
+
+func handleExpvars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// handleRegistrySnapshot dumps the raw state of the registry, which is
+// otherwise only inferable from the logs.
+func handleRegistrySnapshot(registry *registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		buf, err := json.MarshalIndent(registry.snapshot(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(buf)
+	}
+}
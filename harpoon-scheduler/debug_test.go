@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	registry := newRegistry(nil)
+	registry.schedule("alpha-0", taskSpec{endpoint: "http://a:1"}, nil)
+	h := adminHandler(registry, nil, nil) // the debug endpoints need neither
+
+	r, _ := http.NewRequest("GET", "/debug/vars", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("/debug/vars: expected %d, got %d", expected, got)
+	}
+	var vars map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("/debug/vars: %s", err)
+	}
+	if _, ok := vars["memstats"]; !ok {
+		t.Errorf("/debug/vars: expected memstats, got %v", vars)
+	}
+
+	r, _ = http.NewRequest("GET", "/debug/goroutines", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "TestDebugHandler") {
+		t.Errorf("/debug/goroutines: expected the stack of this test, got %q", w.Body.String())
+	}
+
+	r, _ = http.NewRequest("GET", "/debug/registry", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var snapshot registrySnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+		t.Fatalf("/debug/registry: %s", err)
+	}
+	entry, ok := snapshot.Containers[registryPendingSchedule]["alpha-0"]
+	if !ok || entry.Operation == nil {
+		t.Fatalf("/debug/registry: expected alpha-0 pending schedule, got %+v", snapshot.Containers)
+	}
+	if expected, got := "http://a:1", entry.Endpoint; expected != got {
+		t.Errorf("/debug/registry: expected agent %q, got %q", expected, got)
+	}
+}
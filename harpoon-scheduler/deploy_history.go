@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// The deploy history remembers the last jobs which were successfully
+// scheduled or migrated to, by job name, so a job can be rolled back to an
+// earlier deployment with a single request. Deployments are identified by
+// their ref, the hash also found in the job's container IDs.
+
+var (
+	errJobNotDeployed       = errors.New("job has no recorded deployment")
+	errNoPreviousDeployment = errors.New("job has no previous deployment to roll back to")
+)
+
+// deployment is a job as it was deployed.
+type deployment struct {
+	Ref  string        `json:"ref"`
+	Time time.Time     `json:"time"`
+	Job  scheduler.Job `json:"job"`
+}
+
+// deployHistory keeps up to size deployments per job, most recent last. It's
+// persisted in the file at path, if any. It's owned by the scheduler loop, and
+// not safe for concurrent use.
+type deployHistory struct {
+	path string
+	size int
+	jobs map[string][]deployment // job name: deployments
+}
+
+// newDeployHistory returns the history recorded at path, or an empty history
+// if there's none.
+func newDeployHistory(path string, size int) (*deployHistory, error) {
+	h := &deployHistory{path: path, size: size, jobs: map[string][]deployment{}}
+	if path == "" {
+		return h, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &h.jobs); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return h, nil
+}
+
+// record makes the job the current deployment. A job deployed again moves to
+// the end of the history.
+func (h *deployHistory) record(job scheduler.Job) {
+	var (
+		ref         = refHash(job)
+		deployments = []deployment{}
+	)
+	for _, d := range h.jobs[job.JobName] {
+		if d.Ref != ref {
+			deployments = append(deployments, d)
+		}
+	}
+	deployments = append(deployments, deployment{Ref: ref, Time: time.Now(), Job: job})
+	if len(deployments) > h.size {
+		deployments = deployments[len(deployments)-h.size:]
+	}
+	h.jobs[job.JobName] = deployments
+	h.save()
+}
+
+// forget drops the history of an unscheduled job.
+func (h *deployHistory) forget(jobName string) {
+	delete(h.jobs, jobName)
+	h.save()
+}
+
+// deployments returns the deployments of the job, most recent last.
+func (h *deployHistory) deployments(jobName string) []deployment {
+	return append([]deployment{}, h.jobs[jobName]...)
+}
+
+// current returns the job as it's currently deployed.
+func (h *deployHistory) current(jobName string) (deployment, error) {
+	deployments := h.jobs[jobName]
+	if len(deployments) == 0 {
+		return deployment{}, errJobNotDeployed
+	}
+	return deployments[len(deployments)-1], nil
+}
+
+// currents returns the current deployment of each job.
+func (h *deployHistory) currents() []deployment {
+	currents := make([]deployment, 0, len(h.jobs))
+	for _, deployments := range h.jobs {
+		if len(deployments) > 0 {
+			currents = append(currents, deployments[len(deployments)-1])
+		}
+	}
+	return currents
+}
+
+// target returns the deployment with the ref, or the one before the current
+// deployment if ref is empty.
+func (h *deployHistory) target(jobName, ref string) (deployment, error) {
+	deployments := h.jobs[jobName]
+	if ref == "" {
+		if len(deployments) < 2 {
+			return deployment{}, errNoPreviousDeployment
+		}
+		return deployments[len(deployments)-2], nil
+	}
+	for _, d := range deployments {
+		if d.Ref == ref {
+			return d, nil
+		}
+	}
+	return deployment{}, unknownRefError{jobName, ref}
+}
+
+// save writes the history, logging any error: failing to persist it is no
+// reason to fail the deployment.
+func (h *deployHistory) save() {
+	if h.path == "" {
+		return
+	}
+	buf, err := json.Marshal(h.jobs)
+	if err == nil {
+		err = writeFileAtomically(h.path, buf)
+	}
+	if err != nil {
+		log.Printf("scheduler: can't write deploy history: %s", err)
+	}
+}
+
+type unknownRefError struct{ jobName, ref string }
+
+func (e unknownRefError) Error() string {
+	return fmt.Sprintf("job %s has no recorded deployment %s", e.jobName, e.ref)
+}
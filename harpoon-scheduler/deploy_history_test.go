@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestDeployHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-scheduler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "history.json")
+	history, err := newDeployHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := history.target("alpha", ""); err != errNoPreviousDeployment {
+		t.Fatalf("expected %q, got %v", errNoPreviousDeployment, err)
+	}
+
+	var (
+		v1 = scheduler.Job{JobName: "alpha", Contact: configstore.Contact{Owner: "v1"}}
+		v2 = scheduler.Job{JobName: "alpha", Contact: configstore.Contact{Owner: "v2"}}
+		v3 = scheduler.Job{JobName: "alpha", Contact: configstore.Contact{Owner: "v3"}}
+	)
+	history.record(v1)
+	history.record(v2)
+	history.record(v1) // rolled back
+	history.record(v3)
+
+	// Reload, to check persistence.
+	history, err = newDeployHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployments := history.deployments("alpha")
+	if expected, got := 2, len(deployments); expected != got {
+		t.Fatalf("expected %d deployments, got %d", expected, got)
+	}
+	if expected, got := refHash(v1), deployments[0].Ref; expected != got {
+		t.Errorf("expected oldest deployment %s, got %s", expected, got)
+	}
+	if current, err := history.current("alpha"); err != nil || current.Ref != refHash(v3) {
+		t.Errorf("expected current deployment %s, got %s (%v)", refHash(v3), current.Ref, err)
+	}
+	if target, err := history.target("alpha", ""); err != nil || target.Ref != refHash(v1) {
+		t.Errorf("expected previous deployment %s, got %s (%v)", refHash(v1), target.Ref, err)
+	}
+	if _, err := history.target("alpha", refHash(v2)); err == nil {
+		t.Errorf("expected error for a deployment beyond the history size, got none")
+	}
+
+	history.forget("alpha")
+	if _, err := history.current("alpha"); err != errJobNotDeployed {
+		t.Errorf("expected %q, got %v", errJobNotDeployed, err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// Namespaces may restrict when their jobs are deployed, for organizations
+// with change freezes: weekly deploy windows, outside of which jobs can't be
+// scheduled or rolled back, and freezes, during which they can't at all.
+// Emergencies override both, with ?emergency=true and, ideally, a ?reason=;
+// overrides and blocked requests are recorded in the audit log. Namespaces
+// without windows may deploy at any time, except during their freezes.
+
+// deployWindow is a weekly window in which the jobs of a namespace may be
+// deployed.
+type deployWindow struct {
+	Days     []string `json:"days,omitempty"`     // mon, tue, ...; empty for every day
+	Start    string   `json:"start"`              // HH:MM, inclusive
+	End      string   `json:"end"`                // HH:MM, exclusive; not after start for windows spanning midnight
+	Timezone string   `json:"timezone,omitempty"` // e.g. Europe/Berlin; empty for UTC
+}
+
+// deployFreeze blocks deployments of the jobs of a namespace from From until
+// Until.
+type deployFreeze struct {
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (w deployWindow) valid() error {
+	for _, day := range w.Days {
+		if _, ok := weekdays[day]; !ok {
+			return fmt.Errorf("invalid day %q (want mon, tue, ...)", day)
+		}
+	}
+	if _, err := clockMinutes(w.Start); err != nil {
+		return fmt.Errorf("start: %s", err)
+	}
+	if _, err := clockMinutes(w.End); err != nil {
+		return fmt.Errorf("end: %s", err)
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("timezone: %s", err)
+	}
+	return nil
+}
+
+// contains returns true if t lies in the window. Windows spanning midnight
+// belong to the day they start on.
+func (w deployWindow) contains(t time.Time) bool {
+	location, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false // validated on load
+	}
+	var (
+		local      = t.In(location)
+		minute     = local.Hour()*60 + local.Minute()
+		start, _   = clockMinutes(w.Start)
+		end, _     = clockMinutes(w.End)
+		day        = local.Weekday()
+		overnight  = end <= start
+		afterStart = minute >= start
+	)
+	if overnight && !afterStart {
+		if minute >= end {
+			return false
+		}
+		day = (day + 6) % 7 // the window started the day before
+	} else if !afterStart || (!overnight && minute >= end) {
+		return false
+	}
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if weekdays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (w deployWindow) String() string {
+	s := fmt.Sprintf("%s-%s", w.Start, w.End)
+	if len(w.Days) > 0 {
+		s = strings.Join(w.Days, ",") + " " + s
+	}
+	if w.Timezone != "" {
+		s += " " + w.Timezone
+	}
+	return s
+}
+
+// clockMinutes parses HH:MM into minutes since midnight.
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// deployBlockedError is returned by deployable outside the deploy windows of
+// a namespace, or during its freezes.
+type deployBlockedError struct {
+	namespace string
+	reason    string
+}
+
+func (e deployBlockedError) Error() string {
+	return fmt.Sprintf("namespace %q can't deploy now: %s; add ?emergency=true&reason=... to override", e.namespace, e.reason)
+}
+
+// deployable returns a deployBlockedError if the jobs of the namespace can't
+// be deployed at time t.
+func (n *namespaces) deployable(namespace string, t time.Time) error {
+	if n == nil || namespace == "" {
+		return nil
+	}
+	policy := n.policies[namespace]
+	for _, freeze := range policy.Freezes {
+		if !t.Before(freeze.From) && t.Before(freeze.Until) {
+			reason := fmt.Sprintf("frozen until %s", freeze.Until.Format(time.RFC3339))
+			if freeze.Reason != "" {
+				reason += " (" + freeze.Reason + ")"
+			}
+			return deployBlockedError{namespace, reason}
+		}
+	}
+	if len(policy.Windows) == 0 {
+		return nil
+	}
+	windows := make([]string, len(policy.Windows))
+	for i, window := range policy.Windows {
+		if window.contains(t) {
+			return nil
+		}
+		windows[i] = window.String()
+	}
+	return deployBlockedError{namespace, fmt.Sprintf("outside of its deploy windows (%s)", strings.Join(windows, "; "))}
+}
+
+// deployAllowed writes an error response and returns false if the job can't
+// be deployed now, unless the request declares an emergency.
+func (n *namespaces) deployAllowed(w http.ResponseWriter, r *http.Request, audit *auditLog, operation string, job scheduler.Job) bool {
+	if err := n.deployPermitted(r, audit, operation, job); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return false
+	}
+	return true
+}
+
+// deployPermitted returns why the job can't be deployed now, unless the
+// request declares an emergency. Blocked requests and overrides are recorded
+// in the audit log.
+func (n *namespaces) deployPermitted(r *http.Request, audit *auditLog, operation string, job scheduler.Job) error {
+	err := n.deployable(job.Namespace, time.Now())
+	if err == nil {
+		return nil
+	}
+	entry := auditEntry{
+		Operation: operation,
+		JobName:   job.JobName,
+		Namespace: job.Namespace,
+		Remote:    r.RemoteAddr,
+		Policy:    err.Error(),
+		Reason:    r.URL.Query().Get("reason"),
+	}
+	if r.URL.Query().Get("emergency") != "true" {
+		entry.Outcome = auditBlocked
+		audit.record(entry)
+		return err
+	}
+	entry.Outcome = auditOverridden
+	audit.record(entry)
+	log.Printf("%s %s: emergency override of deploy policy: %s (reason: %q)", operation, job.JobName, err, entry.Reason)
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestDeployWindowContains(t *testing.T) {
+	var (
+		office    = deployWindow{Days: []string{"mon", "tue", "wed", "thu"}, Start: "09:00", End: "17:00"}
+		overnight = deployWindow{Days: []string{"fri"}, Start: "22:00", End: "02:00"}
+		berlin    = deployWindow{Start: "09:00", End: "10:00", Timezone: "Europe/Berlin"}
+	)
+	for _, tuple := range []struct {
+		window   deployWindow
+		time     string
+		expected bool
+	}{
+		{office, "2014-11-03T09:00:00Z", true}, // Monday
+		{office, "2014-11-03T16:59:00Z", true},
+		{office, "2014-11-03T17:00:00Z", false},
+		{office, "2014-11-03T08:59:00Z", false},
+		{office, "2014-11-07T12:00:00Z", false}, // Friday
+		{overnight, "2014-11-07T23:00:00Z", true},
+		{overnight, "2014-11-08T01:00:00Z", true}, // Saturday, but the window started Friday
+		{overnight, "2014-11-08T02:00:00Z", false},
+		{overnight, "2014-11-08T23:00:00Z", false},
+		{berlin, "2014-11-03T08:30:00Z", true}, // 09:30 CET
+		{berlin, "2014-11-03T09:30:00Z", false},
+	} {
+		at, err := time.Parse(time.RFC3339, tuple.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tuple.window.contains(at); tuple.expected != got {
+			t.Errorf("%s at %s: expected %v, got %v", tuple.window, tuple.time, tuple.expected, got)
+		}
+	}
+}
+
+func TestDeployable(t *testing.T) {
+	var (
+		monday = time.Date(2014, 11, 3, 12, 0, 0, 0, time.UTC)
+		n      = &namespaces{policies: map[string]namespacePolicy{
+			"team-a": {Windows: []deployWindow{{Days: []string{"mon"}, Start: "09:00", End: "17:00"}}},
+			"team-b": {Freezes: []deployFreeze{{From: monday.Add(-time.Hour), Until: monday.Add(time.Hour), Reason: "launch"}}},
+		}}
+	)
+	for _, tuple := range []struct {
+		namespace string
+		time      time.Time
+		blocked   bool
+	}{
+		{"", monday, false},
+		{"team-a", monday, false},
+		{"team-a", monday.Add(6 * time.Hour), true},
+		{"team-b", monday, true},
+		{"team-b", monday.Add(time.Hour), false},
+	} {
+		err := n.deployable(tuple.namespace, tuple.time)
+		if _, blocked := err.(deployBlockedError); tuple.blocked != blocked {
+			t.Errorf("%q at %s: expected blocked %v, got %v", tuple.namespace, tuple.time, tuple.blocked, err)
+		}
+	}
+}
+
+func TestDeployAllowedAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-scheduler-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		audit = &auditLog{path: filepath.Join(dir, "audit.log")}
+		now   = time.Now()
+		n     = &namespaces{policies: map[string]namespacePolicy{
+			"team-a": {Freezes: []deployFreeze{{From: now.Add(-time.Hour), Until: now.Add(time.Hour)}}},
+		}}
+		job = scheduler.Job{JobName: "team-a.alpha", Namespace: "team-a"}
+	)
+
+	r, _ := http.NewRequest("POST", "/schedule", nil)
+	w := httptest.NewRecorder()
+	if n.deployAllowed(w, r, audit, "schedule", job) {
+		t.Fatal("expected deploy during freeze to be blocked")
+	}
+	if expected, got := http.StatusForbidden, w.Code; expected != got {
+		t.Errorf("expected %d, got %d", expected, got)
+	}
+
+	r, _ = http.NewRequest("POST", "/schedule?emergency=true&reason=outage", nil)
+	if !n.deployAllowed(httptest.NewRecorder(), r, audit, "schedule", job) {
+		t.Fatal("expected emergency deploy to be allowed")
+	}
+
+	f, err := os.Open(audit.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var (
+		entries = []auditEntry{}
+		s       = bufio.NewScanner(f)
+	)
+	for s.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if expected, got := 2, len(entries); expected != got {
+		t.Fatalf("expected %d audit entries, got %d", expected, got)
+	}
+	if expected, got := auditBlocked, entries[0].Outcome; expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if expected, got := (auditEntry{Outcome: auditOverridden, Reason: "outage", JobName: "team-a.alpha"}), entries[1]; expected.Outcome != got.Outcome || expected.Reason != got.Reason || expected.JobName != got.JobName {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// The desired state is every job as it's currently deployed, with the agents
+// its containers are placed on. It's exported as a single document, which can
+// be imported to restore the jobs after a disaster, or to clone an
+// environment, e.g. to bring up staging with the topology of production.
+// Imported jobs are scheduled like any other: they must pass the
+// authorization, deploy windows, and quotas of their namespaces. They're
+// placed anew, unless the placements of the document are kept, which requires
+// the same agents.
+
+const (
+	importScheduled = "scheduled"
+	importUnchanged = "unchanged" // already deployed
+	importFailed    = "failed"
+)
+
+var errNoPlacement = errors.New("no placement given")
+
+// desiredState is the document of GET /export and POST /import.
+type desiredState struct {
+	Time      time.Time     `json:"time"`
+	Jobs      []exportedJob `json:"jobs"`                // sorted by job name
+	Untracked []string      `json:"untracked,omitempty"` // jobs with containers but no recorded deployment, which can't be exported
+}
+
+// exportedJob is a job as it's currently deployed.
+type exportedJob struct {
+	Ref        string            `json:"ref"`
+	Job        scheduler.Job     `json:"job"`
+	Placements map[string]string `json:"placements"` // container ID: agent endpoint
+}
+
+// importResult is the outcome of the import of a job.
+type importResult struct {
+	JobName string `json:"job_name"`
+	Outcome string `json:"outcome"` // scheduled, unchanged, or failed
+	Error   string `json:"error,omitempty"`
+}
+
+// exportState returns the desired state of the deployments, with the
+// placements of their containers in the registry snapshot. Containers being
+// unscheduled, and those of other deployments of the jobs, are left out.
+func exportState(deployments []deployment, snapshot registrySnapshot) desiredState {
+	var (
+		state   = desiredState{Time: snapshot.Time, Jobs: []exportedJob{}}
+		tracked = map[string]bool{}   // job name
+		seen    = map[string]bool{}   // untracked job name
+		placed  = map[string]string{} // container ID: endpoint
+	)
+	for status, containers := range snapshot.Containers {
+		if status == registryPendingUnschedule {
+			continue
+		}
+		for containerID, entry := range containers {
+			placed[containerID] = entry.Endpoint
+		}
+	}
+	for _, d := range deployments {
+		tracked[d.Job.JobName] = true
+		placements := map[string]string{}
+		for _, task := range d.Job.Tasks {
+			for instance := 0; instance < task.Instances(); instance++ {
+				containerID := makeContainerID(d.Job, task, instance)
+				if endpoint, ok := placed[containerID]; ok {
+					placements[containerID] = endpoint
+				}
+			}
+		}
+		state.Jobs = append(state.Jobs, exportedJob{Ref: d.Ref, Job: d.Job, Placements: placements})
+	}
+	for _, containers := range snapshot.Containers {
+		for _, entry := range containers {
+			if !tracked[entry.JobName] && !seen[entry.JobName] {
+				seen[entry.JobName] = true
+				state.Untracked = append(state.Untracked, entry.JobName)
+			}
+		}
+	}
+	sort.Sort(exportedJobsByName(state.Jobs))
+	sort.Strings(state.Untracked)
+	return state
+}
+
+type exportedJobsByName []exportedJob
+
+func (a exportedJobsByName) Len() int           { return len(a) }
+func (a exportedJobsByName) Less(i, j int) bool { return a[i].Job.JobName < a[j].Job.JobName }
+func (a exportedJobsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// placeJobAt places the containers of the job on the agents given by
+// placements, if those agents can take them.
+func placeJobAt(job scheduler.Job, placements map[string]string, agentStates map[string]agentState) (map[string]taskSpec, error) {
+	var (
+		m      = map[string]taskSpec{}                // containerID: taskSpec
+		placed = map[string][]agent.ContainerConfig{} // endpoint: configs placed by us
+	)
+	for _, task := range job.Tasks {
+		for instance := 0; instance < task.Instances(); instance++ {
+			containerID := makeContainerID(job, task, instance)
+			endpoint, ok := placements[containerID]
+			if !ok {
+				return map[string]taskSpec{}, placementError{task.TaskName, instance, task.Instances(), errNoPlacement}
+			}
+			state, ok := agentStates[endpoint]
+			if !ok {
+				return map[string]taskSpec{}, placementError{task.TaskName, instance, task.Instances(), fmt.Errorf("unknown agent %s", endpoint)}
+			}
+			if r, ok := filterAgent(instanceTask(task, instance), state, placed[endpoint]); !ok {
+				return map[string]taskSpec{}, placementError{task.TaskName, instance, task.Instances(), fmt.Errorf("agent %s: %s", endpoint, r.Reason)}
+			}
+			placed[endpoint] = append(placed[endpoint], task.ContainerConfig)
+			m[containerID] = taskSpec{
+				endpoint:        endpoint,
+				ContainerConfig: task.ContainerConfig,
+			}
+		}
+	}
+	incContainersPlaced(len(m))
+	incJobContainersPlaced(m)
+	return m, nil
+}
+
+// handleExport writes the desired state of the jobs in the namespaces the
+// request is authorized for.
+func handleExport(s *basicScheduler, registry *registry, namespaces *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deployments := []deployment{}
+		for _, d := range s.currentDeployments() {
+			if namespaces.authorize(r, d.Job.Namespace) == nil {
+				deployments = append(deployments, d)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(exportState(deployments, registry.snapshot()))
+	}
+}
+
+// handleImport schedules the jobs of the desired state in the body, one after
+// the other. Jobs which are already deployed, with the same ref, are left
+// alone. A job which fails to import doesn't stop the others. If the keep
+// query parameter is true, jobs are placed as in the document. Deploy windows
+// may be overridden as for POST /schedule.
+func handleImport(s *basicScheduler, namespaces *namespaces, audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var state desiredState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		defer r.Body.Close()
+
+		var (
+			keep    = r.URL.Query().Get("keep") == "true"
+			results = make([]importResult, 0, len(state.Jobs))
+			code    = http.StatusOK
+		)
+		for _, e := range state.Jobs {
+			var placements map[string]string
+			if keep {
+				placements = e.Placements
+				if placements == nil {
+					placements = map[string]string{}
+				}
+			}
+			result := importJob(s, namespaces, audit, r, e.Job, placements)
+			if result.Outcome == importFailed {
+				code = http.StatusBadRequest
+			}
+			results = append(results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+func importJob(s *basicScheduler, namespaces *namespaces, audit *auditLog, r *http.Request, job scheduler.Job, placements map[string]string) importResult {
+	failed := func(err error) importResult {
+		return importResult{JobName: job.JobName, Outcome: importFailed, Error: err.Error()}
+	}
+	if err := job.Valid(); err != nil {
+		return failed(err)
+	}
+	if err := namespaces.authorize(r, job.Namespace); err != nil {
+		return failed(err)
+	}
+	if deployments := s.deployments(job.JobName); len(deployments) > 0 {
+		if current := deployments[len(deployments)-1]; current.Ref != refHash(job) {
+			return failed(fmt.Errorf("job is deployed with ref %s; migrate it instead", current.Ref))
+		}
+		return importResult{JobName: job.JobName, Outcome: importUnchanged}
+	}
+	if err := namespaces.deployPermitted(r, audit, "import", job); err != nil {
+		return failed(err)
+	}
+	if err := s.scheduleAt(job, placements); err != nil {
+		return failed(err)
+	}
+	return importResult{JobName: job.JobName, Outcome: importScheduled}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestExportState(t *testing.T) {
+	var (
+		task = scheduler.Task{
+			TaskName:        "web",
+			Scale:           2,
+			ContainerConfig: agent.ContainerConfig{Resources: agent.Resources{Memory: 64, CPUs: 1}},
+		}
+		alpha = scheduler.Job{JobName: "alpha", Tasks: map[string]scheduler.Task{"web": task}}
+		beta  = scheduler.Job{JobName: "beta", Tasks: map[string]scheduler.Task{"web": task}}
+		a0    = makeContainerID(alpha, task, 0)
+		a1    = makeContainerID(alpha, task, 1)
+		b0    = makeContainerID(beta, task, 0)
+	)
+	snapshot := registrySnapshot{
+		Containers: map[registryStatus]map[string]registrySnapshotEntry{
+			registryScheduled: {
+				a0:      {Endpoint: "http://a:1", JobName: "alpha"},
+				"stale": {Endpoint: "http://a:1", JobName: "alpha"}, // of another deployment
+				b0:      {Endpoint: "http://b:2", JobName: "beta"},
+				"gamma": {Endpoint: "http://b:2", JobName: "gamma"},
+			},
+			registryPendingSchedule:   {a1: {Endpoint: "http://b:2", JobName: "alpha"}},
+			registryPendingUnschedule: {makeContainerID(beta, task, 1): {Endpoint: "http://a:1", JobName: "beta"}},
+		},
+	}
+	deployments := []deployment{
+		{Ref: refHash(beta), Job: beta},
+		{Ref: refHash(alpha), Job: alpha},
+	}
+
+	state := exportState(deployments, snapshot)
+	expected := []exportedJob{
+		{Ref: refHash(alpha), Job: alpha, Placements: map[string]string{a0: "http://a:1", a1: "http://b:2"}},
+		{Ref: refHash(beta), Job: beta, Placements: map[string]string{b0: "http://b:2"}},
+	}
+	if got := state.Jobs; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	if expected, got := []string{"gamma"}, state.Untracked; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected untracked %v, got %v", expected, got)
+	}
+}
+
+func TestPlaceJobAt(t *testing.T) {
+	var (
+		task = scheduler.Task{
+			TaskName:        "web",
+			Scale:           2,
+			ContainerConfig: agent.ContainerConfig{Resources: agent.Resources{Memory: 64, CPUs: 1}},
+		}
+		job         = scheduler.Job{JobName: "alpha", Tasks: map[string]scheduler.Task{"web": task}}
+		c0          = makeContainerID(job, task, 0)
+		c1          = makeContainerID(job, task, 1)
+		agentStates = map[string]agentState{
+			"http://a:1": {hostResources: agent.HostResources{Memory: agent.TotalReserved{Total: 128}, CPUs: agent.TotalReserved{Total: 2}}},
+			"http://b:2": {hostResources: agent.HostResources{Memory: agent.TotalReserved{Total: 64}, CPUs: agent.TotalReserved{Total: 1}}},
+		}
+	)
+
+	m, err := placeJobAt(job, map[string]string{c0: "http://a:1", c1: "http://a:1"}, agentStates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "http://a:1", m[c1].endpoint; expected != got {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	for _, placements := range []map[string]string{
+		{c0: "http://a:1"},                   // missing placement
+		{c0: "http://a:1", c1: "http://c:3"}, // unknown agent
+		{c0: "http://b:2", c1: "http://b:2"}, // no room for the second
+	} {
+		if _, err := placeJobAt(job, placements, agentStates); err == nil {
+			t.Errorf("%v: expected error, got none", placements)
+		}
+	}
+}
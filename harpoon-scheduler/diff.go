@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// A jobDiff describes what migrating a running job to a new config would
+// change, so the change can be reviewed before it's made.
+type jobDiff struct {
+	JobName      string              `json:"job_name"`
+	TasksAdded   []string            `json:"tasks_added"`
+	TasksRemoved []string            `json:"tasks_removed"`
+	Tasks        map[string]taskDiff `json:"tasks"`    // changed tasks which exist before and after
+	Replaced     []string            `json:"replaced"` // running containers which would be stopped
+	Unchanged    bool                `json:"unchanged"`
+}
+
+// taskDiff describes the changes to a task. Changes to fields without a
+// dedicated diff are listed by their JSON name in Changed.
+type taskDiff struct {
+	Scale       *intChange              `json:"scale,omitempty"`
+	ArtifactURL *stringChange           `json:"artifact_url,omitempty"`
+	Env         map[string]stringChange `json:"env,omitempty"` // empty for variables which are added or removed
+	Resources   *resourcesChange        `json:"resources,omitempty"`
+	Changed     []string                `json:"changed,omitempty"`
+}
+
+type intChange struct {
+	Old int `json:"old"`
+	New int `json:"new"`
+}
+
+type stringChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type resourcesChange struct {
+	Old agent.Resources `json:"old"`
+	New agent.Resources `json:"new"`
+}
+
+// diffJob compares the containers of the job running on the agents with the
+// new job.
+func diffJob(jobName string, newJob scheduler.Job, agentStates map[string]agentState) jobDiff {
+	var (
+		running = map[string]agent.ContainerConfig{} // task name: config of an instance
+		scale   = map[string]int{}                   // task name: running instances
+		ids     = []string{}                         // running container IDs
+	)
+	for _, state := range agentStates {
+		for id, containerInstance := range state.containerInstances {
+			if containerInstance.Config.JobName != jobName {
+				continue
+			}
+			running[containerInstance.Config.TaskName] = containerInstance.Config
+			scale[containerInstance.Config.TaskName]++
+			ids = append(ids, id)
+		}
+	}
+
+	d := jobDiff{
+		JobName:      jobName,
+		TasksAdded:   []string{},
+		TasksRemoved: []string{},
+		Tasks:        map[string]taskDiff{},
+		Replaced:     []string{},
+	}
+	for taskName, task := range newJob.Tasks {
+		config, ok := running[taskName]
+		if !ok {
+			d.TasksAdded = append(d.TasksAdded, taskName)
+			continue
+		}
+		if td, changed := diffTask(config, scale[taskName], task); changed {
+			d.Tasks[taskName] = td
+		}
+	}
+	for taskName := range running {
+		if _, ok := newJob.Tasks[taskName]; !ok {
+			d.TasksRemoved = append(d.TasksRemoved, taskName)
+		}
+	}
+
+	// Container IDs hash the whole job, so any change replaces every
+	// container, but a job migrated to its own config keeps them.
+	keep := map[string]bool{}
+	for _, task := range newJob.Tasks {
+		for instance := 0; instance < task.Instances(); instance++ {
+			keep[makeContainerID(newJob, task, instance)] = true
+		}
+	}
+	for _, id := range ids {
+		if !keep[id] {
+			d.Replaced = append(d.Replaced, id)
+		}
+	}
+
+	sort.Strings(d.TasksAdded)
+	sort.Strings(d.TasksRemoved)
+	sort.Strings(d.Replaced)
+	d.Unchanged = len(d.TasksAdded) == 0 && len(d.TasksRemoved) == 0 && len(d.Tasks) == 0 && len(d.Replaced) == 0
+	return d
+}
+
+// diffTask compares the config of a running instance of the task, and the
+// number of running instances, with the new task.
+func diffTask(before agent.ContainerConfig, beforeScale int, task scheduler.Task) (taskDiff, bool) {
+	var (
+		d       taskDiff
+		changed bool
+	)
+	after := expectedConfig(task, before)
+
+	if beforeScale != task.Instances() {
+		d.Scale, changed = &intChange{beforeScale, task.Instances()}, true
+	}
+	if before.ArtifactURL != after.ArtifactURL {
+		d.ArtifactURL, changed = &stringChange{before.ArtifactURL, after.ArtifactURL}, true
+	}
+	if env := diffEnv(before.Env, after.Env); len(env) > 0 {
+		d.Env, changed = env, true
+	}
+	if !reflect.DeepEqual(before.Resources, after.Resources) {
+		d.Resources, changed = &resourcesChange{before.Resources, after.Resources}, true
+	}
+	if fields := changedFields(before, after, "artifact_url", "env", "resources"); len(fields) > 0 {
+		d.Changed, changed = fields, true
+	}
+	return d, changed
+}
+
+func diffEnv(before, after map[string]string) map[string]stringChange {
+	m := map[string]stringChange{}
+	for k, v := range before {
+		if w, ok := after[k]; !ok || v != w {
+			m[k] = stringChange{Old: v, New: w}
+		}
+	}
+	for k, w := range after {
+		if _, ok := before[k]; !ok {
+			m[k] = stringChange{New: w}
+		}
+	}
+	return m
+}
+
+// changedFields returns the sorted JSON names of the top-level fields which
+// differ between the configs, except the ignored ones.
+func changedFields(before, after agent.ContainerConfig, ignore ...string) []string {
+	var (
+		beforeFields = jsonFields(before)
+		afterFields  = jsonFields(after)
+		ignored      = map[string]bool{}
+		fields       = []string{}
+	)
+	for _, name := range ignore {
+		ignored[name] = true
+	}
+	for name := range beforeFields {
+		afterFields[name] = afterFields[name] // fields omitted when empty
+	}
+	for name, value := range afterFields {
+		if !ignored[name] && string(beforeFields[name]) != string(value) {
+			fields = append(fields, name)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func jsonFields(config agent.ContainerConfig) map[string]json.RawMessage {
+	m := map[string]json.RawMessage{}
+	buf, err := json.Marshal(config)
+	if err != nil {
+		return m
+	}
+	json.Unmarshal(buf, &m)
+	return m
+}
+
+// runningArtifactURL returns the artifact URL of a running container of the
+// job, or the empty string if none runs.
+func runningArtifactURL(jobName string, agentStates map[string]agentState) string {
+	for _, state := range agentStates {
+		for _, containerInstance := range state.containerInstances {
+			if containerInstance.Config.JobName == jobName {
+				return containerInstance.Config.ArtifactURL
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+func TestDiffJob(t *testing.T) {
+	var (
+		artifactURL = "http://filestore.berlin/alpha-1.tar.gz"
+		oldConfig   = configstore.JobConfig{
+			JobName: "alpha",
+			Tasks: []configstore.TaskConfig{
+				{TaskName: "web", Scale: 2, Env: map[string]string{"A": "1", "B": "2"}, Resources: agent.Resources{Memory: 64, CPUs: 1}},
+				{TaskName: "worker", Scale: 1, Resources: agent.Resources{Memory: 32, CPUs: 1}},
+			},
+		}
+		oldJob      = makeJob(oldConfig, artifactURL)
+		agentStates = map[string]agentState{"http://a:1": {containerInstances: map[string]agent.ContainerInstance{}}}
+	)
+	for _, task := range oldJob.Tasks {
+		for instance := 0; instance < task.Scale; instance++ {
+			id := makeContainerID(oldJob, task, instance)
+			agentStates["http://a:1"].containerInstances[id] = agent.ContainerInstance{ID: id, Config: task.ContainerConfig}
+		}
+	}
+
+	if d := diffJob("alpha", oldJob, agentStates); !d.Unchanged {
+		t.Fatalf("expected no changes against the running config, got %+v", d)
+	}
+
+	newConfig := configstore.JobConfig{
+		JobName: "alpha",
+		Tasks: []configstore.TaskConfig{
+			{TaskName: "web", Scale: 3, Env: map[string]string{"A": "1", "B": "3", "C": "4"}, Resources: agent.Resources{Memory: 128, CPUs: 1}, Grace: agent.Grace{Startup: 5}},
+			{TaskName: "cron", Scale: 1},
+		},
+	}
+	d := diffJob("alpha", makeJob(newConfig, "http://filestore.berlin/alpha-2.tar.gz"), agentStates)
+
+	if expected, got := []string{"cron"}, d.TasksAdded; !reflect.DeepEqual(expected, got) {
+		t.Errorf("tasks added: expected %v, got %v", expected, got)
+	}
+	if expected, got := []string{"worker"}, d.TasksRemoved; !reflect.DeepEqual(expected, got) {
+		t.Errorf("tasks removed: expected %v, got %v", expected, got)
+	}
+	if expected, got := 3, len(d.Replaced); expected != got {
+		t.Errorf("expected %d replaced containers, got %v", expected, d.Replaced)
+	}
+	web, ok := d.Tasks["web"]
+	if !ok {
+		t.Fatalf("expected changes to web, got %+v", d.Tasks)
+	}
+	if expected, got := (&intChange{2, 3}), web.Scale; !reflect.DeepEqual(expected, got) {
+		t.Errorf("scale: expected %v, got %v", expected, got)
+	}
+	if web.ArtifactURL == nil || web.ArtifactURL.New != "http://filestore.berlin/alpha-2.tar.gz" {
+		t.Errorf("expected artifact change, got %v", web.ArtifactURL)
+	}
+	if expected, got := (map[string]stringChange{"B": {"2", "3"}, "C": {"", "4"}}), web.Env; !reflect.DeepEqual(expected, got) {
+		t.Errorf("env: expected %v, got %v", expected, got)
+	}
+	if web.Resources == nil || web.Resources.New.Memory != 128 {
+		t.Errorf("expected resources change, got %v", web.Resources)
+	}
+	if expected, got := []string{"grace"}, web.Changed; !reflect.DeepEqual(expected, got) {
+		t.Errorf("changed fields: expected %v, got %v", expected, got)
+	}
+}
+
+func TestMakeJobForEnvironment(t *testing.T) {
+	config := configstore.JobConfig{
+		JobName:     "alpha",
+		ArtifactURL: "http://filestore.berlin/alpha-1.tar.gz",
+		Tasks: []configstore.TaskConfig{
+			{TaskName: "web", Scale: 2, Env: map[string]string{"A": "1", "B": "2"}},
+			{TaskName: "worker", Scale: 1},
+		},
+		Environments: map[string]configstore.Overlay{
+			"production": {
+				Env:         map[string]string{"B": "prod"},
+				Scale:       map[string]int{"web": 10},
+				ArtifactURL: "http://filestore.berlin/alpha-2.tar.gz",
+			},
+		},
+	}
+
+	resolved, err := config.Resolve("production")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := makeJob(resolved, "")
+	if expected, got := 10, job.Tasks["web"].Scale; expected != got {
+		t.Errorf("expected scale %d, got %d", expected, got)
+	}
+	if expected, got := 1, job.Tasks["worker"].Scale; expected != got {
+		t.Errorf("expected scale %d, got %d", expected, got)
+	}
+	if expected, got := (map[string]string{"A": "1", "B": "prod"}), job.Tasks["web"].Env; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected env %v, got %v", expected, got)
+	}
+	if expected, got := "http://filestore.berlin/alpha-2.tar.gz", job.Tasks["worker"].ArtifactURL; expected != got {
+		t.Errorf("expected artifact URL %s, got %s", expected, got)
+	}
+	if expected, got := "2", config.Tasks[0].Env["B"]; expected != got {
+		t.Errorf("expected base config to keep %s, got %s", expected, got)
+	}
+
+	if _, err := config.Resolve("staging"); err == nil {
+		t.Errorf("expected error resolving unknown environment")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainer tracks in-flight requests, so the server can be shut down without
+// dropping operations midway. Once draining, new requests are refused.
+type drainer struct {
+	sync.Mutex
+	draining bool
+	inflight int
+	idle     chan struct{} // closed once draining, with no requests in flight
+}
+
+func (d *drainer) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !d.enter() {
+			w.Header().Set("Connection", "close")
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("scheduler is shutting down"))
+			return
+		}
+		defer d.leave()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// enter counts a request in flight, unless draining.
+func (d *drainer) enter() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inflight++
+	return true
+}
+
+func (d *drainer) leave() {
+	d.Lock()
+	defer d.Unlock()
+	d.inflight--
+	if d.draining && d.inflight == 0 {
+		close(d.idle)
+	}
+}
+
+// drain refuses new requests and waits for in-flight requests to complete,
+// up to the timeout. It returns false if the timeout expired first.
+func (d *drainer) drain(timeout time.Duration) bool {
+	d.Lock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if d.inflight == 0 {
+			close(d.idle)
+		}
+	}
+	idle := d.idle
+	d.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
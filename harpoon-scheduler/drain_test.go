@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainer(t *testing.T) {
+	var (
+		d       = &drainer{}
+		started = make(chan struct{})
+		release = make(chan struct{})
+		h       = d.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+	)
+
+	go h.ServeHTTP(httptest.NewRecorder(), &http.Request{Method: "POST"})
+	<-started
+
+	if d.drain(10 * time.Millisecond) {
+		t.Fatal("expected drain to time out with a request in flight")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, &http.Request{Method: "POST"})
+	if expected, got := http.StatusServiceUnavailable, w.Code; expected != got {
+		t.Errorf("expected %d while draining, got %d", expected, got)
+	}
+
+	close(release)
+	if !d.drain(time.Second) {
+		t.Fatal("expected drain to complete")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+// Error responses carry a machine-readable code in addition to the HTTP
+// status, so clients can tell failures worth retrying, like a lack of
+// capacity or a failing agent, from those which aren't, like an invalid job.
+// Errors of unknown classes keep their status, and get no code.
+
+// classifyError returns the HTTP status and code for an error of a scheduling
+// operation. Unknown errors are bad requests, without a code.
+func classifyError(err error) (int, errors.Code) {
+	switch e := err.(type) {
+	case requestError:
+		return http.StatusBadRequest, errors.BadRequest
+	case agent.ValidationErrors, unknownNamespaceError:
+		return errors.StatusUnprocessableEntity, errors.InvalidJob
+	case quotaError:
+		return http.StatusConflict, errors.QuotaExceeded
+	case stateError:
+		if e.scheduled {
+			return http.StatusConflict, errors.AlreadyScheduled
+		}
+		return http.StatusConflict, errors.Conflict
+	case placementError:
+		if _, ok := e.err.(noTrustableAgentError); ok {
+			return http.StatusServiceUnavailable, errors.NoAgents
+		}
+		return http.StatusServiceUnavailable, errors.NoCapacity
+	case agentError:
+		return http.StatusBadGateway, errors.AgentFailure
+	case requirementsError:
+		return errors.StatusFailedDependency, errors.DependenciesUnmet
+	}
+	switch err {
+	case errNamespaceRequired, errInvalidContainerID:
+		return errors.StatusUnprocessableEntity, errors.InvalidJob
+	}
+	return http.StatusBadRequest, ""
+}
+
+// writeClassifiedError writes the error with the status of its class.
+func writeClassifiedError(w http.ResponseWriter, err error) {
+	status, _ := classifyError(err)
+	writeError(w, status, err)
+}
+
+// requestError is returned for requests which can't be read.
+type requestError struct{ err error }
+
+func (e requestError) Error() string { return e.err.Error() }
+
+// agentError is returned when an agent fails an operation on a container, or
+// doesn't complete it in time.
+type agentError struct {
+	what, containerID, endpoint, problem string
+}
+
+func (e agentError) Error() string {
+	return fmt.Sprintf("%s %s on %s: %s", e.what, e.containerID, e.endpoint, e.problem)
+}
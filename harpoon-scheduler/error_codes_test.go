@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   errors.Code
+	}{
+		{requestError{fmt.Errorf("unexpected EOF")}, http.StatusBadRequest, errors.BadRequest},
+		{agent.ValidationErrors{{Field: "job_name", Message: "missing"}}, errors.StatusUnprocessableEntity, errors.InvalidJob},
+		{unknownNamespaceError{"alpha"}, errors.StatusUnprocessableEntity, errors.InvalidJob},
+		{errNamespaceRequired, errors.StatusUnprocessableEntity, errors.InvalidJob},
+		{quotaError{"alpha", "memory", "2048 MB", "1024 MB"}, http.StatusConflict, errors.QuotaExceeded},
+		{stateError{"a-b-c-0", "already scheduled", true}, http.StatusConflict, errors.AlreadyScheduled},
+		{stateError{"a-b-c-0", "is pending move", false}, http.StatusConflict, errors.Conflict},
+		{placementError{"web", 0, 1, errInsufficientCapacity}, http.StatusServiceUnavailable, errors.NoCapacity},
+		{placementError{"web", 0, 1, noTrustableAgentError{}}, http.StatusServiceUnavailable, errors.NoAgents},
+		{agentError{"schedule", "a-b-c-0", "http://a:3333", "timeout"}, http.StatusBadGateway, errors.AgentFailure},
+		{requirementsError{"web", []requirement{{"queue", requirementMissing, false}}}, errors.StatusFailedDependency, errors.DependenciesUnmet},
+		{fmt.Errorf("something else"), http.StatusBadRequest, ""},
+	} {
+		status, code := classifyError(tc.err)
+		if expected, got := tc.status, status; expected != got {
+			t.Errorf("%s: expected status %d, got %d", tc.err, expected, got)
+		}
+		if expected, got := tc.code, code; expected != got {
+			t.Errorf("%s: expected code %q, got %q", tc.err, expected, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// Explanations show how the placement algorithm sees each agent for an
+// instance of a task, so users can find out why a task landed where it did,
+// or why it can't be placed: which agents were filtered, and why, and how the
+// eligible agents rank. Unlike placement, which breaks ties at random,
+// explanations are reproducible: ties go to the first agent by endpoint, and
+// the agents tied with it are listed.
+
+// placementExplanation explains the placement of an instance of a task.
+type placementExplanation struct {
+	Chosen string             `json:"chosen,omitempty"` // empty if the instance can't be placed
+	Tied   []string           `json:"tied,omitempty"`   // eligible agents ranking as well as the chosen one
+	Error  string             `json:"error,omitempty"`  // why the instance can't be placed
+	Agents []agentExplanation `json:"agents"`           // sorted by endpoint
+}
+
+// agentExplanation explains how the placement algorithm sees an agent.
+type agentExplanation struct {
+	Endpoint      string       `json:"agent"`
+	Cluster       string       `json:"cluster,omitempty"`
+	FailureDomain string       `json:"failure_domain,omitempty"`
+	Verdict       string       `json:"verdict"`             // chosen, eligible, or filtered
+	Rejection     *rejection   `json:"rejection,omitempty"` // why the agent was filtered
+	Rank          *spreadScore `json:"rank,omitempty"`      // for eligible agents; lower is better
+}
+
+// spreadScore is the rank of an eligible agent, as compared by spread.
+type spreadScore struct {
+	DomainInstances int  `json:"domain_instances"` // instances of the task in the agent's failure domain
+	AgentInstances  int  `json:"agent_instances"`  // instances of the task on the agent
+	ArtifactCached  bool `json:"artifact_cached"`
+}
+
+const (
+	verdictChosen   = "chosen"
+	verdictEligible = "eligible"
+	verdictFiltered = "filtered"
+)
+
+// explainPlacement explains where the next instance of the task would be
+// placed, given the agent states.
+func explainPlacement(task scheduler.Task, agentStates map[string]agentState) placementExplanation {
+	endpoints := make([]string, 0, len(agentStates))
+	for endpoint := range agentStates {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	var (
+		e          = placementExplanation{Agents: []agentExplanation{}}
+		rank       = spreadRank(task, agentStates, nil)
+		eligible   = []string{}
+		rejections = []rejection{}
+	)
+	for _, endpoint := range endpoints {
+		state := agentStates[endpoint]
+		a := agentExplanation{
+			Endpoint:      endpoint,
+			Cluster:       agentCluster(state),
+			FailureDomain: failureDomain(state),
+			Verdict:       verdictEligible,
+		}
+		if r, ok := filterAgent(task, state, nil); !ok {
+			a.Verdict, a.Rejection = verdictFiltered, &r
+			rejections = append(rejections, r)
+		} else {
+			r := rank(endpoint)
+			a.Rank = &spreadScore{DomainInstances: r[0], AgentInstances: r[1], ArtifactCached: r[2] == 0}
+			eligible = append(eligible, endpoint)
+		}
+		e.Agents = append(e.Agents, a)
+	}
+
+	if len(eligible) == 0 {
+		e.Error = noAgentError(task, rejections).Error()
+		return e
+	}
+	chosen, err := spread(task, eligible, agentStates, nil)
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	e.Chosen = chosen
+	for i, a := range e.Agents {
+		switch {
+		case a.Endpoint == chosen:
+			e.Agents[i].Verdict = verdictChosen
+		case a.Verdict == verdictEligible && rank(a.Endpoint) == rank(chosen):
+			e.Tied = append(e.Tied, a.Endpoint)
+		}
+	}
+	return e
+}
+
+// handleExplain explains the placement of an instance of the task in the
+// body. The body may be a plain container config, or a task, with its
+// clusters, max_per_agent, and min_domains. Agents in any of the task's
+// clusters are eligible.
+func handleExplain(agentStater agentStater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var task scheduler.Task
+		if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := task.ContainerConfig.Valid(); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid container config: %s", err))
+			return
+		}
+		if task.MinDomains < 0 || task.MaxPerAgent < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("min_domains and max_per_agent must not be negative"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(explainPlacement(task, agentStater.agentStates()))
+	}
+}
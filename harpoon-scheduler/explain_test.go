@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestExplainPlacement(t *testing.T) {
+	var (
+		config = agent.ContainerConfig{
+			ArtifactURL: "http://artifacts/web.tar.gz",
+			Resources:   agent.Resources{Memory: 512, CPUs: 1},
+			Storage:     agent.Storage{Volumes: map[string]string{"/data": "/srv/data"}},
+		}
+		volumes     = []string{"/srv/data"}
+		agentStates = map[string]agentState{
+			"http://a:1": {dirty: true},
+			"http://b:2": {hostResources: agent.HostResources{Volumes: []string{}}},
+			"http://c:3": {hostResources: agent.HostResources{Volumes: volumes, Memory: agent.TotalReserved{Total: 1024, Reserved: 1024}}},
+			"http://d:4": {hostResources: agent.HostResources{Volumes: volumes}},
+			"http://e:5": {hostResources: agent.HostResources{Volumes: volumes}},
+			"http://f:6": {hostResources: agent.HostResources{Volumes: volumes}, artifacts: map[string]struct{}{config.ArtifactURL: struct{}{}}},
+		}
+	)
+
+	e := explainPlacement(scheduler.Task{ContainerConfig: config}, agentStates)
+	if expected, got := "http://f:6", e.Chosen; expected != got {
+		t.Errorf("expected %q chosen, got %q", expected, got)
+	}
+	if len(e.Tied) != 0 {
+		t.Errorf("expected no ties, got %v", e.Tied)
+	}
+	var (
+		expected = map[string]string{
+			"http://a:1": rejectDirty,
+			"http://b:2": rejectMissingVolume,
+			"http://c:3": rejectMemory,
+			"http://d:4": verdictEligible,
+			"http://e:5": verdictEligible,
+			"http://f:6": verdictChosen,
+		}
+		got = map[string]string{}
+	)
+	for _, a := range e.Agents {
+		if a.Rejection != nil {
+			got[a.Endpoint] = a.Rejection.Reason
+		} else {
+			got[a.Endpoint] = a.Verdict
+		}
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// Without the cached artifact, d and e tie, and d wins by endpoint.
+	delete(agentStates, "http://f:6")
+	e = explainPlacement(scheduler.Task{ContainerConfig: config}, agentStates)
+	if expected, got := "http://d:4", e.Chosen; expected != got {
+		t.Errorf("expected %q chosen, got %q", expected, got)
+	}
+	if expected, got := []string{"http://e:5"}, e.Tied; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected ties %v, got %v", expected, got)
+	}
+
+	// Without room anywhere, the error is that of the algorithm.
+	delete(agentStates, "http://d:4")
+	delete(agentStates, "http://e:5")
+	e = explainPlacement(scheduler.Task{ContainerConfig: config}, agentStates)
+	if expected, got := errInsufficientCapacity.Error(), e.Error; expected != got {
+		t.Errorf("expected error %q, got %q", expected, got)
+	}
+}
@@ -2,18 +2,28 @@ package main
 
 import (
 	"expvar"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
 var (
 	expvarJobScheduleRequests         = expvar.NewInt("job_schedule_requests")
 	expvarJobMigrateRequests          = expvar.NewInt("job_migrate_requests")
 	expvarJobUnscheduleRequests       = expvar.NewInt("job_unschedule_requests")
+	expvarJobRollbackRequests         = expvar.NewInt("job_rollback_requests")
 	expvarTaskScheduleRequests        = expvar.NewInt("task_schedule_requests")
 	expvarTaskUnscheduleRequests      = expvar.NewInt("task_unschedule_requests")
+	expvarContainerMoveRequests       = expvar.NewInt("container_move_requests")
 	expvarContainersPlaced            = expvar.NewInt("containers_placed")
 	expvarContainersLost              = expvar.NewInt("containers_lost")
+	expvarContainersPreempted         = expvar.NewInt("containers_preempted")
+	expvarContainersRestarted         = expvar.NewInt("containers_restarted")
+	expvarContainersParked            = expvar.NewInt("containers_parked")
+	expvarContainersRebalanced        = expvar.NewInt("containers_rebalanced")
 	expvarSignalScheduleSuccessful    = expvar.NewInt("signal_schedule_successful")
 	expvarSignalScheduleFailed        = expvar.NewInt("signal_schedule_failed")
 	expvarSignalUnscheduleSuccessful  = expvar.NewInt("signal_unschedule_successful")
@@ -24,7 +34,12 @@ var (
 	expvarSignalContainerStartFailed  = expvar.NewInt("signal_container_start_failed")
 	expvarSignalContainerStopFailed   = expvar.NewInt("signal_container_stop_failed")
 	expvarSignalContainerDeleteFailed = expvar.NewInt("signal_container_delete_failed")
+	expvarSignalMoveSuccessful        = expvar.NewInt("signal_move_successful")
+	expvarSignalMoveFailed            = expvar.NewInt("signal_move_failed")
+	expvarSignalInvalid               = expvar.NewInt("signal_invalid")
 	expvarContainerEventsReceived     = expvar.NewInt("container_events_received")
+	expvarUnknownContainerStatuses    = expvar.NewInt("unknown_container_statuses")
+	expvarWatchdogStalls              = expvar.NewInt("watchdog_stalls")
 )
 
 var (
@@ -46,6 +61,12 @@ var (
 		Name:      "job_unschedule_requests",
 		Help:      "Number of job unschedule requests received by the scheduler.",
 	})
+	prometheusJobRollbackRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "job_rollback_requests",
+		Help:      "Number of job rollback requests received by the scheduler.",
+	})
 	prometheusTaskScheduleRequests = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "scheduler",
@@ -58,6 +79,12 @@ var (
 		Name:      "task_unschedule_requests",
 		Help:      "Number of task unschedule requests received by the transformer.",
 	})
+	prometheusContainerMoveRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "container_move_requests",
+		Help:      "Number of container move requests received by the scheduler.",
+	})
 	prometheusContainersPlaced = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "scheduler",
@@ -70,6 +97,30 @@ var (
 		Name:      "containers_lost",
 		Help:      "Number of containers lost.",
 	})
+	prometheusContainersPreempted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "containers_preempted",
+		Help:      "Number of containers preempted for higher-priority jobs.",
+	})
+	prometheusContainersRestarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "containers_restarted",
+		Help:      "Number of failed containers restarted.",
+	})
+	prometheusContainersParked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "containers_parked",
+		Help:      "Number of containers which failed too often, and are no longer restarted.",
+	})
+	prometheusContainersRebalanced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "containers_rebalanced",
+		Help:      "Number of containers moved by the rebalancer.",
+	})
 	prometheusSignalScheduleSuccessful = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "scheduler",
@@ -130,12 +181,42 @@ var (
 		Name:      "signal_container_delete_failed",
 		Help:      "Number of 'container delete failed' signals received by the registry.",
 	})
+	prometheusSignalMoveSuccessful = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "signal_move_successful",
+		Help:      "Number of 'move successful' signals received by the registry.",
+	})
+	prometheusSignalMoveFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "signal_move_failed",
+		Help:      "Number of 'move failed' signals received by the registry.",
+	})
+	prometheusSignalInvalid = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "signal_invalid",
+		Help:      "Number of signals ignored by the registry, because they didn't fit the state of their container.",
+	})
 	prometheusContainerEventsReceived = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "harpoon",
 		Subsystem: "scheduler",
 		Name:      "container_events_received",
 		Help:      "Number of container(s) events received from remote agents.",
 	})
+	prometheusUnknownContainerStatuses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "unknown_container_statuses",
+		Help:      "Number of container instances received from remote agents with a status the scheduler doesn't know.",
+	})
+	prometheusWatchdogStalls = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "watchdog_stalls",
+		Help:      "Number of times a component didn't respond to the watchdog in time.",
+	})
 )
 
 func incJobScheduleRequests(n int) {
@@ -153,6 +234,11 @@ func incJobUnscheduleRequests(n int) {
 	prometheusJobUnscheduleRequests.Add(float64(n))
 }
 
+func incJobRollbackRequests(n int) {
+	expvarJobRollbackRequests.Add(int64(n))
+	prometheusJobRollbackRequests.Add(float64(n))
+}
+
 func incTaskScheduleRequests(n int) {
 	expvarTaskScheduleRequests.Add(int64(n))
 	prometheusTaskScheduleRequests.Add(float64(n))
@@ -163,6 +249,11 @@ func incTaskUnscheduleRequests(n int) {
 	prometheusTaskUnscheduleRequests.Add(float64(n))
 }
 
+func incContainerMoveRequests(n int) {
+	expvarContainerMoveRequests.Add(int64(n))
+	prometheusContainerMoveRequests.Add(float64(n))
+}
+
 func incContainersPlaced(n int) {
 	expvarContainersPlaced.Add(int64(n))
 	prometheusContainersPlaced.Add(float64(n))
@@ -173,6 +264,26 @@ func incContainersLost(n int) {
 	prometheusContainersLost.Add(float64(n))
 }
 
+func incContainersPreempted(n int) {
+	expvarContainersPreempted.Add(int64(n))
+	prometheusContainersPreempted.Add(float64(n))
+}
+
+func incContainersRestarted(n int) {
+	expvarContainersRestarted.Add(int64(n))
+	prometheusContainersRestarted.Add(float64(n))
+}
+
+func incContainersParked(n int) {
+	expvarContainersParked.Add(int64(n))
+	prometheusContainersParked.Add(float64(n))
+}
+
+func incContainersRebalanced(n int) {
+	expvarContainersRebalanced.Add(int64(n))
+	prometheusContainersRebalanced.Add(float64(n))
+}
+
 func incSignalScheduleSuccessful(n int) {
 	expvarSignalScheduleSuccessful.Add(int64(n))
 	prometheusSignalScheduleSuccessful.Add(float64(n))
@@ -223,7 +334,312 @@ func incSignalContainerDeleteFailed(n int) {
 	prometheusSignalContainerDeleteFailed.Add(float64(n))
 }
 
+func incSignalMoveSuccessful(n int) {
+	expvarSignalMoveSuccessful.Add(int64(n))
+	prometheusSignalMoveSuccessful.Add(float64(n))
+}
+
+func incSignalMoveFailed(n int) {
+	expvarSignalMoveFailed.Add(int64(n))
+	prometheusSignalMoveFailed.Add(float64(n))
+}
+
+func incSignalInvalid(n int) {
+	expvarSignalInvalid.Add(int64(n))
+	prometheusSignalInvalid.Add(float64(n))
+}
+
 func incContainerEventsReceived(n int) {
 	expvarContainerEventsReceived.Add(int64(n))
 	prometheusContainerEventsReceived.Add(float64(n))
 }
+
+func incUnknownContainerStatuses(n int) {
+	expvarUnknownContainerStatuses.Add(int64(n))
+	prometheusUnknownContainerStatuses.Add(float64(n))
+}
+
+func incWatchdogStalls(n int) {
+	expvarWatchdogStalls.Add(int64(n))
+	prometheusWatchdogStalls.Add(float64(n))
+}
+
+// Per-agent metrics are labeled with the agent endpoint.
+var (
+	expvarAgentQueueDepth     = expvar.NewMap("agent_queue_depth")
+	prometheusAgentQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "agent_queue_depth",
+		Help:      "Number of operations queued for an agent. Growing queues point to slow agents.",
+	}, []string{"agent"})
+)
+
+// Utilization metrics are computed from the agent states, see
+// computeUtilization. Cluster metrics are labeled with the cluster, which is
+// empty for agents in none.
+var (
+	prometheusClusterMemory = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "cluster_memory_mb",
+		Help:      "Memory in MB offered by the trusted agents, by cluster and kind (total or reserved).",
+	}, []string{"cluster", "kind"})
+	prometheusClusterCPUs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "cluster_cpus",
+		Help:      "CPUs offered by the trusted agents, by cluster and kind (total or reserved).",
+	}, []string{"cluster", "kind"})
+	prometheusAgentMemoryUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "agent_memory_utilization",
+		Help:      "Ratio of reserved to total memory of a trusted agent, from 0 to 1.",
+	}, []string{"agent"})
+	prometheusAgentCPUUtilization = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "agent_cpu_utilization",
+		Help:      "Ratio of reserved to total CPUs of a trusted agent, from 0 to 1.",
+	}, []string{"agent"})
+)
+
+func setAgentQueueDepth(endpoint string, n int) {
+	depth := new(expvar.Int)
+	depth.Set(int64(n))
+	expvarAgentQueueDepth.Set(endpoint, depth)
+	prometheusAgentQueueDepth.WithLabelValues(endpoint).Set(float64(n))
+}
+
+// Per-job metrics are labeled with the job and task, and with the values of
+// the container labels named by setMetricsLabels, so they can be broken down
+// by e.g. team or cost center.
+var (
+	metricsLabels                 []string
+	prometheusJobContainersPlaced *prometheus.CounterVec
+	prometheusJobContainersLost   *prometheus.CounterVec
+	prometheusJobMemoryReserved   *prometheus.GaugeVec
+	prometheusJobCPUsReserved     *prometheus.GaugeVec
+)
+
+func init() {
+	setMetricsLabels(nil)
+}
+
+// setMetricsLabels sets the container labels copied into the label sets of
+// per-job metrics. It must be called before the scheduler starts.
+func setMetricsLabels(names []string) {
+	metricsLabels = names
+	labelNames := []string{"job", "task"}
+	for _, name := range names {
+		labelNames = append(labelNames, metricLabelName(name))
+	}
+	prometheusJobContainersPlaced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "job_containers_placed",
+		Help:      "Number of containers successfully placed, by job, task, and configured labels.",
+	}, labelNames)
+	prometheusJobContainersLost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "job_containers_lost",
+		Help:      "Number of containers lost, by job, task, and configured labels.",
+	}, labelNames)
+	prometheusJobMemoryReserved = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "job_memory_reserved_mb",
+		Help:      "Memory in MB reserved by the live containers, by job, task, and configured labels.",
+	}, labelNames)
+	prometheusJobCPUsReserved = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "harpoon",
+		Subsystem: "scheduler",
+		Name:      "job_cpus_reserved",
+		Help:      "CPUs reserved by the live containers, by job, task, and configured labels.",
+	}, labelNames)
+}
+
+// metricLabelName turns a container label name into a valid metric label
+// name, e.g. "cost-center" becomes "label_cost_center". The prefix keeps
+// container labels from colliding with job and task.
+func metricLabelName(name string) string {
+	return "label_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func metricLabelValues(c agent.ContainerConfig) []string {
+	values := []string{c.JobName, c.TaskName}
+	for _, name := range metricsLabels {
+		values = append(values, c.Labels[name]) // empty if unset
+	}
+	return values
+}
+
+func incJobContainersPlaced(m map[string]taskSpec) {
+	for _, taskSpec := range m {
+		prometheusJobContainersPlaced.WithLabelValues(metricLabelValues(taskSpec.ContainerConfig)...).Inc()
+	}
+}
+
+func incJobContainersLost(m map[string]taskSpec) {
+	for _, taskSpec := range m {
+		prometheusJobContainersLost.WithLabelValues(metricLabelValues(taskSpec.ContainerConfig)...).Inc()
+	}
+}
+
+// clusterUtilization is the utilization of the cluster, as computed from the agent
+// states.
+type clusterUtilization struct {
+	clusterMemory map[string]agent.TotalReserved // cluster: MB
+	clusterCPUs   map[string]agent.TotalReserved // cluster: CPUs
+	agentMemory   map[string]float64             // endpoint: reserved/total
+	agentCPUs     map[string]float64             // endpoint: reserved/total
+	jobs          map[string]jobUtilization      // label values joined by NUL
+}
+
+// jobUtilization is what the live containers sharing per-job metric label
+// values reserve.
+type jobUtilization struct {
+	labelValues []string
+	memory      float64 // MB
+	cpus        float64
+}
+
+// computeUtilization computes the utilization from the agent states. Dirty
+// agents are left out, as their reports can't be trusted.
+func computeUtilization(agentStates map[string]agentState) clusterUtilization {
+	u := clusterUtilization{
+		clusterMemory: map[string]agent.TotalReserved{},
+		clusterCPUs:   map[string]agent.TotalReserved{},
+		agentMemory:   map[string]float64{},
+		agentCPUs:     map[string]float64{},
+		jobs:          map[string]jobUtilization{},
+	}
+	for endpoint, state := range agentStates {
+		if state.dirty {
+			continue
+		}
+		var (
+			cluster = agentCluster(state)
+			mem     = state.hostResources.Memory
+			cpu     = state.hostResources.CPUs
+		)
+		u.clusterMemory[cluster] = agent.TotalReserved{Total: u.clusterMemory[cluster].Total + mem.Total, Reserved: u.clusterMemory[cluster].Reserved + mem.Reserved}
+		u.clusterCPUs[cluster] = agent.TotalReserved{Total: u.clusterCPUs[cluster].Total + cpu.Total, Reserved: u.clusterCPUs[cluster].Reserved + cpu.Reserved}
+		if mem.Total > 0 {
+			u.agentMemory[endpoint] = mem.Reserved / mem.Total
+		}
+		if cpu.Total > 0 {
+			u.agentCPUs[endpoint] = cpu.Reserved / cpu.Total
+		}
+		for _, containerInstance := range state.containerInstances {
+			if terminated(containerInstance.Status) {
+				continue
+			}
+			var (
+				labelValues = metricLabelValues(containerInstance.Config)
+				key         = strings.Join(labelValues, "\x00")
+				job         = u.jobs[key]
+			)
+			job.labelValues = labelValues
+			job.memory += float64(containerInstance.Config.Resources.Memory)
+			job.cpus += containerInstance.Config.Resources.CPUs
+			u.jobs[key] = job
+		}
+	}
+	return u
+}
+
+// setUtilization sets the utilization metrics. Label sets of agents and jobs
+// which are gone are dropped.
+func setUtilization(u clusterUtilization) {
+	for _, vec := range []*prometheus.GaugeVec{
+		prometheusClusterMemory,
+		prometheusClusterCPUs,
+		prometheusAgentMemoryUtilization,
+		prometheusAgentCPUUtilization,
+		prometheusJobMemoryReserved,
+		prometheusJobCPUsReserved,
+	} {
+		vec.Reset()
+	}
+	for cluster, memory := range u.clusterMemory {
+		prometheusClusterMemory.WithLabelValues(cluster, "total").Set(memory.Total)
+		prometheusClusterMemory.WithLabelValues(cluster, "reserved").Set(memory.Reserved)
+	}
+	for cluster, cpus := range u.clusterCPUs {
+		prometheusClusterCPUs.WithLabelValues(cluster, "total").Set(cpus.Total)
+		prometheusClusterCPUs.WithLabelValues(cluster, "reserved").Set(cpus.Reserved)
+	}
+	for endpoint, ratio := range u.agentMemory {
+		prometheusAgentMemoryUtilization.WithLabelValues(endpoint).Set(ratio)
+	}
+	for endpoint, ratio := range u.agentCPUs {
+		prometheusAgentCPUUtilization.WithLabelValues(endpoint).Set(ratio)
+	}
+	for _, job := range u.jobs {
+		prometheusJobMemoryReserved.WithLabelValues(job.labelValues...).Set(job.memory)
+		prometheusJobCPUsReserved.WithLabelValues(job.labelValues...).Set(job.cpus)
+	}
+}
+
+// reportUtilization sets the utilization metrics every interval.
+func reportUtilization(agentStater agentStater, interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		setUtilization(computeUtilization(agentStater.agentStates()))
+	}
+}
+
+// registerMetrics registers the Prometheus collectors. It must be called
+// after setMetricsLabels.
+func registerMetrics() {
+	for _, collector := range []prometheus.Collector{
+		prometheusJobScheduleRequests,
+		prometheusJobMigrateRequests,
+		prometheusJobUnscheduleRequests,
+		prometheusJobRollbackRequests,
+		prometheusTaskScheduleRequests,
+		prometheusTaskUnscheduleRequests,
+		prometheusContainerMoveRequests,
+		prometheusContainersPlaced,
+		prometheusContainersLost,
+		prometheusContainersPreempted,
+		prometheusContainersRestarted,
+		prometheusContainersParked,
+		prometheusContainersRebalanced,
+		prometheusSignalScheduleSuccessful,
+		prometheusSignalScheduleFailed,
+		prometheusSignalUnscheduleSuccessful,
+		prometheusSignalUnscheduleFailed,
+		prometheusSignalContainerLost,
+		prometheusSignalAgentUnavailable,
+		prometheusSignalContainerPutFailed,
+		prometheusSignalContainerStartFailed,
+		prometheusSignalContainerStopFailed,
+		prometheusSignalContainerDeleteFailed,
+		prometheusSignalMoveSuccessful,
+		prometheusSignalMoveFailed,
+		prometheusSignalInvalid,
+		prometheusContainerEventsReceived,
+		prometheusUnknownContainerStatuses,
+		prometheusWatchdogStalls,
+		prometheusAgentQueueDepth,
+		prometheusClusterMemory,
+		prometheusClusterCPUs,
+		prometheusAgentMemoryUtilization,
+		prometheusAgentCPUUtilization,
+		prometheusJobContainersPlaced,
+		prometheusJobContainersLost,
+		prometheusJobMemoryReserved,
+		prometheusJobCPUsReserved,
+	} {
+		prometheus.MustRegister(collector)
+	}
+}
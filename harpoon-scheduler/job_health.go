@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// A job's health sums up the health of its containers, as reported by their
+// agents, in one signal: healthy if all of its containers run, failing if
+// none runs but some failed or are parked by the crash loop policy, degraded
+// in between, and unknown if none of its containers can be judged, e.g.
+// because their agents are dirty. GET /jobs shows the health of each job,
+// with the counts it's based on. The health watcher checks jobs periodically,
+// and notifies job owners when the health of their job changes, so alerting
+// can key off a single job-level signal.
+
+// Job health states.
+const (
+	jobHealthy  = "healthy"
+	jobDegraded = "degraded"
+	jobFailing  = "failing"
+	jobUnknown  = "unknown"
+)
+
+type jobHealth struct {
+	State     string `json:"state"`
+	Healthy   int    `json:"healthy"`
+	Unhealthy int    `json:"unhealthy"`
+	Unknown   int    `json:"unknown"`
+}
+
+// add counts a container of the job, by its health.
+func (h *jobHealth) add(containerHealth string) {
+	switch containerHealth {
+	case "healthy":
+		h.Healthy++
+	case "unhealthy", "failing":
+		h.Unhealthy++
+	default:
+		h.Unknown++
+	}
+	h.State = h.state()
+}
+
+func (h jobHealth) state() string {
+	switch {
+	case h.Healthy > 0 && h.Unhealthy == 0 && h.Unknown == 0:
+		return jobHealthy
+	case h.Healthy == 0 && h.Unhealthy > 0:
+		return jobFailing
+	case h.Healthy == 0:
+		return jobUnknown
+	}
+	return jobDegraded
+}
+
+func (h jobHealth) String() string {
+	return fmt.Sprintf("%s (%d healthy, %d unhealthy, %d unknown)", h.State, h.Healthy, h.Unhealthy, h.Unknown)
+}
+
+// containerHealth returns the health of the container instance, which is
+// failing if it's parked.
+func containerHealth(containerInstance agent.ContainerInstance, dirty bool, failures map[string]failureRecord) string {
+	if record, ok := failures[containerInstance.ID]; ok && record.Parked {
+		return "failing"
+	}
+	return health(containerInstance.Status, dirty)
+}
+
+// jobHealths returns the health of each job running on the agents, by job
+// name.
+func jobHealths(agentStates map[string]agentState, failures map[string]failureRecord) map[string]jobHealth {
+	m := map[string]jobHealth{}
+	for _, state := range agentStates {
+		for _, containerInstance := range state.containerInstances {
+			h := m[containerInstance.Config.JobName]
+			h.add(containerHealth(containerInstance, state.dirty, failures))
+			m[containerInstance.Config.JobName] = h
+		}
+	}
+	return m
+}
+
+// watchJobHealth checks the health of all jobs every interval, and notifies
+// owners of jobs whose health changed since the previous check. Jobs seen
+// for the first time only set the baseline.
+func watchJobHealth(agentStater agentStater, failing func() map[string]failureRecord, n *notifier, interval time.Duration) {
+	previous := map[string]jobHealth{}
+	for _ = range time.Tick(interval) {
+		current := jobHealths(agentStater.agentStates(), failing())
+		for jobName, h := range current {
+			if before, ok := previous[jobName]; ok && before.State != h.State {
+				log.Printf("job health: %s changed from %s to %s", jobName, before.State, h)
+				n.healthChanged(jobName, before.State, h)
+			}
+		}
+		previous = current
+	}
+}
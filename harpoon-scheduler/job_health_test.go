@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestJobHealths(t *testing.T) {
+	instance := func(id, jobName string, status agent.ContainerStatus) agent.ContainerInstance {
+		return agent.ContainerInstance{
+			ID:     id,
+			Status: status,
+			Config: agent.ContainerConfig{JobName: jobName},
+		}
+	}
+
+	agentStates := map[string]agentState{
+		"http://a:3333": {
+			containerInstances: map[string]agent.ContainerInstance{
+				"a1": instance("a1", "alpha", agent.ContainerStatusRunning),
+				"b1": instance("b1", "beta", agent.ContainerStatusRunning),
+				"c1": instance("c1", "gamma", agent.ContainerStatusFailed),
+				"c2": instance("c2", "gamma", agent.ContainerStatusRunning), // parked
+			},
+		},
+		"http://b:3333": {
+			containerInstances: map[string]agent.ContainerInstance{
+				"a2": instance("a2", "alpha", agent.ContainerStatusRunning),
+				"b2": instance("b2", "beta", agent.ContainerStatusFailed),
+			},
+		},
+		"http://c:3333": {
+			dirty: true,
+			containerInstances: map[string]agent.ContainerInstance{
+				"d1": instance("d1", "delta", agent.ContainerStatusRunning),
+			},
+		},
+	}
+	failures := map[string]failureRecord{"c2": {Failures: 5, Parked: true}}
+
+	for jobName, expected := range map[string]jobHealth{
+		"alpha": {State: jobHealthy, Healthy: 2},
+		"beta":  {State: jobDegraded, Healthy: 1, Unhealthy: 1},
+		"gamma": {State: jobFailing, Unhealthy: 2},
+		"delta": {State: jobUnknown, Unknown: 1},
+	} {
+		if got := jobHealths(agentStates, failures)[jobName]; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: expected %+v, got %+v", jobName, expected, got)
+		}
+	}
+
+	jobs := listJobs(agentStates, failures, "")
+	if expected, got := 4, len(jobs); expected != got {
+		t.Fatalf("expected %d jobs, got %d", expected, got)
+	}
+	if expected, got := jobDegraded, jobs[1].Health.State; jobs[1].JobName != "beta" || expected != got {
+		t.Errorf("expected beta to be %s, got %s %s", expected, jobs[1].JobName, got)
+	}
+}
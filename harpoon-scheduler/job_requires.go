@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// Jobs may require other jobs, e.g. an app its queue consumer, to be
+// scheduled and healthy before they're scheduled themselves. A required job is
+// met if it runs, and its health is healthy. POST /schedule checks the
+// requirements of a job before scheduling it. By default, it fails fast if
+// any are unmet; with -requires.wait, or the wait query parameter, it waits up
+// to that long for them to be met. The requirements of scheduled jobs are
+// remembered until they're unscheduled, and taken from the deploy history on
+// startup, so GET /jobs can show their state.
+
+const requirementsPollInterval = time.Second
+
+// requirementMissing is the state of required jobs which don't run. Jobs
+// which run are in the state of their health.
+const requirementMissing = "missing"
+
+type requirement struct {
+	JobName string `json:"job_name"`
+	State   string `json:"state"`
+	Met     bool   `json:"met"`
+}
+
+// requirementStates returns the state of each of the required jobs, given
+// the health of the running jobs.
+func requirementStates(required configstore.Requires, healths map[string]jobHealth) []requirement {
+	r := make([]requirement, 0, len(required))
+	for _, jobName := range required {
+		state := requirementMissing
+		if h, ok := healths[jobName]; ok {
+			state = h.State
+		}
+		r = append(r, requirement{
+			JobName: jobName,
+			State:   state,
+			Met:     state == jobHealthy,
+		})
+	}
+	return r
+}
+
+func unmetRequirements(r []requirement) []requirement {
+	unmet := []requirement{}
+	for _, requirement := range r {
+		if !requirement.Met {
+			unmet = append(unmet, requirement)
+		}
+	}
+	return unmet
+}
+
+// requirementsError is returned when requirements of a job are unmet.
+type requirementsError struct {
+	jobName string
+	unmet   []requirement
+}
+
+func (e requirementsError) Error() string {
+	unmet := make([]string, len(e.unmet))
+	for i, requirement := range e.unmet {
+		unmet[i] = fmt.Sprintf("%s (%s)", requirement.JobName, requirement.State)
+	}
+	return fmt.Sprintf("%s requires jobs which aren't scheduled and healthy: %s", e.jobName, strings.Join(unmet, ", "))
+}
+
+// jobRequirements checks the requirements of jobs against the health of the
+// jobs running on the agents, and remembers those of scheduled jobs. A nil
+// jobRequirements accepts every job.
+type jobRequirements struct {
+	sync.Mutex
+	agentStater agentStater
+	failing     func() map[string]failureRecord
+	wait        time.Duration // default wait for unmet requirements; 0 to fail fast
+	interval    time.Duration
+	scheduled   map[string]configstore.Requires
+}
+
+func newJobRequirements(agentStater agentStater, failing func() map[string]failureRecord, wait time.Duration, deployments []deployment) *jobRequirements {
+	r := &jobRequirements{
+		agentStater: agentStater,
+		failing:     failing,
+		wait:        wait,
+		interval:    requirementsPollInterval,
+		scheduled:   map[string]configstore.Requires{},
+	}
+	for _, d := range deployments {
+		r.scheduledJob(d.Job)
+	}
+	return r
+}
+
+// waitFor returns the wait given by the wait query parameter of the request,
+// or the default wait.
+func (c *jobRequirements) waitFor(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		if c == nil {
+			return 0, nil
+		}
+		return c.wait, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 {
+		return 0, fmt.Errorf("invalid wait %q", value)
+	}
+	return wait, nil
+}
+
+// check returns a requirementsError if requirements of the job are still
+// unmet after waiting up to wait.
+func (c *jobRequirements) check(job scheduler.Job, wait time.Duration) error {
+	if c == nil || len(job.Requires) == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		unmet := unmetRequirements(requirementStates(job.Requires, jobHealths(c.agentStater.agentStates(), c.failing())))
+		if len(unmet) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return requirementsError{job.JobName, unmet}
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+// scheduledJob remembers the requirements of the job.
+func (c *jobRequirements) scheduledJob(job scheduler.Job) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(job.Requires) == 0 {
+		delete(c.scheduled, job.JobName)
+		return
+	}
+	c.scheduled[job.JobName] = job.Requires
+}
+
+// unscheduledJob forgets the requirements of the job.
+func (c *jobRequirements) unscheduledJob(jobName string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.scheduled, jobName)
+}
+
+// states returns the state of the requirements of the scheduled job, given
+// the health of the running jobs, or nil if it has none.
+func (c *jobRequirements) states(jobName string, healths map[string]jobHealth) []requirement {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	required := c.scheduled[jobName]
+	c.Unlock()
+	if len(required) == 0 {
+		return nil
+	}
+	return requirementStates(required, healths)
+}
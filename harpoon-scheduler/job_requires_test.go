@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestRequirementStates(t *testing.T) {
+	healths := map[string]jobHealth{
+		"queue": {State: jobHealthy, Healthy: 2},
+		"db":    {State: jobDegraded, Healthy: 1, Unhealthy: 1},
+	}
+	expected := []requirement{
+		{JobName: "queue", State: jobHealthy, Met: true},
+		{JobName: "db", State: jobDegraded, Met: false},
+		{JobName: "cache", State: requirementMissing, Met: false},
+	}
+	if got := requirementStates(configstore.Requires{"queue", "db", "cache"}, healths); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestJobRequirementsCheck(t *testing.T) {
+	var (
+		stater       = &fakeAgentStater{states: map[string]agentState{}}
+		requirements = newJobRequirements(stater, func() map[string]failureRecord { return nil }, 0, nil)
+		job          = scheduler.Job{JobName: "app", Requires: configstore.Requires{"queue"}}
+	)
+	requirements.interval = time.Millisecond
+
+	err := requirements.check(job, 0)
+	if _, ok := err.(requirementsError); !ok {
+		t.Fatalf("expected requirementsError, got %v", err)
+	}
+	if err := requirements.check(scheduler.Job{JobName: "queue"}, 0); err != nil {
+		t.Errorf("expected job without requirements to pass, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stater.Lock()
+		stater.states = map[string]agentState{
+			"http://a:3333": {containerInstances: map[string]agent.ContainerInstance{
+				"q1": {ID: "q1", Status: agent.ContainerStatusRunning, Config: agent.ContainerConfig{JobName: "queue"}},
+			}},
+		}
+		stater.Unlock()
+	}()
+	if err := requirements.check(job, time.Second); err != nil {
+		t.Fatalf("expected requirements to be met while waiting, got %v", err)
+	}
+
+	requirements.scheduledJob(job)
+	healths := jobHealths(stater.agentStates(), nil)
+	if expected, got := []requirement{{"queue", jobHealthy, true}}, requirements.states("app", healths); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+	requirements.unscheduledJob("app")
+	if got := requirements.states("app", healths); got != nil {
+		t.Errorf("expected no requirements after unschedule, got %+v", got)
+	}
+}
@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
@@ -22,34 +23,54 @@ type Scheduler interface {
 // stored/latent configuration that can produce jobs, see configstore's
 // JobConfig.
 type Job struct {
-	JobName string          `json:"job_name"` // job name, i.e. bazooka app
-	Tasks   map[string]Task `json:"tasks"`    // task name, i.e. bazooka proc: task
+	JobName   string               `json:"job_name"`            // job name, i.e. bazooka app, prefixed by the namespace
+	Namespace string               `json:"namespace,omitempty"` // team owning the job; empty for the default namespace
+	Tasks     map[string]Task      `json:"tasks"`               // task name, i.e. bazooka proc: task
+	Depends   configstore.Depends  `json:"depends,omitempty"`   // task name: tasks which must run first
+	Requires  configstore.Requires `json:"requires,omitempty"`  // jobs which must be scheduled and healthy first
+	configstore.Contact
+
+	CanaryJudge string `json:"canary_judge,omitempty"` // webhook judging the first new instance of each task during migrations
+	Concurrency int    `json:"concurrency,omitempty"`  // container operations run at once when (un)scheduling; 0 for the scheduler's default
 }
 
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (j Job) Valid() error {
-	var errs []string
+	var errs agent.ValidationErrors
 	if j.JobName == "" {
-		errs = append(errs, "job name not specified")
+		errs.Add("job_name", "not specified")
+	}
+	if j.Namespace != "" {
+		if !configstore.ValidNamespace(j.Namespace) {
+			errs.Add("namespace", "%q must be lowercase letters, digits, and dashes", j.Namespace)
+		}
+		if !strings.HasPrefix(j.JobName, j.Namespace+".") {
+			errs.Add("job_name", "%q must be prefixed by the namespace (%s.)", j.JobName, j.Namespace)
+		}
+	}
+	taskNames := make([]string, 0, len(j.Tasks))
+	for taskName := range j.Tasks {
+		taskNames = append(taskNames, taskName)
 	}
-	var (
-		index    = 1
-		numTasks = len(j.Tasks)
-	)
-	for taskName, task := range j.Tasks {
+	sort.Strings(taskNames) // stable error order
+	for _, taskName := range taskNames {
+		field := fmt.Sprintf("tasks[%s]", taskName)
 		if taskName == "" {
-			errs = append(errs, fmt.Sprintf("task %d/%d has empty name", index, numTasks))
+			errs.Add(field, "empty task name")
 		}
-		if err := task.Valid(); err != nil {
-			errs = append(errs, fmt.Sprintf("task %d/%d invalid: %s", index, numTasks, err))
+		errs.Nest(field, j.Tasks[taskName].Valid())
+		if namespace := j.Tasks[taskName].Labels[configstore.NamespaceLabel]; namespace != j.Namespace {
+			errs.Add(field, "%s label %q must match the namespace %q", configstore.NamespaceLabel, namespace, j.Namespace)
 		}
-		index++
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	errs.Nest("depends", j.Depends.Valid(taskNames))
+	errs.Nest("requires", j.Requires.Valid(j.JobName))
+	errs.Nest("", j.Contact.Valid())
+	if j.Concurrency < 0 {
+		errs.Add("concurrency", "%d must not be negative", j.Concurrency)
 	}
-	return nil
+	return errs.Err()
 }
 
 // Task defines a unique process that should be running on a container API.
@@ -59,30 +80,53 @@ type Task struct {
 	TaskName     string                    `json:"task_name"`
 	Scale        int                       `json:"scale"`
 	HealthChecks []configstore.HealthCheck `json:"health_checks"`
+	MaxPerAgent  int                       `json:"max_per_agent,omitempty"` // 0 for unlimited
+	MinDomains   int                       `json:"min_domains,omitempty"`   // failure domains to spread across
+	Clusters     []string                  `json:"clusters,omitempty"`      // clusters to run scale instances in each of; empty for any agent
 	agent.ContainerConfig
 }
 
 // Valid performs a validation check, to ensure invalid structures may be
 // detected as early as possible.
 func (t Task) Valid() error {
-	var errs []string
+	var errs agent.ValidationErrors
 	if t.TaskName == "" {
-		errs = append(errs, "task name not specified")
+		errs.Add("task_name", "not specified")
 	}
 	if t.Scale <= 0 {
-		errs = append(errs, fmt.Sprintf("scale (%d) must be greater than zero", t.Scale))
+		errs.Add("scale", "%d must be greater than zero", t.Scale)
+	}
+	if t.MaxPerAgent < 0 {
+		errs.Add("max_per_agent", "%d must not be negative", t.MaxPerAgent)
 	}
+	if t.MinDomains < 0 || t.MinDomains > t.Scale {
+		errs.Add("min_domains", "%d must be between 0 and scale (%d)", t.MinDomains, t.Scale)
+	}
+	errs.Nest("clusters", configstore.ValidClusters(t.Clusters))
 	for index, healthCheck := range t.HealthChecks {
-		if err := healthCheck.Valid(); err != nil {
-			errs = append(errs, fmt.Sprintf("health check %d/%d invalid: %s", index, len(t.HealthChecks), err))
-		}
+		errs.Nest(fmt.Sprintf("health_checks[%d]", index), healthCheck.Valid())
 	}
+	// The container config is embedded, so its fields are at the task level.
 	containerConfig := t.ContainerConfig
-	if err := containerConfig.Valid(); err != nil {
-		errs = append(errs, fmt.Sprintf("container config invalid: %s", err))
+	errs.Nest("", containerConfig.Valid())
+	return errs.Err()
+}
+
+// Instances returns the number of instances of the task: its scale, in each
+// of its clusters.
+func (t Task) Instances() int {
+	if len(t.Clusters) == 0 {
+		return t.Scale
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	return t.Scale * len(t.Clusters)
+}
+
+// Cluster returns the cluster the instance of the task runs in, or the empty
+// string if the task may run on any agent. Instances are assigned to the
+// clusters in order, scale instances each.
+func (t Task) Cluster(instance int) string {
+	if len(t.Clusters) == 0 || t.Scale <= 0 {
+		return ""
 	}
-	return nil
+	return t.Clusters[(instance/t.Scale)%len(t.Clusters)]
 }
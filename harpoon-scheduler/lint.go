@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+// POST /lint applies the config store's lint rules to the job config in the
+// body, so tools can catch bad configs before they're stored or scheduled.
+// It answers with the findings, errors and warnings alike; a config is fine
+// to store if none of them is an error.
+
+type lintResponse struct {
+	Errors   int                  `json:"errors"`
+	Warnings int                  `json:"warnings"`
+	Findings configstore.Findings `json:"findings"`
+}
+
+func handleLint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var jobConfig configstore.JobConfig
+		if err := json.NewDecoder(r.Body).Decode(&jobConfig); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job config: %s", err))
+			return
+		}
+		defer r.Body.Close()
+		findings := configstore.Lint(jobConfig)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lintResponse{
+			Errors:   len(findings.Errors()),
+			Warnings: len(findings.Warnings()),
+			Findings: findings,
+		})
+	}
+}
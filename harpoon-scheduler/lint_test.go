@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+func TestHandleLint(t *testing.T) {
+	body := fmt.Sprintf(`{
+		"job_name": "web",
+		"schema_version": %d,
+		"tasks": [{
+			"task_name": "http",
+			"scale": 2,
+			"ports": {"http": 0},
+			"health_checks": [{"protocol": "TCP", "port": "admin", "initial_delay": "1s", "timeout": "1s", "interval": "5s"}],
+			"command": {"working_dir": "/", "exec": ["./web"]},
+			"resources": {"mem": 4, "cpus": 1},
+			"grace": {"startup": 10, "shutdown": 10}
+		}]
+	}`, configstore.JobConfigSchemaVersion)
+
+	var (
+		w    = httptest.NewRecorder()
+		r, _ = http.NewRequest("POST", "/lint", strings.NewReader(body))
+	)
+	handleLint().ServeHTTP(w, r)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("expected status %d, got %d: %s", expected, got, w.Body.String())
+	}
+
+	var response lintResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, response.Errors; expected != got {
+		t.Errorf("expected %d errors, got %d: %v", expected, got, response.Findings)
+	}
+	if expected, got := 1, response.Warnings; expected != got {
+		t.Errorf("expected %d warnings, got %d: %v", expected, got, response.Findings)
+	}
+	for _, finding := range response.Findings {
+		switch finding.Rule {
+		case "health_checks":
+			if expected, got := configstore.SeverityError, finding.Severity; expected != got {
+				t.Errorf("health check of unknown port: expected %s, got %s", expected, got)
+			}
+		case "resources":
+			if expected, got := "tasks[0].resources.mem", finding.Field; expected != got {
+				t.Errorf("resources: expected field %s, got %s", expected, got)
+			}
+		default:
+			t.Errorf("unexpected finding %+v", finding)
+		}
+	}
+}
@@ -6,54 +6,235 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/streadway/handy/report"
 
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
 	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
+	"github.com/soundcloud/harpoon/lib/middleware"
+)
+
+// version and gitSHA are set at build time, with -ldflags "-X main.version
+// ...".
+var (
+	version = "unknown"
+	gitSHA  = "unknown"
 )
 
 func main() {
 	var (
 		listen            = flag.String("listen", ":8080", "HTTP listen address")
 		agentPollInterval = flag.Duration("agent.poll.interval", 250*time.Millisecond, "how often to poll agents when starting or stopping containers")
+		agentConcurrency  = flag.Int("agent.concurrency", 1, "operations run at once against each agent; never more than one per container")
+		jobConcurrency    = flag.Int("job.concurrency", 1, "container operations a job schedule or unschedule runs at once, unless the job sets its own concurrency")
+		globalConcurrency = flag.Int("global.concurrency", 0, "container operations job schedules and unschedules run at once overall (0 for unlimited)")
+		rateLimitRate     = flag.Float64("ratelimit.rate", 0, "mutating requests per second allowed per client (0 to disable)")
+		rateLimitBurst    = flag.Int("ratelimit.burst", 10, "mutating requests a client may make at once")
+		preempt           = flag.Bool("preempt", false, "allow jobs that don't fit to preempt containers of lower-priority jobs")
+		shutdownTimeout   = flag.Duration("shutdown.timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+		adminAddr         = flag.String("admin.addr", "", "address to serve /metrics, /healthz, /readyz, and /debug/ on, keeping /metrics off -listen (empty to disable)")
+		debugAddr         = flag.String("debug.addr", "", "deprecated alias of -admin.addr")
+		metricsAddr       = flag.String("metrics.addr", "", "deprecated alias of -admin.addr")
+		watchdogThreshold = flag.Duration("watchdog.threshold", 10*time.Minute, "how long the scheduler, registry, or transformer may take to process a message before considered stuck")
+		journalPath       = flag.String("migration.journal", "", "file recording migration progress, so interrupted migrations can be recovered (empty to disable)")
+		auditPath         = flag.String("audit.log", "", "file to append audit records to, e.g. emergency overrides of deploy windows (empty to only log them)")
+		historySize       = flag.Int("deploy.history", 10, "deployments remembered per job, for rollbacks")
+		historyPath       = flag.String("deploy.history.file", "", "file persisting the deploy history across restarts (empty to keep it in memory)")
+		namespacesPath    = flag.String("namespaces", "", "file configuring the tokens and quotas of namespaces (empty to leave namespaces unrestricted)")
+		operatorToken     = flag.String("operator.token.file", "", "file holding the token of the default namespace, which operators' requests carry; required with -namespaces")
+		namespaceRequired = flag.Bool("namespace.required", false, "refuse to schedule jobs in the default namespace; requires -namespaces")
+		canaryTimeout     = flag.Duration("canary.timeout", 10*time.Minute, "how long canary judges may take to answer, after which the migration is aborted")
+		metricsLabels     = flag.String("metrics.labels", "", "comma-separated container labels to break down per-job metrics by, e.g. team,env")
+		metricsInterval   = flag.Duration("metrics.utilization.interval", 15*time.Second, "how often to compute the utilization metrics")
+		healthInterval    = flag.Duration("health.interval", 15*time.Second, "how often to check the health of jobs, notifying owners of changes")
+		requiresWait      = flag.Duration("requires.wait", 0, "how long POST /schedule waits for the jobs a job requires to be scheduled and healthy (0 to fail fast)")
+		restartBackoff    = flag.Duration("restart.backoff", defaultCrashLoopPolicy.base, "delay before restarting a failed container, doubled with each failure")
+		restartBackoffMax = flag.Duration("restart.backoff.max", defaultCrashLoopPolicy.max, "maximum delay before restarting a failed container")
+		restartFailures   = flag.Int("restart.failures", defaultCrashLoopPolicy.threshold, "failures, each within -restart.window of the last, after which a container is no longer restarted")
+		restartWindow     = flag.Duration("restart.window", defaultCrashLoopPolicy.window, "time a container must run without failing for its failure count to reset")
+		notifyFailures    = flag.Int("notify.failures", 3, "container failures within -notify.failures.window which notify the job owner")
+		notifyWindow      = flag.Duration("notify.failures.window", 10*time.Minute, "window in which container failures are counted")
+		notifySMTP        = flag.String("notify.smtp", "", "SMTP server (host:port) for mailto: notifications (empty to disable)")
+		notifyFrom        = flag.String("notify.from", "harpoon-scheduler", "sender address of mailto: notifications")
+		rebalanceInterval = flag.Duration("rebalance.interval", 0, "how often to move containers from busy to idle agents (0 to disable)")
+		rebalanceSkew     = flag.Float64("rebalance.threshold", 0.2, "utilization difference, from 0 to 1, tolerated between agents")
+		rebalanceMoves    = flag.Int("rebalance.moves", 1, "containers moved per rebalancing round")
+		rebalanceDryRun   = flag.Bool("rebalance.dry-run", false, "only log the moves the rebalancer would make")
+		configstoreGit    = flag.String("configstore.git", "", "clone of the git config store to reconcile the jobs with, enabling declarative mode (empty to disable)")
+		configstoreRemote = flag.String("configstore.remote", "origin", "remote of the git config store clone (empty to not fetch)")
+		configstoreBranch = flag.String("configstore.branch", "master", "branch of the git config store remote")
+		configstoreEnv    = flag.String("configstore.environment", "", "environment to resolve configs for in declarative mode, e.g. production")
+		configstoreFetch  = flag.Duration("configstore.fetch.interval", time.Minute, "how often to fetch from the remote of the git config store (0 to only fetch when needed)")
+		reconcileInterval = flag.Duration("reconcile.interval", time.Minute, "how often to reconcile the jobs with the config store in declarative mode")
 		agents            = multiagent{}
+		clusterAgents     = clusteragent{}
+		corsOrigins       = middleware.Origins{}
 	)
 	flag.Var(&agents, "agent", "repeatable list of agent endpoints")
+	flag.Var(&clusterAgents, "cluster.agent", "repeatable list of cluster=endpoint agents, put in the cluster regardless of their cluster label")
+	flag.Var(&corsOrigins, "cors.origin", "repeatable list of origins allowed to make cross-origin requests (* for any)")
 	flag.Parse()
 
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.Lmicroseconds)
 
+	if *metricsLabels != "" {
+		setMetricsLabels(strings.Split(*metricsLabels, ","))
+	}
+	registerMetrics()
+
 	// Should make agent discovery dynamic, likely via glimpse.
-	agentDiscovery := staticAgentDiscovery(agents.slice())
-	for _, agentEndpoint := range agentDiscovery {
+	var agentDiscovery agentDiscovery = staticAgentDiscovery(agents.slice())
+	if len(clusterAgents) > 0 {
+		d := staticClusterDiscovery{}
+		for _, endpoint := range agents.slice() {
+			d[endpoint] = ""
+		}
+		for endpoint, cluster := range clusterAgents {
+			d[endpoint] = cluster
+		}
+		agentDiscovery = d
+	}
+	for _, agentEndpoint := range agentDiscovery.endpoints() {
 		log.Printf("agent: %s", agentEndpoint)
 	}
 
+	history, err := newDeployHistory(*historyPath, *historySize)
+	if err != nil {
+		log.Fatalf("can't read deploy history: %s", err)
+	}
+
+	var namespaces *namespaces
+	if *namespacesPath != "" {
+		if namespaces, err = loadNamespaces(*namespacesPath, *operatorToken, *namespaceRequired); err != nil {
+			log.Fatalf("can't read namespaces: %s", err)
+		}
+	} else if *namespaceRequired {
+		log.Fatal("-namespace.required requires -namespaces")
+	}
+
+	var (
+		audit    = &auditLog{path: *auditPath}
+		lost     = make(chan map[string]taskSpec)
+		notifier = newNotifier(*notifyFailures, *notifyWindow, *notifySMTP, *notifyFrom)
+		registry = newRegistry(lost)
+	)
+	registry.crashLoop = crashLoopPolicy{*restartBackoff, *restartBackoffMax, *restartFailures, *restartWindow}
+
 	var (
-		lost        = make(chan map[string]taskSpec)
-		registry    = newRegistry(lost)
-		transformer = newTransformer(agentDiscovery, registry, *agentPollInterval)
-		scheduler   = newBasicScheduler(registry, transformer, lost)
+		transformer = newTransformer(agentDiscovery, registry, *agentPollInterval, *agentConcurrency, notifier)
+		scheduler   = newBasicScheduler(registry, transformer, lost, *preempt, namespaces, &migrationJournal{*journalPath}, &canaryJudge{*canaryTimeout}, history, notifier, newConcurrencyLimits(*jobConcurrency, *globalConcurrency))
 		router      = httprouter.New()
 	)
+	defer notifier.stop()
 	defer transformer.stop()
 	defer scheduler.stop()
 
-	router.POST(`/schedule`, noParams(report.JSON(logWriter{}, handleSchedule(scheduler))))
+	watchdog := newWatchdog(map[string]func(){
+		"scheduler":   scheduler.ping,
+		"registry":    registry.ping,
+		"transformer": transformer.ping,
+	}, *watchdogThreshold/10, *watchdogThreshold)
+	defer watchdog.stop()
+
+	if *rebalanceInterval > 0 {
+		rebalancer := newRebalancer(transformer, scheduler.move, rebalancePolicy{*rebalanceInterval, *rebalanceSkew, *rebalanceMoves, *rebalanceDryRun})
+		defer rebalancer.stop()
+	}
+
+	go reportUtilization(transformer, *metricsInterval)
+	go watchJobHealth(transformer, registry.failing, notifier, *healthInterval)
+
+	requirements := newJobRequirements(transformer, registry.failing, *requiresWait, scheduler.currentDeployments())
+
+	if *configstoreGit != "" {
+		store, err := configstore.NewGitStore(*configstoreGit, *configstoreRemote, *configstoreBranch, *configstoreFetch)
+		if err != nil {
+			log.Fatalf("can't open config store: %s", err)
+		}
+		defer store.Stop()
+		reconciler := newReconciler(store, *configstoreEnv, scheduler, namespaces, requirements, *reconcileInterval)
+		defer reconciler.stop()
+		router.POST(`/reconcile`, noParams(handleReconcile(reconciler)))
+		router.POST(`/configstore/refresh`, noParams(store))
+	}
+
+	var limiter *middleware.RateLimiter
+	if *rateLimitRate > 0 {
+		limiter = middleware.NewRateLimiter(*rateLimitRate, *rateLimitBurst)
+	}
+
+	router.POST(`/schedule`, noParams(report.JSON(logWriter{}, handleSchedule(scheduler, namespaces, audit, requirements))))
 	router.POST(`/migrate`, noParams(report.JSON(logWriter{}, handleMigrate(scheduler))))
-	router.POST(`/unschedule`, noParams(report.JSON(logWriter{}, handleUnschedule(scheduler))))
+	router.POST(`/unschedule`, noParams(report.JSON(logWriter{}, handleUnschedule(scheduler, namespaces, requirements))))
+	router.POST(`/containers/:id/move`, handleMove(scheduler, transformer, namespaces))
+	router.GET(`/jobs`, noParams(handleJobs(transformer, registry.failing, registry.annotations, requirements)))
+	router.GET(`/jobs/:name/containers`, handleJobContainers(transformer, registry.failing, registry.annotations))
+	router.GET(`/jobs/:name/deployments`, handleJobDeployments(scheduler))
+	router.GET(`/jobs/:name/progress`, handleJobProgress(scheduler))
+	router.POST(`/jobs/:name/rollback`, handleJobRollback(scheduler, namespaces, audit))
+	router.POST(`/jobs/:name/diff`, handleJobDiff(transformer))
+	router.POST(`/jobs/:name/tasks/:task/restart`, handleTaskRestart(newRestarter(transformer, restartAgentContainer), namespaces))
+	router.PUT(`/jobs/:name/annotation`, handleAnnotate(registry.annotations, annotationJob, transformer, namespaces))
+	router.DELETE(`/jobs/:name/annotation`, handleAnnotate(registry.annotations, annotationJob, transformer, namespaces))
+	router.PUT(`/containers/:id/annotation`, handleAnnotate(registry.annotations, annotationContainer, transformer, namespaces))
+	router.DELETE(`/containers/:id/annotation`, handleAnnotate(registry.annotations, annotationContainer, transformer, namespaces))
+	router.GET(`/annotations`, noParams(handleAnnotations(registry.annotations)))
+	router.POST(`/explain`, noParams(handleExplain(transformer)))
+	router.POST(`/lint`, noParams(handleLint()))
+	router.GET(`/export`, noParams(handleExport(scheduler, registry, namespaces)))
+	router.POST(`/import`, noParams(report.JSON(logWriter{}, handleImport(scheduler, namespaces, audit))))
+	router.GET(`/clusters`, noParams(handleClusters(transformer)))
+	router.GET(`/namespaces`, noParams(handleNamespaces(transformer, namespaces)))
+	router.GET(`/preempted`, noParams(handlePreempted(scheduler, namespaces)))
+	router.GET(`/version`, noParams(handleVersion()))
+	router.GET(`/healthz`, noParams(handleHealthz(watchdog)))
+	router.GET(`/readyz`, noParams(handleReadyz(transformer)))
+	router.GET(`/migration`, noParams(handleMigration(scheduler)))
+	router.POST(`/migration/resume`, noParams(report.JSON(logWriter{}, handleRecoverMigration(scheduler, transformer, namespaces, false))))
+	router.POST(`/migration/rollback`, noParams(report.JSON(logWriter{}, handleRecoverMigration(scheduler, transformer, namespaces, true))))
+	if *adminAddr == "" {
+		*adminAddr = *metricsAddr
+	}
+	if *adminAddr == "" {
+		*adminAddr = *debugAddr
+	}
+	if *adminAddr == "" {
+		router.GET(`/metrics`, noParams(prometheus.Handler()))
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	drainer := &drainer{}
 	log.Printf("listening on %s", *listen)
-	go log.Print(http.ListenAndServe(*listen, router))
+	go http.Serve(listener, drainer.handler(middleware.CORS(corsOrigins, middleware.RateLimit(limiter, nil, router))))
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("admin listening on %s", *adminAddr)
+			log.Printf("admin listener: %s", http.ListenAndServe(*adminAddr, adminHandler(registry, watchdog, transformer)))
+		}()
+	}
 
-	<-interrupt()
+	log.Printf("received %s; shutting down", <-interrupt())
+	listener.Close()
+	if !drainer.drain(*shutdownTimeout) {
+		log.Printf("in-flight requests didn't finish within %s", *shutdownTimeout)
+	}
+	// Deferred stops let the scheduler and transformer finish their current
+	// operations.
 }
 
 func noParams(h http.Handler) httprouter.Handle {
@@ -62,18 +243,36 @@ func noParams(h http.Handler) httprouter.Handle {
 	}
 }
 
-func handleSchedule(scheduler scheduler.Scheduler) http.HandlerFunc {
+// handleSchedule schedules the job in the body, once the jobs it requires are
+// scheduled and healthy.
+func handleSchedule(scheduler scheduler.Scheduler, namespaces *namespaces, audit *auditLog, requirements *jobRequirements) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		job, err := readJob(r.Body)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
+			writeClassifiedError(w, err)
 			return
 		}
 		defer r.Body.Close()
-		if err := scheduler.Schedule(job); err != nil {
+		if !namespaces.authorized(w, r, job.Namespace) {
+			return
+		}
+		if !namespaces.deployAllowed(w, r, audit, "schedule", job) {
+			return
+		}
+		wait, err := requirements.waitFor(r)
+		if err != nil {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
+		if err := requirements.check(job, wait); err != nil {
+			writeClassifiedError(w, err)
+			return
+		}
+		if err := scheduler.Schedule(job); err != nil {
+			writeClassifiedError(w, err)
+			return
+		}
+		requirements.scheduledJob(job)
 		writeSuccess(w, fmt.Sprintf("%s successfully scheduled", job.JobName))
 	}
 }
@@ -84,40 +283,349 @@ func handleMigrate(scheduler scheduler.Scheduler) http.HandlerFunc {
 	}
 }
 
-func handleUnschedule(scheduler scheduler.Scheduler) http.HandlerFunc {
+func handleUnschedule(scheduler scheduler.Scheduler, namespaces *namespaces, requirements *jobRequirements) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		job, err := readJob(r.Body)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
+			writeClassifiedError(w, err)
 			return
 		}
 		defer r.Body.Close()
+		if !namespaces.authorized(w, r, job.Namespace) {
+			return
+		}
 		if err := scheduler.Unschedule(job); err != nil {
-			writeError(w, http.StatusBadRequest, err)
+			writeClassifiedError(w, err)
 			return
 		}
+		requirements.unscheduledJob(job.JobName)
 		writeSuccess(w, fmt.Sprintf("%s successfully unscheduled", job.JobName))
 	}
 }
 
+// handleMove moves a container to the agent given by the agent query
+// parameter.
+func handleMove(s *basicScheduler, agentStater agentStater, namespaces *namespaces) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var (
+			containerID = ps.ByName("id")
+			endpoint    = r.URL.Query().Get("agent")
+		)
+		if endpoint == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("agent not specified"))
+			return
+		}
+		if !namespaces.authorized(w, r, containerNamespace(containerID, agentStater)) {
+			return
+		}
+		switch err := s.move(containerID, endpoint); err {
+		case nil:
+			writeSuccess(w, fmt.Sprintf("%s successfully moved to %s", containerID, endpoint))
+		case errContainerNotFound:
+			writeError(w, http.StatusNotFound, err)
+		default:
+			writeClassifiedError(w, err)
+		}
+	}
+}
+
+// handleJobs lists the running jobs with their health, annotations, and the
+// state of their requirements, optionally only those in the namespace given by
+// the namespace query parameter.
+func handleJobs(agentStater agentStater, failing func() map[string]failureRecord, annotations *annotations, requirements *jobRequirements) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			agentStates = agentStater.agentStates()
+			failures    = failing()
+			healths     = jobHealths(agentStates, failures)
+			jobs        = listJobs(agentStates, failures, r.URL.Query().Get("namespace"))
+		)
+		for i, job := range jobs {
+			if an, ok := annotations.get(annotationJob, job.JobName); ok {
+				jobs[i].Annotation = &an
+			}
+			jobs[i].Requires = requirements.states(job.JobName, healths)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+	}
+}
+
+// handleJobContainers lists the containers of a job, optionally filtered by
+// task, status, and labels, with the same query parameters as the agent's
+// container list, and by the cluster query parameter. Failed containers carry
+// their failure record, from failing, and annotated ones their annotation.
+func handleJobContainers(agentStater agentStater, failing func() map[string]failureRecord, annotations *annotations) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		filter, err := agent.ParseContainerFilter(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		filter.JobName = ps.ByName("name")
+		containers := jobContainers(filter, agentStater.agentStates(), failing())
+		if cluster := r.URL.Query().Get("cluster"); cluster != "" {
+			inCluster := []jobContainer{}
+			for _, container := range containers {
+				if container.Cluster == cluster {
+					inCluster = append(inCluster, container)
+				}
+			}
+			containers = inCluster
+		}
+		for i, container := range containers {
+			if an, ok := annotations.get(annotationContainer, container.ContainerID); ok {
+				containers[i].Annotation = &an
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(containers)
+	}
+}
+
+// handleJobDeployments lists the recorded deployments of a job, most recent
+// last.
+func handleJobDeployments(s *basicScheduler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		deployments := s.deployments(ps.ByName("name"))
+		if len(deployments) == 0 {
+			writeError(w, http.StatusNotFound, errJobNotDeployed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deployments)
+	}
+}
+
+// handleJobProgress reports the progress of the most recent schedule or
+// unschedule of a job.
+func handleJobProgress(s *basicScheduler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		progress, ok := s.progress(ps.ByName("name"))
+		if !ok {
+			writeError(w, http.StatusNotFound, errNoJobOperation)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(progress)
+	}
+}
+
+// handleJobRollback migrates a job back to the deployment given by the ref
+// query parameter, or to its previous deployment.
+func handleJobRollback(s *basicScheduler, namespaces *namespaces, audit *auditLog) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var (
+			jobName   = ps.ByName("name")
+			namespace string
+		)
+		if deployments := s.deployments(jobName); len(deployments) > 0 {
+			namespace = deployments[len(deployments)-1].Job.Namespace
+		}
+		if !namespaces.authorized(w, r, namespace) {
+			return
+		}
+		if !namespaces.deployAllowed(w, r, audit, "rollback", scheduler.Job{JobName: jobName, Namespace: namespace}) {
+			return
+		}
+		ref, err := s.rollback(jobName, r.URL.Query().Get("ref"))
+		_, unknownRef := err.(unknownRefError)
+		switch {
+		case err == nil:
+			writeSuccess(w, fmt.Sprintf("%s successfully rolled back to %s", jobName, ref))
+		case err == errJobNotDeployed, unknownRef:
+			writeError(w, http.StatusNotFound, err)
+		case err == errNoPreviousDeployment:
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusBadRequest, err)
+		}
+	}
+}
+
+// handleJobDiff compares the running job with the job config in the body,
+// showing what migrating to it would change. The artifact URL is that of the
+// running job, unless given by the artifact_url query parameter.
+func handleJobDiff(agentStater agentStater) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var (
+			jobName = ps.ByName("name")
+			config  configstore.JobConfig
+		)
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if config.JobName == "" {
+			config.JobName = jobName
+		}
+		if name := configstore.NamespacedJobName(config.Namespace, config.JobName); name != jobName {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("job config is for %q, not %q", name, jobName))
+			return
+		}
+		if err := config.Valid(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		config, err := config.Resolve(r.URL.Query().Get("environment"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var (
+			agentStates = agentStater.agentStates()
+			artifactURL = r.URL.Query().Get("artifact_url")
+		)
+		if artifactURL == "" && config.ArtifactURL == "" {
+			artifactURL = runningArtifactURL(jobName, agentStates)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diffJob(jobName, makeJob(config, artifactURL), agentStates))
+	}
+}
+
+// handleClusters summarizes the agents of each cluster.
+func handleClusters(agentStater agentStater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clusterStatuses(agentStater.agentStates()))
+	}
+}
+
+// handleNamespaces reports the resources used by each namespace, and its
+// quota.
+func handleNamespaces(agentStater agentStater, namespaces *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(namespaces.status(agentStater.agentStates()))
+	}
+}
+
+// handlePreempted lists the preempted containers, optionally only those in
+// the namespace given by the namespace query parameter. With namespaces, only
+// the containers of the namespaces the request carries the token of are
+// listed, as for /export.
+func handlePreempted(s *basicScheduler, namespaces *namespaces) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			namespace = r.URL.Query().Get("namespace")
+			preempted = map[string]preemptedContainer{}
+		)
+		for containerID, taskSpec := range s.preempted() {
+			if namespace != "" && taskSpec.Labels[configstore.NamespaceLabel] != namespace {
+				continue
+			}
+			if namespaces.authorize(r, taskSpec.Labels[configstore.NamespaceLabel]) != nil {
+				continue
+			}
+			preempted[containerID] = preemptedContainer{
+				Endpoint:        taskSpec.endpoint,
+				ContainerConfig: taskSpec.ContainerConfig,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(preempted)
+	}
+}
+
+// handleVersion reports the scheduler build, and the agent API versions it
+// speaks.
+func handleVersion() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agent.VersionInfo{
+			Version:             version,
+			GitSHA:              gitSHA,
+			APIVersions:         []string{agent.APIVersion},
+			ConfigSchemaVersion: agent.ConfigSchemaVersion,
+		})
+	}
+}
+
+// handleHealthz reports whether the scheduler is alive, i.e. none of its
+// components are stuck.
+func handleHealthz(w *watchdog) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if stuck := w.unhealthy(); len(stuck) > 0 {
+			writeError(rw, http.StatusServiceUnavailable, fmt.Errorf("stuck: %s", strings.Join(stuck, ", ")))
+			return
+		}
+		writeSuccess(rw, "ok")
+	}
+}
+
+// handleReadyz reports whether the scheduler is ready to serve requests, i.e.
+// it knows the state of all agents.
+func handleReadyz(t *transformer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if unsynced := t.unsynced(); len(unsynced) > 0 {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("waiting for agents: %s", strings.Join(unsynced, ", ")))
+			return
+		}
+		writeSuccess(w, "ready")
+	}
+}
+
+func handleMigration(s *basicScheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		migration := s.migration()
+		if migration.JobName == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no migration recorded"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(migration)
+	}
+}
+
+// handleRecoverMigration resumes or, if rollback is true, rolls back an
+// interrupted migration.
+func handleRecoverMigration(s *basicScheduler, agentStater agentStater, namespaces *namespaces, rollback bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !namespaces.authorized(w, r, jobNamespace(s.migration().JobName, agentStater)) {
+			return
+		}
+		switch err := s.recoverMigration(rollback); err {
+		case nil:
+			migration := s.migration()
+			writeSuccess(w, fmt.Sprintf("migration of %s %s", migration.JobName, migration.State))
+		case errNoInterruptedMigration, errCantResumeRollback:
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+type preemptedContainer struct {
+	Endpoint        string                `json:"agent"`
+	ContainerConfig agent.ContainerConfig `json:"config"`
+}
+
 func readJob(r io.Reader) (scheduler.Job, error) {
 	var job scheduler.Job
 	if err := json.NewDecoder(r).Decode(&job); err != nil {
-		return scheduler.Job{}, err
+		return scheduler.Job{}, requestError{err}
 	}
 	if err := job.Valid(); err != nil {
-		return scheduler.Job{}, fmt.Errorf("invalid job: %s", err)
+		return scheduler.Job{}, err // keep the field errors for the response
 	}
 	return job, nil
 }
 
-func writeError(w http.ResponseWriter, code int, err error) {
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(errorResponse{
-		StatusCode: code,
-		StatusText: http.StatusText(code),
-		Error:      err.Error(),
-	})
+// writeError writes the error with the code of its class or, for errors of
+// unknown classes, of the status.
+func writeError(w http.ResponseWriter, status int, err error) {
+	_, code := classifyError(err)
+	if code == "" {
+		code = errors.ForStatus(status)
+	}
+	response := errorResponse{Error: *errors.New(status, code, err.Error())}
+	if errs, ok := err.(agent.ValidationErrors); ok {
+		response.Message = fmt.Sprintf("validation failed: %s", err)
+		response.Errors = errs
+	}
+	errors.Write(w, status, response)
 }
 
 func writeSuccess(w http.ResponseWriter, message string) {
@@ -128,15 +636,16 @@ func writeSuccess(w http.ResponseWriter, message string) {
 }
 
 func interrupt() chan os.Signal {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	return c
 }
 
 type errorResponse struct {
-	StatusCode int    `json:"status_code"`
-	StatusText string `json:"status_text"`
-	Error      string `json:"error"`
+	errors.Error
+
+	// Errors has one entry per problem, if the request failed validation.
+	Errors []agent.FieldError `json:"errors,omitempty"`
 }
 
 type successResponse struct {
@@ -155,13 +664,11 @@ type multiagent map[string]struct{}
 func (*multiagent) String() string { return "" }
 
 func (a *multiagent) Set(value string) error {
-	if !strings.HasPrefix(strings.ToLower(value), "http") {
-		value = "http://" + value
+	endpoint, err := parseAgentEndpoint(value)
+	if err != nil {
+		return err
 	}
-	if _, err := url.Parse(value); err != nil {
-		return fmt.Errorf("invalid agent endpoint: %s", err)
-	}
-	(*a)[value] = struct{}{}
+	(*a)[endpoint] = struct{}{}
 	return nil
 }
 
@@ -173,6 +680,33 @@ func (a multiagent) slice() []string {
 	return s
 }
 
+type clusteragent map[string]string // endpoint: cluster
+
+func (*clusteragent) String() string { return "" }
+
+func (a *clusteragent) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q must be cluster=endpoint", value)
+	}
+	endpoint, err := parseAgentEndpoint(parts[1])
+	if err != nil {
+		return err
+	}
+	(*a)[endpoint] = parts[0]
+	return nil
+}
+
+func parseAgentEndpoint(value string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(value), "http") {
+		value = "http://" + value
+	}
+	if _, err := url.Parse(value); err != nil {
+		return "", fmt.Errorf("invalid agent endpoint: %s", err)
+	}
+	return value, nil
+}
+
 type stopper interface {
 	stop()
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// A migration is carried out as a sequence of steps, each scheduling or
+// unscheduling one container. The sequence and the number of completed steps
+// are written to the journal as the migration progresses, so a migration
+// interrupted by a crash can be resumed or rolled back after a restart.
+
+const (
+	stepSchedule   = "schedule"
+	stepUnschedule = "unschedule"
+
+	migrationRunning     = "running"
+	migrationRollingBack = "rolling back"
+	migrationCompleted   = "completed"
+	migrationRolledBack  = "rolled back"
+)
+
+type migrationStep struct {
+	Op          string                `json:"op"`
+	ContainerID string                `json:"container_id"`
+	Endpoint    string                `json:"agent"`
+	Config      agent.ContainerConfig `json:"config"`
+}
+
+func (s migrationStep) inverse() migrationStep {
+	switch s.Op {
+	case stepSchedule:
+		s.Op = stepUnschedule
+	case stepUnschedule:
+		s.Op = stepSchedule
+	}
+	return s
+}
+
+func (s migrationStep) apply(registryPublic registryPublic) error {
+	m := map[string]taskSpec{s.ContainerID: {endpoint: s.Endpoint, ContainerConfig: s.Config}}
+	switch s.Op {
+	case stepSchedule:
+		return schedule(m, registryPublic, nil)
+	case stepUnschedule:
+		return unschedule(m, registryPublic, nil)
+	}
+	return fmt.Errorf("unknown migration step %q", s.Op)
+}
+
+// migrationRecord is the journal entry of a migration. Done is the number of
+// completed steps.
+type migrationRecord struct {
+	JobName     string          `json:"job_name"`
+	Steps       []migrationStep `json:"steps"`
+	Done        int             `json:"done"`
+	State       string          `json:"state"`
+	Interrupted bool            `json:"interrupted"` // the scheduler stopped during the migration, or the canary judge aborted it
+	Error       string          `json:"error,omitempty"`
+	CanaryJudge string          `json:"canary_judge,omitempty"`
+	Verdicts    []canaryVerdict `json:"verdicts,omitempty"`
+}
+
+// pending reports whether the migration was interrupted and awaits a decision
+// to resume or roll back.
+func (r migrationRecord) pending() bool {
+	return r.Interrupted && (r.State == migrationRunning || r.State == migrationRollingBack)
+}
+
+// inPlace returns the containers which should exist after the completed
+// steps: old containers which haven't been unscheduled yet, and new
+// containers which have been scheduled.
+func (r migrationRecord) inPlace() map[string]taskSpec {
+	m := map[string]taskSpec{}
+	for i, step := range r.Steps {
+		if (step.Op == stepSchedule && i < r.Done) || (step.Op == stepUnschedule && i >= r.Done) {
+			m[step.ContainerID] = taskSpec{endpoint: step.Endpoint, ContainerConfig: step.Config}
+		}
+	}
+	return m
+}
+
+// reconcile accounts for the step which was in progress when the migration
+// was interrupted, by checking whether the agents already reflect it.
+func (r *migrationRecord) reconcile(agentStates map[string]agentState) {
+	var (
+		step  migrationStep
+		delta int
+	)
+	switch {
+	case r.State == migrationRunning && r.Done < len(r.Steps):
+		step, delta = r.Steps[r.Done], 1
+	case r.State == migrationRollingBack && r.Done > 0:
+		step, delta = r.Steps[r.Done-1].inverse(), -1
+	default:
+		return
+	}
+	_, exists := agentStates[step.Endpoint].containerInstances[step.ContainerID]
+	if (step.Op == stepSchedule && exists) || (step.Op == stepUnschedule && !exists) {
+		log.Printf("scheduler: migrate: %s %s on %s was completed before the interruption", step.Op, step.ContainerID, step.Endpoint)
+		r.Done += delta
+	}
+}
+
+// migrationSteps produces the migration sequence: per task, schedule one new
+// instance and unschedule one old instance, and then unschedule the instances
+// of old tasks which aren't in the new job.
+func migrationSteps(taskNames []string, newTaskGroups, oldTaskGroups map[string][]containerIDTaskSpec) []migrationStep {
+	var (
+		steps = []migrationStep{}
+		seen  = map[string]bool{}
+		step  = func(op string, c containerIDTaskSpec) migrationStep {
+			return migrationStep{Op: op, ContainerID: c.containerID, Endpoint: c.endpoint, Config: c.ContainerConfig}
+		}
+	)
+	for _, taskName := range taskNames {
+		var (
+			newContainerIDTaskSpecs = newTaskGroups[taskName]
+			oldContainerIDTaskSpecs = oldTaskGroups[taskName]
+		)
+		for i := 0; i < max(len(newContainerIDTaskSpecs), len(oldContainerIDTaskSpecs)); i++ {
+			if i < len(newContainerIDTaskSpecs) {
+				steps = append(steps, step(stepSchedule, newContainerIDTaskSpecs[i]))
+			}
+			if i < len(oldContainerIDTaskSpecs) {
+				steps = append(steps, step(stepUnschedule, oldContainerIDTaskSpecs[i]))
+			}
+		}
+		seen[taskName] = true
+	}
+	lingering := []string{}
+	for taskName := range oldTaskGroups {
+		if !seen[taskName] {
+			lingering = append(lingering, taskName)
+		}
+	}
+	sort.Strings(lingering)
+	for _, taskName := range lingering {
+		for _, c := range oldTaskGroups[taskName] {
+			steps = append(steps, step(stepUnschedule, c))
+		}
+	}
+	return steps
+}
+
+// runMigration carries out the remaining steps of the migration. If a step
+// fails, the completed steps are rolled back. Canaries are judged once they
+// run; see canaryJudge.
+func runMigration(record *migrationRecord, journal *migrationJournal, judge *canaryJudge, registryPublic registryPublic) error {
+	record.State = migrationRunning
+	record.Interrupted = false
+	if err := journal.save(*record); err != nil {
+		return fmt.Errorf("can't write migration journal: %s", err)
+	}
+	for record.Done < len(record.Steps) {
+		step := record.Steps[record.Done]
+		if err := step.apply(registryPublic); err != nil {
+			verb := "scheduling"
+			if step.Op == stepUnschedule {
+				verb = "unscheduling"
+			}
+			err = fmt.Errorf("while %s instance of task %q: %s", verb, step.Config.TaskName, err)
+			record.Error = err.Error()
+			rollbackMigration(record, journal, registryPublic)
+			return err
+		}
+		record.Done++
+		journal.record(*record)
+		log.Printf("scheduler: migrate: %q: %s-1 OK (%d/%d)", step.Config.TaskName, step.Op, record.Done, len(record.Steps))
+		if record.CanaryJudge == "" || judge == nil || !record.isCanary(record.Done-1) {
+			continue
+		}
+		verdict := judge.judge(record.CanaryJudge, record.JobName, step)
+		record.Verdicts = append(record.Verdicts, verdict)
+		journal.record(*record)
+		log.Printf("scheduler: migrate: %q: canary judge: %s %s", step.Config.TaskName, verdict.Verdict, verdict.Reason)
+		switch verdict.Verdict {
+		case verdictRollback:
+			err := fmt.Errorf("canary judge rolled back task %q: %s", step.Config.TaskName, verdict.Reason)
+			record.Error = err.Error()
+			rollbackMigration(record, journal, registryPublic)
+			return err
+		case verdictAbort:
+			err := fmt.Errorf("canary judge aborted task %q: %s; resume or roll back", step.Config.TaskName, verdict.Reason)
+			record.Error = err.Error()
+			record.Interrupted = true
+			journal.record(*record)
+			return err
+		}
+	}
+	record.State = migrationCompleted
+	journal.record(*record)
+	log.Printf("scheduler: migrate: job %q: migrated", record.JobName)
+	return nil
+}
+
+// rollbackMigration reverts the completed steps of the migration, most recent
+// first. Like the rest of the undo machinery, it's best-effort.
+func rollbackMigration(record *migrationRecord, journal *migrationJournal, registryPublic registryPublic) {
+	record.State = migrationRollingBack
+	record.Interrupted = false
+	journal.record(*record)
+	for record.Done > 0 {
+		step := record.Steps[record.Done-1].inverse()
+		if err := step.apply(registryPublic); err != nil {
+			log.Printf("scheduler: migrate: rollback: %s %s on %s: %s", step.Op, step.ContainerID, step.Endpoint, err)
+		}
+		record.Done--
+		journal.record(*record)
+	}
+	record.State = migrationRolledBack
+	journal.record(*record)
+	log.Printf("scheduler: migrate: job %q: rolled back", record.JobName)
+}
+
+// migrationJournal persists the record of the most recent migration in a
+// file. A journal without a path doesn't persist anything.
+type migrationJournal struct {
+	path string
+}
+
+// load returns the recorded migration. The record is empty if there's none.
+func (j *migrationJournal) load() (migrationRecord, error) {
+	if j.path == "" {
+		return migrationRecord{}, nil
+	}
+	buf, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return migrationRecord{}, nil
+	}
+	if err != nil {
+		return migrationRecord{}, err
+	}
+	var record migrationRecord
+	if err := json.Unmarshal(buf, &record); err != nil {
+		return migrationRecord{}, fmt.Errorf("%s: %s", j.path, err)
+	}
+	return record, nil
+}
+
+// save atomically replaces the recorded migration.
+func (j *migrationJournal) save(record migrationRecord) error {
+	if j.path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(j.path, buf)
+}
+
+// writeFileAtomically replaces the file at path with buf, via a temporary
+// file, so readers never see a partial file.
+func writeFileAtomically(path string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// record saves the migration, logging any error. Once a migration has
+// started, failing to record its progress is no reason to abandon it.
+func (j *migrationJournal) record(record migrationRecord) {
+	if err := j.save(record); err != nil {
+		log.Printf("scheduler: migrate: can't write migration journal: %s", err)
+	}
+}
+
+var (
+	errNoInterruptedMigration = errors.New("no interrupted migration")
+	errCantResumeRollback     = errors.New("interrupted migration was rolling back; it can only be rolled back")
+)
+
+// recoverMigration resumes or rolls back an interrupted migration. If the
+// scheduler restarted, the registry has forgotten the containers which the
+// migration had in place, so they're restored first.
+func recoverMigration(
+	record *migrationRecord,
+	rollback bool,
+	agentStater agentStater,
+	registryPublic registryPublic,
+	journal *migrationJournal,
+	judge *canaryJudge,
+) error {
+	if !record.pending() {
+		return errNoInterruptedMigration
+	}
+	if !rollback && record.State == migrationRollingBack {
+		return errCantResumeRollback
+	}
+	record.reconcile(agentStater.agentStates())
+	registryPublic.restore(record.inPlace())
+	if rollback {
+		log.Printf("scheduler: migrate: job %q: rolling back interrupted migration at step %d/%d", record.JobName, record.Done, len(record.Steps))
+		rollbackMigration(record, journal, registryPublic)
+		return nil
+	}
+	log.Printf("scheduler: migrate: job %q: resuming interrupted migration at step %d/%d", record.JobName, record.Done, len(record.Steps))
+	return runMigration(record, journal, judge, registryPublic)
+}
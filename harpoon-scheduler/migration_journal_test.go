@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestMigrationSteps(t *testing.T) {
+	c := func(id string) containerIDTaskSpec {
+		return containerIDTaskSpec{containerID: id, taskSpec: taskSpec{endpoint: "http://a:1"}}
+	}
+	steps := migrationSteps(
+		[]string{"api", "web"},
+		map[string][]containerIDTaskSpec{
+			"api": {c("api-new-0")},
+			"web": {c("web-new-0"), c("web-new-1")},
+		},
+		map[string][]containerIDTaskSpec{
+			"api":    {c("api-old-0"), c("api-old-1")},
+			"web":    {c("web-old-0")},
+			"worker": {c("worker-old-0")},
+		},
+	)
+
+	var got []string
+	for _, step := range steps {
+		got = append(got, step.Op+" "+step.ContainerID)
+	}
+	expected := []string{
+		"schedule api-new-0",
+		"unschedule api-old-0",
+		"unschedule api-old-1",
+		"schedule web-new-0",
+		"unschedule web-old-0",
+		"schedule web-new-1",
+		"unschedule worker-old-0",
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestMigrationRecovery(t *testing.T) {
+	record := migrationRecord{
+		JobName: "alpha",
+		Steps: []migrationStep{
+			{Op: stepSchedule, ContainerID: "new-0", Endpoint: "http://a:1"},
+			{Op: stepUnschedule, ContainerID: "old-0", Endpoint: "http://a:1"},
+			{Op: stepSchedule, ContainerID: "new-1", Endpoint: "http://a:1"},
+			{Op: stepUnschedule, ContainerID: "old-1", Endpoint: "http://a:1"},
+		},
+		Done:  2,
+		State: migrationRunning,
+	}
+
+	// Interrupted while scheduling new-1, which made it to the agent.
+	record.reconcile(map[string]agentState{
+		"http://a:1": {containerInstances: map[string]agent.ContainerInstance{
+			"new-0": {ID: "new-0"},
+			"new-1": {ID: "new-1"},
+			"old-1": {ID: "old-1"},
+		}},
+	})
+	if expected, got := 3, record.Done; expected != got {
+		t.Fatalf("expected %d done step(s), got %d", expected, got)
+	}
+
+	var inPlace []string
+	for containerID := range record.inPlace() {
+		inPlace = append(inPlace, containerID)
+	}
+	for _, containerID := range []string{"new-0", "new-1", "old-1"} {
+		if _, ok := record.inPlace()[containerID]; !ok {
+			t.Errorf("expected %s in place, got %v", containerID, inPlace)
+		}
+	}
+	if expected, got := 3, len(inPlace); expected != got {
+		t.Errorf("expected %d container(s) in place, got %v", expected, inPlace)
+	}
+}
+
+func TestMigrationJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "harpoon-scheduler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal := &migrationJournal{filepath.Join(dir, "migration.json")}
+	record, err := journal.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.JobName != "" {
+		t.Fatalf("expected empty record, got %v", record)
+	}
+
+	record = migrationRecord{
+		JobName: "alpha",
+		Steps:   []migrationStep{{Op: stepSchedule, ContainerID: "new-0", Endpoint: "http://a:1"}},
+		State:   migrationRunning,
+	}
+	if err := journal.save(record); err != nil {
+		t.Fatal(err)
+	}
+	got, err := journal.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(record, got) {
+		t.Errorf("expected %v, got %v", record, got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// planMigration places the instances of the new job, simulating the migration
+// sequence against the agent states: per task, in task name order, schedule
+// one new instance and unschedule one old instance. Each new instance is
+// placed with the cluster as it will be at that step, old and new instances
+// together. If the cluster can't hold some step, planMigration fails before
+// anything has been changed.
+func planMigration(
+	newJob scheduler.Job,
+	oldTaskGroups map[string][]containerIDTaskSpec,
+	agentStates map[string]agentState,
+	algoFactory schedulingAlgorithmFactory,
+) (map[string][]containerIDTaskSpec, error) {
+	var (
+		simulated     = copySimulatedStates(agentStates)
+		newTaskGroups = map[string][]containerIDTaskSpec{}
+		placed        = 0
+	)
+	for _, taskName := range sortedTaskNames(newJob) {
+		var (
+			task  = newJob.Tasks[taskName]
+			old   = oldTaskGroups[taskName]
+			steps = max(task.Instances(), len(old))
+		)
+		for i := 0; i < steps; i++ {
+			if i < task.Instances() {
+				containerID := makeContainerID(newJob, task, i)
+				endpoint, err := algoFactory(simulated)(containerID, instanceTask(task, i))
+				if err != nil {
+					return nil, fmt.Errorf("cluster can't hold old and new instances of task %q at step %d/%d: %s", taskName, i+1, steps, err)
+				}
+				placed++
+				addSimulated(simulated, endpoint, containerID, task.ContainerConfig)
+				newTaskGroups[taskName] = append(newTaskGroups[taskName], containerIDTaskSpec{
+					containerID: containerID,
+					taskSpec: taskSpec{
+						endpoint:        endpoint,
+						ContainerConfig: task.ContainerConfig,
+					},
+				})
+			}
+			if i < len(old) {
+				removeSimulated(simulated, old[i].endpoint, old[i].containerID)
+			}
+		}
+	}
+	incContainersPlaced(placed)
+	return newTaskGroups, nil
+}
+
+// copySimulatedStates deep-copies the parts of the agent states modified by
+// the simulation.
+func copySimulatedStates(agentStates map[string]agentState) map[string]agentState {
+	m := make(map[string]agentState, len(agentStates))
+	for endpoint, state := range agentStates {
+		containerInstances := make(map[string]agent.ContainerInstance, len(state.containerInstances))
+		for id, containerInstance := range state.containerInstances {
+			containerInstances[id] = containerInstance
+		}
+		state.containerInstances = containerInstances
+		m[endpoint] = state
+	}
+	return m
+}
+
+func addSimulated(agentStates map[string]agentState, endpoint, containerID string, config agent.ContainerConfig) {
+	state := agentStates[endpoint]
+	state.containerInstances[containerID] = agent.ContainerInstance{
+		ID:     containerID,
+		Status: agent.ContainerStatusRunning,
+		Config: config,
+	}
+	state.hostResources.Memory.Reserved += float64(config.Resources.Memory)
+	state.hostResources.CPUs.Reserved += config.Resources.CPUs
+	state.hostResources.Containers.Reserved++
+	agentStates[endpoint] = state
+}
+
+func removeSimulated(agentStates map[string]agentState, endpoint, containerID string) {
+	state, ok := agentStates[endpoint]
+	if !ok {
+		return
+	}
+	containerInstance, ok := state.containerInstances[containerID]
+	if !ok {
+		return
+	}
+	delete(state.containerInstances, containerID)
+	state.hostResources.Memory.Reserved -= float64(containerInstance.Config.Resources.Memory)
+	state.hostResources.CPUs.Reserved -= containerInstance.Config.Resources.CPUs
+	state.hostResources.Containers.Reserved--
+	agentStates[endpoint] = state
+}
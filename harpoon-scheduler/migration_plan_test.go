@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestPlanMigration(t *testing.T) {
+	var (
+		config = agent.ContainerConfig{
+			JobName:   "alpha",
+			TaskName:  "web",
+			Resources: agent.Resources{Memory: 50, CPUs: 1},
+		}
+		newJob = scheduler.Job{
+			JobName: "alpha",
+			Tasks: map[string]scheduler.Task{
+				"web": {TaskName: "web", Scale: 2, ContainerConfig: config},
+			},
+		}
+		oldTaskGroups = map[string][]containerIDTaskSpec{
+			"web": {
+				{containerID: "old-0", taskSpec: taskSpec{endpoint: "http://a:1", ContainerConfig: config}},
+				{containerID: "old-1", taskSpec: taskSpec{endpoint: "http://a:1", ContainerConfig: config}},
+			},
+		}
+		full = agentState{
+			hostResources: agent.HostResources{
+				Memory: agent.TotalReserved{Total: 100, Reserved: 100},
+				CPUs:   agent.TotalReserved{Total: 4, Reserved: 2},
+			},
+			containerInstances: map[string]agent.ContainerInstance{
+				"old-0": {ID: "old-0", Config: config},
+				"old-1": {ID: "old-1", Config: config},
+			},
+		}
+	)
+
+	// Old and new instances can't coexist on the single full agent.
+	_, err := planMigration(newJob, oldTaskGroups, map[string]agentState{"http://a:1": full}, randomNonDirty)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if expected, got := `task "web" at step 1/2`, err.Error(); !strings.Contains(got, expected) {
+		t.Errorf("expected error containing %q, got %q", expected, got)
+	}
+	if expected, got := 100.0, full.hostResources.Memory.Reserved; expected != got {
+		t.Errorf("expected agent state to be untouched, got %.0f reserved", got)
+	}
+	if _, ok := full.containerInstances[makeContainerID(newJob, newJob.Tasks["web"], 0)]; ok {
+		t.Error("expected agent state to be untouched, got new instance")
+	}
+
+	// With room for one more instance elsewhere, the first new instance goes
+	// there, and the second takes the place of the first old one.
+	agentStates := map[string]agentState{
+		"http://a:1": full,
+		"http://b:2": {hostResources: agent.HostResources{
+			Memory: agent.TotalReserved{Total: 50},
+			CPUs:   agent.TotalReserved{Total: 4},
+		}},
+	}
+	newTaskGroups, err := planMigration(newJob, oldTaskGroups, agentStates, randomNonDirty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(newTaskGroups["web"]); expected != got {
+		t.Fatalf("expected %d new instances, got %d", expected, got)
+	}
+	for i, expected := range []string{"http://b:2", "http://a:1"} {
+		if got := newTaskGroups["web"][i].endpoint; expected != got {
+			t.Errorf("instance %d: expected %q, got %q", i, expected, got)
+		}
+	}
+}
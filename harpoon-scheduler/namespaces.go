@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// Namespaces let teams share a scheduler. The namespace of a job prefixes its
+// name, and so its container IDs, and labels its containers, so teams pick
+// job names without colliding and list only their own jobs. Operators may
+// configure namespaces in a file: requests changing the jobs of a namespace
+// must then carry its token, as "Authorization: Bearer <token>", and the jobs
+// of a namespace mustn't use more than its quota. Jobs in the default
+// namespace are the operators': requests changing them must carry the
+// operator token, and they have no quota.
+
+var (
+	errTokenRequired     = errors.New("namespace token required")
+	errInvalidToken      = errors.New("invalid namespace token")
+	errNamespaceRequired = errors.New("jobs must be in a namespace")
+)
+
+// namespacePolicy is the configuration of a namespace.
+type namespacePolicy struct {
+	Token   string             `json:"token"`
+	Quota   namespaceResources `json:"quota"`                    // zero values are unlimited
+	Windows []deployWindow     `json:"deploy_windows,omitempty"` // empty to deploy at any time
+	Freezes []deployFreeze     `json:"freezes,omitempty"`
+}
+
+// namespaceResources are resources used by, or allowed to, a namespace.
+type namespaceResources struct {
+	Memory     int     `json:"mem"`  // MB
+	CPUs       float64 `json:"cpus"` // fractional CPUs
+	Containers int     `json:"containers"`
+}
+
+func (r *namespaceResources) add(resources agent.Resources) {
+	r.Memory += resources.Memory
+	r.CPUs += resources.CPUs
+	r.Containers++
+}
+
+// namespaces holds the configured namespaces. A nil namespaces restricts
+// nothing.
+type namespaces struct {
+	policies      map[string]namespacePolicy // namespace: policy
+	operatorToken string                     // token of the default namespace
+	required      bool                       // whether jobs may be scheduled in the default namespace
+}
+
+// loadNamespaces reads the namespaces configured in the file at path, a JSON
+// object of namespace name to policy, and the operator token in the file at
+// operatorTokenPath.
+func loadNamespaces(path, operatorTokenPath string, required bool) (*namespaces, error) {
+	if operatorTokenPath == "" {
+		return nil, errors.New("an operator token is required with namespaces")
+	}
+	token, err := ioutil.ReadFile(operatorTokenPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(token)) <= 0 {
+		return nil, fmt.Errorf("%s: empty operator token", operatorTokenPath)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n := &namespaces{
+		policies:      map[string]namespacePolicy{},
+		operatorToken: string(bytes.TrimSpace(token)),
+		required:      required,
+	}
+	if err := json.Unmarshal(buf, &n.policies); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for namespace, policy := range n.policies {
+		if !configstore.ValidNamespace(namespace) {
+			return nil, fmt.Errorf("%s: invalid namespace %q", path, namespace)
+		}
+		if policy.Token == "" {
+			return nil, fmt.Errorf("%s: namespace %q has no token", path, namespace)
+		}
+		for i, window := range policy.Windows {
+			if err := window.valid(); err != nil {
+				return nil, fmt.Errorf("%s: namespace %q: deploy_windows[%d]: %s", path, namespace, i, err)
+			}
+		}
+		for i, freeze := range policy.Freezes {
+			if !freeze.Until.After(freeze.From) {
+				return nil, fmt.Errorf("%s: namespace %q: freezes[%d]: until must be after from", path, namespace, i)
+			}
+		}
+	}
+	return n, nil
+}
+
+// authorize checks that the request carries the token of the namespace, or
+// the operator token for the default namespace.
+func (n *namespaces) authorize(r *http.Request, namespace string) error {
+	if n == nil {
+		return nil
+	}
+	token := n.operatorToken
+	if namespace != "" {
+		policy, ok := n.policies[namespace]
+		if !ok {
+			return unknownNamespaceError{namespace}
+		}
+		token = policy.Token
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return errTokenRequired
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) != 1 {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// authorized writes an error response and returns false unless the request
+// carries the token of the namespace.
+func (n *namespaces) authorized(w http.ResponseWriter, r *http.Request, namespace string) bool {
+	switch err := n.authorize(r, namespace); err {
+	case nil:
+		return true
+	case errTokenRequired:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, err)
+	default:
+		writeError(w, http.StatusForbidden, err)
+	}
+	return false
+}
+
+// admit checks that the job fits the quota of its namespace, in addition to
+// the containers of the namespace's other jobs. Containers of the job itself,
+// such as those replaced by a migration, aren't counted.
+func (n *namespaces) admit(job scheduler.Job, agentStates map[string]agentState) error {
+	if n == nil {
+		return nil
+	}
+	if job.Namespace == "" {
+		if n.required {
+			return errNamespaceRequired
+		}
+		return nil
+	}
+	policy, ok := n.policies[job.Namespace]
+	if !ok {
+		return unknownNamespaceError{job.Namespace}
+	}
+	usage := namespaceUsage(agentStates, job.JobName)[job.Namespace]
+	for _, task := range job.Tasks {
+		for i := 0; i < task.Instances(); i++ {
+			usage.add(task.Resources)
+		}
+	}
+	quota := policy.Quota
+	switch {
+	case quota.Memory > 0 && usage.Memory > quota.Memory:
+		return quotaError{job.Namespace, "memory", fmt.Sprintf("%d MB", usage.Memory), fmt.Sprintf("%d MB", quota.Memory)}
+	case quota.CPUs > 0 && usage.CPUs > quota.CPUs:
+		return quotaError{job.Namespace, "CPUs", fmt.Sprintf("%.2f", usage.CPUs), fmt.Sprintf("%.2f", quota.CPUs)}
+	case quota.Containers > 0 && usage.Containers > quota.Containers:
+		return quotaError{job.Namespace, "containers", fmt.Sprint(usage.Containers), fmt.Sprint(quota.Containers)}
+	}
+	return nil
+}
+
+// status returns the usage of every namespace with containers or a policy,
+// and its quota.
+func (n *namespaces) status(agentStates map[string]agentState) map[string]namespaceStatus {
+	m := map[string]namespaceStatus{}
+	for namespace, usage := range namespaceUsage(agentStates, "") {
+		m[namespace] = namespaceStatus{Usage: usage}
+	}
+	if n != nil {
+		for namespace, policy := range n.policies {
+			quota := policy.Quota
+			m[namespace] = namespaceStatus{Usage: m[namespace].Usage, Quota: &quota}
+		}
+	}
+	return m
+}
+
+type namespaceStatus struct {
+	Usage namespaceResources  `json:"usage"`
+	Quota *namespaceResources `json:"quota,omitempty"` // absent for unconfigured namespaces
+}
+
+// namespaceUsage sums the resources of the containers in each namespace,
+// except those of the excluded job.
+func namespaceUsage(agentStates map[string]agentState, excludeJobName string) map[string]namespaceResources {
+	m := map[string]namespaceResources{}
+	for _, state := range agentStates {
+		for _, containerInstance := range state.containerInstances {
+			namespace := containerInstance.Config.Labels[configstore.NamespaceLabel]
+			if namespace == "" || containerInstance.Config.JobName == excludeJobName {
+				continue
+			}
+			usage := m[namespace]
+			usage.add(containerInstance.Config.Resources)
+			m[namespace] = usage
+		}
+	}
+	return m
+}
+
+// jobSummary describes a running job in the job list.
+type jobSummary struct {
+	JobName    string        `json:"job_name"`
+	Namespace  string        `json:"namespace,omitempty"`
+	Containers int           `json:"containers"`
+	Health     jobHealth     `json:"health"`
+	Annotation *annotation   `json:"annotation,omitempty"`
+	Requires   []requirement `json:"requires,omitempty"`
+}
+
+// listJobs summarizes the jobs running on the agents, sorted by name, with
+// their health. If namespace isn't empty, only jobs in that namespace are
+// listed.
+func listJobs(agentStates map[string]agentState, failures map[string]failureRecord, namespace string) []jobSummary {
+	m := map[string]jobSummary{}
+	for _, state := range agentStates {
+		for _, containerInstance := range state.containerInstances {
+			config := containerInstance.Config
+			if namespace != "" && config.Labels[configstore.NamespaceLabel] != namespace {
+				continue
+			}
+			summary := m[config.JobName]
+			summary.JobName, summary.Namespace = config.JobName, config.Labels[configstore.NamespaceLabel]
+			summary.Containers++
+			summary.Health.add(containerHealth(containerInstance, state.dirty, failures))
+			m[config.JobName] = summary
+		}
+	}
+	jobs := make([]jobSummary, 0, len(m))
+	for _, summary := range m {
+		jobs = append(jobs, summary)
+	}
+	sort.Sort(jobSummariesByName(jobs))
+	return jobs
+}
+
+type jobSummariesByName []jobSummary
+
+func (a jobSummariesByName) Len() int           { return len(a) }
+func (a jobSummariesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a jobSummariesByName) Less(i, j int) bool { return a[i].JobName < a[j].JobName }
+
+// jobNamespace returns the namespace of the running job, or the empty string
+// if it doesn't run.
+func jobNamespace(jobName string, agentStater agentStater) string {
+	return findNamespace(agentStater, func(containerInstance agent.ContainerInstance) bool {
+		return containerInstance.Config.JobName == jobName
+	})
+}
+
+// containerNamespace returns the namespace of the running container, or the
+// empty string if it doesn't run.
+func containerNamespace(containerID string, agentStater agentStater) string {
+	return findNamespace(agentStater, func(containerInstance agent.ContainerInstance) bool {
+		return containerInstance.ID == containerID
+	})
+}
+
+func findNamespace(agentStater agentStater, match func(agent.ContainerInstance) bool) string {
+	for _, state := range agentStater.agentStates() {
+		for _, containerInstance := range state.containerInstances {
+			if match(containerInstance) {
+				return containerInstance.Config.Labels[configstore.NamespaceLabel]
+			}
+		}
+	}
+	return ""
+}
+
+type unknownNamespaceError struct{ namespace string }
+
+func (e unknownNamespaceError) Error() string {
+	return fmt.Sprintf("unknown namespace %q", e.namespace)
+}
+
+type quotaError struct{ namespace, resource, requested, quota string }
+
+func (e quotaError) Error() string {
+	return fmt.Sprintf("namespace %s would use %s %s, exceeding its quota of %s", e.namespace, e.requested, e.resource, e.quota)
+}
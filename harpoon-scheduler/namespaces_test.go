@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+)
+
+func TestNamespacedJob(t *testing.T) {
+	var (
+		config = configstore.JobConfig{
+			JobName:   "alpha",
+			Namespace: "team-a",
+			Tasks: []configstore.TaskConfig{{
+				TaskName:  "web",
+				Scale:     1,
+				Command:   agent.Command{WorkingDir: "/srv/alpha", Exec: []string{"./alpha"}},
+				Resources: agent.Resources{Memory: 32, CPUs: 0.1},
+				Grace:     agent.Grace{Startup: 1, Shutdown: 1},
+			}},
+		}
+		job  = makeJob(config, "http://filestore.berlin/alpha-1.tar.gz")
+		task = job.Tasks["web"]
+	)
+	if err := job.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "team-a.alpha", job.JobName; expected != got {
+		t.Errorf("expected job name %q, got %q", expected, got)
+	}
+	if expected, got := "team-a.alpha-", makeContainerID(job, task, 0); !strings.HasPrefix(got, expected) {
+		t.Errorf("expected container ID prefixed by %q, got %q", expected, got)
+	}
+	if expected, got := "team-a", task.Labels[configstore.NamespaceLabel]; expected != got {
+		t.Errorf("expected namespace label %q, got %q", expected, got)
+	}
+
+	job.JobName = "alpha"
+	if err := job.Valid(); err == nil {
+		t.Errorf("expected error for a job name without the namespace, got none")
+	}
+}
+
+func TestNamespaceAuthorize(t *testing.T) {
+	n := &namespaces{policies: map[string]namespacePolicy{"team-a": {Token: "secret"}}, operatorToken: "root"}
+
+	for _, tuple := range []struct {
+		namespace     string
+		authorization string
+		expected      error
+	}{
+		{"", "Bearer root", nil},
+		{"", "", errTokenRequired},
+		{"", "Bearer secret", errInvalidToken},
+		{"team-a", "Bearer root", errInvalidToken},
+		{"team-a", "Bearer secret", nil},
+		{"team-a", "", errTokenRequired},
+		{"team-a", "Bearer guess", errInvalidToken},
+		{"team-b", "Bearer secret", unknownNamespaceError{"team-b"}},
+	} {
+		r, _ := http.NewRequest("POST", "/schedule", nil)
+		if tuple.authorization != "" {
+			r.Header.Set("Authorization", tuple.authorization)
+		}
+		if expected, got := tuple.expected, n.authorize(r, tuple.namespace); expected != got {
+			t.Errorf("%q %q: expected %v, got %v", tuple.namespace, tuple.authorization, expected, got)
+		}
+	}
+
+	if err := (*namespaces)(nil).authorize(&http.Request{Header: http.Header{}}, "team-a"); err != nil {
+		t.Errorf("nil namespaces: expected no error, got %v", err)
+	}
+}
+
+func TestNamespaceAdmit(t *testing.T) {
+	var (
+		n = &namespaces{
+			policies: map[string]namespacePolicy{"team-a": {Token: "secret", Quota: namespaceResources{Memory: 256, Containers: 3}}},
+			required: true,
+		}
+		running = makeJob(configstore.JobConfig{
+			JobName:   "alpha",
+			Namespace: "team-a",
+			Tasks:     []configstore.TaskConfig{{TaskName: "web", Scale: 2, Resources: agent.Resources{Memory: 64, CPUs: 1}}},
+		}, "")
+		agentStates = map[string]agentState{"http://a:1": {containerInstances: map[string]agent.ContainerInstance{}}}
+	)
+	for _, task := range running.Tasks {
+		for instance := 0; instance < task.Scale; instance++ {
+			id := makeContainerID(running, task, instance)
+			agentStates["http://a:1"].containerInstances[id] = agent.ContainerInstance{ID: id, Config: task.ContainerConfig}
+		}
+	}
+
+	job := func(namespace, jobName string, scale, memory int) configstore.JobConfig {
+		return configstore.JobConfig{
+			JobName:   jobName,
+			Namespace: namespace,
+			Tasks:     []configstore.TaskConfig{{TaskName: "web", Scale: scale, Resources: agent.Resources{Memory: memory, CPUs: 1}}},
+		}
+	}
+
+	for _, tuple := range []struct {
+		config configstore.JobConfig
+		ok     bool
+	}{
+		{job("team-a", "beta", 1, 64), true},
+		{job("team-a", "beta", 1, 256), false}, // memory
+		{job("team-a", "beta", 2, 32), false},  // containers
+		{job("team-a", "alpha", 3, 64), true},  // replaces the running containers
+		{job("team-b", "beta", 1, 64), false},  // unknown namespace
+		{job("", "beta", 1, 64), false},        // namespace required
+	} {
+		err := n.admit(makeJob(tuple.config, ""), agentStates)
+		if ok := err == nil; tuple.ok != ok {
+			t.Errorf("%s.%s %+v: expected ok %v, got %v", tuple.config.Namespace, tuple.config.JobName, tuple.config.Tasks[0], tuple.ok, err)
+		}
+	}
+
+	if expected, got := 128, n.status(agentStates)["team-a"].Usage.Memory; expected != got {
+		t.Errorf("expected team-a to use %d MB, got %d", expected, got)
+	}
+	if expected, got := 1, len(listJobs(agentStates, nil, "team-a")); expected != got {
+		t.Errorf("expected %d job in team-a, got %d", expected, got)
+	}
+	if expected, got := 0, len(listJobs(agentStates, nil, "team-b")); expected != got {
+		t.Errorf("expected %d jobs in team-b, got %d", expected, got)
+	}
+}
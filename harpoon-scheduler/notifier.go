@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// The notifier tells job owners about things they should know without
+// watching dashboards: their job was scheduled or migrated, their containers
+// were lost, a container keeps failing, or the health of their job changed.
+// Jobs declare where to send notifications in their contact; jobs without one
+// aren't notified.
+//
+// The scheduler and transformer report events to the notifier, which never
+// blocks them: notifications are queued and delivered by a goroutine of its
+// own. A nil notifier drops everything.
+
+const (
+	notifyQueueSize = 64
+	notifyTimeout   = 10 * time.Second
+)
+
+// Notification events.
+const (
+	eventScheduleComplete  = "schedule-complete"
+	eventMigrationComplete = "migration-complete"
+	eventContainersLost    = "containers-lost"
+	eventContainerFailing  = "container-failing"
+	eventJobHealth         = "job-health"
+)
+
+type notification struct {
+	Event      string     `json:"event"`
+	JobName    string     `json:"job_name"`
+	Owner      string     `json:"owner,omitempty"`
+	Containers []string   `json:"containers,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Health     *jobHealth `json:"health,omitempty"`
+	Message    string     `json:"message"`
+	Time       time.Time  `json:"time"`
+
+	notify string // where to deliver it
+}
+
+type notifier struct {
+	sync.Mutex
+	contacts map[string]configstore.Contact // job name: contact
+	failures map[string][]time.Time         // container ID: recent failures
+
+	failureThreshold int // failures within the window which trigger a notification
+	failureWindow    time.Duration
+	smtpAddr         string // for mailto: contacts; empty to disable
+	smtpFrom         string
+
+	queue chan notification
+	quit  chan chan struct{}
+}
+
+// newNotifier returns a running notifier. A container is reported as failing
+// once it failed failureThreshold times within failureWindow.
+func newNotifier(failureThreshold int, failureWindow time.Duration, smtpAddr, smtpFrom string) *notifier {
+	n := &notifier{
+		contacts:         map[string]configstore.Contact{},
+		failures:         map[string][]time.Time{},
+		failureThreshold: failureThreshold,
+		failureWindow:    failureWindow,
+		smtpAddr:         smtpAddr,
+		smtpFrom:         smtpFrom,
+		queue:            make(chan notification, notifyQueueSize),
+		quit:             make(chan chan struct{}),
+	}
+	go n.loop()
+	return n
+}
+
+func (n *notifier) stop() {
+	if n == nil {
+		return
+	}
+	q := make(chan struct{})
+	n.quit <- q
+	<-q
+}
+
+// scheduled records the job's contact, and reports the outcome of scheduling
+// the job.
+func (n *notifier) scheduled(job scheduler.Job, err error) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.contacts[job.JobName] = job.Contact
+	n.send(job.JobName, notification{
+		Event:   eventScheduleComplete,
+		Message: outcome("scheduling "+job.JobName, err),
+		Error:   errorString(err),
+	})
+}
+
+// migrated records the new contact of the job, if it was migrated to a new
+// config, and reports the outcome of the migration.
+func (n *notifier) migrated(jobName string, contact *configstore.Contact, err error) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	if contact != nil {
+		n.contacts[jobName] = *contact
+	}
+	n.send(jobName, notification{
+		Event:   eventMigrationComplete,
+		Message: outcome("migrating "+jobName, err),
+		Error:   errorString(err),
+	})
+}
+
+// unscheduled forgets the job's contact.
+func (n *notifier) unscheduled(jobName string) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	delete(n.contacts, jobName)
+}
+
+// lost reports containers lost with their agents, one notification per job.
+func (n *notifier) lost(m map[string]taskSpec) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	byJob := map[string][]string{}
+	for containerID, taskSpec := range m {
+		byJob[taskSpec.JobName] = append(byJob[taskSpec.JobName], containerID)
+	}
+	for jobName, containerIDs := range byJob {
+		sort.Strings(containerIDs)
+		n.send(jobName, notification{
+			Event:      eventContainersLost,
+			Containers: containerIDs,
+			Message:    fmt.Sprintf("%s lost %d container(s)", jobName, len(containerIDs)),
+		})
+	}
+}
+
+// failed records a failure of the container, and reports the container as
+// failing if it failed too often recently. The count starts over after each
+// report, so a crash-looping container is reported once per threshold.
+func (n *notifier) failed(containerID string, taskSpec taskSpec, reason string) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	var (
+		now    = time.Now()
+		recent = []time.Time{}
+	)
+	for _, t := range n.failures[containerID] {
+		if now.Sub(t) < n.failureWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < n.failureThreshold {
+		n.failures[containerID] = recent
+		return
+	}
+	delete(n.failures, containerID)
+	n.send(taskSpec.JobName, notification{
+		Event:      eventContainerFailing,
+		Containers: []string{containerID},
+		Error:      reason,
+		Message:    fmt.Sprintf("%s failed %d times within %s on %s", containerID, len(recent), n.failureWindow, taskSpec.endpoint),
+	})
+}
+
+// healthChanged reports that the health of the job changed from the state.
+func (n *notifier) healthChanged(jobName, from string, health jobHealth) {
+	if n == nil {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+	n.send(jobName, notification{
+		Event:   eventJobHealth,
+		Health:  &health,
+		Message: fmt.Sprintf("%s changed from %s to %s", jobName, from, health),
+	})
+}
+
+// send queues the notification for the job's contact. It must be called with
+// the lock held. If the queue is full, the notification is dropped.
+func (n *notifier) send(jobName string, notification notification) {
+	contact, ok := n.contacts[jobName]
+	if !ok || contact.Notify == "" {
+		return
+	}
+	notification.JobName = jobName
+	notification.Owner = contact.Owner
+	notification.Time = time.Now()
+	notification.notify = contact.Notify
+	select {
+	case n.queue <- notification:
+	default:
+		log.Printf("notifier: queue full; dropping %s notification for %s", notification.Event, jobName)
+	}
+}
+
+func (n *notifier) loop() {
+	for {
+		select {
+		case notification := <-n.queue:
+			if err := n.deliver(notification); err != nil {
+				log.Printf("notifier: %s notification for %s to %s: %s", notification.Event, notification.JobName, notification.notify, err)
+			}
+
+		case q := <-n.quit:
+			close(q)
+			return
+		}
+	}
+}
+
+func (n *notifier) deliver(notification notification) error {
+	u, err := url.Parse(notification.notify)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return postWebhook(u.String(), notification)
+	case "mailto":
+		if n.smtpAddr == "" {
+			return fmt.Errorf("no SMTP server configured")
+		}
+		return sendMail(n.smtpAddr, n.smtpFrom, u.Opaque, notification)
+	default:
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+}
+
+func postWebhook(webhookURL string, notification notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+func sendMail(addr, from, to string, notification notification) error {
+	body, err := json.MarshalIndent(notification, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: [harpoon] %s: %s\r\n", notification.JobName, notification.Event)
+	fmt.Fprintf(&msg, "\r\n%s\r\n\r\n%s\r\n", notification.Message, body)
+	return smtp.SendMail(addr, nil, from, []string{to}, msg.Bytes())
+}
+
+func outcome(what string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%s failed: %s", what, err)
+	}
+	return what + " succeeded"
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
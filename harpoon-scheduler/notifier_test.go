@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestNotifier(t *testing.T) {
+	notifications := make(chan notification, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("bad notification: %s", err)
+		}
+		notifications <- n
+	}))
+	defer s.Close()
+
+	n := newNotifier(3, time.Minute, "", "")
+	defer n.stop()
+
+	n.scheduled(scheduler.Job{JobName: "quiet"}, nil) // no contact
+	n.scheduled(scheduler.Job{JobName: "alpha", Contact: configstore.Contact{Owner: "team-a", Notify: s.URL}}, nil)
+	expectNotification(t, notifications, notification{Event: eventScheduleComplete, JobName: "alpha", Owner: "team-a", Message: "scheduling alpha succeeded"})
+
+	spec := taskSpec{endpoint: "http://a:3333", ContainerConfig: agent.ContainerConfig{JobName: "alpha"}}
+	for i := 0; i < 3; i++ {
+		n.failed("alpha-1", spec, "exit status 1")
+	}
+	n.failed("alpha-1", spec, "exit status 1") // count starts over
+	expectNotification(t, notifications, notification{Event: eventContainerFailing, JobName: "alpha", Owner: "team-a", Containers: []string{"alpha-1"}, Error: "exit status 1", Message: "alpha-1 failed 3 times within 1m0s on http://a:3333"})
+
+	n.lost(map[string]taskSpec{
+		"alpha-2": spec,
+		"alpha-1": spec,
+		"quiet-1": taskSpec{ContainerConfig: agent.ContainerConfig{JobName: "quiet"}},
+	})
+	expectNotification(t, notifications, notification{Event: eventContainersLost, JobName: "alpha", Owner: "team-a", Containers: []string{"alpha-1", "alpha-2"}, Message: "alpha lost 2 container(s)"})
+
+	health := jobHealth{State: jobDegraded, Healthy: 1, Unhealthy: 1}
+	n.healthChanged("alpha", jobHealthy, health)
+	expectNotification(t, notifications, notification{Event: eventJobHealth, JobName: "alpha", Owner: "team-a", Health: &health, Message: "alpha changed from healthy to degraded (1 healthy, 1 unhealthy, 0 unknown)"})
+
+	n.unscheduled("alpha")
+	n.migrated("alpha", nil, fmt.Errorf("boom"))
+	select {
+	case got := <-notifications:
+		t.Errorf("unexpected notification %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectNotification(t *testing.T, notifications chan notification, expected notification) {
+	select {
+	case got := <-notifications:
+		if got.Time.IsZero() {
+			t.Errorf("%s: notification has no time", expected.Event)
+		}
+		got.Time = time.Time{}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("expected %+v, got %+v", expected, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no %s notification", expected.Event)
+	}
+}
+
+func TestContactValid(t *testing.T) {
+	for notify, valid := range map[string]bool{
+		"":                        true,
+		"https://hooks.example/x": true,
+		"mailto:oncall@example":   true,
+		"http://":                 false,
+		"mailto:":                 false,
+		"ftp://example/x":         false,
+	} {
+		if err := (configstore.Contact{Notify: notify}).Valid(); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", notify, valid, err)
+		}
+	}
+}
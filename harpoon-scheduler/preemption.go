@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// preemptedRetryInterval is how often the scheduler tries to reschedule the
+// containers it preempted, as room frees up.
+const preemptedRetryInterval = time.Minute
+
+// placeJobPreempting places the job as if containers of lower-priority jobs
+// were gone, removing them from a copy of the agent states, lowest priority
+// first, until the job fits. It returns the placement, and the containers to
+// preempt for it: those on the agents the job was placed on. Nothing is
+// unscheduled; see preemptContainers.
+func placeJobPreempting(
+	job scheduler.Job,
+	agentStates map[string]agentState,
+	algoFactory schedulingAlgorithmFactory,
+) (map[string]taskSpec, map[string]taskSpec, error) {
+	var (
+		priority  = jobPriority(job)
+		simulated = make(map[string]agentState, len(agentStates))
+		removed   = map[string]taskSpec{}
+	)
+	for endpoint, state := range agentStates {
+		simulated[endpoint] = state
+	}
+	taskSpecMap, err := placeJob(job, algoFactory(simulated))
+	for _, candidate := range preemptionCandidates(priority, agentStates) {
+		if !isInsufficientCapacity(err) {
+			break
+		}
+		removeContainer(simulated, candidate)
+		removed[candidate.containerID] = candidate.taskSpec
+		taskSpecMap, err = placeJob(job, algoFactory(simulated))
+	}
+	if isInsufficientCapacity(err) {
+		placementError := err.(placementError)
+		placementError.err = fmt.Errorf("%s (not enough to preempt below priority %d)", placementError.err, priority)
+		return map[string]taskSpec{}, map[string]taskSpec{}, placementError
+	}
+	if err != nil {
+		return map[string]taskSpec{}, map[string]taskSpec{}, err
+	}
+
+	// Containers removed from agents the job wasn't placed on made no room
+	// for it.
+	placedOn := map[string]bool{}
+	for _, spec := range taskSpecMap {
+		placedOn[spec.endpoint] = true
+	}
+	victims := map[string]taskSpec{}
+	for containerID, spec := range removed {
+		if placedOn[spec.endpoint] {
+			victims[containerID] = spec
+		}
+	}
+	return taskSpecMap, victims, nil
+}
+
+// removeContainer removes the candidate, and what it reserves, from the
+// agent states, without modifying the state it shares with other copies.
+func removeContainer(agentStates map[string]agentState, candidate preemptionCandidate) {
+	state := agentStates[candidate.endpoint]
+	containerInstances := make(map[string]agent.ContainerInstance, len(state.containerInstances))
+	for id, containerInstance := range state.containerInstances {
+		if id != candidate.containerID {
+			containerInstances[id] = containerInstance
+		}
+	}
+	state.containerInstances = containerInstances
+	state.hostResources.Memory.Reserved -= float64(candidate.Resources.Memory)
+	state.hostResources.CPUs.Reserved -= candidate.Resources.CPUs
+	state.hostResources.Containers.Reserved--
+	agentStates[candidate.endpoint] = state
+}
+
+// preemptContainers unschedules the victims making room for the job, and
+// records them in preempted, so they're rescheduled once there's room.
+func preemptContainers(job scheduler.Job, victims map[string]taskSpec, registryPublic registryPublic, preempted map[string]taskSpec) error {
+	priority := jobPriority(job)
+	for containerID, spec := range victims {
+		log.Printf("scheduler: preempting %s (priority %d) on %s for %s (priority %d)", containerID, spec.Priority, spec.endpoint, job.JobName, priority)
+	}
+	if err := unschedule(victims, registryPublic, nil); err != nil {
+		return fmt.Errorf("when preempting containers for %s: %s", job.JobName, err)
+	}
+	incContainersPreempted(len(victims))
+	for containerID, spec := range victims {
+		preempted[containerID] = spec
+	}
+	return nil
+}
+
+func isInsufficientCapacity(err error) bool {
+	placementError, ok := err.(placementError)
+	return ok && placementError.err == errInsufficientCapacity
+}
+
+// jobPriority is the highest priority of the job's tasks.
+func jobPriority(job scheduler.Job) int {
+	priority, first := 0, true
+	for _, task := range job.Tasks {
+		if first || task.Priority > priority {
+			priority, first = task.Priority, false
+		}
+	}
+	return priority
+}
+
+type preemptionCandidate struct {
+	containerID string
+	taskSpec
+}
+
+// preemptionCandidates returns the containers with a priority lower than the
+// given one, lowest priority first.
+func preemptionCandidates(priority int, agentStates map[string]agentState) []preemptionCandidate {
+	candidates := []preemptionCandidate{}
+	for endpoint, agentState := range agentStates {
+		if agentState.dirty {
+			continue
+		}
+		for id, containerInstance := range agentState.containerInstances {
+			if containerInstance.Config.Priority >= priority {
+				continue
+			}
+			candidates = append(candidates, preemptionCandidate{
+				containerID: id,
+				taskSpec: taskSpec{
+					endpoint:        endpoint,
+					ContainerConfig: containerInstance.Config,
+				},
+			})
+		}
+	}
+	sort.Sort(candidatesByPriority(candidates))
+	return candidates
+}
+
+type candidatesByPriority []preemptionCandidate
+
+func (a candidatesByPriority) Len() int      { return len(a) }
+func (a candidatesByPriority) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a candidatesByPriority) Less(i, j int) bool {
+	if a[i].Priority != a[j].Priority {
+		return a[i].Priority < a[j].Priority
+	}
+	return a[i].containerID < a[j].containerID
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestPreemptionCandidates(t *testing.T) {
+	instance := func(id string, priority int) agent.ContainerInstance {
+		return agent.ContainerInstance{ID: id, Config: agent.ContainerConfig{Priority: priority}}
+	}
+	candidates := preemptionCandidates(5, map[string]agentState{
+		"http://a:1": {containerInstances: map[string]agent.ContainerInstance{
+			"high":  instance("high", 9),
+			"low-b": instance("low-b", 1),
+			"equal": instance("equal", 5),
+		}},
+		"http://b:2": {containerInstances: map[string]agent.ContainerInstance{
+			"lowest": instance("lowest", -1),
+			"low-a":  instance("low-a", 1),
+		}},
+		"http://dirty:3": {dirty: true, containerInstances: map[string]agent.ContainerInstance{
+			"untrusted": instance("untrusted", 0),
+		}},
+	})
+
+	var ids []string
+	for _, candidate := range candidates {
+		ids = append(ids, candidate.containerID)
+	}
+	if expected, got := []string{"lowest", "low-a", "low-b"}, ids; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestPlaceJobPreempting(t *testing.T) {
+	var (
+		instance = func(id string, priority int) agent.ContainerInstance {
+			return agent.ContainerInstance{ID: id, Config: agent.ContainerConfig{Priority: priority, Resources: agent.Resources{Memory: 512, CPUs: 1}}}
+		}
+		full = func(instances ...agent.ContainerInstance) agentState {
+			m := map[string]agent.ContainerInstance{}
+			for _, instance := range instances {
+				m[instance.ID] = instance
+			}
+			return agentState{
+				hostResources: agent.HostResources{
+					Memory: agent.TotalReserved{Total: 1024, Reserved: 1024},
+					CPUs:   agent.TotalReserved{Total: 2, Reserved: 2},
+				},
+				containerInstances: m,
+			}
+		}
+		agentStates = map[string]agentState{
+			"http://a:1": full(instance("a-low", 1), instance("a-high", 9)),
+			"http://b:2": full(instance("b-lowest", 0), instance("b-high", 9)),
+		}
+		algoFactory = func(agentStates map[string]agentState) schedulingAlgorithm { return randomNonDirty(agentStates) }
+		job         = func(priority int, scale int) scheduler.Job {
+			return makeJob(configstore.JobConfig{
+				JobName:  "urgent",
+				Priority: priority,
+				Tasks:    []configstore.TaskConfig{{TaskName: "web", Scale: scale, Resources: agent.Resources{Memory: 512, CPUs: 1}}},
+			}, "http://filestore.berlin/urgent-1.tar.gz")
+		}
+	)
+
+	taskSpecMap, victims, err := placeJobPreempting(job(5, 1), agentStates, algoFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"b-lowest"}, containerIDs(victims); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected victims %v, got %v", expected, got)
+	}
+	for _, spec := range taskSpecMap {
+		if expected, got := "http://b:2", spec.endpoint; expected != got {
+			t.Errorf("expected placement on %s, got %s", expected, got)
+		}
+	}
+	if expected, got := 2, len(agentStates["http://b:2"].containerInstances); expected != got {
+		t.Errorf("expected the agent states to be left alone, with %d containers on b, got %d", expected, got)
+	}
+
+	// Two instances need both lower-priority containers gone.
+	_, victims, err = placeJobPreempting(job(5, 2), agentStates, algoFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"a-low", "b-lowest"}, containerIDs(victims); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected victims %v, got %v", expected, got)
+	}
+
+	// Three instances don't fit, even with both gone: nothing is preempted.
+	taskSpecMap, victims, err = placeJobPreempting(job(5, 3), agentStates, algoFactory)
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if len(taskSpecMap) != 0 || len(victims) != 0 {
+		t.Errorf("expected no placement and no victims, got %v and %v", taskSpecMap, victims)
+	}
+}
+
+func containerIDs(m map[string]taskSpec) []string {
+	ids := []string{}
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// Agents only receive containers when jobs are scheduled or migrated, so an
+// agent added to a busy cluster stays idle while the old agents stay loaded.
+// The rebalancer periodically compares the utilization of the agents, and
+// moves containers from the most to the least utilized ones, until they're
+// within a threshold of each other, or it made as many moves as it may per
+// round. Moves go through the scheduler, so containers keep running on their
+// old agent until they run on the new one.
+
+type rebalancer struct {
+	quit chan chan struct{}
+}
+
+// rebalancePolicy configures the rebalancer.
+type rebalancePolicy struct {
+	interval  time.Duration // between rounds
+	threshold float64       // utilization difference tolerated between agents, from 0 to 1
+	moves     int           // per round
+	dryRun    bool          // only log the moves
+}
+
+// rebalanceMove is a container move planned by the rebalancer.
+type rebalanceMove struct {
+	containerID string
+	from, to    string // agent endpoints
+}
+
+// newRebalancer returns a running rebalancer. Move must move the container to
+// the agent, and return once it's done.
+func newRebalancer(agentStater agentStater, move func(containerID, endpoint string) error, policy rebalancePolicy) *rebalancer {
+	r := &rebalancer{
+		quit: make(chan chan struct{}),
+	}
+	go r.loop(agentStater, move, policy)
+	return r
+}
+
+func (r *rebalancer) stop() {
+	q := make(chan struct{})
+	r.quit <- q
+	<-q
+}
+
+func (r *rebalancer) loop(agentStater agentStater, move func(containerID, endpoint string) error, policy rebalancePolicy) {
+	tick := time.Tick(policy.interval)
+	for {
+		select {
+		case <-tick:
+			rebalance(agentStater, move, policy)
+
+		case q := <-r.quit:
+			close(q)
+			return
+		}
+	}
+}
+
+// rebalance plans a round of moves, and carries them out, unless the policy
+// says it's a dry run. A failed move ends the round, as the plan was made for
+// agents which no longer look like they did.
+func rebalance(agentStater agentStater, move func(containerID, endpoint string) error, policy rebalancePolicy) {
+	for _, m := range planRebalance(agentStater.agentStates(), policy.threshold, policy.moves) {
+		if policy.dryRun {
+			log.Printf("rebalancer: would move %s from %s to %s", m.containerID, m.from, m.to)
+			continue
+		}
+		log.Printf("rebalancer: moving %s from %s to %s", m.containerID, m.from, m.to)
+		if err := move(m.containerID, m.to); err != nil {
+			log.Printf("rebalancer: move %s from %s to %s: %s", m.containerID, m.from, m.to, err)
+			return
+		}
+		incContainersRebalanced(1)
+	}
+}
+
+// planRebalance returns up to maxMoves moves which bring the utilization of
+// the agents of each cluster within threshold of each other, or as close as
+// they get. Containers aren't moved between clusters. Only schedulable agents
+// take part, and nothing is planned while any agent's report can't be
+// trusted.
+func planRebalance(agentStates map[string]agentState, threshold float64, maxMoves int) []rebalanceMove {
+	for _, state := range agentStates {
+		if state.dirty {
+			return []rebalanceMove{}
+		}
+	}
+	var (
+		states   = copySimulatedStates(agentStates)
+		moves    = []rebalanceMove{}
+		clusters = []string{}
+		seen     = map[string]bool{}
+	)
+	for _, state := range states {
+		if cluster := agentCluster(state); !seen[cluster] {
+			clusters, seen[cluster] = append(clusters, cluster), true
+		}
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		for len(moves) < maxMoves {
+			from, to, ok := extremes(states, cluster)
+			if !ok || utilization(states[from].hostResources)-utilization(states[to].hostResources) <= threshold {
+				break
+			}
+			containerID, ok := pickContainer(states, from, to)
+			if !ok {
+				break
+			}
+			config := states[from].containerInstances[containerID].Config
+			removeSimulated(states, from, containerID)
+			addSimulated(states, to, containerID, config)
+			moves = append(moves, rebalanceMove{containerID, from, to})
+		}
+	}
+	return moves
+}
+
+// extremes returns the most and least utilized schedulable agents in the
+// cluster. Ties go to the first endpoint in sorted order.
+func extremes(agentStates map[string]agentState, cluster string) (most, least string, ok bool) {
+	endpoints := make([]string, 0, len(agentStates))
+	for endpoint, state := range agentStates {
+		if !state.unschedulable && agentCluster(state) == cluster {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) < 2 {
+		return "", "", false
+	}
+	sort.Strings(endpoints)
+	most, least = endpoints[0], endpoints[0]
+	for _, endpoint := range endpoints[1:] {
+		u := utilization(agentStates[endpoint].hostResources)
+		if u > utilization(agentStates[most].hostResources) {
+			most = endpoint
+		}
+		if u < utilization(agentStates[least].hostResources) {
+			least = endpoint
+		}
+	}
+	return most, least, most != least
+}
+
+// pickContainer returns the running container whose move from one agent to
+// the other reduces the difference in their utilization the most. Containers
+// the other agent can't take, or whose move would spread their task worse,
+// aren't considered.
+func pickContainer(agentStates map[string]agentState, from, to string) (string, bool) {
+	var (
+		source, target = agentStates[from], agentStates[to]
+		best           = math.Abs(utilization(source.hostResources) - utilization(target.hostResources))
+		containerIDs   = make([]string, 0, len(source.containerInstances))
+		picked         string
+	)
+	for containerID := range source.containerInstances {
+		containerIDs = append(containerIDs, containerID)
+	}
+	sort.Strings(containerIDs) // stable choice among equals
+	for _, containerID := range containerIDs {
+		config := source.containerInstances[containerID].Config
+		if source.containerInstances[containerID].Status != agent.ContainerStatusRunning {
+			continue
+		}
+		if _, missing := missingVolume(config, target.hostResources.Volumes); missing {
+			continue
+		}
+		if !hasRoom(scheduler.Task{ContainerConfig: config}, target, nil) || !keepsSpread(agentStates, from, to, config) {
+			continue
+		}
+		var (
+			after   = source.hostResources
+			afterTo = target.hostResources
+		)
+		after.Memory.Reserved -= float64(config.Resources.Memory)
+		after.CPUs.Reserved -= config.Resources.CPUs
+		afterTo.Memory.Reserved += float64(config.Resources.Memory)
+		afterTo.CPUs.Reserved += config.Resources.CPUs
+		if skew := math.Abs(utilization(after) - utilization(afterTo)); skew < best {
+			best, picked = skew, containerID
+		}
+	}
+	return picked, picked != ""
+}
+
+// keepsSpread returns true if moving the container doesn't spread its task
+// worse: the target agent doesn't run the task yet, and is in the same
+// failure domain as the source agent, or in one which doesn't run the task.
+func keepsSpread(agentStates map[string]agentState, from, to string, config agent.ContainerConfig) bool {
+	sameTask := func(state agentState) bool {
+		for _, containerInstance := range state.containerInstances {
+			if containerInstance.Config.JobName == config.JobName && containerInstance.Config.TaskName == config.TaskName {
+				return true
+			}
+		}
+		return false
+	}
+	if sameTask(agentStates[to]) {
+		return false
+	}
+	domain := failureDomain(agentStates[to])
+	if domain == failureDomain(agentStates[from]) {
+		return true
+	}
+	for _, state := range agentStates {
+		if failureDomain(state) == domain && sameTask(state) {
+			return false
+		}
+	}
+	return true
+}
+
+// utilization returns the larger of the reserved fractions of the agent's
+// memory and CPUs. Totals of zero are treated as unknown, as in hasRoom.
+func utilization(resources agent.HostResources) float64 {
+	var u float64
+	if resources.Memory.Total > 0 {
+		u = math.Max(u, resources.Memory.Reserved/resources.Memory.Total)
+	}
+	if resources.CPUs.Total > 0 {
+		u = math.Max(u, resources.CPUs.Reserved/resources.CPUs.Total)
+	}
+	return u
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	var (
+		config = func(job string, memory int) agent.ContainerConfig {
+			return agent.ContainerConfig{JobName: job, TaskName: "t", Resources: agent.Resources{Memory: memory}}
+		}
+		agentWith = func(domain string, configs map[string]agent.ContainerConfig) agentState {
+			state := agentState{
+				hostResources:      agent.HostResources{Memory: agent.TotalReserved{Total: 1000}, Labels: map[string]string{agent.FailureDomainLabel: domain}},
+				containerInstances: map[string]agent.ContainerInstance{},
+			}
+			for id, config := range configs {
+				state.containerInstances[id] = agent.ContainerInstance{ID: id, Status: agent.ContainerStatusRunning, Config: config}
+				state.hostResources.Memory.Reserved += float64(config.Resources.Memory)
+			}
+			return state
+		}
+		busy = func() agentState {
+			return agentWith("", map[string]agent.ContainerConfig{
+				"a": config("a", 300),
+				"b": config("b", 200),
+				"c": config("c", 100),
+			})
+		}
+	)
+
+	for name, testCase := range map[string]struct {
+		agentStates map[string]agentState
+		threshold   float64
+		maxMoves    int
+		expected    []rebalanceMove
+	}{
+		"balanced": {
+			agentStates: map[string]agentState{"x": busy(), "y": busy()},
+			threshold:   0.1,
+			maxMoves:    3,
+			expected:    []rebalanceMove{},
+		},
+		"new agent": {
+			agentStates: map[string]agentState{"x": busy(), "y": agentWith("", nil)},
+			threshold:   0.1,
+			maxMoves:    3,
+			expected:    []rebalanceMove{{"a", "x", "y"}},
+		},
+		"rate limited": {
+			agentStates: map[string]agentState{
+				"x": busy(),
+				"y": busy(),
+				"z": agentWith("", nil),
+			},
+			threshold: 0.05,
+			maxMoves:  1,
+			expected:  []rebalanceMove{{"a", "x", "z"}},
+		},
+		"within threshold": {
+			agentStates: map[string]agentState{"x": busy(), "y": agentWith("", nil)},
+			threshold:   0.7,
+			maxMoves:    3,
+			expected:    []rebalanceMove{},
+		},
+		"dirty agent": {
+			agentStates: map[string]agentState{"x": busy(), "y": {dirty: true}},
+			threshold:   0.1,
+			maxMoves:    3,
+			expected:    []rebalanceMove{},
+		},
+		"task already on target": {
+			agentStates: map[string]agentState{
+				"x": busy(),
+				"y": agentWith("", map[string]agent.ContainerConfig{"a2": config("a", 10)}),
+			},
+			threshold: 0.1,
+			maxMoves:  1,
+			expected:  []rebalanceMove{{"b", "x", "y"}},
+		},
+		"task already in target domain": {
+			agentStates: map[string]agentState{
+				"x": busy(),
+				"y": agentWith("rack-2", nil),
+				"z": agentWith("rack-2", map[string]agent.ContainerConfig{"a2": config("a", 10), "b2": config("b", 10), "c2": config("c", 10)}),
+			},
+			threshold: 0.1,
+			maxMoves:  3,
+			expected:  []rebalanceMove{},
+		},
+	} {
+		if got := planRebalance(testCase.agentStates, testCase.threshold, testCase.maxMoves); !reflect.DeepEqual(testCase.expected, got) {
+			t.Errorf("%s: expected %v, got %v", name, testCase.expected, got)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+// In declarative mode, the scheduler converges the jobs to the configs in the
+// config store, rather than waiting for /schedule requests. Every interval,
+// and whenever POST /reconcile asks for it, e.g. from the webhook of the
+// config repository, the reconciler lists the configs, and schedules the jobs
+// whose desired state is running but which aren't deployed, migrates those
+// deployed with a different config, and unschedules those whose desired
+// state is stopped. Jobs without a desired state, or without a config, are
+// left alone, so jobs scheduled by hand keep running. Jobs are only changed
+// while their namespace's deploy window is open, and scheduled once the jobs
+// they require are met; otherwise the next round tries again.
+
+// Reconcile actions.
+const (
+	reconcileSchedule   = "schedule"
+	reconcileMigrate    = "migrate"
+	reconcileUnschedule = "unschedule"
+)
+
+// reconcileScheduler is the part of the scheduler the reconciler drives.
+type reconcileScheduler interface {
+	Schedule(scheduler.Job) error
+	Migrate(scheduler.Job, configstore.JobConfig) error
+	Unschedule(scheduler.Job) error
+	currentDeployments() []deployment
+}
+
+// reconcileAction is a change the reconciler made, or tried to make.
+type reconcileAction struct {
+	JobName string
+	Action  string
+	Err     error
+}
+
+func (a reconcileAction) String() string {
+	if a.Err != nil {
+		return fmt.Sprintf("%s %s: %s", a.Action, a.JobName, a.Err)
+	}
+	return fmt.Sprintf("%s %s", a.Action, a.JobName)
+}
+
+type reconciler struct {
+	store        configstore.Lister
+	environment  string
+	scheduler    reconcileScheduler
+	namespaces   *namespaces
+	requirements *jobRequirements
+	trigger      chan struct{}
+	quit         chan chan struct{}
+}
+
+// newReconciler returns a running reconciler, converging the jobs to the
+// configs of the store, resolved for the environment, every interval.
+func newReconciler(store configstore.Lister, environment string, s reconcileScheduler, namespaces *namespaces, requirements *jobRequirements, interval time.Duration) *reconciler {
+	r := &reconciler{
+		store:        store,
+		environment:  environment,
+		scheduler:    s,
+		namespaces:   namespaces,
+		requirements: requirements,
+		trigger:      make(chan struct{}, 1),
+		quit:         make(chan chan struct{}),
+	}
+	go r.loop(interval)
+	return r
+}
+
+func (r *reconciler) stop() {
+	q := make(chan struct{})
+	r.quit <- q
+	<-q
+}
+
+// reconcileSoon asks for a reconcile, unless one is pending already.
+func (r *reconciler) reconcileSoon() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *reconciler) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.trigger:
+		case q := <-r.quit:
+			close(q)
+			return
+		}
+		for _, action := range r.reconcile() {
+			log.Printf("reconciler: %s", action)
+		}
+	}
+}
+
+// reconcile converges the jobs to the configs in the store once, and returns
+// the actions it took.
+func (r *reconciler) reconcile() []reconcileAction {
+	configs, err := r.store.List(r.environment)
+	if err != nil {
+		log.Printf("reconciler: can't list configs: %s", err)
+		return nil
+	}
+	sort.Sort(storedConfigsByName(configs))
+
+	current := map[string]deployment{}
+	for _, d := range r.scheduler.currentDeployments() {
+		current[d.Job.JobName] = d
+	}
+
+	actions := []reconcileAction{}
+	for _, c := range configs {
+		var (
+			jobName     = configstore.NamespacedJobName(c.Namespace, c.JobName)
+			d, deployed = current[jobName]
+		)
+		if c.Desired == "" {
+			continue
+		}
+		if err := r.namespaces.deployable(c.Namespace, time.Now()); err != nil {
+			continue // try again once the window opens
+		}
+		switch {
+		case c.Desired == configstore.DesiredRunning && !deployed:
+			if c.ArtifactURL == "" {
+				actions = append(actions, reconcileAction{jobName, reconcileSchedule, fmt.Errorf("config has no artifact_url")})
+				continue
+			}
+			job := makeJob(c.JobConfig, "")
+			if err := job.Valid(); err != nil {
+				actions = append(actions, reconcileAction{jobName, reconcileSchedule, err})
+				continue
+			}
+			if err := r.requirements.check(job, 0); err != nil {
+				continue // try again once the requirements are met
+			}
+			err := r.scheduler.Schedule(job)
+			if err == nil {
+				r.requirements.scheduledJob(job)
+			}
+			actions = append(actions, reconcileAction{jobName, reconcileSchedule, err})
+
+		case c.Desired == configstore.DesiredRunning && deployed:
+			artifactURL := c.ArtifactURL
+			if artifactURL == "" {
+				artifactURL, _ = getArtifactURL(d.Job)
+			}
+			if refHash(makeJob(c.JobConfig, artifactURL)) == d.Ref {
+				continue
+			}
+			actions = append(actions, reconcileAction{jobName, reconcileMigrate, r.scheduler.Migrate(d.Job, c.JobConfig)})
+
+		case c.Desired == configstore.DesiredStopped && deployed:
+			err := r.scheduler.Unschedule(d.Job)
+			if err == nil {
+				r.requirements.unscheduledJob(jobName)
+			}
+			actions = append(actions, reconcileAction{jobName, reconcileUnschedule, err})
+		}
+	}
+	return actions
+}
+
+// handleReconcile asks the reconciler to converge the jobs now, e.g. from the
+// webhook of the config repository on pushes. It answers before the
+// reconcile is done.
+func handleReconcile(r *reconciler) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		r.reconcileSoon()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+type storedConfigsByName []configstore.StoredConfig
+
+func (a storedConfigsByName) Len() int      { return len(a) }
+func (a storedConfigsByName) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a storedConfigsByName) Less(i, j int) bool {
+	return configstore.NamespacedJobName(a[i].Namespace, a[i].JobName) < configstore.NamespacedJobName(a[j].Namespace, a[j].JobName)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestReconcile(t *testing.T) {
+	var (
+		config = func(jobName, desired, artifactURL string) configstore.StoredConfig {
+			return configstore.StoredConfig{Ref: jobName, JobConfig: configstore.JobConfig{
+				JobName:     jobName,
+				ArtifactURL: artifactURL,
+				Desired:     desired,
+				Tasks: []configstore.TaskConfig{{
+					TaskName:  "web",
+					Scale:     1,
+					Command:   agent.Command{WorkingDir: "/srv/" + jobName, Exec: []string{"./" + jobName}},
+					Resources: agent.Resources{Memory: 64, CPUs: 1},
+					Grace:     agent.Grace{Startup: 1, Shutdown: 1},
+				}},
+			}}
+		}
+		alpha   = config("alpha", configstore.DesiredRunning, "http://filestore.berlin/alpha-1.tar.gz")
+		beta    = config("beta", configstore.DesiredRunning, "http://filestore.berlin/beta-2.tar.gz")
+		gamma   = config("gamma", configstore.DesiredRunning, "")
+		delta   = config("delta", configstore.DesiredStopped, "")
+		epsilon = config("epsilon", "", "http://filestore.berlin/epsilon-1.tar.gz")
+		zeta    = config("zeta", configstore.DesiredRunning, "")
+
+		betaJob    = makeJob(beta.JobConfig, "http://filestore.berlin/beta-1.tar.gz")
+		gammaJob   = makeJob(gamma.JobConfig, "http://filestore.berlin/gamma-1.tar.gz")
+		deltaJob   = makeJob(delta.JobConfig, "http://filestore.berlin/delta-1.tar.gz")
+		epsilonJob = makeJob(epsilon.JobConfig, "http://filestore.berlin/epsilon-0.tar.gz")
+		s          = &fakeReconcileScheduler{deployments: []deployment{
+			{Ref: refHash(betaJob), Job: betaJob},
+			{Ref: refHash(gammaJob), Job: gammaJob},
+			{Ref: refHash(deltaJob), Job: deltaJob},
+			{Ref: refHash(epsilonJob), Job: epsilonJob},
+		}}
+		store = fakeLister{zeta, epsilon, delta, gamma, beta, alpha}
+		r     = &reconciler{store: store, scheduler: s}
+	)
+
+	got := r.reconcile()
+	if len(got) != 4 {
+		t.Fatalf("expected 4 actions, got %v", got)
+	}
+	expected := []reconcileAction{
+		{"alpha", reconcileSchedule, nil},
+		{"beta", reconcileMigrate, nil},
+		{"delta", reconcileUnschedule, nil},
+		{"zeta", reconcileSchedule, got[3].Err},
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if got[3].Err == nil {
+		t.Errorf("expected zeta, without artifact URL, not to be scheduled")
+	}
+	if expected, got := []string{"schedule alpha", "migrate beta", "unschedule delta"}, s.calls; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestReconcileUnchanged(t *testing.T) {
+	var (
+		alpha = configstore.StoredConfig{Ref: "1", JobConfig: configstore.JobConfig{
+			JobName:     "alpha",
+			ArtifactURL: "http://filestore.berlin/alpha-1.tar.gz",
+			Desired:     configstore.DesiredRunning,
+			Tasks:       []configstore.TaskConfig{{TaskName: "web", Scale: 1}},
+		}}
+		alphaJob = makeJob(alpha.JobConfig, "")
+		s        = &fakeReconcileScheduler{deployments: []deployment{{Ref: refHash(alphaJob), Job: alphaJob}}}
+		r        = &reconciler{store: fakeLister{alpha}, scheduler: s}
+	)
+	if got := r.reconcile(); len(got) != 0 {
+		t.Errorf("expected no actions, got %v", got)
+	}
+}
+
+type fakeLister []configstore.StoredConfig
+
+func (l fakeLister) List(string) ([]configstore.StoredConfig, error) {
+	return append([]configstore.StoredConfig{}, l...), nil
+}
+
+type fakeReconcileScheduler struct {
+	sync.Mutex
+	deployments []deployment
+	calls       []string
+}
+
+func (s *fakeReconcileScheduler) Schedule(job scheduler.Job) error {
+	return s.call("schedule " + job.JobName)
+}
+
+func (s *fakeReconcileScheduler) Migrate(existingJob scheduler.Job, _ configstore.JobConfig) error {
+	return s.call("migrate " + existingJob.JobName)
+}
+
+func (s *fakeReconcileScheduler) Unschedule(job scheduler.Job) error {
+	return s.call("unschedule " + job.JobName)
+}
+
+func (s *fakeReconcileScheduler) currentDeployments() []deployment {
+	return s.deployments
+}
+
+func (s *fakeReconcileScheduler) call(call string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.calls = append(s.calls, call)
+	return nil
+}
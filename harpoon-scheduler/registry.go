@@ -8,43 +8,109 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 )
 
-// The registry needs to support three operations:
+// The registry needs to support four operations:
 //
 //  1. Schedule a new job from scratch.
 //  2. Unschedule an existing job.
 //  3. Migrate a job to a new configuration, one task instance at a time.
+//  4. Move a container to another agent.
 //
-// We support scheduling and unscheduling directly. We support migrations by
-// having the actor schedule-1/unschedule-1 in a loop. The actor should
-// maintain an undo stack, to roll back in case of error.
+// We support scheduling, unscheduling, and moving directly. We support
+// migrations by having the actor schedule-1/unschedule-1 in a loop. The actor
+// should maintain an undo stack, to roll back in case of error.
 
 type registryPublic interface {
 	schedule(string, taskSpec, chan schedulingSignalWithContext) error
 	unschedule(string, taskSpec, chan schedulingSignalWithContext) error
+	move(string, string, chan schedulingSignalWithContext) error
+	restore(map[string]taskSpec)
+	previousPlacements() map[string]string
 }
 
 type registryPrivate interface {
 	signal(string, schedulingSignal)
-	notify(chan<- registryState)
-	stop(chan<- registryState)
+	failed(string, time.Time) (failureRecord, bool)
+	restarted(string)
+	silenced(string, string, time.Time) bool
+	notify(chan<- []registryTransition)
+	stop(chan<- []registryTransition)
 }
 
 var (
 	errInvalidContainerID = errors.New("invalid container ID")
 )
 
+// stateError is returned for operations on containers in the wrong state,
+// e.g. scheduling a container which is already scheduled.
+type stateError struct {
+	containerID string
+	problem     string
+	scheduled   bool // the container is already scheduled, or pending schedule
+}
+
+func (e stateError) Error() string { return e.containerID + " " + e.problem }
+
 type registry struct {
 	sync.RWMutex
-	pendingSchedule   map[string]taskSpec
-	scheduled         map[string]taskSpec
-	pendingUnschedule map[string]taskSpec
-	signals           map[string]chan schedulingSignalWithContext
-	subscriptions     map[chan<- registryState]struct{}
-	lost              chan map[string]taskSpec
+	containers    map[string]*containerRecord // container ID: record
+	subscriptions map[chan<- []registryTransition]*subscription
+	lost          chan map[string]taskSpec
+	failures      map[string]failureRecord
+	crashLoop     crashLoopPolicy // may be changed before use
+	annotations   *annotations
+	previous      map[string]previousPlacement // container ID: where it ran, once it left
+}
+
+// placementMemory is how long the registry remembers where containers ran
+// after they left it, e.g. when their agent was lost, so they're placed back
+// there, or at least in the same failure domain, when they're rescheduled.
+const placementMemory = time.Hour
+
+// previousPlacement is where a container ran before it left the registry.
+type previousPlacement struct {
+	endpoint string
+	left     time.Time
+}
+
+// startAttempts is how often the transformer tries to start a container
+// before the registry gives up on scheduling it.
+const startAttempts = 3
+
+// containerRecord is what the registry knows about a container: where it is
+// in its lifecycle, its spec, and the operation in flight, if any.
+type containerRecord struct {
+	status registryStatus
+	spec   taskSpec
+	op     *operation // nil when scheduled
+}
+
+type operationKind string
+
+const (
+	opSchedule   operationKind = "schedule"
+	opUnschedule operationKind = "unschedule"
+	opMove       operationKind = "move"
+)
+
+// operation is a schedule, unschedule, or move in flight. Its outcome is sent
+// to the signal chan, if any, once the operation is complete.
+type operation struct {
+	kind     operationKind
+	attempts int // 1 for the first try
+	started  time.Time
+	updated  time.Time // of the last attempt
+	signal   chan schedulingSignalWithContext
+	source   taskSpec // for moves: where the container runs until it's moved
+}
+
+func newOperation(kind operationKind, c chan schedulingSignalWithContext) *operation {
+	now := time.Now()
+	return &operation{kind: kind, attempts: 1, started: now, updated: now, signal: c}
 }
 
 // newRegistry produces a new registry. If lost is non-nil, it will receive
@@ -52,12 +118,13 @@ type registry struct {
 // they will be re-scheduled.
 func newRegistry(lost chan map[string]taskSpec) *registry {
 	return &registry{
-		pendingSchedule:   map[string]taskSpec{},
-		scheduled:         map[string]taskSpec{},
-		pendingUnschedule: map[string]taskSpec{},
-		signals:           map[string]chan schedulingSignalWithContext{},
-		subscriptions:     map[chan<- registryState]struct{}{},
-		lost:              lost,
+		containers:    map[string]*containerRecord{},
+		subscriptions: map[chan<- []registryTransition]*subscription{},
+		lost:          lost,
+		failures:      map[string]failureRecord{},
+		crashLoop:     defaultCrashLoopPolicy,
+		annotations:   newAnnotations(),
+		previous:      map[string]previousPlacement{},
 	}
 }
 
@@ -69,29 +136,24 @@ func (r *registry) schedule(containerID string, taskSpec taskSpec, c chan schedu
 	if containerID == "" {
 		return errInvalidContainerID
 	}
-	if _, ok := r.pendingSchedule[containerID]; ok {
-		return fmt.Errorf("%s already pending schedule", containerID)
-	}
-	if _, ok := r.scheduled[containerID]; ok {
-		return fmt.Errorf("%s already scheduled", containerID)
-	}
-	if _, ok := r.pendingUnschedule[containerID]; ok {
-		return fmt.Errorf("%s is pending unschedule", containerID)
-	}
-	if _, ok := r.signals[containerID]; ok {
-		panic(fmt.Sprintf("%s has a registered signal but isn't present in any state map!", containerID))
+	switch status, _ := r.lookup(containerID); status {
+	case registryPendingSchedule:
+		return stateError{containerID, "already pending schedule", true}
+	case registryScheduled:
+		return stateError{containerID, "already scheduled", true}
+	case registryPendingUnschedule:
+		return stateError{containerID, "is pending unschedule", false}
+	case registryPendingMove:
+		return stateError{containerID, "is pending move", false}
 	}
 
-	r.pendingSchedule[containerID] = taskSpec
-	if c != nil {
-		r.signals[containerID] = c
+	r.containers[containerID] = &containerRecord{
+		status: registryPendingSchedule,
+		spec:   taskSpec,
+		op:     newOperation(opSchedule, c),
 	}
 
-	broadcast(r.subscriptions, registryState{
-		pendingSchedule:   cp(r.pendingSchedule),
-		scheduled:         cp(r.scheduled),
-		pendingUnschedule: cp(r.pendingUnschedule),
-	})
+	broadcast(r.subscriptions, registryTransition{containerID, taskSpec, registryNone, registryPendingSchedule})
 
 	return nil
 }
@@ -104,194 +166,524 @@ func (r *registry) unschedule(containerID string, taskSpec taskSpec, c chan sche
 	if containerID == "" {
 		return errInvalidContainerID
 	}
-	if _, ok := r.pendingSchedule[containerID]; ok {
-		return fmt.Errorf("%s is pending schedule", containerID)
+	switch status, _ := r.lookup(containerID); status {
+	case registryPendingSchedule:
+		return stateError{containerID, "is pending schedule", false}
+	case registryPendingUnschedule:
+		return stateError{containerID, "is already pending unschedule", false}
+	case registryPendingMove:
+		return stateError{containerID, "is pending move", false}
+	case registryNone:
+		return stateError{containerID, "isn't scheduled", false}
+	}
+
+	r.containers[containerID] = &containerRecord{
+		status: registryPendingUnschedule,
+		spec:   taskSpec,
+		op:     newOperation(opUnschedule, c),
+	}
+
+	broadcast(r.subscriptions, registryTransition{containerID, taskSpec, registryScheduled, registryPendingUnschedule})
+
+	return nil
+}
+
+// move implements the registryPublic interface. The container keeps running
+// where it is until the transformer has started it on the new agent, so it's
+// never down in between. If the move fails, the container stays where it was.
+func (r *registry) move(containerID string, endpoint string, c chan schedulingSignalWithContext) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if containerID == "" {
+		return errInvalidContainerID
 	}
-	if _, ok := r.pendingUnschedule[containerID]; ok {
-		return fmt.Errorf("%s is already pending unschedule", containerID)
+	record, ok := r.containers[containerID]
+	if !ok {
+		return stateError{containerID, "isn't scheduled", false}
 	}
-	if _, ok := r.scheduled[containerID]; !ok {
-		return fmt.Errorf("%s isn't scheduled", containerID)
+	if record.status != registryScheduled {
+		return stateError{containerID, fmt.Sprintf("is %s", record.status), false}
 	}
-	if _, ok := r.signals[containerID]; ok {
-		panic(fmt.Sprintf("%s has a registered signal but isn't present in any state map!", containerID))
+	if record.spec.endpoint == endpoint {
+		return stateError{containerID, fmt.Sprintf("is already on %s", endpoint), false}
 	}
 
-	delete(r.scheduled, containerID)
-	r.pendingUnschedule[containerID] = taskSpec
-	if c != nil {
-		r.signals[containerID] = c
-	}
+	op := newOperation(opMove, c)
+	op.source = record.spec
+	record.status, record.op = registryPendingMove, op
+	record.spec.endpoint = endpoint
 
-	broadcast(r.subscriptions, registryState{
-		pendingSchedule:   cp(r.pendingSchedule),
-		scheduled:         cp(r.scheduled),
-		pendingUnschedule: cp(r.pendingUnschedule),
-	})
+	broadcast(r.subscriptions, registryTransition{containerID, record.spec, registryScheduled, registryPendingMove})
 
 	return nil
 }
 
+// restore implements the registryPublic interface. It marks containers as
+// scheduled without going through pending-schedule, because they're known to
+// exist already, e.g. when recovering an interrupted migration after a
+// restart. Containers the registry already knows about are left alone.
+func (r *registry) restore(taskSpecMap map[string]taskSpec) {
+	r.Lock()
+	defer r.Unlock()
+
+	transitions := []registryTransition{}
+	for containerID, taskSpec := range taskSpecMap {
+		if status, _ := r.lookup(containerID); status != registryNone {
+			continue
+		}
+		r.containers[containerID] = &containerRecord{status: registryScheduled, spec: taskSpec}
+		transitions = append(transitions, registryTransition{containerID, taskSpec, registryNone, registryScheduled})
+	}
+
+	broadcast(r.subscriptions, transitions...)
+}
+
+// previousPlacements implements the registryPublic interface. It returns
+// the agent endpoint each container ran on before it left the registry,
+// within placementMemory, by container ID.
+func (r *registry) previousPlacements() map[string]string {
+	r.Lock()
+	defer r.Unlock()
+
+	var (
+		cutoff     = time.Now().Add(-placementMemory)
+		placements = make(map[string]string, len(r.previous))
+	)
+	for containerID, placement := range r.previous {
+		if placement.left.Before(cutoff) {
+			delete(r.previous, containerID)
+			continue
+		}
+		placements[containerID] = placement.endpoint
+	}
+	return placements
+}
+
+// ping returns once the registry lock could be acquired.
+func (r *registry) ping() {
+	r.RLock()
+	defer r.RUnlock()
+}
+
 // signal implements the registryPrivate interface. It's called by components
-// that effect changes against remote agents, i.e. the transformer.
+// that effect changes against remote agents, i.e. the transformer. Signals
+// complete the operation in flight, moving the container to its next state,
+// and are forwarded to whoever waits for the operation. Start failures are
+// retried, up to startAttempts. Signals which don't fit the state of the
+// container, e.g. because they were duplicated or arrived late, are ignored.
 func (r *registry) signal(containerID string, schedulingSignal schedulingSignal) {
 	r.Lock()
 	defer r.Unlock()
 
-	// Mutate state based on signal.
-	context := "(no additional context provided)"
+	var (
+		record  = r.containers[containerID] // nil if none
+		from, _ = r.lookup(containerID)
+		to      registryStatus
+		context string
+	)
+
+	// expect returns true if the container is in one of the given states.
+	expect := func(statuses ...registryStatus) bool {
+		for _, status := range statuses {
+			if from == status {
+				return true
+			}
+		}
+		ignoreSignal(containerID, schedulingSignal, from)
+		return false
+	}
+
 	switch schedulingSignal {
 	case signalScheduleSuccessful:
 		incSignalScheduleSuccessful(1)
-		spec, exists := r.pendingSchedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingSchedule) {
+			return
 		}
-		r.scheduled[containerID] = spec
-		delete(r.pendingSchedule, containerID)
-		context = fmt.Sprintf("%s pending-schedule → scheduled: OK, on %s", containerID, spec.endpoint)
+		to = registryScheduled
+		context = fmt.Sprintf("%s pending-schedule → scheduled: OK, on %s", containerID, record.spec.endpoint)
 
 	case signalScheduleFailed:
 		incSignalScheduleFailed(1)
-		spec, exists := r.pendingSchedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingSchedule) {
+			return
 		}
-		delete(r.pendingSchedule, containerID)
-		context = fmt.Sprintf("%s pending-schedule → (deleted): schedule failed on %s", containerID, spec.endpoint)
+		to = registryNone
+		context = fmt.Sprintf("%s pending-schedule → (deleted): schedule failed on %s", containerID, record.spec.endpoint)
 
 	case signalUnscheduleSuccessful:
 		incSignalUnscheduleSuccessful(1)
-		if _, exists := r.pendingUnschedule[containerID]; !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingUnschedule) {
+			return
 		}
-		delete(r.pendingUnschedule, containerID)
+		to = registryNone
 		context = fmt.Sprintf("%s pending-unschedule → (deleted): OK", containerID)
 
 	case signalUnscheduleFailed:
 		incSignalUnscheduleFailed(1)
-		spec, exists := r.pendingUnschedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingUnschedule) {
+			return
 		}
-		delete(r.pendingUnschedule, containerID)
-		r.scheduled[containerID] = spec
-		context = fmt.Sprintf("%s pending-unschedule → (deleted): unschedule failed on %s", containerID, spec.endpoint)
+		to = registryScheduled
+		context = fmt.Sprintf("%s pending-unschedule → scheduled: unschedule failed on %s", containerID, record.spec.endpoint)
 
 	case signalContainerLost:
 		incSignalContainerLost(1)
-		spec, exists := r.scheduled[containerID]
-		if !exists {
-			context = fmt.Sprintf("%s lost, but it wasn't known to be scheduled: ignoring the signal", containerID)
-			break
+		if !expect(registryScheduled) {
+			return
 		}
-		delete(r.scheduled, containerID)
+		to = registryNone
 		if r.lost != nil {
-			r.lost <- map[string]taskSpec{containerID: spec}
+			r.lost <- map[string]taskSpec{containerID: record.spec}
 		}
-		context = fmt.Sprintf("%s LOST → abandoned, on %s", containerID, spec.endpoint)
+		context = fmt.Sprintf("%s LOST → abandoned, on %s", containerID, record.spec.endpoint)
 
 	case signalAgentUnavailable:
 		incSignalAgentUnavailable(1)
-		if spec, exists := r.pendingSchedule[containerID]; exists {
-			delete(r.pendingSchedule, containerID)
-			context = fmt.Sprintf("%s pending-schedule → (deleted): agent (%s) unavailable", containerID, spec.endpoint)
-		} else if spec, exists := r.pendingUnschedule[containerID]; exists {
-			delete(r.pendingUnschedule, containerID)
-			context = fmt.Sprintf("%s pending-unschedule → (deleted): agent (%q) unavailable", containerID, spec.endpoint)
-		} else {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingSchedule, registryPendingUnschedule, registryPendingMove) {
+			return
 		}
+		if from == registryPendingMove {
+			to = registryScheduled
+			context = fmt.Sprintf("%s pending-move → scheduled: agent (%s) unavailable; stays on %s", containerID, record.spec.endpoint, record.op.source.endpoint)
+			break
+		}
+		to = registryNone
+		context = fmt.Sprintf("%s %s → (deleted): agent (%s) unavailable", containerID, from, record.spec.endpoint)
 
 	case signalContainerPutFailed:
 		incSignalContainerPutFailed(1)
-		spec, exists := r.pendingSchedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingSchedule) {
+			return
 		}
-		delete(r.pendingSchedule, containerID)
-		context = fmt.Sprintf("%s pending-schedule → (deleted): container PUT failed on %s", containerID, spec.endpoint)
+		to = registryNone
+		context = fmt.Sprintf("%s pending-schedule → (deleted): container PUT failed on %s", containerID, record.spec.endpoint)
 
 	case signalContainerStartFailed:
 		incSignalContainerStartFailed(1)
-		spec, exists := r.pendingUnschedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingSchedule) {
+			return
+		}
+		if record.op.attempts < startAttempts {
+			// The transformer removed the container which failed to start,
+			// so it can try again from scratch.
+			record.op.attempts++
+			record.op.updated = time.Now()
+			broadcast(r.subscriptions, registryTransition{containerID, record.spec, registryPendingSchedule, registryPendingSchedule})
+			log.Printf("registry: signal: %s pending-schedule: container start failed on %s; retrying (attempt %d of %d)", containerID, record.spec.endpoint, record.op.attempts, startAttempts)
+			return
 		}
-		delete(r.pendingSchedule, containerID)
-		context = fmt.Sprintf("%s pending-schedule → (deleted): container start failed on %s", containerID, spec.endpoint)
+		to = registryNone
+		context = fmt.Sprintf("%s pending-schedule → (deleted): container start failed on %s after %d attempt(s)", containerID, record.spec.endpoint, record.op.attempts)
 
 	case signalContainerStopFailed:
 		incSignalContainerStopFailed(1)
-		spec, exists := r.pendingUnschedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingUnschedule) {
+			return
 		}
-		delete(r.pendingUnschedule, containerID)
-		r.scheduled[containerID] = spec // assume failed stop means container still runs; require another user action to move it away again
-		context = fmt.Sprintf("%s pending-unschedule → scheduled: container stop failed on %s", containerID, spec.endpoint)
+		to = registryScheduled // assume failed stop means container still runs; require another user action to move it away again
+		context = fmt.Sprintf("%s pending-unschedule → scheduled: container stop failed on %s", containerID, record.spec.endpoint)
 
 	case signalContainerDeleteFailed:
 		incSignalContainerDeleteFailed(1)
-		spec, exists := r.pendingUnschedule[containerID]
-		if !exists {
-			panic("invalid state in scheduler registry")
+		if !expect(registryPendingUnschedule) {
+			return
+		}
+		to = registryNone // assume failed delete isn't an error condition (for us, at least)
+		context = fmt.Sprintf("%s pending-unschedule → (deleted): OK, but delete container failed on %s", containerID, record.spec.endpoint)
+
+	case signalMoveSuccessful:
+		incSignalMoveSuccessful(1)
+		if !expect(registryPendingMove) {
+			return
 		}
-		delete(r.pendingUnschedule, containerID)
-		// assume failed delete isn't an error condition (for us, at least)
-		context = fmt.Sprintf("%s pending-unschedule → (deleted): OK, but delete container failed on %s", containerID, spec.endpoint)
+		to = registryScheduled
+		context = fmt.Sprintf("%s pending-move → scheduled: OK, moved from %s to %s", containerID, record.op.source.endpoint, record.spec.endpoint)
+
+	case signalMoveFailed:
+		incSignalMoveFailed(1)
+		if !expect(registryPendingMove) {
+			return
+		}
+		to = registryScheduled
+		context = fmt.Sprintf("%s pending-move → scheduled: start failed on %s; stays on %s", containerID, record.spec.endpoint, record.op.source.endpoint)
 
 	default:
-		panic(fmt.Sprintf("%q got unknown scheduling signal %s (%d)", containerID, schedulingSignal, schedulingSignal))
+		ignoreSignal(containerID, schedulingSignal, from)
+		return
 	}
 
-	// Forward the signal to anyone that may be waiting on that container ID.
-	if c, exists := r.signals[containerID]; exists {
-		// At the moment, every incoming signal indicates the maneuver is
-		// complete. So, close and delete the registered signal chan after
-		// sending the signal. (This invariant may not hold in the future.)
-		c <- schedulingSignalWithContext{schedulingSignal, context}
-		close(c)
-		delete(r.signals, containerID)
+	// The operation in flight, if any, is complete. Forward the signal to
+	// anyone waiting on it.
+	if op := record.op; op != nil && op.signal != nil {
+		op.signal <- schedulingSignalWithContext{schedulingSignal, context}
+		close(op.signal)
 	}
 
-	broadcast(r.subscriptions, registryState{
-		pendingSchedule:   cp(r.pendingSchedule),
-		scheduled:         cp(r.scheduled),
-		pendingUnschedule: cp(r.pendingUnschedule),
-	})
+	if from == registryPendingMove && schedulingSignal != signalMoveSuccessful {
+		record.spec = record.op.source // the move didn't happen
+	}
+	if to == registryNone && (from == registryScheduled || from == registryPendingUnschedule) {
+		r.previous[containerID] = previousPlacement{record.spec.endpoint, time.Now()} // it ran there
+	}
+	if to == registryNone {
+		delete(r.containers, containerID)
+		delete(r.failures, containerID)
+		r.annotations.clear(annotationContainer, containerID)
+	} else {
+		record.status, record.op = to, nil
+	}
+	if to != from {
+		broadcast(r.subscriptions, registryTransition{containerID, record.spec, from, to})
+	}
 
 	log.Printf("registry: signal: %s", context)
 }
 
-func broadcast(subscriptions map[chan<- registryState]struct{}, registryState registryState) {
-	for c := range subscriptions {
-		c <- registryState
+// ignoreSignal logs and counts a signal which doesn't fit the state of the
+// container. Ignored signals change nothing, and aren't forwarded, as they may
+// belong to an earlier operation than the one being waited for.
+func ignoreSignal(containerID string, schedulingSignal schedulingSignal, from registryStatus) {
+	incSignalInvalid(1)
+	log.Printf("registry: signal: %s got %s while %s: invalid, ignoring the signal", containerID, schedulingSignal, from)
+}
+
+// failed implements the registryPrivate interface. The transformer calls it
+// for every desired container it finds failed on its agent. A failure is
+// recorded once per restart, so repeated observations of the same failure
+// don't count; the boolean is true if this call recorded a new failure.
+func (r *registry) failed(containerID string, now time.Time) (failureRecord, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	record := r.failures[containerID]
+	if record.awaitingRestart {
+		return record, false
+	}
+	if now.Sub(record.LastFailure) > r.crashLoop.window {
+		record.Failures = 0 // it ran fine for a while
+	}
+	record.Failures++
+	record.LastFailure = now
+	record.RetryAt = now.Add(r.crashLoop.backoff(record.Failures))
+	record.awaitingRestart = true
+	if !record.Parked && record.Failures >= r.crashLoop.threshold {
+		record.Parked = true
+		incContainersParked(1)
+		log.Printf("registry: %s failed %d times within %s; parking it until it's rescheduled", containerID, record.Failures, r.crashLoop.window)
+	}
+	r.failures[containerID] = record
+	return record, true
+}
+
+// restarted implements the registryPrivate interface. The next failure of the
+// container counts as a new one.
+func (r *registry) restarted(containerID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if record, ok := r.failures[containerID]; ok {
+		record.awaitingRestart = false
+		r.failures[containerID] = record
+	}
+}
+
+// silenced implements the registryPrivate interface. Silenced containers,
+// and containers of silenced jobs, aren't restarted.
+func (r *registry) silenced(containerID, jobName string, now time.Time) bool {
+	return r.annotations.silenced(containerID, jobName, now)
+}
+
+// failing returns the failure records of containers which failed since they
+// were scheduled.
+func (r *registry) failing() map[string]failureRecord {
+	r.RLock()
+	defer r.RUnlock()
+
+	failures := make(map[string]failureRecord, len(r.failures))
+	for containerID, record := range r.failures {
+		failures[containerID] = record
+	}
+	return failures
+}
+
+// registrySnapshot is the raw state of the registry, for debugging.
+type registrySnapshot struct {
+	Time        time.Time                                           `json:"time"`
+	Containers  map[registryStatus]map[string]registrySnapshotEntry `json:"containers"` // status: container ID: entry
+	Failures    map[string]failureRecord                            `json:"failures"`
+	Subscribers []int                                               `json:"subscribers"` // transitions queued for each subscriber
+}
+
+type registrySnapshotEntry struct {
+	Endpoint  string             `json:"agent"`
+	JobName   string             `json:"job_name"`
+	TaskName  string             `json:"task_name"`
+	Operation *operationSnapshot `json:"operation,omitempty"` // in flight
+}
+
+type operationSnapshot struct {
+	Kind           operationKind `json:"kind"`
+	Attempts       int           `json:"attempts"`
+	Started        time.Time     `json:"started"`
+	Age            string        `json:"age"`
+	SinceAttempt   string        `json:"since_attempt"`
+	AwaitingSignal bool          `json:"awaiting_signal"`  // someone waits for the outcome
+	Source         string        `json:"source,omitempty"` // for moves: the agent the container leaves
+}
+
+// snapshot returns the raw state of the registry: every container by status,
+// with the operation in flight, if any.
+func (r *registry) snapshot() registrySnapshot {
+	r.RLock()
+	defer r.RUnlock()
+
+	var (
+		now = time.Now()
+		s   = registrySnapshot{
+			Time:        now,
+			Containers:  map[registryStatus]map[string]registrySnapshotEntry{},
+			Failures:    make(map[string]failureRecord, len(r.failures)),
+			Subscribers: make([]int, 0, len(r.subscriptions)),
+		}
+	)
+	for _, status := range []registryStatus{registryPendingSchedule, registryScheduled, registryPendingUnschedule, registryPendingMove} {
+		s.Containers[status] = map[string]registrySnapshotEntry{}
+	}
+	for containerID, record := range r.containers {
+		entry := registrySnapshotEntry{
+			Endpoint: record.spec.endpoint,
+			JobName:  record.spec.JobName,
+			TaskName: record.spec.TaskName,
+		}
+		if op := record.op; op != nil {
+			entry.Operation = &operationSnapshot{
+				Kind:           op.kind,
+				Attempts:       op.attempts,
+				Started:        op.started,
+				Age:            now.Sub(op.started).String(),
+				SinceAttempt:   now.Sub(op.updated).String(),
+				AwaitingSignal: op.signal != nil,
+				Source:         op.source.endpoint,
+			}
+		}
+		s.Containers[record.status][containerID] = entry
+	}
+	for containerID, record := range r.failures {
+		s.Failures[containerID] = record
+	}
+	for _, sub := range r.subscriptions {
+		sub.Lock()
+		s.Subscribers = append(s.Subscribers, len(sub.pending))
+		sub.Unlock()
+	}
+	return s
+}
+
+// lookup returns the state of the container in the registry.
+func (r *registry) lookup(containerID string) (registryStatus, taskSpec) {
+	if record, ok := r.containers[containerID]; ok {
+		return record.status, record.spec
+	}
+	return registryNone, taskSpec{}
+}
+
+// broadcast queues the transitions for every subscriber. It never blocks.
+func broadcast(subscriptions map[chan<- []registryTransition]*subscription, transitions ...registryTransition) {
+	if len(transitions) == 0 {
+		return
+	}
+	for _, s := range subscriptions {
+		s.push(transitions)
 	}
 }
 
 // notify implements the registryPrivate interface. Components that are
 // responsible for effecting change in remote agents should subscribe to
-// registry state changes, so they can react to new desires.
-func (r *registry) notify(c chan<- registryState) {
+// registry state changes, so they can react to new desires. The first batch
+// is a snapshot: a transition from none for every container in the registry.
+func (r *registry) notify(c chan<- []registryTransition) {
 	r.Lock()
 	defer r.Unlock()
 	if _, ok := r.subscriptions[c]; ok {
 		return
 	}
-	r.subscriptions[c] = struct{}{}
+	snapshot := []registryTransition{}
+	for containerID, record := range r.containers {
+		snapshot = append(snapshot, registryTransition{containerID, record.spec, registryNone, record.status})
+	}
+	r.subscriptions[c] = newSubscription(c, snapshot)
 }
 
 // stop implements the registryPrivate interface.
-func (r *registry) stop(c chan<- registryState) {
+func (r *registry) stop(c chan<- []registryTransition) {
 	r.Lock()
 	defer r.Unlock()
-	if _, ok := r.subscriptions[c]; !ok {
+	s, ok := r.subscriptions[c]
+	if !ok {
 		return
 	}
+	s.stop()
 	delete(r.subscriptions, c)
 }
 
+// subscription queues transitions for one subscriber, so the registry never
+// waits for a slow subscriber. Whatever has queued up by the time the
+// subscriber is ready is delivered as one batch.
+type subscription struct {
+	sync.Mutex
+	pending []registryTransition
+	wake    chan struct{}
+	quit    chan struct{}
+}
+
+func newSubscription(c chan<- []registryTransition, snapshot []registryTransition) *subscription {
+	s := &subscription{
+		pending: snapshot,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	s.wake <- struct{}{}
+	go s.loop(c)
+	return s
+}
+
+func (s *subscription) push(transitions []registryTransition) {
+	s.Lock()
+	defer s.Unlock()
+	s.pending = append(s.pending, transitions...)
+	select {
+	case s.wake <- struct{}{}:
+	default: // already awake
+	}
+}
+
+func (s *subscription) loop(c chan<- []registryTransition) {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.quit:
+			return
+		}
+		s.Lock()
+		batch := s.pending
+		s.pending = nil
+		s.Unlock()
+		if batch == nil {
+			continue
+		}
+		select {
+		case c <- batch:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *subscription) stop() {
+	close(s.quit)
+}
+
 func cp(src map[string]taskSpec) map[string]taskSpec {
 	dst := map[string]taskSpec{}
 	for k, v := range src {
@@ -313,6 +705,8 @@ const (
 	signalContainerStartFailed
 	signalContainerStopFailed
 	signalContainerDeleteFailed
+	signalMoveSuccessful
+	signalMoveFailed
 )
 
 func (s schedulingSignal) String() string {
@@ -337,6 +731,10 @@ func (s schedulingSignal) String() string {
 		return "container-stop-failed"
 	case signalContainerDeleteFailed:
 		return "container-delete-failed"
+	case signalMoveSuccessful:
+		return "move-successful"
+	case signalMoveFailed:
+		return "move-failed"
 	default:
 		return "unknown-signal"
 	}
@@ -352,8 +750,82 @@ type taskSpec struct {
 	agent.ContainerConfig
 }
 
-type registryState struct {
-	pendingSchedule   map[string]taskSpec
-	scheduled         map[string]taskSpec
-	pendingUnschedule map[string]taskSpec
+// crashLoopPolicy decides when failed containers are restarted. Each failure
+// doubles the delay before the restart, from base up to max. A container
+// which fails threshold times, each within window of the last, is parked: it's
+// left failed until it's rescheduled or unscheduled.
+type crashLoopPolicy struct {
+	base, max time.Duration
+	threshold int
+	window    time.Duration
+}
+
+var defaultCrashLoopPolicy = crashLoopPolicy{
+	base:      time.Second,
+	max:       5 * time.Minute,
+	threshold: 5,
+	window:    10 * time.Minute,
+}
+
+// backoff returns the delay before restarting a container after its nth
+// failure.
+func (p crashLoopPolicy) backoff(n int) time.Duration {
+	d := p.base
+	for i := 1; i < n && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	return d
+}
+
+// failureRecord tracks the recent failures of a container.
+type failureRecord struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	RetryAt     time.Time `json:"retry_at"`
+	Parked      bool      `json:"parked"` // won't be restarted
+
+	awaitingRestart bool // the last failure has been counted
+}
+
+// registryStatus is the state of a container in the registry.
+type registryStatus string
+
+const (
+	registryNone              registryStatus = "(none)"
+	registryPendingSchedule   registryStatus = "pending-schedule"
+	registryScheduled         registryStatus = "scheduled"
+	registryPendingUnschedule registryStatus = "pending-unschedule"
+	registryPendingMove       registryStatus = "pending-move" // spec is the target
+)
+
+// registryTransition describes a container moving between registry states.
+// It's what subscribers receive, instead of the full state. A container
+// moving from pending-schedule to pending-schedule should be tried again. A
+// container moving to pending-move should be started on its new agent, and
+// then removed from its old one.
+type registryTransition struct {
+	containerID string
+	taskSpec    taskSpec
+	from, to    registryStatus
+}
+
+// desired reports whether the container should exist on its agent after the
+// transition.
+func (t registryTransition) desired() bool {
+	return t.to == registryPendingSchedule || t.to == registryScheduled || t.to == registryPendingMove
+}
+
+// move reports whether the transition asks to move the container to the
+// agent of its spec.
+func (t registryTransition) move() bool {
+	return t.from != registryPendingMove && t.to == registryPendingMove
+}
+
+// retry reports whether the transition asks to try scheduling the container
+// again, after its start failed.
+func (t registryTransition) retry() bool {
+	return t.from == registryPendingSchedule && t.to == registryPendingSchedule
 }
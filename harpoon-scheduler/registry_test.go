@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"reflect"
 	"testing"
+	"testing/quick"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
@@ -32,7 +35,7 @@ func TestRegistrySchedule(t *testing.T) {
 	if err := r.schedule(testContainerID, testTaskSpec, c); err != nil {
 		t.Errorf("while scheduling good container: %s", err)
 	}
-	if _, ok := r.pendingSchedule[testContainerID]; !ok {
+	if status, _ := r.lookup(testContainerID); status != registryPendingSchedule {
 		t.Fatalf("%s isn't pending-schedule", testContainerID)
 	}
 
@@ -51,10 +54,10 @@ func TestRegistrySchedule(t *testing.T) {
 	case <-time.After(1 * time.Millisecond):
 		t.Fatal("never got signal after a successful schedule")
 	}
-	if _, ok := r.pendingSchedule[testContainerID]; ok {
+	if status, _ := r.lookup(testContainerID); status == registryPendingSchedule {
 		t.Fatalf("%s is still pending-schedule", testContainerID)
 	}
-	if _, ok := r.scheduled[testContainerID]; !ok {
+	if status, _ := r.lookup(testContainerID); status != registryScheduled {
 		t.Fatalf("%s isn't scheduled", testContainerID)
 	}
 
@@ -105,7 +108,7 @@ func TestRegistryUnschedule(t *testing.T) {
 	if err := r.schedule(testContainerID, testTaskSpec, nil); err != nil {
 		t.Fatalf("while scheduling good container: %s", err)
 	}
-	if _, ok := r.pendingSchedule[testContainerID]; !ok {
+	if status, _ := r.lookup(testContainerID); status != registryPendingSchedule {
 		t.Fatalf("%s isn't pending-schedule", testContainerID)
 	}
 
@@ -118,7 +121,7 @@ func TestRegistryUnschedule(t *testing.T) {
 
 	// Pretend we're a transformer, and move it to scheduled.
 	r.signal(testContainerID, signalScheduleSuccessful)
-	if _, ok := r.scheduled[testContainerID]; !ok {
+	if status, _ := r.lookup(testContainerID); status != registryScheduled {
 		t.Fatalf("%s isn't scheduled", testContainerID)
 	}
 
@@ -127,7 +130,7 @@ func TestRegistryUnschedule(t *testing.T) {
 	if err := r.unschedule(testContainerID, testTaskSpec, c); err != nil {
 		t.Errorf("while unscheduling a scheduled container: %s", err)
 	}
-	if _, ok := r.pendingUnschedule[testContainerID]; !ok {
+	if status, _ := r.lookup(testContainerID); status != registryPendingUnschedule {
 		t.Fatalf("%s isn't pending-unschedule", testContainerID)
 	}
 
@@ -148,7 +151,409 @@ func TestRegistryUnschedule(t *testing.T) {
 	case <-time.After(1 * time.Millisecond):
 		t.Fatal("never got signal after a successful unschedule")
 	}
-	if _, ok := r.pendingUnschedule[testContainerID]; ok {
+	if status, _ := r.lookup(testContainerID); status == registryPendingUnschedule {
 		t.Fatalf("%s is still pending-unschedule", testContainerID)
 	}
 }
+
+func TestRegistryNotify(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	r := newRegistry(nil)
+	if err := r.schedule("a", taskSpec{endpoint: "http://nowhere"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan []registryTransition)
+	r.notify(c)
+	defer r.stop(c)
+
+	// The registry mustn't wait for us to receive.
+	for _, containerID := range []string{"b", "c"} {
+		if err := r.schedule(containerID, taskSpec{endpoint: "http://nowhere"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.signal("a", signalScheduleSuccessful)
+
+	want := []registryTransition{
+		{"a", taskSpec{endpoint: "http://nowhere"}, registryNone, registryPendingSchedule}, // snapshot
+		{"b", taskSpec{endpoint: "http://nowhere"}, registryNone, registryPendingSchedule},
+		{"c", taskSpec{endpoint: "http://nowhere"}, registryNone, registryPendingSchedule},
+		{"a", taskSpec{endpoint: "http://nowhere"}, registryPendingSchedule, registryScheduled},
+	}
+	have := []registryTransition{}
+	for len(have) < len(want) {
+		select {
+		case batch := <-c:
+			have = append(have, batch...)
+		case <-time.After(10 * time.Millisecond):
+			t.Fatalf("timeout; have %v", have)
+		}
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestRegistryCrashLoop(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	r := newRegistry(nil)
+	r.crashLoop = crashLoopPolicy{base: time.Second, max: 3 * time.Second, threshold: 4, window: time.Minute}
+	if err := r.schedule("a", taskSpec{endpoint: "http://nowhere"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	r.signal("a", signalScheduleSuccessful)
+
+	now := time.Now()
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		record, isNew := r.failed("a", now)
+		if !isNew {
+			t.Fatalf("failure %d: not recorded", i+1)
+		}
+		if got := record.RetryAt.Sub(now); expected != got {
+			t.Errorf("failure %d: expected backoff %s, got %s", i+1, expected, got)
+		}
+		if record.Parked {
+			t.Errorf("failure %d: parked too early", i+1)
+		}
+		if _, isNew := r.failed("a", now); isNew {
+			t.Errorf("failure %d: counted twice", i+1)
+		}
+		r.restarted("a")
+	}
+
+	if record, _ := r.failed("a", now); !record.Parked || record.Failures != 4 {
+		t.Errorf("expected container to be parked after 4 failures, got %+v", record)
+	}
+	r.restarted("a")
+
+	// A container which ran fine for a while starts over, but stays parked.
+	if record, _ := r.failed("a", now.Add(2*time.Minute)); record.Failures != 1 || !record.Parked {
+		t.Errorf("expected failure count to reset, got %+v", record)
+	}
+
+	if err := r.unschedule("a", taskSpec{endpoint: "http://nowhere"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	r.signal("a", signalUnscheduleSuccessful)
+	if failing := r.failing(); len(failing) != 0 {
+		t.Errorf("expected unscheduled container to be forgotten, got %v", failing)
+	}
+}
+
+func TestRegistryLateSignals(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		r    = newRegistry(nil)
+		spec = taskSpec{endpoint: "http://nowhere"}
+	)
+	if err := r.schedule("a", spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	r.signal("a", signalScheduleSuccessful)
+	r.signal("a", signalScheduleSuccessful) // duplicated
+	if status, _ := r.lookup("a"); status != registryScheduled {
+		t.Fatalf("expected %s, got %s", registryScheduled, status)
+	}
+
+	c := make(chan schedulingSignalWithContext, 1)
+	if err := r.unschedule("a", spec, c); err != nil {
+		t.Fatal(err)
+	}
+	r.signal("a", signalScheduleFailed)       // late, belongs to the schedule
+	r.signal("a", schedulingSignal(99))       // unknown
+	r.signal("b", signalUnscheduleSuccessful) // never scheduled
+	select {
+	case sig := <-c:
+		t.Fatalf("invalid signal was forwarded: %s", sig.schedulingSignal)
+	default:
+	}
+	if status, _ := r.lookup("a"); status != registryPendingUnschedule {
+		t.Fatalf("expected %s, got %s", registryPendingUnschedule, status)
+	}
+
+	r.signal("a", signalUnscheduleSuccessful)
+	if sig := <-c; sig.schedulingSignal != signalUnscheduleSuccessful {
+		t.Errorf("expected %s, got %s", signalUnscheduleSuccessful, sig.schedulingSignal)
+	}
+}
+
+func TestRegistryStartRetries(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		r           = newRegistry(nil)
+		spec        = taskSpec{endpoint: "http://nowhere"}
+		c           = make(chan schedulingSignalWithContext, 1)
+		transitions = make(chan []registryTransition)
+	)
+	r.notify(transitions)
+	defer r.stop(transitions)
+	if err := r.schedule("a", spec, c); err != nil {
+		t.Fatal(err)
+	}
+
+	expectTransition := func(expected registryTransition) {
+		for {
+			select {
+			case batch := <-transitions:
+				for _, got := range batch {
+					if reflect.DeepEqual(got, expected) {
+						return
+					}
+				}
+			case <-time.After(10 * time.Millisecond):
+				t.Fatalf("no transition %v", expected)
+			}
+		}
+	}
+	retry := registryTransition{"a", spec, registryPendingSchedule, registryPendingSchedule}
+
+	for attempt := 2; attempt <= startAttempts; attempt++ {
+		r.signal("a", signalContainerStartFailed)
+		expectTransition(retry)
+		if status, _ := r.lookup("a"); status != registryPendingSchedule {
+			t.Fatalf("attempt %d: expected %s, got %s", attempt, registryPendingSchedule, status)
+		}
+		if got := r.containers["a"].op.attempts; attempt != got {
+			t.Errorf("expected attempt %d, got %d", attempt, got)
+		}
+		select {
+		case sig := <-c:
+			t.Fatalf("attempt %d: got %s before giving up", attempt, sig.schedulingSignal)
+		default:
+		}
+	}
+
+	r.signal("a", signalContainerStartFailed)
+	expectTransition(registryTransition{"a", spec, registryPendingSchedule, registryNone})
+	if sig := <-c; sig.schedulingSignal != signalContainerStartFailed {
+		t.Errorf("expected %s, got %s", signalContainerStartFailed, sig.schedulingSignal)
+	}
+	if status, _ := r.lookup("a"); status != registryNone {
+		t.Errorf("expected %s after giving up, got %s", registryNone, status)
+	}
+}
+
+func TestRegistryMove(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		r      = newRegistry(nil)
+		source = taskSpec{endpoint: "http://here"}
+		target = taskSpec{endpoint: "http://there"}
+	)
+	if err := r.move("a", target.endpoint, nil); err == nil {
+		t.Errorf("while moving an unscheduled container: expected error, got none")
+	}
+	if err := r.schedule("a", source, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.move("a", target.endpoint, nil); err == nil {
+		t.Errorf("while moving a container that's pending-schedule: expected error, got none")
+	}
+	r.signal("a", signalScheduleSuccessful)
+	if err := r.move("a", source.endpoint, nil); err == nil {
+		t.Errorf("while moving a container to its own agent: expected error, got none")
+	}
+
+	transitions := make(chan []registryTransition, 1)
+	r.notify(transitions)
+	defer r.stop(transitions)
+	<-transitions // snapshot
+
+	for _, testCase := range []struct {
+		signal   schedulingSignal
+		expected taskSpec
+	}{
+		{signalMoveFailed, source},
+		{signalAgentUnavailable, source},
+		{signalMoveSuccessful, target},
+	} {
+		c := make(chan schedulingSignalWithContext, 1)
+		if err := r.move("a", target.endpoint, c); err != nil {
+			t.Fatalf("%s: %s", testCase.signal, err)
+		}
+		if err := r.unschedule("a", source, nil); err == nil {
+			t.Errorf("%s: while unscheduling a container that's pending-move: expected error, got none", testCase.signal)
+		}
+		r.signal("a", testCase.signal)
+		if sig := <-c; sig.schedulingSignal != testCase.signal {
+			t.Errorf("%s: got %s", testCase.signal, sig.schedulingSignal)
+		}
+
+		expected := []registryTransition{
+			{"a", target, registryScheduled, registryPendingMove},
+			{"a", testCase.expected, registryPendingMove, registryScheduled},
+		}
+		if got := <-transitions; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: expected transitions %v, got %v", testCase.signal, expected, got)
+		}
+		if status, spec := r.lookup("a"); status != registryScheduled || spec.endpoint != testCase.expected.endpoint {
+			t.Errorf("%s: expected %s on %s, got %s on %s", testCase.signal, registryScheduled, testCase.expected.endpoint, status, spec.endpoint)
+		}
+	}
+}
+
+// TestRegistrySignalSequences replays random sequences of operations and
+// signals, in any order, and checks the registry neither panics nor ends up
+// inconsistent.
+func TestRegistryPreviousPlacements(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		r    = newRegistry(nil)
+		spec = func(endpoint string) taskSpec { return taskSpec{endpoint: endpoint} }
+	)
+	for containerID, endpoint := range map[string]string{"lost": "http://a:1", "unscheduled": "http://b:2", "failed": "http://c:3"} {
+		if err := r.schedule(containerID, spec(endpoint), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.signal("lost", signalScheduleSuccessful)
+	r.signal("unscheduled", signalScheduleSuccessful)
+	r.signal("failed", signalContainerStartFailed)
+	r.signal("failed", signalContainerStartFailed)
+	r.signal("failed", signalContainerStartFailed)
+	if err := r.unschedule("unscheduled", spec("http://b:2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	r.signal("unscheduled", signalUnscheduleSuccessful)
+	r.signal("lost", signalContainerLost)
+
+	// Containers which never ran have no previous placement.
+	expected := map[string]string{"lost": "http://a:1", "unscheduled": "http://b:2"}
+	if got := r.previousPlacements(); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	r.previous["lost"] = previousPlacement{"http://a:1", time.Now().Add(-placementMemory - time.Minute)}
+	if expected, got := (map[string]string{"unscheduled": "http://b:2"}), r.previousPlacements(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v after the lost container was forgotten, got %v", expected, got)
+	}
+}
+
+func TestRegistrySignalSequences(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		containerIDs = []string{"a", "b", "c"}
+		spec         = taskSpec{endpoint: "http://nowhere"}
+		signals      = []schedulingSignal{}
+	)
+	for s := signalScheduleSuccessful; s <= signalMoveFailed; s++ {
+		signals = append(signals, s)
+	}
+	signals = append(signals, schedulingSignal(99)) // unknown
+
+	replay := func(ops []uint16) bool {
+		r := newRegistry(nil)
+		for _, op := range ops {
+			var (
+				containerID = containerIDs[int(op)%len(containerIDs)]
+				n           = int(op) / len(containerIDs) % (len(signals) + 3)
+				c           = make(chan schedulingSignalWithContext, 1)
+			)
+			switch n {
+			case 0:
+				r.schedule(containerID, spec, c)
+			case 1:
+				r.unschedule(containerID, spec, c)
+			case 2:
+				r.move(containerID, "http://elsewhere", c)
+			default:
+				r.signal(containerID, signals[n-3])
+			}
+			if err := registryConsistent(r); err != nil {
+				t.Logf("after %v: %s", ops, err)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(replay, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// registryConsistent checks that operations are in flight exactly for
+// pending containers, and match their state.
+func registryConsistent(r *registry) error {
+	r.RLock()
+	defer r.RUnlock()
+
+	for containerID, record := range r.containers {
+		switch record.status {
+		case registryPendingSchedule:
+			if record.op == nil || record.op.kind != opSchedule {
+				return fmt.Errorf("%s is %s, but has operation %+v", containerID, record.status, record.op)
+			}
+			if record.op.attempts < 1 || record.op.attempts > startAttempts {
+				return fmt.Errorf("%s made %d attempts", containerID, record.op.attempts)
+			}
+		case registryPendingUnschedule:
+			if record.op == nil || record.op.kind != opUnschedule {
+				return fmt.Errorf("%s is %s, but has operation %+v", containerID, record.status, record.op)
+			}
+		case registryPendingMove:
+			if record.op == nil || record.op.kind != opMove {
+				return fmt.Errorf("%s is %s, but has operation %+v", containerID, record.status, record.op)
+			}
+			if record.op.source.endpoint == record.spec.endpoint {
+				return fmt.Errorf("%s is moving to %s, where it already is", containerID, record.spec.endpoint)
+			}
+		case registryScheduled:
+			if record.op != nil {
+				return fmt.Errorf("%s is %s, but has operation %+v", containerID, record.status, record.op)
+			}
+		default:
+			return fmt.Errorf("%s has invalid state %s", containerID, record.status)
+		}
+	}
+	return nil
+}
+
+func BenchmarkRegistrySignal1kContainers1Subscriber(b *testing.B) {
+	benchmarkRegistrySignal(b, 1000, 1)
+}
+
+func BenchmarkRegistrySignal1kContainers10Subscribers(b *testing.B) {
+	benchmarkRegistrySignal(b, 1000, 10)
+}
+
+func BenchmarkRegistrySignal10kContainers10Subscribers(b *testing.B) {
+	benchmarkRegistrySignal(b, 10000, 10)
+}
+
+// benchmarkRegistrySignal measures one schedule-and-signal round trip in a
+// registry already holding n containers, with subscribers draining their
+// transitions concurrently.
+func benchmarkRegistrySignal(b *testing.B, n, subscribers int) {
+	log.SetOutput(ioutil.Discard)
+
+	r := newRegistry(nil)
+	for i := 0; i < n; i++ {
+		r.containers[fmt.Sprintf("existing-%d", i)] = &containerRecord{status: registryScheduled, spec: taskSpec{endpoint: "http://nowhere"}}
+	}
+	for i := 0; i < subscribers; i++ {
+		c := make(chan []registryTransition)
+		r.notify(c)
+		defer r.stop(c)
+		go func() {
+			for _ = range c {
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		containerID := fmt.Sprintf("benchmark-%d", i)
+		if err := r.schedule(containerID, taskSpec{endpoint: "http://nowhere"}, nil); err != nil {
+			b.Fatal(err)
+		}
+		r.signal(containerID, signalScheduleSuccessful)
+	}
+}
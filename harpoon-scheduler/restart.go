@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+// Tasks may be restarted in place, e.g. to reload their config or mitigate a
+// leak, without migrating to a new artifact. The restarter restarts the
+// running instances of a task through their agents, a batch at a time. Before
+// each batch, it waits until enough instances run that min healthy remain
+// while the batch restarts; after each batch, it waits until the batch runs
+// again, with an incremented restart counter. If either takes longer than the
+// instances' startup grace period allows, the restart stops. Only one restart
+// of a task runs at a time.
+
+const restartPollInterval = time.Second
+
+var (
+	// errTaskNotFound is returned by restartTask if no instance of the task
+	// runs.
+	errTaskNotFound = errors.New("task not found")
+
+	// errRestartRunning is returned by restartTask if the task is already
+	// being restarted.
+	errRestartRunning = errors.New("task is already being restarted")
+)
+
+// restartPolicy says how many instances of a task are restarted at once, and
+// how many must keep running meanwhile.
+type restartPolicy struct {
+	batchSize  int
+	minHealthy int // -1 for all instances but a batch
+}
+
+type restarter struct {
+	agentStater agentStater
+	restart     func(endpoint, containerID string) error // restarts the container, and returns once the agent accepted
+	poll        time.Duration
+
+	sync.Mutex
+	running map[string]struct{} // job/task
+}
+
+func newRestarter(agentStater agentStater, restart func(endpoint, containerID string) error) *restarter {
+	return &restarter{
+		agentStater: agentStater,
+		restart:     restart,
+		poll:        restartPollInterval,
+		running:     map[string]struct{}{},
+	}
+}
+
+// restartAgentContainer restarts the container through the agent's API.
+func restartAgentContainer(endpoint, containerID string) error {
+	proxy, err := newRemoteAgent(endpoint)
+	if err != nil {
+		return err
+	}
+	return proxy.Restart(containerID)
+}
+
+// restartTask restarts the running instances of the task per the policy, and
+// returns how many it restarted.
+func (r *restarter) restartTask(jobName, taskName string, policy restartPolicy) (int, error) {
+	key := jobName + "/" + taskName
+	r.Lock()
+	if _, ok := r.running[key]; ok {
+		r.Unlock()
+		return 0, errRestartRunning
+	}
+	r.running[key] = struct{}{}
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.running, key)
+		r.Unlock()
+	}()
+
+	instances := taskInstances(jobName, taskName, r.agentStater.agentStates())
+	if len(instances) == 0 {
+		return 0, errTaskNotFound
+	}
+	var (
+		running = []taskInstance{}
+		grace   = time.Duration(2*instances[0].config.Grace.Startup+instances[0].config.Grace.Shutdown) * time.Second
+	)
+	for _, instance := range instances {
+		if instance.status == agent.ContainerStatusRunning {
+			running = append(running, instance)
+		}
+	}
+	if policy.batchSize < 1 {
+		return 0, fmt.Errorf("batch size %d must be positive", policy.batchSize)
+	}
+	if policy.minHealthy < 0 {
+		policy.minHealthy = max(len(running)-policy.batchSize, 0)
+	}
+	if policy.minHealthy+min(policy.batchSize, len(running)) > len(running) {
+		return 0, fmt.Errorf("%d running instance(s) can't keep %d healthy while restarting %d at once", len(running), policy.minHealthy, policy.batchSize)
+	}
+
+	restarted := 0
+	for i := 0; i < len(running); i += policy.batchSize {
+		batch := running[i:min(i+policy.batchSize, len(running))]
+
+		if err := r.await(grace, func(states map[string]agentState) bool {
+			return healthyInstances(jobName, taskName, states) >= policy.minHealthy+len(batch)
+		}); err != nil {
+			return restarted, fmt.Errorf("waiting for %d healthy instance(s) before restarting %s: %s", policy.minHealthy+len(batch), batch[0].containerID, err)
+		}
+
+		for _, instance := range batch {
+			log.Printf("restarter: restart %s on %s", instance.containerID, instance.endpoint)
+			if err := r.restart(instance.endpoint, instance.containerID); err != nil {
+				return restarted, fmt.Errorf("restart %s on %s: %s", instance.containerID, instance.endpoint, err)
+			}
+		}
+
+		if err := r.await(grace, func(states map[string]agentState) bool {
+			for _, instance := range batch {
+				containerInstance, ok := states[instance.endpoint].containerInstances[instance.containerID]
+				if !ok || containerInstance.Status != agent.ContainerStatusRunning || restarts(containerInstance) <= instance.restarts {
+					return false
+				}
+			}
+			return true
+		}); err != nil {
+			return restarted, fmt.Errorf("waiting for %s to run again: %s", batch[0].containerID, err)
+		}
+		restarted += len(batch)
+	}
+	return restarted, nil
+}
+
+// await polls the agent states until ready returns true, or the timeout
+// expires.
+func (r *restarter) await(timeout time.Duration, ready func(map[string]agentState) bool) error {
+	deadline := time.Now().Add(timeout)
+	for !ready(r.agentStater.agentStates()) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %s", timeout)
+		}
+		time.Sleep(r.poll)
+	}
+	return nil
+}
+
+type taskInstance struct {
+	containerID string
+	endpoint    string
+	status      agent.ContainerStatus
+	restarts    uint64
+	config      agent.ContainerConfig
+}
+
+// taskInstances returns the instances of the task, ordered by container ID.
+func taskInstances(jobName, taskName string, agentStates map[string]agentState) []taskInstance {
+	instances := []taskInstance{}
+	for endpoint, agentState := range agentStates {
+		for containerID, containerInstance := range agentState.containerInstances {
+			if containerInstance.Config.JobName != jobName || containerInstance.Config.TaskName != taskName {
+				continue
+			}
+			instances = append(instances, taskInstance{
+				containerID: containerID,
+				endpoint:    endpoint,
+				status:      containerInstance.Status,
+				restarts:    restarts(containerInstance),
+				config:      containerInstance.Config,
+			})
+		}
+	}
+	sort.Sort(taskInstancesByID(instances))
+	return instances
+}
+
+// healthyInstances counts the running instances of the task on agents which
+// aren't dirty.
+func healthyInstances(jobName, taskName string, agentStates map[string]agentState) int {
+	n := 0
+	for _, instance := range taskInstances(jobName, taskName, agentStates) {
+		if instance.status == agent.ContainerStatusRunning && !agentStates[instance.endpoint].dirty {
+			n++
+		}
+	}
+	return n
+}
+
+func restarts(containerInstance agent.ContainerInstance) uint64 {
+	if containerInstance.Metrics == nil {
+		return 0
+	}
+	return containerInstance.Metrics.Restarts
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type taskInstancesByID []taskInstance
+
+func (a taskInstancesByID) Len() int           { return len(a) }
+func (a taskInstancesByID) Less(i, j int) bool { return a[i].containerID < a[j].containerID }
+func (a taskInstancesByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// handleTaskRestart restarts the running instances of a task in place, per
+// the batch_size (default 1) and min_healthy (default all but a batch) query
+// parameters.
+func handleTaskRestart(r *restarter, namespaces *namespaces) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		var (
+			jobName  = ps.ByName("name")
+			taskName = ps.ByName("task")
+			policy   = restartPolicy{batchSize: 1, minHealthy: -1}
+		)
+		for param, dst := range map[string]*int{"batch_size": &policy.batchSize, "min_healthy": &policy.minHealthy} {
+			if s := req.URL.Query().Get(param); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < 0 {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", param, s))
+					return
+				}
+				*dst = n
+			}
+		}
+		namespace := findNamespace(r.agentStater, func(containerInstance agent.ContainerInstance) bool {
+			return containerInstance.Config.JobName == jobName
+		})
+		if !namespaces.authorized(w, req, namespace) {
+			return
+		}
+		n, err := r.restartTask(jobName, taskName, policy)
+		switch err {
+		case nil:
+			writeSuccess(w, fmt.Sprintf("%s/%s: %d instance(s) successfully restarted", jobName, taskName, n))
+		case errTaskNotFound:
+			writeError(w, http.StatusNotFound, err)
+		case errRestartRunning:
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%s (after restarting %d instance(s))", err, n))
+		}
+	}
+}
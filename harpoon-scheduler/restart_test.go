@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+type fakeAgentStater struct {
+	sync.Mutex
+	states map[string]agentState
+}
+
+func (f *fakeAgentStater) agentStates() map[string]agentState {
+	f.Lock()
+	defer f.Unlock()
+	return f.states
+}
+
+func TestRestartTask(t *testing.T) {
+	var (
+		config = agent.ContainerConfig{JobName: "a", TaskName: "web", Grace: agent.Grace{Startup: 1, Shutdown: 1}}
+		states = map[string]agentState{
+			"http://x:1": {containerInstances: map[string]agent.ContainerInstance{}},
+			"http://y:1": {containerInstances: map[string]agent.ContainerInstance{}},
+		}
+		stater = &fakeAgentStater{states: states}
+		order  = []string{}
+	)
+	for id, endpoint := range map[string]string{"1": "http://x:1", "2": "http://x:1", "3": "http://y:1"} {
+		states[endpoint].containerInstances[id] = agent.ContainerInstance{ID: id, Status: agent.ContainerStatusRunning, Config: config}
+	}
+	states["http://y:1"].containerInstances["other"] = agent.ContainerInstance{ID: "other", Status: agent.ContainerStatusRunning, Config: agent.ContainerConfig{JobName: "a", TaskName: "db"}}
+
+	r := newRestarter(stater, func(endpoint, containerID string) error {
+		stater.Lock()
+		defer stater.Unlock()
+		order = append(order, containerID)
+		containerInstance := states[endpoint].containerInstances[containerID]
+		containerInstance.Metrics = &agent.ContainerMetrics{Restarts: restarts(containerInstance) + 1}
+		states[endpoint].containerInstances[containerID] = containerInstance
+		return nil
+	})
+	r.poll = 0
+
+	n, err := r.restartTask("a", "web", restartPolicy{batchSize: 2, minHealthy: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, n; want != have {
+		t.Errorf("want %d restarted, have %d", want, have)
+	}
+	if want, have := "[1 2 3]", fmt.Sprint(order); want != have {
+		t.Errorf("want order %s, have %s", want, have)
+	}
+
+	if _, err := r.restartTask("a", "web", restartPolicy{batchSize: 1, minHealthy: 3}); err == nil {
+		t.Errorf("want error for a policy keeping all instances healthy, have none")
+	}
+	if _, err := r.restartTask("a", "api", restartPolicy{batchSize: 1, minHealthy: -1}); err != errTaskNotFound {
+		t.Errorf("want %v, have %v", errTaskNotFound, err)
+	}
+}
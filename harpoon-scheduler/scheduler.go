@@ -1,15 +1,18 @@
 // The scheduler implements the public scheduler API, allowing users to
-// schedule and unschedule jobs, and migrate scheduled jobs to a new job
-// config.
+// schedule and unschedule jobs, migrate scheduled jobs to a new job config,
+// and move containers between agents.
 package main
 
 import (
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
@@ -29,21 +32,59 @@ type basicScheduler struct {
 	scheduleRequests   chan scheduleRequest
 	migrateRequests    chan migrateRequest
 	unscheduleRequests chan unscheduleRequest
+	moveRequests       chan moveRequest
+	preemptedRequests  chan chan map[string]taskSpec
+	migrationRequests  chan chan migrationRecord
+	recoverRequests    chan recoverRequest
+	rollbackRequests   chan rollbackRequest
+	historyRequests    chan historyRequest
+	currentRequests    chan chan []deployment
+	rescheduleRequests chan struct{}
+	pings              chan chan struct{}
 	quit               chan chan struct{}
+
+	limits *concurrencyLimits // read outside of the loop, which waits for operations to finish
 }
 
+// newBasicScheduler returns a running scheduler. If preempt is true, jobs
+// which don't fit may preempt containers of lower-priority jobs. Jobs must
+// fit the quotas of their namespaces, which may be nil. Migrations
+// are recorded in the journal; if it holds an interrupted migration, it must
+// be resumed or rolled back before the next migration. Canaries of jobs with a
+// canary judge are judged via judge, which may be nil. Successful deployments
+// are recorded in the history, so jobs can be rolled back. Job owners are told
+// about the outcome of their requests via the notifier, which may be nil. Jobs
+// operate on their containers within the concurrency limits, which may be nil
+// to operate on one container at a time.
 func newBasicScheduler(
 	registryPublic registryPublic,
 	agentStater agentStater,
 	lost chan map[string]taskSpec,
+	preempt bool,
+	namespaces *namespaces,
+	journal *migrationJournal,
+	judge *canaryJudge,
+	history *deployHistory,
+	notifier *notifier,
+	limits *concurrencyLimits,
 ) *basicScheduler {
 	s := &basicScheduler{
 		scheduleRequests:   make(chan scheduleRequest),
 		migrateRequests:    make(chan migrateRequest),
 		unscheduleRequests: make(chan unscheduleRequest),
+		moveRequests:       make(chan moveRequest),
+		preemptedRequests:  make(chan chan map[string]taskSpec),
+		migrationRequests:  make(chan chan migrationRecord),
+		recoverRequests:    make(chan recoverRequest),
+		rollbackRequests:   make(chan rollbackRequest),
+		historyRequests:    make(chan historyRequest),
+		currentRequests:    make(chan chan []deployment),
+		rescheduleRequests: make(chan struct{}),
+		pings:              make(chan chan struct{}),
 		quit:               make(chan chan struct{}),
+		limits:             limits,
 	}
-	go s.loop(registryPublic, agentStater, lost)
+	go s.loop(registryPublic, agentStater, lost, preempt, namespaces, journal, judge, history, notifier, limits)
 	return s
 }
 
@@ -56,6 +97,19 @@ func (s *basicScheduler) Schedule(job scheduler.Job) error {
 	return <-req.resp
 }
 
+// scheduleAt schedules the job with its containers on the agents given by
+// placements, a map of container ID to agent endpoint, rather than placing
+// them anew. A nil placements places them as Schedule does.
+func (s *basicScheduler) scheduleAt(job scheduler.Job, placements map[string]string) error {
+	req := scheduleRequest{
+		job:        job,
+		placements: placements,
+		resp:       make(chan error),
+	}
+	s.scheduleRequests <- req
+	return <-req.resp
+}
+
 func (s *basicScheduler) Migrate(existingJob scheduler.Job, newJobConfig configstore.JobConfig) error {
 	req := migrateRequest{
 		existingJob:  existingJob,
@@ -75,6 +129,88 @@ func (s *basicScheduler) Unschedule(job scheduler.Job) error {
 	return <-req.resp
 }
 
+// move moves a scheduled container to the agent at endpoint, and returns once
+// it runs there.
+func (s *basicScheduler) move(containerID, endpoint string) error {
+	req := moveRequest{
+		containerID: containerID,
+		endpoint:    endpoint,
+		resp:        make(chan error),
+	}
+	s.moveRequests <- req
+	return <-req.resp
+}
+
+// preempted returns the containers which were preempted to make room for
+// higher-priority jobs, so they may be rescheduled later.
+func (s *basicScheduler) preempted() map[string]taskSpec {
+	c := make(chan map[string]taskSpec)
+	s.preemptedRequests <- c
+	return <-c
+}
+
+// migration returns the record of the most recent migration.
+func (s *basicScheduler) migration() migrationRecord {
+	c := make(chan migrationRecord)
+	s.migrationRequests <- c
+	return <-c
+}
+
+// recoverMigration resumes or, if rollback is true, rolls back a migration
+// which was interrupted by a restart of the scheduler.
+func (s *basicScheduler) recoverMigration(rollback bool) error {
+	req := recoverRequest{
+		rollback: rollback,
+		resp:     make(chan error),
+	}
+	s.recoverRequests <- req
+	return <-req.resp
+}
+
+// rollback migrates the job back to the deployment with the ref, or to the
+// previous deployment if ref is empty, and returns the ref rolled back to.
+func (s *basicScheduler) rollback(jobName, ref string) (string, error) {
+	req := rollbackRequest{
+		jobName: jobName,
+		ref:     ref,
+		resp:    make(chan rollbackResponse),
+	}
+	s.rollbackRequests <- req
+	resp := <-req.resp
+	return resp.ref, resp.err
+}
+
+// deployments returns the recorded deployments of the job, most recent last.
+func (s *basicScheduler) deployments(jobName string) []deployment {
+	req := historyRequest{
+		jobName: jobName,
+		resp:    make(chan []deployment),
+	}
+	s.historyRequests <- req
+	return <-req.resp
+}
+
+// currentDeployments returns the current deployment of each job with a
+// recorded deployment.
+func (s *basicScheduler) currentDeployments() []deployment {
+	c := make(chan []deployment)
+	s.currentRequests <- c
+	return <-c
+}
+
+// progress returns the progress of the most recent schedule or unschedule of
+// the job, which may still be running.
+func (s *basicScheduler) progress(jobName string) (operationProgress, bool) {
+	return s.limits.get(jobName)
+}
+
+// ping returns once the scheduler loop has processed a message.
+func (s *basicScheduler) ping() {
+	c := make(chan struct{})
+	s.pings <- c
+	<-c
+}
+
 func (s *basicScheduler) stop() {
 	q := make(chan struct{})
 	s.quit <- q
@@ -85,46 +221,243 @@ func (s *basicScheduler) loop(
 	registryPublic registryPublic,
 	agentStater agentStater,
 	lost chan map[string]taskSpec,
+	preempt bool,
+	namespaces *namespaces,
+	journal *migrationJournal,
+	judge *canaryJudge,
+	history *deployHistory,
+	notifier *notifier,
+	limits *concurrencyLimits,
 ) {
-	algoFactory := randomNonDirty
+	var (
+		domains     = map[string]string{} // endpoint: failure domain, of the agents seen so far
+		algoFactory = func(agentStates map[string]agentState) schedulingAlgorithm {
+			return stickyRandomNonDirty(agentStates, registryPublic.previousPlacements(), domains)
+		}
+		preempted      = map[string]taskSpec{} // waiting for room to be rescheduled
+		retryPreempted = time.NewTicker(preemptedRetryInterval)
+		lostContainers = map[string]taskSpec{} // waiting to be rescheduled
+		rescheduling   = false
+	)
+	defer retryPreempted.Stop()
+
+	migration, err := journal.load()
+	if err != nil {
+		log.Printf("scheduler: can't read migration journal: %s", err)
+	}
+	if migration.State == migrationRunning || migration.State == migrationRollingBack {
+		migration.Interrupted = true
+		log.Printf("scheduler: migration of job %q was interrupted while %s, after %d/%d step(s); resume or roll back", migration.JobName, migration.State, migration.Done, len(migration.Steps))
+	}
 
 	for {
 		select {
 		case req := <-s.scheduleRequests:
 			incJobScheduleRequests(1)
-			taskSpecMap, err := placeJob(req.job, algoFactory(agentStater.agentStates()))
+			if err := namespaces.admit(req.job, agentStater.agentStates()); err != nil {
+				notifier.scheduled(req.job, err)
+				req.resp <- err
+				continue
+			}
+			var (
+				taskSpecMap map[string]taskSpec
+				err         error
+			)
+			if req.placements != nil {
+				taskSpecMap, err = placeJobAt(req.job, req.placements, agentStater.agentStates())
+			} else {
+				taskSpecMap, err = placeJob(req.job, algoFactory(agentStater.agentStates()))
+				if isInsufficientCapacity(err) && preempt {
+					var victims map[string]taskSpec
+					taskSpecMap, victims, err = placeJobPreempting(req.job, agentStater.agentStates(), algoFactory)
+					if err == nil {
+						err = preemptContainers(req.job, victims, registryPublic, preempted)
+					}
+				}
+			}
 			if err != nil {
+				notifier.scheduled(req.job, err)
 				req.resp <- err
 				continue
 			}
 			log.Printf("scheduler: schedule %s: %d taskSpec(s)", req.job.JobName, len(taskSpecMap))
-			req.resp <- schedule(taskSpecMap, registryPublic)
+			err = scheduleInStages(req.job, taskSpecMap, registryPublic, limits)
+			if err == nil {
+				history.record(req.job)
+			}
+			notifier.scheduled(req.job, err)
+			req.resp <- err
 
 		case req := <-s.migrateRequests:
 			incJobMigrateRequests(1)
 			log.Printf("scheduler: migrate %s", req.existingJob.JobName)
-			artifactURL, err := getArtifactURL(req.existingJob)
-			if err != nil {
+			if migration.pending() {
+				req.resp <- fmt.Errorf("interrupted migration of job %q must be resumed or rolled back first", migration.JobName)
+				continue
+			}
+			artifactURL := req.newJobConfig.ArtifactURL
+			if artifactURL == "" {
+				if artifactURL, err = getArtifactURL(req.existingJob); err != nil {
+					req.resp <- fmt.Errorf("can't migrate job %q: %s", req.existingJob.JobName, err)
+					continue
+				}
+			}
+			var (
+				newJob = makeJob(req.newJobConfig, artifactURL)
+				record migrationRecord
+			)
+			if newJob.Namespace != req.existingJob.Namespace {
+				req.resp <- fmt.Errorf("can't migrate job %q from namespace %q to %q", req.existingJob.JobName, req.existingJob.Namespace, newJob.Namespace)
+				continue
+			}
+			if err := namespaces.admit(newJob, agentStater.agentStates()); err != nil {
 				req.resp <- fmt.Errorf("can't migrate job %q: %s", req.existingJob.JobName, err)
 				continue
 			}
-			req.resp <- migrate(
+			record, err = migrate(
 				req.existingJob,
-				makeJob(req.newJobConfig, artifactURL),
+				newJob,
+				agentStater,
+				algoFactory,
+				registryPublic,
+				journal,
+				judge,
+			)
+			if record.JobName != "" {
+				migration = record
+			}
+			if err == nil {
+				if current, _ := history.current(req.existingJob.JobName); current.Ref != refHash(req.existingJob) {
+					history.record(req.existingJob) // deployed before the history was kept
+				}
+				history.record(newJob)
+			}
+			notifier.migrated(req.existingJob.JobName, &newJob.Contact, err)
+			req.resp <- err
+
+		case req := <-s.rollbackRequests:
+			incJobRollbackRequests(1)
+			log.Printf("scheduler: roll back %s to %q", req.jobName, req.ref)
+			if migration.pending() {
+				req.resp <- rollbackResponse{err: fmt.Errorf("interrupted migration of job %q must be resumed or rolled back first", migration.JobName)}
+				continue
+			}
+			current, err := history.current(req.jobName)
+			if err != nil {
+				req.resp <- rollbackResponse{err: err}
+				continue
+			}
+			target, err := history.target(req.jobName, req.ref)
+			if err != nil {
+				req.resp <- rollbackResponse{err: err}
+				continue
+			}
+			if err := namespaces.admit(target.Job, agentStater.agentStates()); err != nil {
+				req.resp <- rollbackResponse{err: err}
+				continue
+			}
+			// Rolling back returns to a config which ran before, so canaries
+			// aren't judged.
+			record, err := migrate(
+				current.Job,
+				target.Job,
 				agentStater,
-				algoFactory(agentStater.agentStates()),
+				algoFactory,
 				registryPublic,
+				journal,
+				nil,
 			)
+			if record.JobName != "" {
+				migration = record
+			}
+			if err == nil {
+				history.record(target.Job)
+			}
+			notifier.migrated(req.jobName, &target.Job.Contact, err)
+			req.resp <- rollbackResponse{ref: target.Ref, err: err}
+
+		case req := <-s.historyRequests:
+			req.resp <- history.deployments(req.jobName)
+
+		case c := <-s.currentRequests:
+			c <- history.currents()
+
+		case req := <-s.recoverRequests:
+			err := recoverMigration(&migration, req.rollback, agentStater, registryPublic, journal, judge)
+			if migration.JobName != "" {
+				notifier.migrated(migration.JobName, nil, err)
+			}
+			req.resp <- err
+
+		case c := <-s.migrationRequests:
+			c <- migration
+
+		case c := <-s.pings:
+			close(c)
 
 		case req := <-s.unscheduleRequests:
 			incJobUnscheduleRequests(1)
-			taskSpecMap := findJob(req.job, agentStater)
+			taskSpecMap, err := findJob(req.job, agentStater)
+			if err != nil {
+				log.Printf("scheduler: unschedule %q: %s", req.job.JobName, err)
+				req.resp <- err
+				continue
+			}
 			log.Printf("scheduler: unschedule %q: %d taskSpec(s)", req.job.JobName, len(taskSpecMap))
-			req.resp <- unschedule(taskSpecMap, registryPublic)
+			err = unscheduleInStages(req.job, taskSpecMap, registryPublic, limits)
+			if err == nil {
+				history.forget(req.job.JobName)
+				notifier.unscheduled(req.job.JobName)
+			}
+			req.resp <- err
+
+		case req := <-s.moveRequests:
+			incContainerMoveRequests(1)
+			log.Printf("scheduler: move %s to %s", req.containerID, req.endpoint)
+			req.resp <- moveContainer(req.containerID, req.endpoint, agentStater, registryPublic)
 
 		case m := <-lost:
 			incContainersLost(len(m))
-			log.Printf("scheduler: LOST: %v (TODO: something with this)", m)
+			incJobContainersLost(m)
+			notifier.lost(m)
+			log.Printf("scheduler: LOST: %v", m)
+			for containerID, taskSpec := range m {
+				lostContainers[containerID] = taskSpec
+			}
+			if !rescheduling {
+				// The transformer signals the containers of a lost agent one
+				// at a time, and can't answer for the agent states until
+				// it's done, so we wait for it outside of the loop.
+				rescheduling = true
+				go func() {
+					agentStater.agentStates()
+					s.rescheduleRequests <- struct{}{}
+				}()
+			}
+
+		case <-s.rescheduleRequests:
+			rescheduling = false
+			rescheduled, _ := reschedule("lost", lostContainers, history, algoFactory(agentStater.agentStates()), registryPublic)
+			incContainersPlaced(len(rescheduled))
+			incJobContainersPlaced(rescheduled)
+			lostContainers = map[string]taskSpec{}
+
+		case <-retryPreempted.C:
+			if len(preempted) <= 0 {
+				continue
+			}
+			rescheduled, dropped := reschedule("preempted", preempted, history, algoFactory(agentStater.agentStates()), registryPublic)
+			incContainersPlaced(len(rescheduled))
+			incJobContainersPlaced(rescheduled)
+			for containerID := range rescheduled {
+				delete(preempted, containerID)
+			}
+			for _, containerID := range dropped {
+				delete(preempted, containerID)
+			}
+
+		case c := <-s.preemptedRequests:
+			c <- cp(preempted)
 
 		case q := <-s.quit:
 			close(q)
@@ -139,22 +472,93 @@ func (s *basicScheduler) loop(
 func placeJob(job scheduler.Job, placeContainer schedulingAlgorithm) (map[string]taskSpec, error) {
 	m := map[string]taskSpec{} // containerID: taskSpec
 	for _, task := range job.Tasks {
-		for instance := 0; instance < task.Scale; instance++ {
-			endpoint, err := placeContainer(task.ContainerConfig)
+		for instance := 0; instance < task.Instances(); instance++ {
+			containerID := makeContainerID(job, task, instance)
+			endpoint, err := placeContainer(containerID, instanceTask(task, instance))
 			if err != nil {
-				return map[string]taskSpec{}, fmt.Errorf("couldn't place instance %d/%d of %q: %s", instance+1, task.Scale, task.TaskName, err)
+				return map[string]taskSpec{}, placementError{task.TaskName, instance, task.Instances(), err}
 			}
-			m[makeContainerID(job, task, instance)] = taskSpec{
+			m[containerID] = taskSpec{
 				endpoint:        endpoint,
 				ContainerConfig: task.ContainerConfig,
 			}
 		}
 	}
 	incContainersPlaced(len(m))
+	incJobContainersPlaced(m)
 	return m, nil
 }
 
-func findJob(job scheduler.Job, agentStater agentStater) map[string]taskSpec {
+// reschedule places the lost or preempted containers of jobs which are still
+// deployed anew, and schedules them, without waiting for them to start. The
+// algorithm is expected to place them back where they ran, if it can. It
+// returns the rescheduled containers, and the containers of jobs which were
+// unscheduled or migrated since, which are dropped.
+func reschedule(what string, containers map[string]taskSpec, history *deployHistory, placeContainer schedulingAlgorithm, registryPublic registryPublic) (rescheduled map[string]taskSpec, dropped []string) {
+	containerIDs := make([]string, 0, len(containers))
+	for containerID := range containers {
+		containerIDs = append(containerIDs, containerID)
+	}
+	sort.Strings(containerIDs)
+
+	rescheduled = map[string]taskSpec{}
+	for _, containerID := range containerIDs {
+		d, err := history.current(containers[containerID].JobName)
+		if err != nil {
+			log.Printf("scheduler: not rescheduling %s %s: %s", what, containerID, err)
+			dropped = append(dropped, containerID)
+			continue
+		}
+		task, instance, ok := findInstance(d.Job, containerID)
+		if !ok {
+			log.Printf("scheduler: not rescheduling %s %s: not in the current deployment of %s", what, containerID, d.Job.JobName)
+			dropped = append(dropped, containerID)
+			continue
+		}
+		endpoint, err := placeContainer(containerID, instanceTask(task, instance))
+		if err != nil {
+			log.Printf("scheduler: can't reschedule %s %s: %s", what, containerID, err)
+			continue
+		}
+		spec := taskSpec{endpoint: endpoint, ContainerConfig: task.ContainerConfig}
+		if err := registryPublic.schedule(containerID, spec, nil); err != nil {
+			log.Printf("scheduler: can't reschedule %s %s: %s", what, containerID, err)
+			continue
+		}
+		log.Printf("scheduler: rescheduled %s %s on %s, was on %s", what, containerID, endpoint, containers[containerID].endpoint)
+		rescheduled[containerID] = spec
+	}
+	return rescheduled, dropped
+}
+
+// findInstance returns the task and instance of the job with the container
+// ID.
+func findInstance(job scheduler.Job, containerID string) (scheduler.Task, int, bool) {
+	for _, task := range job.Tasks {
+		for instance := 0; instance < task.Instances(); instance++ {
+			if makeContainerID(job, task, instance) == containerID {
+				return task, instance, true
+			}
+		}
+	}
+	return scheduler.Task{}, 0, false
+}
+
+// placementError is returned by placeJob. Err is the error of the scheduling
+// algorithm.
+type placementError struct {
+	taskName        string
+	instance, scale int
+	err             error
+}
+
+func (e placementError) Error() string {
+	return fmt.Sprintf("couldn't place instance %d/%d of %q: %s", e.instance+1, e.scale, e.taskName, e.err)
+}
+
+// findJob returns the containers of the job. It fails if a container has the
+// job and task name, but not the config of the task.
+func findJob(job scheduler.Job, agentStater agentStater) (map[string]taskSpec, error) {
 	m := map[string]taskSpec{}
 	for endpoint, agentState := range agentStater.agentStates() {
 		for _, containerInstance := range agentState.containerInstances {
@@ -167,11 +571,8 @@ func findJob(job scheduler.Job, agentStater agentStater) map[string]taskSpec {
 				continue
 			}
 
-			// Just a safety check, as I'm not totally confident in the
-			// implementation yet. Remove this check eventually; definitely
-			// before shipping! :)
-			if !reflect.DeepEqual(job.Tasks[containerInstance.Config.TaskName].ContainerConfig, containerInstance.Config) {
-				panic("invalid state in findJob")
+			if !matchesTask(job.Tasks[containerInstance.Config.TaskName], containerInstance.Config) {
+				return nil, fmt.Errorf("container %s on %s doesn't have the config of task %q of job %q", containerInstance.ID, endpoint, containerInstance.Config.TaskName, job.JobName)
 			}
 
 			m[containerInstance.ID] = taskSpec{
@@ -180,106 +581,142 @@ func findJob(job scheduler.Job, agentStater agentStater) map[string]taskSpec {
 			}
 		}
 	}
-	return m
+	return m, nil
 }
 
-// Unschedule oldJob and schedule newJob, one task instance at a time.
+// jobContainers collects the container instances matching the filter, which
+// usually names a job, across all agents, sorted by task name and container
+// ID. Offset and limit are ignored. Containers which failed recently carry
+// their failure record.
+func jobContainers(filter agent.ContainerFilter, agentStates map[string]agentState, failures map[string]failureRecord) []jobContainer {
+	containers := []jobContainer{}
+	for endpoint, agentState := range agentStates {
+		for _, containerInstance := range agentState.containerInstances {
+			if !filter.Match(containerInstance) {
+				continue
+			}
+			container := jobContainer{
+				ContainerID: containerInstance.ID,
+				TaskName:    containerInstance.Config.TaskName,
+				Endpoint:    endpoint,
+				Cluster:     agentCluster(agentState),
+				Status:      containerInstance.Status,
+				Health:      containerHealth(containerInstance, agentState.dirty, failures),
+				Metrics:     containerInstance.Metrics,
+				Error:       containerInstance.Error,
+				LastExit:    containerInstance.LastExit,
+				Restarts:    containerInstance.Restarts,
+				Labels:      containerInstance.Config.Labels,
+				LogURL:      fmt.Sprintf("%s/api/v0/containers/%s/log", endpoint, containerInstance.ID),
+			}
+			if record, ok := failures[containerInstance.ID]; ok {
+				container.Failures = &record
+			}
+			containers = append(containers, container)
+		}
+	}
+	sort.Sort(jobContainersByTask(containers))
+	return containers
+}
+
+// health summarizes the status of a container instance. Reports from dirty
+// agents can't be trusted.
+func health(status agent.ContainerStatus, dirty bool) string {
+	if dirty {
+		return "unknown"
+	}
+	switch status {
+	case agent.ContainerStatusRunning:
+		return "healthy"
+	case agent.ContainerStatusFailed, agent.ContainerStatusFinished:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+type jobContainer struct {
+	ContainerID string                  `json:"container_id"`
+	TaskName    string                  `json:"task_name"`
+	Endpoint    string                  `json:"agent"`
+	Cluster     string                  `json:"cluster,omitempty"`
+	Status      agent.ContainerStatus   `json:"status"`
+	Health      string                  `json:"health"`
+	Metrics     *agent.ContainerMetrics `json:"metrics,omitempty"`
+	Error       string                  `json:"error,omitempty"`
+	LastExit    *agent.ContainerExit    `json:"last_exit,omitempty"`
+	Restarts    uint64                  `json:"restarts,omitempty"`
+	Labels      agent.Labels            `json:"labels,omitempty"`
+	Failures    *failureRecord          `json:"failures,omitempty"`
+	Annotation  *annotation             `json:"annotation,omitempty"`
+	LogURL      string                  `json:"log_url"` // add ?history=N, or stream with Accept: text/event-stream
+}
+
+type jobContainersByTask []jobContainer
+
+func (a jobContainersByTask) Len() int      { return len(a) }
+func (a jobContainersByTask) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a jobContainersByTask) Less(i, j int) bool {
+	if a[i].TaskName != a[j].TaskName {
+		return a[i].TaskName < a[j].TaskName
+	}
+	return a[i].ContainerID < a[j].ContainerID
+}
+
+// Unschedule oldJob and schedule newJob, one task instance at a time. The
+// returned record is empty if the migration didn't start.
 func migrate(
 	oldJob, newJob scheduler.Job,
 	agentStater agentStater,
-	algo schedulingAlgorithm,
+	algoFactory schedulingAlgorithmFactory,
 	registryPublic registryPublic,
-) error {
-	undo := []func(){}
-	defer func() {
-		for i := len(undo) - 1; i >= 0; i-- { // LIFO
-			undo[i]()
-		}
-	}()
-
+	journal *migrationJournal,
+	judge *canaryJudge,
+) (migrationRecord, error) {
 	// Get old/new taskSpecs grouped by name, so we can migrate in a safe way.
-	newTaskSpecMap, err := placeJob(newJob, algo)
+	// Placing the new job simulates the migration, so we fail before
+	// touching anything if the cluster can't hold it.
+	agentStates := agentStater.agentStates()
+	oldTaskSpecs, err := findJob(oldJob, agentStater)
 	if err != nil {
-		return fmt.Errorf("when placing tasks for new job: %s", err)
+		return migrationRecord{}, err
 	}
-	var (
-		oldTaskGroups = groupByTask(findJob(oldJob, agentStater))
-		newTaskGroups = groupByTask(newTaskSpecMap)
-	)
-
-	// Per-task: schedule 1, unschedule 1.
-	for taskName, newContainerIDTaskSpecs := range newTaskGroups {
-		oldContainerIDTaskSpecs := oldTaskGroups[taskName]
-		log.Printf("scheduler: migrate: job %s task %s: old scale %d, new scale %d", newJob.JobName, taskName, len(oldContainerIDTaskSpecs), len(newContainerIDTaskSpecs))
-		for i := 0; i < max(len(newContainerIDTaskSpecs), len(oldContainerIDTaskSpecs)); i++ {
-			// Schedule 1 new.
-			if i < len(newContainerIDTaskSpecs) {
-				var (
-					id   = newContainerIDTaskSpecs[i].containerID
-					spec = newContainerIDTaskSpecs[i].taskSpec
-					m    = map[string]taskSpec{id: spec}
-				)
-				if err := schedule(m, registryPublic); err != nil {
-					return fmt.Errorf("while scheduling instance of task %q: %s", taskName, err)
-				}
-				undo = append(undo, func() { unschedule(m, registryPublic) })
-				log.Printf("scheduler: migrate: %q: schedule-1 OK", taskName)
-			}
-			// Unschedule 1 old.
-			if i < len(oldContainerIDTaskSpecs) {
-				var (
-					id   = oldContainerIDTaskSpecs[i].containerID
-					spec = oldContainerIDTaskSpecs[i].taskSpec
-					m    = map[string]taskSpec{id: spec}
-				)
-				if err := unschedule(m, registryPublic); err != nil {
-					return fmt.Errorf("while unscheduling instance of task %q: %s", taskName, err)
-				}
-				undo = append(undo, func() { schedule(m, registryPublic) })
-				log.Printf("scheduler: migrate: %q: unschedule-1 OK", taskName)
-			}
-		}
-		delete(oldTaskGroups, taskName) // everything is unscheduled
-		log.Printf("scheduler: migrate: job %q task %q: migrated", newJob.JobName, taskName)
+	oldTaskGroups := groupByTask(oldTaskSpecs)
+	newTaskGroups, err := planMigration(newJob, oldTaskGroups, agentStates, algoFactory)
+	if err != nil {
+		return migrationRecord{}, fmt.Errorf("when placing tasks for new job: %s", err)
 	}
-
-	// If the old job had tasks that aren't in the new job, they'll still be
-	// lingering in the oldTaskGroups map. Unschedule them.
 	for taskName, containerIDTaskSpecs := range oldTaskGroups {
-		log.Printf("scheduler: migrate: job %q task %q: old scale %d, new scale 0", newJob.JobName, taskName, len(containerIDTaskSpecs))
-		for i := 0; i < len(containerIDTaskSpecs); i++ {
-			var (
-				id   = containerIDTaskSpecs[i].containerID
-				spec = containerIDTaskSpecs[i].taskSpec
-				m    = map[string]taskSpec{id: spec}
-			)
-			if err := unschedule(m, registryPublic); err != nil {
-				return fmt.Errorf("while unscheduling instance of task %q: %s", taskName, err)
-			}
-			undo = append(undo, func() { schedule(m, registryPublic) })
-			log.Printf("scheduler: migrate: %q unschedule-1 OK", taskName)
-		}
-		log.Printf("scheduler: migrate: job %q task %q: unscheduled", oldJob.JobName, taskName)
+		log.Printf("scheduler: migrate: job %s task %s: old scale %d, new scale %d", newJob.JobName, taskName, len(containerIDTaskSpecs), len(newTaskGroups[taskName]))
 	}
 
-	// Getting this far without error means the migration was successful.
-	undo = []func(){} // clear undo stack, so we can return cleanly
-	log.Printf("scheduler: migrate: job %q: migrated", newJob.JobName)
-	return nil
+	// Per-task: schedule 1, unschedule 1. If the old job had tasks that aren't
+	// in the new job, unschedule them afterwards. Should anything fail, the
+	// completed steps are undone.
+	record := migrationRecord{
+		JobName:     newJob.JobName,
+		Steps:       migrationSteps(orderedTaskNames(newJob), newTaskGroups, oldTaskGroups),
+		CanaryJudge: newJob.CanaryJudge,
+	}
+	return record, runMigration(&record, journal, judge, registryPublic)
 }
 
-func schedule(taskSpecMap map[string]taskSpec, registryPublic registryPublic) error {
+// schedule schedules the containers as part of the operation, which may be
+// nil to schedule them one at a time.
+func schedule(taskSpecMap map[string]taskSpec, registryPublic registryPublic, op *jobOperation) error {
 	return xsched(
 		"schedule",
 		signalScheduleSuccessful,
 		registryPublic.schedule,
 		registryPublic.unschedule,
 		taskSpecMap,
-		func(g agent.Grace) time.Duration { return time.Duration(g.Startup) * time.Second },
+		func(g agent.Grace) time.Duration { return startAttempts * time.Duration(g.Startup) * time.Second },
+		op,
 	)
 }
 
-func unschedule(taskSpecMap map[string]taskSpec, registryPublic registryPublic) error {
+// unschedule unschedules the containers as part of the operation, which may
+// be nil to unschedule them one at a time.
+func unschedule(taskSpecMap map[string]taskSpec, registryPublic registryPublic, op *jobOperation) error {
 	return xsched(
 		"unschedule",
 		signalUnscheduleSuccessful,
@@ -287,7 +724,122 @@ func unschedule(taskSpecMap map[string]taskSpec, registryPublic registryPublic)
 		registryPublic.schedule,
 		taskSpecMap,
 		func(g agent.Grace) time.Duration { return time.Duration(g.Shutdown) * time.Second },
+		op,
+	)
+}
+
+// scheduleInStages schedules the containers of the job one stage of its task
+// dependencies at a time, so tasks start only once the tasks they depend on
+// are running, within the concurrency limits. Should a stage fail, the
+// earlier stages are unscheduled again.
+func scheduleInStages(job scheduler.Job, taskSpecMap map[string]taskSpec, registryPublic registryPublic, limits *concurrencyLimits) (err error) {
+	op := limits.start(job, "schedule", len(taskSpecMap))
+	defer func() { op.finish(err) }()
+	stages := byStage(job, taskSpecMap)
+	for i, stage := range stages {
+		if err := schedule(stage, registryPublic, op); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if err := unschedule(stages[j], registryPublic, nil); err != nil {
+					log.Printf("scheduler: undoing schedule of %s: %s", job.JobName, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unscheduleInStages unschedules the containers of the job in reverse order of
+// its task dependencies, so tasks stop before the tasks they depend on, within
+// the concurrency limits.
+func unscheduleInStages(job scheduler.Job, taskSpecMap map[string]taskSpec, registryPublic registryPublic, limits *concurrencyLimits) (err error) {
+	op := limits.start(job, "unschedule", len(taskSpecMap))
+	defer func() { op.finish(err) }()
+	stages := byStage(job, taskSpecMap)
+	for i := len(stages) - 1; i >= 0; i-- {
+		if err := unschedule(stages[i], registryPublic, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// byStage splits the containers of the job by the dependency stage of their
+// task. Jobs without dependencies have a single stage.
+func byStage(job scheduler.Job, taskSpecMap map[string]taskSpec) []map[string]taskSpec {
+	stages, err := job.Depends.Stages(sortedTaskNames(job))
+	if err != nil || len(stages) <= 1 {
+		return []map[string]taskSpec{taskSpecMap} // jobs are validated before they get here
+	}
+	var (
+		stageOf = map[string]int{} // task name: stage
+		m       = make([]map[string]taskSpec, len(stages))
 	)
+	for i, stage := range stages {
+		for _, taskName := range stage {
+			stageOf[taskName] = i
+		}
+		m[i] = map[string]taskSpec{}
+	}
+	for containerID, taskSpec := range taskSpecMap {
+		m[stageOf[taskSpec.TaskName]][containerID] = taskSpec
+	}
+	return m
+}
+
+// errContainerNotFound is returned by moveContainer if no agent runs the
+// container.
+var errContainerNotFound = errors.New("container not found")
+
+// moveContainer moves a container to the agent at endpoint, which must be
+// trustable, schedulable, and have room for it, and waits for the move to
+// complete. The container runs on its old agent until it runs on the new one.
+func moveContainer(containerID, endpoint string, agentStater agentStater, registryPublic registryPublic) error {
+	var (
+		agentStates = agentStater.agentStates()
+		config      agent.ContainerConfig
+		cluster     string
+		found       bool
+	)
+	for _, agentState := range agentStates {
+		if containerInstance, ok := agentState.containerInstances[containerID]; ok {
+			config, cluster, found = containerInstance.Config, agentCluster(agentState), true
+			break
+		}
+	}
+	if !found {
+		return errContainerNotFound
+	}
+	target, ok := agentStates[endpoint]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown agent %s", endpoint)
+	case target.dirty || target.unschedulable:
+		return fmt.Errorf("agent %s doesn't take containers", endpoint)
+	case agentCluster(target) != cluster:
+		return fmt.Errorf("agent %s is in cluster %q, not %q", endpoint, agentCluster(target), cluster)
+	}
+	if volume, ok := missingVolume(config, target.hostResources.Volumes); ok {
+		return fmt.Errorf("agent %s doesn't provide volume %s", endpoint, volume)
+	}
+	if !hasRoom(scheduler.Task{ContainerConfig: config}, target, nil) {
+		return fmt.Errorf("agent %s has no room for %s", endpoint, containerID)
+	}
+
+	c := make(chan schedulingSignalWithContext, 1) // the registry mustn't block if we time out
+	if err := registryPublic.move(containerID, endpoint, c); err != nil {
+		return err
+	}
+	select {
+	case sig := <-c:
+		log.Printf("scheduler: move %s to %s: %s (%s)", containerID, endpoint, sig.schedulingSignal, sig.context)
+		if sig.schedulingSignal != signalMoveSuccessful {
+			return fmt.Errorf("move %s to %s: %s", containerID, endpoint, sig.schedulingSignal)
+		}
+		return nil
+	case <-time.After(2 * time.Duration(config.Grace.Startup+config.Grace.Shutdown) * time.Second):
+		return fmt.Errorf("move %s to %s: timeout", containerID, endpoint)
+	}
 }
 
 func xsched(
@@ -296,45 +848,112 @@ func xsched(
 	apply, revert func(string, taskSpec, chan schedulingSignalWithContext) error,
 	taskSpecMap map[string]taskSpec,
 	choose func(agent.Grace) time.Duration,
+	op *jobOperation,
 ) error {
-	undo := []func(){}
+	var (
+		undo  = []func(){}
+		errs  = []error{}
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, op.concurrency())
+	)
 	defer func() {
 		for i := len(undo) - 1; i >= 0; i-- { // LIFO
 			undo[i]()
 		}
 	}()
 
-	// Could make this concurrent.
-	for containerID, taskSpec := range taskSpecMap {
-		c := make(chan schedulingSignalWithContext)
-		if err := apply(containerID, taskSpec, c); err != nil {
-			log.Printf("scheduler: %s %s on %s: %s", what, containerID, taskSpec.endpoint, err)
-			return err
+	// Up to the job's concurrency of containers are operated on at once.
+	// Once one fails, no more are started.
+	for containerID, spec := range taskSpecMap {
+		slots <- struct{}{}
+		mu.Lock()
+		failed := len(errs) > 0
+		mu.Unlock()
+		if failed {
+			break
 		}
-		select {
-		case sig := <-c:
-			log.Printf("scheduler: %s %s on %s: %s (%s)", what, containerID, taskSpec.endpoint, sig.schedulingSignal, sig.context)
-			if sig.schedulingSignal != acceptable {
-				return fmt.Errorf("%s %s on %s: unacceptable signal, giving up", what, containerID, taskSpec.endpoint)
+		wg.Add(1)
+		go func(containerID string, taskSpec taskSpec) {
+			defer func() { <-slots; wg.Done() }()
+			op.acquire()
+			err := xschedOne(what, acceptable, apply, containerID, taskSpec, choose)
+			op.release(err)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
 			}
 			undo = append(undo, func() { revert(containerID, taskSpec, nil) })
-		case <-time.After(2 * choose(taskSpec.Grace)):
-			return fmt.Errorf("%s %s on %s: timeout", what, containerID, taskSpec.endpoint)
-		}
+		}(containerID, spec)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
 	}
 
 	undo = []func(){} // clear undo stack, so we can return cleanly
 	return nil
 }
 
+// xschedOne applies the operation to one container, and waits for the
+// acceptable signal.
+func xschedOne(
+	what string,
+	acceptable schedulingSignal,
+	apply func(string, taskSpec, chan schedulingSignalWithContext) error,
+	containerID string,
+	taskSpec taskSpec,
+	choose func(agent.Grace) time.Duration,
+) error {
+	c := make(chan schedulingSignalWithContext)
+	if err := apply(containerID, taskSpec, c); err != nil {
+		log.Printf("scheduler: %s %s on %s: %s", what, containerID, taskSpec.endpoint, err)
+		return err
+	}
+	select {
+	case sig := <-c:
+		log.Printf("scheduler: %s %s on %s: %s (%s)", what, containerID, taskSpec.endpoint, sig.schedulingSignal, sig.context)
+		if sig.schedulingSignal != acceptable {
+			return agentError{what, containerID, taskSpec.endpoint, "unacceptable signal, giving up"}
+		}
+		return nil
+	case <-time.After(2 * choose(taskSpec.Grace)):
+		return agentError{what, containerID, taskSpec.endpoint, "timeout"}
+	}
+}
+
+// makeJob makes the job described by the config. Jobs in a namespace are
+// named, and labeled, after it. If artifactURL is empty, the config's artifact
+// URL is used.
 func makeJob(c configstore.JobConfig, artifactURL string) scheduler.Job {
-	tasks := map[string]scheduler.Task{}
+	if artifactURL == "" {
+		artifactURL = c.ArtifactURL
+	}
+	var (
+		jobName = configstore.NamespacedJobName(c.Namespace, c.JobName)
+		tasks   = map[string]scheduler.Task{}
+	)
 	for _, taskConfig := range c.Tasks {
-		tasks[taskConfig.TaskName] = makeTask(taskConfig, c.JobName, artifactURL)
+		task := makeTask(taskConfig, jobName, artifactURL)
+		task.Priority = c.Priority
+		task.Clusters = c.Clusters
+		task.Labels = c.Labels.Merge(taskConfig.Labels)
+		if c.Namespace != "" {
+			task.Labels = task.Labels.Merge(agent.Labels{configstore.NamespaceLabel: c.Namespace})
+		}
+		tasks[taskConfig.TaskName] = task
 	}
 	return scheduler.Job{
-		JobName: c.JobName,
-		Tasks:   tasks,
+		JobName:     jobName,
+		Namespace:   c.Namespace,
+		Tasks:       tasks,
+		Depends:     c.Depends,
+		Requires:    c.Requires,
+		Contact:     c.Contact,
+		CanaryJudge: c.CanaryJudge,
+		Concurrency: c.Concurrency,
 	}
 }
 
@@ -343,6 +962,8 @@ func makeTask(c configstore.TaskConfig, jobName, artifactURL string) scheduler.T
 		TaskName:        c.TaskName,
 		Scale:           c.Scale,
 		HealthChecks:    c.HealthChecks,
+		MaxPerAgent:     c.MaxPerAgent,
+		MinDomains:      c.MinDomains,
 		ContainerConfig: c.MakeContainerConfig(jobName, artifactURL),
 	}
 }
@@ -378,14 +999,48 @@ func getArtifactURL(job scheduler.Job) (string, error) {
 }
 
 // Split 1 taskSpecMap into N taskSpecMaps by task name.
+// groupByTask groups taskSpecs by task name. Within a task, they're sorted by
+// container ID.
 func groupByTask(taskSpecMap map[string]taskSpec) map[string][]containerIDTaskSpec {
 	m := map[string][]containerIDTaskSpec{}
 	for containerID, taskSpec := range taskSpecMap {
 		m[taskSpec.ContainerConfig.TaskName] = append(m[taskSpec.ContainerConfig.TaskName], containerIDTaskSpec{containerID, taskSpec})
 	}
+	for _, containerIDTaskSpecs := range m {
+		sort.Sort(byContainerID(containerIDTaskSpecs))
+	}
 	return m
 }
 
+type byContainerID []containerIDTaskSpec
+
+func (a byContainerID) Len() int           { return len(a) }
+func (a byContainerID) Less(i, j int) bool { return a[i].containerID < a[j].containerID }
+func (a byContainerID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func sortedTaskNames(job scheduler.Job) []string {
+	taskNames := make([]string, 0, len(job.Tasks))
+	for taskName := range job.Tasks {
+		taskNames = append(taskNames, taskName)
+	}
+	sort.Strings(taskNames)
+	return taskNames
+}
+
+// orderedTaskNames returns the task names of the job in the order of their
+// dependencies, and by name among independent tasks.
+func orderedTaskNames(job scheduler.Job) []string {
+	stages, err := job.Depends.Stages(sortedTaskNames(job))
+	if err != nil {
+		return sortedTaskNames(job)
+	}
+	taskNames := []string{}
+	for _, stage := range stages {
+		taskNames = append(taskNames, stage...)
+	}
+	return taskNames
+}
+
 // Simple max integer.
 func max(candidates ...int) int {
 	i := int64(math.MinInt64)
@@ -398,8 +1053,9 @@ func max(candidates ...int) int {
 }
 
 type scheduleRequest struct {
-	job  scheduler.Job
-	resp chan error
+	job        scheduler.Job
+	placements map[string]string // container ID: endpoint; nil to place the job anew
+	resp       chan error
 }
 
 type migrateRequest struct {
@@ -408,6 +1064,33 @@ type migrateRequest struct {
 	resp         chan error
 }
 
+type recoverRequest struct {
+	rollback bool
+	resp     chan error
+}
+
+type rollbackRequest struct {
+	jobName string
+	ref     string
+	resp    chan rollbackResponse
+}
+
+type rollbackResponse struct {
+	ref string
+	err error
+}
+
+type historyRequest struct {
+	jobName string
+	resp    chan []deployment
+}
+
+type moveRequest struct {
+	containerID string
+	endpoint    string
+	resp        chan error
+}
+
 type unscheduleRequest struct {
 	job  scheduler.Job
 	resp chan error
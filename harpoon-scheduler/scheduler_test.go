@@ -1,15 +1,22 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
 	"github.com/soundcloud/harpoon/harpoon-configstore/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+	"github.com/soundcloud/harpoon/lib/errors"
 )
 
 func TestScheduler(t *testing.T) {
@@ -24,10 +31,15 @@ func TestScheduler(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	history, err := newDeployHistory("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	var (
 		registry    = newRegistry(nil)
-		transformer = newTransformer(staticAgentDiscovery{s.URL}, registry, 2*time.Millisecond)
-		scheduler   = newBasicScheduler(registry, transformer, nil)
+		transformer = newTransformer(staticAgentDiscovery{s.URL}, registry, 2*time.Millisecond, 1, nil)
+		scheduler   = newBasicScheduler(registry, transformer, nil, false, nil, &migrationJournal{}, nil, history, nil, nil)
 	)
 	defer transformer.stop()
 	defer scheduler.stop()
@@ -90,11 +102,36 @@ func TestScheduler(t *testing.T) {
 		t.Fatalf("when verifying the migrate: %s", err)
 	}
 
+	log.Printf("☞ roll back")
+	if deployments := scheduler.deployments("alpha"); len(deployments) != 2 {
+		t.Fatalf("expected 2 recorded deployments, got %d", len(deployments))
+	}
+	ref, err := scheduler.rollback("alpha", "")
+	if err != nil {
+		t.Fatalf("during rollback: %s", err)
+	}
+	if expected, got := refHash(firstJob), ref; expected != got {
+		t.Fatalf("expected rollback to %s, got %s", expected, got)
+	}
+
+	log.Printf("☞ verify")
+	if err := verifyContainerInstances(verify, configstore.JobConfig{Tasks: []configstore.TaskConfig{
+		{TaskName: "beta", Scale: 1},
+		{TaskName: "delta", Scale: 2},
+	}}); err != nil {
+		t.Fatalf("when verifying the rollback: %s", err)
+	}
+	if _, err := scheduler.rollback("alpha", "no-such-ref"); err == nil {
+		t.Fatal("expected error when rolling back to an unknown ref, got none")
+	}
+
 	log.Printf("☞ unschedule")
-	secondJob := makeJob(secondJobConfig, dummyArtifactURL)
-	if err := scheduler.Unschedule(secondJob); err != nil {
+	if err := scheduler.Unschedule(firstJob); err != nil {
 		t.Fatalf("during unschedule: %s", err)
 	}
+	if _, err := scheduler.rollback("alpha", ""); err != errJobNotDeployed {
+		t.Fatalf("expected %q after unschedule, got %v", errJobNotDeployed, err)
+	}
 
 	log.Printf("☞ verify")
 	if err := verifyContainerInstances(verify, configstore.JobConfig{}); err != nil {
@@ -104,6 +141,71 @@ func TestScheduler(t *testing.T) {
 	log.Printf("☞ finished")
 }
 
+func TestSchedulerUnscheduleAllocatedPortRange(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := httptest.NewServer(newMockAgent())
+	defer s.Close()
+
+	verify, err := newRemoteAgent(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := newDeployHistory("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		registry    = newRegistry(nil)
+		transformer = newTransformer(staticAgentDiscovery{s.URL}, registry, 2*time.Millisecond, 1, nil)
+		scheduler   = newBasicScheduler(registry, transformer, nil, false, nil, &migrationJournal{}, nil, history, nil, nil)
+		jobConfig   = configstore.JobConfig{
+			JobName: "alpha",
+			Tasks: []configstore.TaskConfig{{
+				TaskName:   "rtp",
+				Scale:      2,
+				PortRanges: map[string]agent.PortRange{"media": {Protocol: agent.PortProtocolUDP, Count: 10}},
+				Command:    agent.Command{WorkingDir: "/srv/rtp", Exec: []string{"./rtp"}},
+				Resources:  agent.Resources{Memory: 32, CPUs: 0.1},
+				Grace:      agent.Grace{Startup: 1, Shutdown: 1},
+			}},
+		}
+	)
+	defer transformer.stop()
+	defer scheduler.stop()
+
+	if err := jobConfig.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	job := makeJob(jobConfig, "http://filestore.berlin/rtp.img")
+	if err := scheduler.Schedule(job); err != nil {
+		t.Fatalf("during schedule: %s", err)
+	}
+	if err := verifyContainerInstances(verify, jobConfig); err != nil {
+		t.Fatalf("when verifying the schedule: %s", err)
+	}
+
+	containerInstances, err := verify.Containers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, containerInstance := range containerInstances {
+		if containerInstance.Config.PortRanges["media"].Start == 0 {
+			t.Fatalf("%s: expected an allocated port range, got none", containerInstance.ID)
+		}
+	}
+
+	if err := scheduler.Unschedule(job); err != nil {
+		t.Fatalf("during unschedule: %s", err)
+	}
+	if err := verifyContainerInstances(verify, configstore.JobConfig{}); err != nil {
+		t.Fatalf("when verifying the unschedule: %s", err)
+	}
+}
+
 func verifyContainerInstances(agent agent.Agent, jobConfig configstore.JobConfig) error {
 	containerInstances, err := agent.Containers()
 	if err != nil {
@@ -130,3 +232,249 @@ func verifyContainerInstances(agent agent.Agent, jobConfig configstore.JobConfig
 	}
 	return nil
 }
+
+func TestJobContainers(t *testing.T) {
+	instance := func(id, jobName, taskName string, status agent.ContainerStatus) agent.ContainerInstance {
+		return agent.ContainerInstance{
+			ID:     id,
+			Status: status,
+			Config: agent.ContainerConfig{JobName: jobName, TaskName: taskName, Labels: agent.Labels{"task": taskName}},
+		}
+	}
+
+	failed := instance("c1", "alpha", "cron", agent.ContainerStatusFailed)
+	failed.LastExit = &agent.ContainerExit{ExitStatus: 137, OOMed: true}
+	failed.Restarts = 3
+
+	agentStates := map[string]agentState{
+		"http://a:3333": {
+			containerInstances: map[string]agent.ContainerInstance{
+				"w2": instance("w2", "alpha", "web", agent.ContainerStatusRunning),
+				"x1": instance("x1", "beta", "web", agent.ContainerStatusRunning),
+			},
+		},
+		"http://b:3333": {
+			dirty: true,
+			containerInstances: map[string]agent.ContainerInstance{
+				"w1": instance("w1", "alpha", "web", agent.ContainerStatusRunning),
+				"c1": failed,
+			},
+		},
+	}
+
+	containers := jobContainers(agent.ContainerFilter{JobName: "alpha"}, agentStates, nil)
+	if expected, got := 3, len(containers); expected != got {
+		t.Fatalf("expected %d containers, got %d", expected, got)
+	}
+
+	for i, expected := range []jobContainer{
+		{ContainerID: "c1", TaskName: "cron", Endpoint: "http://b:3333", Labels: agent.Labels{"task": "cron"}, Status: agent.ContainerStatusFailed, Health: "unknown", LastExit: failed.LastExit, Restarts: 3, LogURL: "http://b:3333/api/v0/containers/c1/log"},
+		{ContainerID: "w1", TaskName: "web", Endpoint: "http://b:3333", Labels: agent.Labels{"task": "web"}, Status: agent.ContainerStatusRunning, Health: "unknown", LogURL: "http://b:3333/api/v0/containers/w1/log"},
+		{ContainerID: "w2", TaskName: "web", Endpoint: "http://a:3333", Labels: agent.Labels{"task": "web"}, Status: agent.ContainerStatusRunning, Health: "healthy", LogURL: "http://a:3333/api/v0/containers/w2/log"},
+	} {
+		if got := containers[i]; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%d: expected %+v, got %+v", i, expected, got)
+		}
+	}
+
+	if expected, got := 0, len(jobContainers(agent.ContainerFilter{JobName: "gamma"}, agentStates, nil)); expected != got {
+		t.Errorf("expected %d containers, got %d", expected, got)
+	}
+
+	if expected, got := 1, len(jobContainers(agent.ContainerFilter{JobName: "alpha", Labels: agent.Labels{"task": "cron"}}, agentStates, nil)); expected != got {
+		t.Errorf("expected %d containers, got %d", expected, got)
+	}
+}
+
+func TestFindJob(t *testing.T) {
+	var (
+		config = agent.ContainerConfig{
+			SchemaVersion: agent.ConfigSchemaVersion,
+			JobName:       "alpha",
+			TaskName:      "web",
+			ArtifactURL:   "http://a/alpha.tar.gz",
+			Resources:     agent.Resources{Memory: 64, CPUs: 1},
+			Grace:         agent.Grace{Startup: 1, Shutdown: 1},
+		}
+		job = scheduler.Job{
+			JobName: "alpha",
+			Tasks:   map[string]scheduler.Task{"web": {TaskName: "web", Scale: 1, ContainerConfig: config}},
+		}
+		patched = config
+		changed = config
+	)
+	patched.Resources = agent.Resources{Memory: 128, CPUs: 2}
+	changed.ArtifactURL = "http://a/alpha-2.tar.gz"
+
+	stater := &fakeAgentStater{states: map[string]agentState{
+		"http://a:3333": {containerInstances: map[string]agent.ContainerInstance{
+			"w1": {ID: "w1", Status: agent.ContainerStatusRunning, Config: patched},
+		}},
+	}}
+	taskSpecs, err := findJob(job, stater)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(taskSpecs); expected != got {
+		t.Errorf("expected %d containers, got %d", expected, got)
+	}
+
+	stater.states["http://a:3333"].containerInstances["w1"] = agent.ContainerInstance{ID: "w1", Status: agent.ContainerStatusRunning, Config: changed}
+	if _, err := findJob(job, stater); err == nil {
+		t.Error("expected error for a container with another config, got none")
+	}
+}
+
+func TestMakeJobLabels(t *testing.T) {
+	job := makeJob(configstore.JobConfig{
+		JobName: "alpha",
+		Labels:  agent.Labels{"team": "a", "env": "prod"},
+		Tasks: []configstore.TaskConfig{
+			{TaskName: "web", Labels: agent.Labels{"env": "canary"}},
+			{TaskName: "cron"},
+		},
+	}, "http://artifacts/alpha.tar.gz")
+
+	for taskName, expected := range map[string]agent.Labels{
+		"web":  {"team": "a", "env": "canary"},
+		"cron": {"team": "a", "env": "prod"},
+	} {
+		if got := job.Tasks[taskName].Labels; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: expected labels %v, got %v", taskName, expected, got)
+		}
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	setMetricsLabels([]string{"team", "cost-center"})
+	defer setMetricsLabels(nil)
+
+	if expected, got := "label_cost_center", metricLabelName("cost-center"); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	values := metricLabelValues(agent.ContainerConfig{JobName: "alpha", TaskName: "web", Labels: agent.Labels{"team": "a"}})
+	if expected, got := []string{"alpha", "web", "a", ""}, values; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestScheduleValidationErrors(t *testing.T) {
+	var (
+		w    = httptest.NewRecorder()
+		body = `{"job_name":"alpha","tasks":{"web":{"task_name":"web","scale":0}}}`
+	)
+	r, _ := http.NewRequest("POST", "/schedule", strings.NewReader(body))
+	handleSchedule(nil, nil, nil, nil).ServeHTTP(w, r)
+
+	if expected, got := errors.StatusUnprocessableEntity, w.Code; expected != got {
+		t.Fatalf("expected %d, got %d", expected, got)
+	}
+
+	var response errorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := errors.InvalidJob, response.Code; expected != got {
+		t.Errorf("expected code %q, got %q", expected, got)
+	}
+
+	fields := map[string]bool{}
+	for _, fieldError := range response.Errors {
+		fields[fieldError.Field] = true
+	}
+	for _, field := range []string{
+		"tasks[web].scale",
+		"tasks[web].job_name",
+		"tasks[web].command.exec",
+		"tasks[web].resources.mem",
+		"tasks[web].grace.startup",
+	} {
+		if !fields[field] {
+			t.Errorf("expected error for %s, got %v", field, response.Errors)
+		}
+	}
+}
+
+func TestJobDepends(t *testing.T) {
+	job := makeJob(configstore.JobConfig{
+		JobName: "alpha",
+		Tasks:   []configstore.TaskConfig{{TaskName: "web"}, {TaskName: "proxy"}, {TaskName: "cron"}},
+		Depends: configstore.Depends{"web": {"proxy"}},
+	}, "http://artifacts/alpha.tar.gz")
+
+	if expected, got := []string{"cron", "proxy", "web"}, orderedTaskNames(job); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected order %v, got %v", expected, got)
+	}
+
+	taskSpecMap := map[string]taskSpec{}
+	for taskName := range job.Tasks {
+		taskSpecMap[taskName+":0"] = taskSpec{ContainerConfig: agent.ContainerConfig{TaskName: taskName}}
+	}
+	stages := byStage(job, taskSpecMap)
+	if expected, got := 2, len(stages); expected != got {
+		t.Fatalf("expected %d stages, got %d", expected, got)
+	}
+	for i, containerIDs := range [][]string{{"cron:0", "proxy:0"}, {"web:0"}} {
+		for _, containerID := range containerIDs {
+			if _, ok := stages[i][containerID]; !ok {
+				t.Errorf("expected %s in stage %d, got %v", containerID, i, stages[i])
+			}
+		}
+	}
+
+	for depends, valid := range map[string]bool{
+		`{"web":["proxy"]}`:                  true,
+		`{"web":["db"]}`:                     false,
+		`{"web":["web"]}`:                    false,
+		`{"web":["proxy"],"proxy":["web"]}`:  false,
+		`{"web":["proxy"],"proxy":["cron"]}`: true,
+	} {
+		var d configstore.Depends
+		if err := json.Unmarshal([]byte(depends), &d); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Valid([]string{"web", "proxy", "cron"}); (err == nil) != valid {
+			t.Errorf("%s: expected valid %v, got %v", depends, valid, err)
+		}
+	}
+}
+
+func TestRescheduleLost(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	history, err := newDeployHistory("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		config = configstore.JobConfig{
+			JobName: "alpha",
+			Tasks:   []configstore.TaskConfig{{TaskName: "web", Scale: 2, Resources: agent.Resources{Memory: 32, CPUs: 0.1}}},
+		}
+		job    = makeJob(config, "http://filestore.berlin/alpha-1.tar.gz")
+		web    = job.Tasks["web"]
+		lostID = makeContainerID(job, web, 1)
+		rack   = func(name string) agentState {
+			return agentState{hostResources: agent.HostResources{Labels: map[string]string{agent.FailureDomainLabel: name}}}
+		}
+		agentStates = map[string]agentState{"http://a2:1": rack("a"), "http://b1:1": rack("b"), "http://b2:1": rack("b")}
+		registry    = newRegistry(nil)
+	)
+	history.record(job)
+	lost := map[string]taskSpec{
+		lostID:                 {endpoint: "http://a1:1", ContainerConfig: web.ContainerConfig},
+		"beta-0123:web-4567:0": {endpoint: "http://a1:1", ContainerConfig: agent.ContainerConfig{JobName: "beta", TaskName: "web"}},
+	}
+
+	rescheduled, dropped := reschedule("lost", lost, history, stickyRandomNonDirty(agentStates, map[string]string{lostID: "http://a1:1"}, map[string]string{"http://a1:1": "a"}), registry)
+	if expected, got := (map[string]taskSpec{lostID: {endpoint: "http://a2:1", ContainerConfig: web.ContainerConfig}}), rescheduled; !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected the lost container of the deployed job in the failure domain of its lost agent, %v, got %v", expected, got)
+	}
+	if expected, got := []string{"beta-0123:web-4567:0"}, dropped; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected the lost container of the undeployed job to be dropped, %v, got %v", expected, got)
+	}
+	if status, _ := registry.lookup(lostID); status != registryPendingSchedule {
+		t.Errorf("expected %s to be pending schedule, got %s", lostID, status)
+	}
+}
@@ -1,28 +1,446 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
 )
 
-type schedulingAlgorithm func(agent.ContainerConfig) (string, error)
+// A schedulingAlgorithm returns the endpoint of the agent where the container,
+// an instance of the task, should be placed. Algorithms are produced for a
+// single placement operation, and remember the instances they've placed so
+// far.
+type schedulingAlgorithm func(containerID string, task scheduler.Task) (string, error)
 
 type schedulingAlgorithmFactory func(map[string]agentState) schedulingAlgorithm
 
+// randomNonDirty places instances on random eligible agents, spreading the
+// instances of a task across failure domains.
 func randomNonDirty(agentStates map[string]agentState) schedulingAlgorithm {
-	return func(agent.ContainerConfig) (string, error) {
+	return stickyRandomNonDirty(agentStates, nil, nil)
+}
+
+// stickyRandomNonDirty is randomNonDirty, but places containers which ran
+// before, as recorded in previous (container ID: endpoint), back on their
+// previous agent, if it's eligible, or else on the best eligible agent in the
+// failure domain of their previous agent, so they find warm caches and their
+// local volume data. domains (endpoint: failure domain) remembers the failure
+// domains of the agents seen so far, so that of agents which are gone, or
+// dirty, is still known; it's updated from the agent states, and may be nil.
+func stickyRandomNonDirty(agentStates map[string]agentState, previous, domains map[string]string) schedulingAlgorithm {
+	if domains == nil {
+		domains = map[string]string{}
+	}
+	for endpoint, state := range agentStates {
+		if !state.dirty {
+			domains[endpoint] = failureDomain(state)
+		}
+	}
+	placed := map[string][]agent.ContainerConfig{} // endpoint: configs placed by us
+	return func(containerID string, task scheduler.Task) (string, error) {
 		endpoints := make([]string, 0, len(agentStates))
 		for key := range agentStates {
 			endpoints = append(endpoints, key)
 		}
+		var (
+			eligible   = []string{} // in random order
+			rejections = []rejection{}
+		)
 		for _, index := range rand.Perm(len(endpoints)) {
-			if agentStates[endpoints[index]].dirty {
+			endpoint := endpoints[index]
+			if r, ok := filterAgent(task, agentStates[endpoint], placed[endpoint]); !ok {
+				rejections = append(rejections, r)
 				continue
 			}
-			return endpoints[index], nil
+			eligible = append(eligible, endpoint)
+		}
+		if len(eligible) == 0 {
+			return "", noAgentError(task, rejections)
+		}
+		endpoint, err := spread(task, eligible, agentStates, placed)
+		if err != nil {
+			return "", err
+		}
+		if previousEndpoint, ok := previous[containerID]; ok {
+			endpoint = stick(previousEndpoint, domains[previousEndpoint], endpoint, eligible, agentStates, spreadRank(task, agentStates, placed))
+		}
+		placed[endpoint] = append(placed[endpoint], task.ContainerConfig)
+		return endpoint, nil
+	}
+}
+
+// rejection says why an agent can't take another instance of a task.
+type rejection struct {
+	Reason string `json:"reason"`
+	Volume string `json:"volume,omitempty"` // for rejectMissingVolume
+	Fields string `json:"fields,omitempty"` // for rejectOutdatedSchema
+}
+
+const (
+	rejectDirty          = "dirty"
+	rejectUnschedulable  = "unschedulable"
+	rejectOutsideCluster = "outside cluster"
+	rejectMissingVolume  = "volume missing"
+	rejectOutdatedSchema = "config schema outdated"
+	rejectMemory         = "insufficient memory"
+	rejectCPUs           = "insufficient cpus"
+	rejectContainers     = "container limit reached"
+	rejectMaxPerAgent    = "max per agent reached"
+)
+
+// capacity returns true if the agent could take the task, but is full.
+func (r rejection) capacity() bool {
+	switch r.Reason {
+	case rejectMemory, rejectCPUs, rejectContainers, rejectMaxPerAgent:
+		return true
+	}
+	return false
+}
+
+// filterAgent returns false, and why, if the agent can't take another
+// instance of the task. Agents are checked for trustability, cluster, config
+// schema, volumes, and room, in that order.
+func filterAgent(task scheduler.Task, state agentState, placed []agent.ContainerConfig) (rejection, bool) {
+	switch {
+	case state.dirty:
+		return rejection{Reason: rejectDirty}, false
+	case state.unschedulable:
+		return rejection{Reason: rejectUnschedulable}, false
+	case !inClusters(task, state):
+		return rejection{Reason: rejectOutsideCluster}, false
+	}
+	if undroppable := task.ContainerConfig.Undroppable(state.configSchemaVersion); len(undroppable) > 0 {
+		return rejection{Reason: rejectOutdatedSchema, Fields: strings.Join(undroppable, ", ")}, false
+	}
+	if volume, ok := missingVolume(task.ContainerConfig, state.hostResources.Volumes); ok {
+		return rejection{Reason: rejectMissingVolume, Volume: volume}, false
+	}
+	if reason := roomShortage(task, state, placed); reason != "" {
+		return rejection{Reason: reason}, false
+	}
+	if !belowMaxPerAgent(task, state, placed) {
+		return rejection{Reason: rejectMaxPerAgent}, false
+	}
+	return rejection{}, true
+}
+
+// noAgentError explains why no agent could take an instance of the task,
+// given the rejections of the agents. Full agents take precedence, as they
+// may have room later, then missing volumes, then clusters.
+func noAgentError(task scheduler.Task, rejections []rejection) error {
+	var (
+		missing  string // a volume no trustable agent provides, so far
+		outdated string // security fields no trustable agent understands, so far
+		full     bool   // some trustable agent was rejected for capacity
+		outside  bool   // some trustable agent is outside the task's clusters
+	)
+	for _, r := range rejections {
+		switch {
+		case r.capacity():
+			full = true
+		case r.Reason == rejectMissingVolume:
+			missing = r.Volume
+		case r.Reason == rejectOutdatedSchema:
+			outdated = r.Fields
+		case r.Reason == rejectOutsideCluster:
+			outside = true
+		}
+	}
+	switch {
+	case full:
+		return errInsufficientCapacity
+	case missing != "":
+		return fmt.Errorf("no agent provides volume %s", missing)
+	case outdated != "":
+		return fmt.Errorf("no agent understands %s", outdated)
+	case outside:
+		return noTrustableAgentError{strings.Join(task.Clusters, ", ")}
+	}
+	return noTrustableAgentError{}
+}
+
+// noTrustableAgentError is returned if no agent could be considered, e.g.
+// because all are dirty, or none is in the task's clusters.
+type noTrustableAgentError struct{ clusters string }
+
+func (e noTrustableAgentError) Error() string {
+	if e.clusters != "" {
+		return fmt.Sprintf("no trustable agent available in cluster %s", e.clusters)
+	}
+	return "no trustable agent available"
+}
+
+// spread picks the eligible agent in the failure domain running the fewest
+// instances of the task. Among equally loaded domains, it picks the agent
+// running the fewest instances, and then agents which have the task's
+// artifact cached, as they start the container without fetching it. Remaining
+// ties go to the earliest eligible agent.
+func spread(task scheduler.Task, eligible []string, agentStates map[string]agentState, placed map[string][]agent.ContainerConfig) (string, error) {
+	var (
+		rank     = spreadRank(task, agentStates, placed)
+		domains  = map[string]struct{}{}
+		best     = ""
+		bestRank [3]int
+	)
+	for _, endpoint := range eligible {
+		domains[failureDomain(agentStates[endpoint])] = struct{}{}
+		if r := rank(endpoint); best == "" || lessRank(r, bestRank) {
+			best, bestRank = endpoint, r
+		}
+	}
+	if len(domains) < task.MinDomains {
+		return "", fmt.Errorf("task needs %d failure domains, only %d available", task.MinDomains, len(domains))
+	}
+	return best, nil
+}
+
+// stick returns the previous agent of a container if it's eligible, or else
+// the best ranked eligible agent in the failure domain of the previous agent,
+// or else the agent picked by spread. Agents without a failure domain, or
+// whose domain isn't known, share the empty one, so there's nothing to stick
+// to.
+func stick(previous, domain, picked string, eligible []string, agentStates map[string]agentState, rank func(string) [3]int) string {
+	var (
+		best     = ""
+		bestRank [3]int
+	)
+	for _, endpoint := range eligible {
+		if endpoint == previous {
+			return previous
+		}
+		if domain == "" || failureDomain(agentStates[endpoint]) != domain {
+			continue
+		}
+		if r := rank(endpoint); best == "" || lessRank(r, bestRank) {
+			best, bestRank = endpoint, r
+		}
+	}
+	if best == "" {
+		return picked
+	}
+	return best
+}
+
+// spreadRank returns a function ranking agents for spread; lower ranks are
+// better. The rank is the instances of the task in the agent's failure
+// domain, on the agent, and 0 if the agent has the artifact cached, else 1.
+func spreadRank(task scheduler.Task, agentStates map[string]agentState, placed map[string][]agent.ContainerConfig) func(string) [3]int {
+	instances := map[string]int{} // failure domain: instance count
+	for endpoint, state := range agentStates {
+		instances[failureDomain(state)] += countInstances(task, state, placed[endpoint])
+	}
+	return func(endpoint string) [3]int {
+		state := agentStates[endpoint]
+		cached := 1
+		if hasArtifact(task, state) {
+			cached = 0
+		}
+		return [3]int{instances[failureDomain(state)], countInstances(task, state, placed[endpoint]), cached}
+	}
+}
+
+// failureDomain returns the agent's failure domain, e.g. its rack. Agents
+// without one share the empty domain.
+func failureDomain(state agentState) string {
+	return state.hostResources.Labels[agent.FailureDomainLabel]
+}
+
+// agentCluster returns the cluster of the agent, named by its cluster label
+// unless it was discovered in a cluster.
+func agentCluster(state agentState) string {
+	if state.cluster != "" {
+		return state.cluster
+	}
+	return state.hostResources.Labels[agent.ClusterLabel]
+}
+
+// inClusters returns true if the agent is in one of the task's clusters, or
+// the task may run on any agent.
+func inClusters(task scheduler.Task, state agentState) bool {
+	if len(task.Clusters) == 0 {
+		return true
+	}
+	cluster := agentCluster(state)
+	for _, c := range task.Clusters {
+		if c == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceTask returns the task as the instance is placed: restricted to the
+// instance's cluster.
+func instanceTask(task scheduler.Task, instance int) scheduler.Task {
+	if cluster := task.Cluster(instance); cluster != "" {
+		task.Clusters = []string{cluster}
+	}
+	return task
+}
+
+// lessRank compares ranks lexicographically.
+func lessRank(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// hasArtifact returns true if the agent has the task's artifact cached.
+func hasArtifact(task scheduler.Task, state agentState) bool {
+	_, ok := state.artifacts[task.ContainerConfig.ArtifactURL]
+	return ok
+}
+
+// errInsufficientCapacity is returned by scheduling algorithms when agents
+// could take the task, but are full.
+var errInsufficientCapacity = errors.New("no agent has room for another instance")
+
+// hasRoom returns true if the agent has the memory and CPUs for another
+// instance of the task, and its container limit, if any, permits another
+// container. Totals of zero are treated as unknown, and not enforced.
+func hasRoom(task scheduler.Task, state agentState, placed []agent.ContainerConfig) bool {
+	return roomShortage(task, state, placed) == ""
+}
+
+// roomShortage returns what the agent lacks to take another instance of the
+// task, as a rejection reason, or the empty string if it has room.
+func roomShortage(task scheduler.Task, state agentState, placed []agent.ContainerConfig) string {
+	var (
+		resources = state.hostResources
+		memory    = float64(task.Resources.Memory)
+		cpus      = task.Resources.CPUs
+	)
+	for _, config := range placed {
+		memory += float64(config.Resources.Memory)
+		cpus += config.Resources.CPUs
+	}
+	switch {
+	case resources.Memory.Total > 0 && resources.Memory.Reserved+memory > resources.Memory.Total:
+		return rejectMemory
+	case resources.CPUs.Total > 0 && resources.CPUs.Reserved+cpus > resources.CPUs.Total:
+		return rejectCPUs
+	case resources.Containers.Total > 0 && resources.Containers.Reserved+float64(len(placed)) >= resources.Containers.Total:
+		return rejectContainers
+	}
+	return ""
+}
+
+// belowMaxPerAgent returns true if the agent runs fewer instances of the task
+// than the task permits per agent. Only instances with an identical container
+// config count, so migrations aren't blocked by the instances they replace.
+func belowMaxPerAgent(task scheduler.Task, state agentState, placed []agent.ContainerConfig) bool {
+	if task.MaxPerAgent <= 0 {
+		return true
+	}
+	return countInstances(task, state, placed) < task.MaxPerAgent
+}
+
+// expectedConfig returns the config an agent holds for an instance of the
+// task, given the config of the instance: agents hold the config as
+// translated to their schema version by scheduleOne, so the task's config is
+// downgraded to the schema version of the instance, for comparison.
+func expectedConfig(task scheduler.Task, instance agent.ContainerConfig) agent.ContainerConfig {
+	expected, _ := task.ContainerConfig.Downgrade(instance.SchemaVersion)
+	return expected
+}
+
+// matchesTask reports whether the config of an instance is that of the task,
+// as the agent resolved it.
+func matchesTask(task scheduler.Task, instance agent.ContainerConfig) bool {
+	return reflect.DeepEqual(resolvedConfig(expectedConfig(task, instance), instance), instance)
+}
+
+// resolvedConfig returns the expected config as the agent holds it for the
+// instance: with the resources of the instance, as a PATCH may change those
+// of a running container, with the ports and port ranges the agent allocated
+// where the expected config has it allocate them, and with the environment
+// variables in which the agent passes them.
+func resolvedConfig(expected, instance agent.ContainerConfig) agent.ContainerConfig {
+	expected.Resources = instance.Resources
+
+	env := make(map[string]string, len(expected.Env))
+	for k, v := range expected.Env {
+		env[k] = v
+	}
+	setEnv := func(name string) {
+		if v, ok := instance.Env[name]; ok {
+			env[name] = v
+		}
+	}
+
+	if len(expected.Ports) > 0 {
+		ports := make(map[string]uint16, len(expected.Ports))
+		for name, port := range expected.Ports {
+			if port == 0 {
+				port = instance.Ports[name]
+			}
+			ports[name] = port
+			setEnv(agent.PortEnv(name))
+		}
+		expected.Ports = ports
+	}
+	if len(expected.PortRanges) > 0 {
+		portRanges := make(map[string]agent.PortRange, len(expected.PortRanges))
+		for name, portRange := range expected.PortRanges {
+			if portRange.Start == 0 {
+				portRange.Start = instance.PortRanges[name].Start
+			}
+			portRanges[name] = portRange
+			setEnv(agent.PortEnv(name))
+			setEnv(agent.PortEnv(name) + "_START")
+			setEnv(agent.PortEnv(name) + "_END")
+		}
+		expected.PortRanges = portRanges
+	}
+
+	if expected.Env != nil || len(env) > 0 {
+		expected.Env = env
+	}
+	return expected
+}
+
+// countInstances counts the instances of the task on the agent, including
+// those placed by the current algorithm.
+func countInstances(task scheduler.Task, state agentState, placed []agent.ContainerConfig) int {
+	n := 0
+	for _, containerInstance := range state.containerInstances {
+		if matchesTask(task, containerInstance.Config) {
+			n++
+		}
+	}
+	for _, config := range placed {
+		if reflect.DeepEqual(config, task.ContainerConfig) {
+			n++
+		}
+	}
+	return n
+}
+
+// missingVolume returns the first host path, in sorted order, which the
+// container config wants to mount but is not among the available volumes.
+func missingVolume(config agent.ContainerConfig, volumes []string) (string, bool) {
+	available := make(map[string]struct{}, len(volumes))
+	for _, volume := range volumes {
+		available[volume] = struct{}{}
+	}
+	wanted := make([]string, 0, len(config.Storage.Volumes))
+	for _, hostPath := range config.Storage.Volumes {
+		wanted = append(wanted, hostPath)
+	}
+	sort.Strings(wanted)
+	for _, hostPath := range wanted {
+		if _, ok := available[hostPath]; !ok {
+			return hostPath, true
 		}
-		return "", fmt.Errorf("no trustable agent available")
 	}
+	return "", false
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+	"github.com/soundcloud/harpoon/harpoon-scheduler/lib"
+)
+
+func TestRandomNonDirty(t *testing.T) {
+	algo := randomNonDirty(map[string]agentState{
+		"http://dirty:1":          {dirty: true},
+		"http://maintenance:2":    {unschedulable: true},
+		"http://schedulable:3":    {},
+		"http://dirty-and-down:4": {dirty: true, unschedulable: true},
+	})
+
+	for i := 0; i < 10; i++ {
+		endpoint, err := algo("", scheduler.Task{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "http://schedulable:3", endpoint; expected != got {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+
+	algo = randomNonDirty(map[string]agentState{
+		"http://maintenance:2": {unschedulable: true},
+	})
+	if _, err := algo("", scheduler.Task{}); err == nil {
+		t.Fatal("expected error when no agent is schedulable, got none")
+	}
+}
+
+func TestRandomNonDirtyVolumes(t *testing.T) {
+	var (
+		mysql = agent.ContainerConfig{
+			Storage: agent.Storage{Volumes: map[string]string{"/var/lib/mysql": "/data/mysql000"}},
+		}
+		agentStates = map[string]agentState{
+			"http://plain:1": {hostResources: agent.HostResources{Volumes: []string{}}},
+			"http://mysql:2": {hostResources: agent.HostResources{Volumes: []string{"/data/mysql000"}}},
+		}
+	)
+
+	for i := 0; i < 10; i++ {
+		endpoint, err := randomNonDirty(agentStates)("", scheduler.Task{ContainerConfig: mysql})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "http://mysql:2", endpoint; expected != got {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+
+	delete(agentStates, "http://mysql:2")
+	_, err := randomNonDirty(agentStates)("", scheduler.Task{ContainerConfig: mysql})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if expected, got := "no agent provides volume /data/mysql000", err.Error(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRandomNonDirtySchemaVersion(t *testing.T) {
+	var (
+		secure      = agent.ContainerConfig{Security: &agent.Security{}}
+		agentStates = map[string]agentState{
+			"http://old:1": {configSchemaVersion: 5},
+			"http://new:2": {configSchemaVersion: agent.ConfigSchemaVersion},
+		}
+	)
+
+	for i := 0; i < 10; i++ {
+		endpoint, err := randomNonDirty(agentStates)("", scheduler.Task{ContainerConfig: secure})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "http://new:2", endpoint; expected != got {
+			t.Fatalf("expected %q, got %q", expected, got)
+		}
+	}
+
+	delete(agentStates, "http://new:2")
+	_, err := randomNonDirty(agentStates)("", scheduler.Task{ContainerConfig: secure})
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+	if expected, got := "no agent understands security", err.Error(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestRandomNonDirtyLimits(t *testing.T) {
+	var (
+		config = agent.ContainerConfig{JobName: "alpha", TaskName: "web"}
+		task   = scheduler.Task{TaskName: "web", MaxPerAgent: 2, ContainerConfig: config}
+		algo   = randomNonDirty(map[string]agentState{
+			"http://a:1": {
+				hostResources: agent.HostResources{Containers: agent.TotalReserved{Total: 10, Reserved: 0}},
+				containerInstances: map[string]agent.ContainerInstance{
+					"alpha-1": {ID: "alpha-1", Config: config},
+				},
+			},
+			"http://b:2": {
+				hostResources: agent.HostResources{Containers: agent.TotalReserved{Total: 2, Reserved: 1}},
+			},
+		})
+		placed = map[string]int{}
+	)
+
+	// a has room for 1 more instance of the task, b for 1 more container.
+	for i := 0; i < 2; i++ {
+		endpoint, err := algo("", task)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		placed[endpoint]++
+	}
+	if expected, got := (map[string]int{"http://a:1": 1, "http://b:2": 1}), placed; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if _, err := algo("", task); err == nil {
+		t.Error("expected error when all agents are at their limits, got none")
+	}
+}
+
+func TestRandomNonDirtySpread(t *testing.T) {
+	rack := func(name string) agentState {
+		return agentState{hostResources: agent.HostResources{
+			Labels: map[string]string{agent.FailureDomainLabel: name},
+		}}
+	}
+	var (
+		agentStates = map[string]agentState{
+			"http://a1:1": rack("a"),
+			"http://a2:1": rack("a"),
+			"http://a3:1": rack("a"),
+			"http://b1:1": rack("b"),
+		}
+		task   = scheduler.Task{Scale: 4, ContainerConfig: agent.ContainerConfig{JobName: "alpha", TaskName: "web"}}
+		algo   = randomNonDirty(agentStates)
+		placed = map[string]int{}
+	)
+
+	for i := 0; i < 4; i++ {
+		endpoint, err := algo("", task)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		placed[failureDomain(agentStates[endpoint])]++
+	}
+	if expected, got := (map[string]int{"a": 2, "b": 2}), placed; !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	task.MinDomains = 3
+	if _, err := randomNonDirty(agentStates)("", task); err == nil {
+		t.Error("expected error with too few failure domains, got none")
+	}
+}
+
+func TestStickyRandomNonDirty(t *testing.T) {
+	rack := func(name string) agentState {
+		return agentState{hostResources: agent.HostResources{
+			Labels: map[string]string{agent.FailureDomainLabel: name},
+		}}
+	}
+	var (
+		agentStates = map[string]agentState{
+			"http://a1:1": rack("a"),
+			"http://a2:1": rack("a"),
+			"http://b1:1": rack("b"),
+			"http://b2:1": rack("b"),
+		}
+		task     = scheduler.Task{ContainerConfig: agent.ContainerConfig{JobName: "alpha", TaskName: "web"}}
+		previous = map[string]string{"alpha-0": "http://a2:1", "alpha-1": "http://b3:1"}
+		domains  = map[string]string{"http://b3:1": "b"}
+	)
+
+	for i := 0; i < 10; i++ {
+		algo := stickyRandomNonDirty(agentStates, previous, domains)
+		endpoint, err := algo("alpha-0", task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "http://a2:1", endpoint; expected != got {
+			t.Fatalf("expected the previous agent %s, got %s", expected, got)
+		}
+		if endpoint, err = algo("alpha-1", task); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := "b", failureDomain(agentStates[endpoint]); expected != got {
+			t.Fatalf("expected an agent in the previous failure domain %s, got %s", expected, endpoint)
+		}
+	}
+
+	agentStates["http://a2:1"] = agentState{dirty: true}
+	endpoint, err := stickyRandomNonDirty(agentStates, previous, domains)("alpha-0", task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "http://a1:1", endpoint; expected != got {
+		t.Errorf("expected the agent left in the failure domain of the dirty previous agent, %s, got %s", expected, got)
+	}
+	if expected, got := "a", domains["http://a1:1"]; expected != got {
+		t.Errorf("expected the failure domain of seen agents to be remembered as %q, got %q", expected, got)
+	}
+}
+
+func TestRandomNonDirtyArtifactCache(t *testing.T) {
+	var (
+		artifactURL = "http://artifacts.local/web-1.tar.gz"
+		cached      = map[string]struct{}{artifactURL: {}}
+		agentStates = map[string]agentState{
+			"http://a:1": {},
+			"http://b:2": {artifacts: cached},
+			"http://c:3": {},
+			"http://d:4": {artifacts: cached},
+		}
+		task = scheduler.Task{ContainerConfig: agent.ContainerConfig{JobName: "alpha", TaskName: "web", ArtifactURL: artifactURL}}
+	)
+
+	for i := 0; i < 10; i++ {
+		var (
+			algo   = randomNonDirty(agentStates)
+			placed = map[string]int{}
+		)
+		for j := 0; j < 4; j++ {
+			endpoint, err := algo("", task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			placed[endpoint]++
+		}
+		// cached agents first, but not at the cost of spreading instances
+		if expected, got := (map[string]int{"http://a:1": 1, "http://b:2": 1, "http://c:3": 1, "http://d:4": 1}), placed; !reflect.DeepEqual(expected, got) {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+
+		endpoint, err := randomNonDirty(agentStates)("", task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := agentStates[endpoint].artifacts[artifactURL]; !ok {
+			t.Fatalf("expected an agent with the artifact cached, got %s", endpoint)
+		}
+	}
+}
+
+func TestHasRoom(t *testing.T) {
+	var (
+		task  = scheduler.Task{ContainerConfig: agent.ContainerConfig{Resources: agent.Resources{Memory: 512, CPUs: 1}}}
+		state = agentState{hostResources: agent.HostResources{
+			Memory: agent.TotalReserved{Total: 2048, Reserved: 1024},
+			CPUs:   agent.TotalReserved{Total: 4, Reserved: 1},
+		}}
+	)
+	if !hasRoom(task, state, nil) {
+		t.Error("expected room for 1 instance")
+	}
+	if !hasRoom(task, state, []agent.ContainerConfig{task.ContainerConfig}) {
+		t.Error("expected room for 2 instances")
+	}
+	if hasRoom(task, state, []agent.ContainerConfig{task.ContainerConfig, task.ContainerConfig}) {
+		t.Error("expected no room for 3 instances")
+	}
+}
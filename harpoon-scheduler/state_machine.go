@@ -16,8 +16,11 @@ import (
 
 type stateMachine struct {
 	agent.Agent
+	configSchemaVersion        int // newest config schema the agent understands
 	containerInstancesRequests chan chan map[string]agent.ContainerInstance
+	exitedRequests             chan chan map[string]agent.ContainerInstance
 	dirtyRequests              chan chan bool
+	syncedRequests             chan chan bool
 	quit                       chan chan struct{}
 }
 
@@ -26,17 +29,34 @@ func newStateMachine(endpoint string) (*stateMachine, error) {
 	if err != nil {
 		return nil, fmt.Errorf("when building agent proxy: %s", err)
 	}
+	// Configs are downgraded to the schema version the agent reports, so an
+	// agent whose version we can't get isn't used. The transformer retries it
+	// with the next agent discovery.
+	info, err := proxy.Version()
+	if err != nil {
+		return nil, fmt.Errorf("when getting agent version: %s", err)
+	}
+	if !info.Supports(agent.APIVersion) {
+		return nil, fmt.Errorf("agent %s speaks API version(s) %v, but we need %s", info.Version, info.APIVersions, agent.APIVersion)
+	}
+	configSchemaVersion := 1 // agents which predate config schema versioning
+	if info.ConfigSchemaVersion > 0 {
+		configSchemaVersion = info.ConfigSchemaVersion
+	}
 	containerEvents, stopper, err := proxy.Events()
 	if err != nil {
 		return nil, fmt.Errorf("when getting agent event stream: %s", err)
 	}
 	s := &stateMachine{
 		Agent: proxy,
+		configSchemaVersion:        configSchemaVersion,
 		containerInstancesRequests: make(chan chan map[string]agent.ContainerInstance),
+		exitedRequests:             make(chan chan map[string]agent.ContainerInstance),
 		dirtyRequests:              make(chan chan bool),
+		syncedRequests:             make(chan chan bool),
 		quit:                       make(chan chan struct{}),
 	}
-	go s.loop(proxy.URL.String(), containerEvents, stopper)
+	go s.loop(proxy.Endpoint(), containerEvents, stopper)
 	return s, nil
 }
 
@@ -46,6 +66,14 @@ func (s *stateMachine) dirty() bool {
 	return <-c
 }
 
+// synced returns true once the state machine has received the initial state
+// of the remote agent.
+func (s *stateMachine) synced() bool {
+	c := make(chan bool)
+	s.syncedRequests <- c
+	return <-c
+}
+
 func (s *stateMachine) proxy() agent.Agent {
 	return s.Agent
 }
@@ -56,6 +84,15 @@ func (s *stateMachine) containerInstances() map[string]agent.ContainerInstance {
 	return <-c
 }
 
+// exitedContainerInstances returns the containers which failed or finished,
+// and weren't deleted yet. They're not among containerInstances, but they
+// still exist on the agent, and may be restarted.
+func (s *stateMachine) exitedContainerInstances() map[string]agent.ContainerInstance {
+	c := make(chan map[string]agent.ContainerInstance)
+	s.exitedRequests <- c
+	return <-c
+}
+
 func (s *stateMachine) stop() {
 	q := make(chan struct{})
 	s.quit <- q
@@ -72,16 +109,28 @@ func (s *stateMachine) loop(
 	}()
 
 	m := map[string]agent.ContainerInstance{} // ID: instance
+
+	// known has the latest state of every container, including finished and
+	// failed ones, so deltas can be applied to it.
+	known := map[string]agent.ContainerInstance{}
+	remember := func(containerInstance agent.ContainerInstance) {
+		if classify(containerInstance.Status) == statusGone {
+			delete(known, containerInstance.ID)
+			return
+		}
+		known[containerInstance.ID] = containerInstance
+	}
+
+	// Containers of unknown status stay in m: they exist on the agent, and
+	// mustn't look missing.
 	updateWith := func(containerInstance agent.ContainerInstance) {
-		switch containerInstance.Status {
-		case agent.ContainerStatusStarting, agent.ContainerStatusRunning:
+		switch classifyReported(endpoint, containerInstance.ID, containerInstance.Status) {
+		case statusActive, statusUnknown:
 			log.Printf("state machine: %s: %q: %s, adding", endpoint, containerInstance.ID, containerInstance.Status)
 			m[containerInstance.ID] = containerInstance
-		case agent.ContainerStatusFinished, agent.ContainerStatusFailed, agent.ContainerStatusDeleted:
+		case statusExited, statusGone:
 			log.Printf("state machine: %s: %q: %s, removing", endpoint, containerInstance.ID, containerInstance.Status)
 			delete(m, containerInstance.ID)
-		default:
-			panic(fmt.Sprintf("container status %q unrepresented in remote agent state machine", containerInstance.Status))
 		}
 	}
 
@@ -91,6 +140,9 @@ func (s *stateMachine) loop(
 	// to influence decisions.
 	dirty := false
 
+	// synced is set true when the initial 'containers' event arrives.
+	synced := false
+
 	for {
 		select {
 		case containerEvent, ok := <-containerEvents:
@@ -111,25 +163,69 @@ func (s *stateMachine) loop(
 				if !ok {
 					panic("impossible")
 				}
-				log.Printf("state machine: %s: initial 'containers' reveals %d running task instance(s)", endpoint, len(containerInstances))
+				// The first event, and periodic ones in delta streams, are
+				// full snapshots, replacing what we know.
+				log.Printf("state machine: %s: 'containers' snapshot reveals %d task instance(s)", endpoint, len(containerInstances))
+				m = map[string]agent.ContainerInstance{}
+				known = map[string]agent.ContainerInstance{}
 				for _, containerInstance := range containerInstances {
+					remember(containerInstance)
 					updateWith(containerInstance)
 				}
 				dirty = false
+				synced = true
 
 			case agent.ContainerInstanceEventName:
 				containerInstance, ok := containerEvent.(agent.ContainerInstance)
 				if !ok {
 					panic("impossible")
 				}
+				remember(containerInstance)
 				updateWith(containerInstance)
+
+			case agent.ContainerDeltaEventName:
+				containerDelta, ok := containerEvent.(agent.ContainerDelta)
+				if !ok {
+					panic("impossible")
+				}
+				previous, ok := known[containerDelta.ID]
+				if !ok && containerDelta.Config == nil {
+					log.Printf("state machine: %s: %q: delta for unknown container, ignoring until the next snapshot", endpoint, containerDelta.ID)
+					dirty = true
+					continue
+				}
+				containerInstance := containerDelta.Apply(previous)
+				remember(containerInstance)
+				updateWith(containerInstance)
+
+			case agent.LogMarkerEventName:
+				logMarker, ok := containerEvent.(agent.LogMarker)
+				if !ok {
+					panic("impossible")
+				}
+				log.Printf("state machine: %s: %q dropped %d log line(s)", endpoint, logMarker.ID, logMarker.Dropped)
+
+			case agent.StreamHeartbeatEventName:
+				// Only keeps the connection busy.
 			}
 
 		case c := <-s.dirtyRequests:
 			c <- dirty
 
+		case c := <-s.syncedRequests:
+			c <- synced
+
 		case c := <-s.containerInstancesRequests:
-			c <- m
+			c <- copyContainerInstances(m)
+
+		case c := <-s.exitedRequests:
+			exited := map[string]agent.ContainerInstance{}
+			for id, containerInstance := range known {
+				if terminated(containerInstance.Status) {
+					exited[id] = containerInstance
+				}
+			}
+			c <- copyContainerInstances(exited)
 
 		case q := <-s.quit:
 			close(q)
@@ -137,3 +233,19 @@ func (s *stateMachine) loop(
 		}
 	}
 }
+
+// copyContainerInstances returns a copy of m, which callers may keep and
+// modify while the state machine carries on. The loop only ever replaces
+// instances in m, never modifies them in place, so copying the instance
+// values suffices, except for their metrics, which are pointers.
+func copyContainerInstances(m map[string]agent.ContainerInstance) map[string]agent.ContainerInstance {
+	c := make(map[string]agent.ContainerInstance, len(m))
+	for id, containerInstance := range m {
+		if containerInstance.Metrics != nil {
+			metrics := *containerInstance.Metrics
+			containerInstance.Metrics = &metrics
+		}
+		c[id] = containerInstance
+	}
+	return c
+}
@@ -5,6 +5,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/soundcloud/harpoon/harpoon-agent/lib"
@@ -12,6 +14,8 @@ import (
 
 type transformer struct {
 	states chan chan map[string]agentState
+	synced chan chan []string
+	pings  chan chan struct{}
 	quit   chan chan struct{}
 }
 
@@ -19,9 +23,13 @@ func newTransformer(
 	agentDiscovery agentDiscovery,
 	registryPrivate registryPrivate,
 	agentPollInterval time.Duration,
+	agentConcurrency int, // operations run at once against each agent
+	notifier *notifier, // told about failed containers; may be nil
 ) *transformer {
 	t := &transformer{
 		states: make(chan chan map[string]agentState),
+		synced: make(chan chan []string),
+		pings:  make(chan chan struct{}),
 		quit:   make(chan chan struct{}),
 	}
 	stateMachines := map[string]*stateMachine{}
@@ -29,6 +37,7 @@ func newTransformer(
 		stateMachine, err := newStateMachine(endpoint)
 		if err != nil {
 			log.Printf("transformer: state machine for %s: %s", endpoint, err)
+			continue
 		}
 		stateMachines[endpoint] = stateMachine
 	}
@@ -38,6 +47,8 @@ func newTransformer(
 		agentDiscovery,
 		registryPrivate,
 		agentPollInterval,
+		agentConcurrency,
+		notifier,
 	)
 	return t
 }
@@ -48,6 +59,22 @@ func (t *transformer) stop() {
 	<-q
 }
 
+// unsynced returns the endpoints of agents whose state machines haven't yet
+// received the initial state of the agent, sorted. Agents which couldn't be
+// reached at all don't have a state machine, and aren't waited for.
+func (t *transformer) unsynced() []string {
+	c := make(chan []string)
+	t.synced <- c
+	return <-c
+}
+
+// ping returns once the transformer loop has processed a message.
+func (t *transformer) ping() {
+	c := make(chan struct{})
+	t.pings <- c
+	<-c
+}
+
 // agentStates implements the agentStater interface. Since the transformer
 // owns (wraps) state machines for all of the remote agents, requests for the
 // current state of agents must be proxied.
@@ -62,6 +89,8 @@ func (t *transformer) loop(
 	agentDiscovery agentDiscovery,
 	registryPrivate registryPrivate,
 	agentPollInterval time.Duration,
+	agentConcurrency int,
+	notifier *notifier,
 ) {
 	defer func() {
 		for _, stateMachine := range stateMachines {
@@ -69,48 +98,142 @@ func (t *transformer) loop(
 		}
 	}()
 
+	// Operations against agents run in per-agent queues, in the background,
+	// so we stay responsive while slow agents catch up.
+	queues := map[string]*agentQueue{}
+	updateQueues := func() {
+		for endpoint, stateMachine := range stateMachines {
+			if _, ok := queues[endpoint]; !ok {
+				queues[endpoint] = newAgentQueue(endpoint, agentConcurrency, runner(stateMachine, registryPrivate, agentPollInterval, notifier))
+			}
+		}
+		for endpoint, queue := range queues {
+			if _, ok := stateMachines[endpoint]; !ok {
+				stopQueue(queue, registryPrivate)
+				delete(queues, endpoint)
+			}
+		}
+	}
+	updateQueues()
+	defer func() {
+		for _, queue := range queues {
+			stopQueue(queue, registryPrivate)
+		}
+	}()
+	enqueue := func(op agentOp) {
+		queue, ok := queues[op.taskSpec.endpoint]
+		if !ok {
+			log.Printf("transformer: %s: agent unavailable", op.taskSpec.endpoint)
+			if op.kind != opRestart {
+				registryPrivate.signal(op.containerID, signalAgentUnavailable)
+			}
+			return
+		}
+		if queue.push(op) {
+			log.Printf("transformer: queued %s %v on %s", op.kind, op.containerID, op.taskSpec.endpoint)
+		}
+	}
+
 	agentEndpoints := make(chan []string)
 	agentDiscovery.notify(agentEndpoints)
 	defer agentDiscovery.stop(agentEndpoints)
 
-	// An intermediary receives the registry states from the registry, and
-	// caches the most recent one. Whenever the main runloop for the
-	// transformer is ready, it receives the latest registry state. This is
-	// necessary because actions we take in our main runloop may have the side
-	// effect of emitting registry state signals back to us. If we don't
-	// receive them, we can deadlock.
-	registryStates0 := make(chan registryState)
-	registryPrivate.notify(registryStates0)
-	defer registryPrivate.stop(registryStates0)
-	registryStates := make(chan registryState)
-	go fwd(registryStates, registryStates0)
+	// The registry queues transitions for us, and never blocks on us. That's
+	// necessary because actions we take in our main runloop may have the
+	// side effect of emitting registry transitions back to us. The first
+	// batch is a snapshot of the registry; we keep the desired state up to
+	// date from there.
+	registryTransitions := make(chan []registryTransition)
+	registryPrivate.notify(registryTransitions)
+	defer registryPrivate.stop(registryTransitions)
+	desired := map[string]taskSpec{}
+
+	// Moving containers exist on two agents for a while. The move takes
+	// care of them, so they're left out of the diff until it's done.
+	moving := map[string]bool{}
+
+	// Containers fail without the registry changing, so we look for them
+	// periodically.
+	failedTick := time.Tick(agentPollInterval)
 
 	for {
 		select {
 		case newAgentEndpoints := <-agentEndpoints:
 			stateMachines = migrateAgents(stateMachines, newAgentEndpoints, registryPrivate)
+			updateQueues()
 
-		case registryState := <-registryStates:
+		case transitions := <-registryTransitions:
+			if len(transitions) == 0 {
+				continue // empty snapshot; nothing is desired yet
+			}
 			var (
-				desired = mergeRegistryStates(registryState.pendingSchedule, registryState.scheduled)
-				actual  = remoteState(stateMachines)
+				retries = map[string]taskSpec{}
+				moves   = map[string]taskSpec{}
 			)
-			toSchedule, toUnschedule := diffRegistryStates(desired, actual)
+			for _, transition := range transitions {
+				if transition.desired() {
+					desired[transition.containerID] = transition.taskSpec
+				} else {
+					delete(desired, transition.containerID)
+				}
+				delete(retries, transition.containerID)
+				delete(moves, transition.containerID)
+				if transition.retry() {
+					retries[transition.containerID] = transition.taskSpec
+				}
+				if transition.move() {
+					moves[transition.containerID] = transition.taskSpec
+				}
+				if transition.to == registryPendingMove {
+					moving[transition.containerID] = true
+				} else {
+					delete(moving, transition.containerID)
+				}
+			}
+			actual := remoteState(stateMachines)
+			toSchedule, toUnschedule, _ := diffRegistryStates(desired, actual)
+			for containerID, taskSpec := range retries {
+				// We removed the container which failed to start, but our
+				// state machines may not know yet.
+				toSchedule[containerID] = taskSpec
+				delete(toUnschedule, containerID)
+			}
+			for containerID := range moving {
+				delete(toSchedule, containerID)
+				delete(toUnschedule, containerID)
+			}
+			for containerID, taskSpec := range moves {
+				enqueue(agentOp{containerID, taskSpec, opMove, findSource(containerID, taskSpec, actual, stateMachines)})
+			}
 			incTaskScheduleRequests(len(toSchedule))
 			incTaskUnscheduleRequests(len(toUnschedule))
 			for containerID, taskSpec := range toSchedule {
-				// Can be made concurrent.
-				log.Printf("transformer: triggering schedule %v on %s", containerID, taskSpec.endpoint)
-				registryPrivate.signal(containerID, scheduleOne(containerID, taskSpec, stateMachines, agentPollInterval))
+				enqueue(agentOp{containerID, taskSpec, opSchedule, nil})
 			}
 			for containerID, taskSpec := range toUnschedule {
-				// Can be made concurrent.
-				log.Printf("transformer: triggering unschedule %v on %s", containerID, taskSpec.endpoint)
-				registryPrivate.signal(containerID, unscheduleOne(containerID, taskSpec, stateMachines, agentPollInterval))
+				enqueue(agentOp{containerID, taskSpec, opUnschedule, nil})
+			}
+
+		case <-failedTick:
+			for containerID, taskSpec := range restartExited(desired, stateMachines, registryPrivate, notifier) {
+				enqueue(agentOp{containerID, taskSpec, opRestart, nil})
 			}
 
 		case c := <-t.states:
-			c <- copyAgentStates(stateMachines)
+			c <- copyAgentStates(stateMachines, discoveredClusters(agentDiscovery))
+
+		case c := <-t.synced:
+			unsynced := []string{}
+			for endpoint, stateMachine := range stateMachines {
+				if !stateMachine.synced() {
+					unsynced = append(unsynced, endpoint)
+				}
+			}
+			sort.Strings(unsynced)
+			c <- unsynced
+
+		case c := <-t.pings:
+			close(c)
 
 		case q := <-t.quit:
 			close(q)
@@ -119,57 +242,107 @@ func (t *transformer) loop(
 	}
 }
 
-// fwd is a single-value-caching forwarder between two chans.
-func fwd(dst chan<- registryState, src <-chan registryState) {
-	for s := range src {
-		func() {
-			for {
-				var ok bool
-				select {
-				case s, ok = <-src: // overwrite
-					if !ok {
-						return
-					}
-				case dst <- s: // successful fwd
-					return
-				}
-			}
-		}()
+// remoteState returns the containers on all agents. Exited containers are
+// included, because they still exist on their agent, and may be restarted in
+// place.
+func remoteState(stateMachines map[string]*stateMachine) map[string]endpointContainerInstance {
+	m := map[string]endpointContainerInstance{}
+	for endpoint, stateMachine := range stateMachines {
+		for _, containerInstance := range stateMachine.containerInstances() {
+			m[containerInstance.ID] = endpointContainerInstance{endpoint, containerInstance}
+		}
+		for _, containerInstance := range stateMachine.exitedContainerInstances() {
+			m[containerInstance.ID] = endpointContainerInstance{endpoint, containerInstance}
+		}
+	}
+	return m
+}
+
+// findSource returns where a container to be moved to the agent of its spec
+// runs now, or nil if it runs nowhere else, e.g. because its agent is gone.
+func findSource(
+	containerID string,
+	target taskSpec,
+	actual map[string]endpointContainerInstance,
+	stateMachines map[string]*stateMachine,
+) *moveSource {
+	containerInstance, ok := actual[containerID]
+	if !ok || containerInstance.endpoint == target.endpoint {
+		return nil
+	}
+	return &moveSource{
+		taskSpec: taskSpec{
+			endpoint:        containerInstance.endpoint,
+			ContainerConfig: containerInstance.Config,
+		},
+		stateMachine: stateMachines[containerInstance.endpoint],
 	}
 }
 
-func mergeRegistryStates(maps ...map[string]taskSpec) map[string]taskSpec {
-	merged := map[string]taskSpec{}
-	for _, m := range maps {
-		for containerID, endpoint := range m {
-			merged[containerID] = endpoint
+// runner returns a function running queued operations against the agent of
+// the state machine, and reporting the outcome to the registry.
+func runner(
+	stateMachine *stateMachine,
+	registryPrivate registryPrivate,
+	agentPollInterval time.Duration,
+	notifier *notifier,
+) func(agentOp) {
+	return func(op agentOp) {
+		switch op.kind {
+		case opSchedule:
+			log.Printf("transformer: triggering schedule %v on %s", op.containerID, op.taskSpec.endpoint)
+			sig := scheduleOne(op.containerID, op.taskSpec, stateMachine, agentPollInterval)
+			if sig == signalContainerPutFailed || sig == signalContainerStartFailed {
+				notifier.failed(op.containerID, op.taskSpec, sig.String())
+			}
+			registryPrivate.signal(op.containerID, sig)
+
+		case opUnschedule:
+			log.Printf("transformer: triggering unschedule %v on %s", op.containerID, op.taskSpec.endpoint)
+			registryPrivate.signal(op.containerID, unscheduleOne(op.containerID, op.taskSpec, stateMachine, agentPollInterval))
+
+		case opMove:
+			log.Printf("transformer: triggering move %v to %s", op.containerID, op.taskSpec.endpoint)
+			registryPrivate.signal(op.containerID, moveOne(op.containerID, op.taskSpec, op.source, stateMachine, agentPollInterval))
+
+		case opRestart:
+			log.Printf("transformer: restarting exited %v on %s", op.containerID, op.taskSpec.endpoint)
+			if err := restartOne(op.containerID, op.taskSpec, stateMachine, agentPollInterval); err != nil {
+				log.Printf("transformer: %s: restart container %s failed: %s", op.taskSpec.endpoint, op.containerID, err)
+			}
+			registryPrivate.restarted(op.containerID)
 		}
 	}
-	return merged
 }
 
-func remoteState(stateMachines map[string]*stateMachine) map[string]endpointContainerInstance {
-	m := map[string]endpointContainerInstance{}
-	for endpoint, stateMachine := range stateMachines {
-		for _, containerInstance := range stateMachine.containerInstances() {
-			m[containerInstance.ID] = endpointContainerInstance{endpoint, containerInstance}
+// stopQueue stops the queue of an agent which went away. Schedules and
+// unschedules which never ran fail, so whoever waits for them finds out.
+func stopQueue(queue *agentQueue, registryPrivate registryPrivate) {
+	for _, op := range queue.stop() {
+		if op.kind != opRestart {
+			registryPrivate.signal(op.containerID, signalAgentUnavailable)
 		}
 	}
-	return m
 }
 
 func scheduleOne(
 	containerID string,
 	taskSpec taskSpec,
-	stateMachines map[string]*stateMachine,
+	stateMachine *stateMachine,
 	agentPollInterval time.Duration,
 ) schedulingSignal {
-	stateMachine, ok := stateMachines[taskSpec.endpoint]
-	if !ok {
-		log.Printf("transformer: %s: agent unavailable", taskSpec.endpoint)
-		return signalAgentUnavailable
+	if undroppable := taskSpec.ContainerConfig.Undroppable(stateMachine.configSchemaVersion); len(undroppable) > 0 {
+		log.Printf("transformer: %s: agent speaks config schema version %d; refusing to drop %s from container %s", taskSpec.endpoint, stateMachine.configSchemaVersion, strings.Join(undroppable, ", "), containerID)
+		return signalContainerPutFailed
 	}
-	if err := stateMachine.proxy().Put(containerID, taskSpec.ContainerConfig); err != nil {
+	containerConfig, dropped := taskSpec.ContainerConfig.Downgrade(stateMachine.configSchemaVersion)
+	if len(dropped) > 0 {
+		log.Printf("transformer: %s: agent speaks config schema version %d; dropping %s from container %s", taskSpec.endpoint, stateMachine.configSchemaVersion, strings.Join(dropped, ", "), containerID)
+	}
+	if err := stateMachine.proxy().Put(containerID, containerConfig); isTransient(err) {
+		log.Printf("transformer: %s: PUT container %s failed: %s", taskSpec.endpoint, containerID, err)
+		return signalAgentUnavailable
+	} else if err != nil {
 		log.Printf("transformer: %s: PUT container %s failed: %s", taskSpec.endpoint, containerID, err)
 		return signalContainerPutFailed
 	}
@@ -185,54 +358,135 @@ func scheduleOne(
 	// container IDs that are in the process of starting up. But since I think
 	// we want to support multiple transformers against the same registry, we
 	// can't rely on that kind of state.
-	if err := func() error {
-		checkTick := time.Tick(agentPollInterval)
-		checkTimeout := time.After(time.Duration(taskSpec.ContainerConfig.Grace.Startup)*time.Second + 500*time.Millisecond)
-		var status agent.ContainerStatus
-		for {
-			select {
-			case <-checkTick:
-				containerInstance, err := stateMachine.proxy().Get(containerID)
-				if err != nil {
-					return fmt.Errorf("when making container GET: %s", err)
-				}
-				switch status = containerInstance.Status; status {
-				case agent.ContainerStatusStarting:
-					continue
-				case agent.ContainerStatusRunning:
-					return nil
-				default:
-					return fmt.Errorf("container status %s", status)
-				}
-			case <-checkTimeout:
-				return fmt.Errorf("container status %s after %ds: timeout", status, taskSpec.ContainerConfig.Grace.Startup)
-			}
-		}
-	}(); err != nil {
+	if err := waitRunning(containerID, taskSpec, stateMachine, agentPollInterval); err != nil {
 		log.Printf("transformer: %s: start container %s failed: %s", taskSpec.endpoint, containerID, err)
+		// Remove the container, so the registry may have us retry from
+		// scratch, and no failed leftover remains.
+		if sig := unscheduleOne(containerID, taskSpec, stateMachine, agentPollInterval); sig != signalUnscheduleSuccessful {
+			log.Printf("transformer: %s: removing container %s after failed start: %s", taskSpec.endpoint, containerID, sig)
+		}
 		return signalContainerStartFailed
 	}
 	return signalScheduleSuccessful
 }
 
+// moveOne starts the container on the target agent, waits for it to run, and
+// only then removes it from the source agent, if any. Should the removal fail,
+// the container is left behind, but the move still succeeded: the container
+// runs where it's wanted, and the leftover is unscheduled like any other
+// container which isn't desired where it is.
+func moveOne(
+	containerID string,
+	target taskSpec,
+	source *moveSource,
+	stateMachine *stateMachine,
+	agentPollInterval time.Duration,
+) schedulingSignal {
+	switch sig := scheduleOne(containerID, target, stateMachine, agentPollInterval); sig {
+	case signalScheduleSuccessful:
+	case signalAgentUnavailable:
+		return sig
+	default:
+		log.Printf("transformer: %s: move container %s failed: %s", target.endpoint, containerID, sig)
+		return signalMoveFailed
+	}
+	if source == nil {
+		return signalMoveSuccessful
+	}
+	if sig := unscheduleOne(containerID, source.taskSpec, source.stateMachine, agentPollInterval); sig != signalUnscheduleSuccessful {
+		log.Printf("transformer: %s: removing moved container %s: %s; leaving it behind", source.taskSpec.endpoint, containerID, sig)
+	}
+	return signalMoveSuccessful
+}
+
+// waitRunning polls the agent until the container is running. It fails if the
+// container doesn't start within its startup grace period.
+func waitRunning(containerID string, taskSpec taskSpec, stateMachine *stateMachine, agentPollInterval time.Duration) error {
+	checkTick := time.Tick(agentPollInterval)
+	checkTimeout := time.After(time.Duration(taskSpec.ContainerConfig.Grace.Startup)*time.Second + 500*time.Millisecond)
+	var status agent.ContainerStatus
+	for {
+		select {
+		case <-checkTick:
+			containerInstance, err := stateMachine.proxy().Get(containerID)
+			if err != nil {
+				return fmt.Errorf("when making container GET: %s", err)
+			}
+			switch status = containerInstance.Status; status {
+			case agent.ContainerStatusStarting:
+				continue
+			case agent.ContainerStatusRunning:
+				return nil
+			default:
+				if containerInstance.Error != "" {
+					return fmt.Errorf("container status %s: %s", status, containerInstance.Error)
+				}
+				return fmt.Errorf("container status %s", status)
+			}
+		case <-checkTimeout:
+			return fmt.Errorf("container status %s after %ds: timeout", status, taskSpec.ContainerConfig.Grace.Startup)
+		}
+	}
+}
+
+// restartExited returns the desired containers which exited on their agent,
+// and should be restarted per their restart policy, now that the backoff
+// prescribed by the registry has passed. Each exit counts as a failure of the
+// container: exiting is what services mustn't do. Containers which failed too
+// often are parked by the registry, and left alone, as are silenced ones.
+func restartExited(
+	desired map[string]taskSpec,
+	stateMachines map[string]*stateMachine,
+	registryPrivate registryPrivate,
+	notifier *notifier,
+) map[string]taskSpec {
+	_, _, toRestart := diffRegistryStates(desired, remoteState(stateMachines))
+	now := time.Now()
+	for containerID, taskSpec := range toRestart {
+		record, isNew := registryPrivate.failed(containerID, now)
+		if isNew {
+			notifier.failed(containerID, taskSpec, "container exited")
+		}
+		if record.Parked || now.Before(record.RetryAt) || registryPrivate.silenced(containerID, taskSpec.JobName, now) {
+			delete(toRestart, containerID)
+		}
+	}
+	return toRestart
+}
+
+func restartOne(
+	containerID string,
+	taskSpec taskSpec,
+	stateMachine *stateMachine,
+	agentPollInterval time.Duration,
+) error {
+	if err := stateMachine.proxy().Start(containerID); err != nil {
+		return err
+	}
+	incContainersRestarted(1)
+	return waitRunning(containerID, taskSpec, stateMachine, agentPollInterval)
+}
+
 func unscheduleOne(
 	containerID string,
 	taskSpec taskSpec,
-	stateMachines map[string]*stateMachine,
+	stateMachine *stateMachine,
 	agentPollInterval time.Duration,
 ) schedulingSignal {
 	// Unscheduling is a bit of a dance.
 	//  1. POST /containers/{id}/stop
 	//  2. Poll GET /containers/{id} until it's terminated
 	//  3. DELETE /containers/{id}
-	stateMachine, ok := stateMachines[taskSpec.endpoint]
-	if !ok {
-		log.Printf("transformer: %s: agent unavailable", taskSpec.endpoint)
-		return signalAgentUnavailable
+	// Containers which already failed or finished skip straight to 3.
+	if containerInstance, err := stateMachine.proxy().Get(containerID); err == nil && terminated(containerInstance.Status) {
+		return deleteOne(containerID, taskSpec, stateMachine)
 	}
 
 	// POST stop
-	if err := stateMachine.proxy().Stop(containerID); err != nil {
+	if err := stateMachine.proxy().Stop(containerID); isTransient(err) {
+		log.Printf("transformer: %s: stop container %s failed: %s", taskSpec.endpoint, containerID, err)
+		return signalAgentUnavailable
+	} else if err != nil {
 		log.Printf("transformer: %s: stop container %s failed: %s", taskSpec.endpoint, containerID, err)
 		return signalContainerStopFailed
 	}
@@ -249,11 +503,8 @@ func unscheduleOne(
 				if err != nil {
 					return fmt.Errorf("when making container GET: %s", err)
 				}
-				switch status = containerInstance.Status; status {
-				case agent.ContainerStatusFailed, agent.ContainerStatusFinished:
+				if status = containerInstance.Status; terminated(status) {
 					return nil
-				default:
-					continue
 				}
 			case <-checkTimeout:
 				return fmt.Errorf("container status %s after %ds: timeout", status, taskSpec.ContainerConfig.Grace.Shutdown)
@@ -264,20 +515,30 @@ func unscheduleOne(
 		return signalContainerStopFailed
 	}
 
-	// DELETE
-	if err := stateMachine.proxy().Delete(containerID); err != nil {
+	return deleteOne(containerID, taskSpec, stateMachine)
+}
+
+func deleteOne(containerID string, taskSpec taskSpec, stateMachine *stateMachine) schedulingSignal {
+	if err := stateMachine.proxy().Delete(containerID); isTransient(err) {
+		log.Printf("transformer: %s: DELETE container %s failed: %s", taskSpec.endpoint, containerID, err)
+		return signalAgentUnavailable
+	} else if err != nil {
 		log.Printf("transformer: %s: DELETE container %s failed: %s", taskSpec.endpoint, containerID, err)
 		return signalContainerDeleteFailed
 	}
 	return signalUnscheduleSuccessful
 }
 
+// diffRegistryStates compares the desired and actual states. Desired
+// containers which exited on their agent, and whose restart policy says to
+// restart them, are returned separately, to be restarted in place.
 func diffRegistryStates(
 	desired map[string]taskSpec,
 	actual map[string]endpointContainerInstance,
-) (toSchedule, toUnschedule map[string]taskSpec) {
+) (toSchedule, toUnschedule, toRestart map[string]taskSpec) {
 	toSchedule = map[string]taskSpec{}
 	toUnschedule = map[string]taskSpec{}
+	toRestart = map[string]taskSpec{}
 
 	//log.Printf("transformer: diff(%d desired, %d actual)", len(desired), len(actual))
 
@@ -292,18 +553,25 @@ func diffRegistryStates(
 			toSchedule[containerID] = desired
 			continue
 		}
-		switch actual.Status {
-		case agent.ContainerStatusStarting, agent.ContainerStatusRunning:
-			// nothing to do
-			//log.Printf("transformer: %v is %s on %s; nothing to do", containerID, actual.Status, actual.endpoint)
-		case agent.ContainerStatusFailed:
-			//log.Printf("transformer: %v is %s on %s; will re-schedule", containerID, actual.Status, actual.endpoint)
-			toSchedule[containerID] = desired
-		case agent.ContainerStatusFinished:
+		switch classify(actual.Status) {
+		case statusActive:
 			// nothing to do
 			//log.Printf("transformer: %v is %s on %s; nothing to do", containerID, actual.Status, actual.endpoint)
+		case statusExited:
+			// The supervisor gave up on the container. Finished containers
+			// are only restarted if their policy asks for it, so one-off
+			// tasks stay finished, but services exiting 0 don't silently
+			// reduce scale.
+			//log.Printf("transformer: %v is %s on %s; restart policy %q", containerID, actual.Status, actual.endpoint, desired.Restart)
+			succeeded := actual.Status == agent.ContainerStatusFinished
+			if desired.endpoint == actual.endpoint && desired.Restart.Restarts(succeeded) {
+				toRestart[containerID] = desired
+			}
 		default:
-			panic(fmt.Sprintf("container status %q has no handler in transformer diffRegistryStates", actual.Status))
+			// Deleted containers never make it into the actual state, and
+			// the state machine logged unknown ones when it saw them.
+			// Either way, wait for a status we understand.
+			//log.Printf("transformer: %v is %s on %s; nothing to do", containerID, actual.Status, actual.endpoint)
 		}
 	}
 
@@ -320,7 +588,8 @@ func diffRegistryStates(
 			continue
 		}
 		if desired.endpoint != actual.endpoint {
-			// move
+			// Not where it should be, e.g. a leftover of a move. Moves
+			// themselves go through the registry, and aren't diffed.
 			//log.Printf("transformer: %v exists on %s but should be on %s; unscheduling former, scheduling latter", containerID, actual.endpoint, desired.endpoint)
 			toUnschedule[containerID] = taskSpec
 			toSchedule[containerID] = desired
@@ -328,7 +597,7 @@ func diffRegistryStates(
 	}
 
 	//log.Printf("transformer: after diff, %d to schedule, %d to unschedule", len(toSchedule), len(toUnschedule))
-	return toSchedule, toUnschedule
+	return toSchedule, toUnschedule, toRestart
 }
 
 // migrateAgents returns a set of state machines that reflect the latest
@@ -374,7 +643,7 @@ func diffAgents(incoming []string, previous map[string]*stateMachine) (surviving
 	return next, previous
 }
 
-func copyAgentStates(stateMachines map[string]*stateMachine) map[string]agentState {
+func copyAgentStates(stateMachines map[string]*stateMachine, clusters map[string]string) map[string]agentState {
 	m := map[string]agentState{}
 	for endpoint, stateMachine := range stateMachines {
 		hostResources, err := stateMachine.proxy().Resources()
@@ -385,19 +654,41 @@ func copyAgentStates(stateMachines map[string]*stateMachine) map[string]agentSta
 			hostResourcesDirty = err != nil
 			stateMachineDirty  = stateMachine.dirty()
 		)
+		// Cached artifacts only guide placement, so agents which don't
+		// report them are trusted all the same.
+		artifacts, err := stateMachine.proxy().Artifacts()
+		if err != nil {
+			log.Printf("transformer: when getting cached artifacts from %s: %s", endpoint, err)
+		}
 		m[endpoint] = agentState{
-			dirty:              hostResourcesDirty || stateMachineDirty,
-			hostResources:      hostResources,
-			containerInstances: stateMachine.containerInstances(),
+			dirty:               hostResourcesDirty || stateMachineDirty,
+			hostResources:       hostResources,
+			unschedulable:       hostResources.Unschedulable,
+			containerInstances:  stateMachine.containerInstances(),
+			artifacts:           artifactURLs(artifacts),
+			cluster:             clusters[endpoint],
+			configSchemaVersion: stateMachine.configSchemaVersion,
 		}
 	}
 	return m
 }
 
 type agentState struct {
-	dirty              bool // if true, don't trust the report
-	hostResources      agent.HostResources
-	containerInstances map[string]agent.ContainerInstance
+	dirty               bool // if true, don't trust the report
+	unschedulable       bool // if true, agent is in maintenance; don't place containers
+	hostResources       agent.HostResources
+	containerInstances  map[string]agent.ContainerInstance
+	artifacts           map[string]struct{} // URLs of the artifacts the agent has cached
+	cluster             string              // if the agent was discovered in a cluster; see agentCluster
+	configSchemaVersion int                 // newest config schema the agent understands
+}
+
+func artifactURLs(artifacts []agent.Artifact) map[string]struct{} {
+	urls := make(map[string]struct{}, len(artifacts))
+	for _, artifact := range artifacts {
+		urls[artifact.URL] = struct{}{}
+	}
+	return urls
 }
 
 type endpointContainerInstance struct {
@@ -27,7 +27,7 @@ func TestTransformerAgentEndpointUpdates(t *testing.T) {
 		defer testAgents[i].Close()
 	}
 
-	transformer := newTransformer(agentDiscovery, registry, 2*time.Millisecond)
+	transformer := newTransformer(agentDiscovery, registry, 2*time.Millisecond, 1, nil)
 	defer transformer.stop()
 
 	// Preflight, we should have 0 remote agents.
@@ -55,6 +55,30 @@ func TestTransformerAgentEndpointUpdates(t *testing.T) {
 	}
 }
 
+func TestTransformerUnsynced(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		registry       = newRegistry(nil)
+		agentDiscovery = newMockAgentDiscovery()
+		testAgent      = httptest.NewServer(newMockAgent())
+	)
+	defer testAgent.Close()
+
+	transformer := newTransformer(agentDiscovery, registry, 2*time.Millisecond, 1, nil)
+	defer transformer.stop()
+	agentDiscovery.add(testAgent.URL)
+
+	deadline := time.After(time.Second)
+	for len(transformer.unsynced()) > 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("agents never synced: %v", transformer.unsynced())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
 func TestTransformerScheduleUnschedule(t *testing.T) {
 	//log.SetFlags(log.Lmicroseconds) // use this when debugging problems
 	log.SetOutput(ioutil.Discard) // use this when everything is copacetic
@@ -63,7 +87,7 @@ func TestTransformerScheduleUnschedule(t *testing.T) {
 	defer s.Close()
 
 	registry := newRegistry(nil)
-	transformer := newTransformer(staticAgentDiscovery([]string{s.URL}), registry, 2*time.Millisecond)
+	transformer := newTransformer(staticAgentDiscovery([]string{s.URL}), registry, 2*time.Millisecond, 1, nil)
 	defer transformer.stop()
 
 	var (
@@ -135,25 +159,201 @@ func TestTransformerScheduleUnschedule(t *testing.T) {
 	log.Printf("☞ finished")
 }
 
-func TestFwd(t *testing.T) {
+func TestTransformerRestartsFailed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	registry := newRegistry(nil)
+	registry.crashLoop = crashLoopPolicy{base: 10 * time.Millisecond, max: 10 * time.Millisecond, threshold: 2, window: time.Minute}
+	transformer := newTransformer(staticAgentDiscovery([]string{s.URL}), registry, 2*time.Millisecond, 1, nil)
+	defer transformer.stop()
+
 	var (
-		in   = make(chan registryState)
-		out  = make(chan registryState)
-		done = make(chan struct{})
+		containerID = "crashy"
+		spec        = taskSpec{endpoint: s.URL, ContainerConfig: agent.ContainerConfig{JobName: "j", TaskName: "t"}}
+		c           = make(chan schedulingSignalWithContext, 1)
 	)
-	go func() { fwd(out, in); close(done) }()
-
-	go func() {
-		in <- registryState{}
-		in <- registryState{}
-		<-out
-		in <- registryState{}
-		close(in)
-	}()
-
-	select {
-	case <-done:
-	case <-time.After(10 * time.Millisecond):
-		t.Error("timeout")
+	if err := registry.schedule(containerID, spec, c); err != nil {
+		t.Fatal(err)
+	}
+	if sig := <-c; sig.schedulingSignal != signalScheduleSuccessful {
+		t.Fatalf("schedule: %s (%s)", sig.schedulingSignal, sig.context)
+	}
+
+	waitFor := func(what string, condition func() bool) {
+		deadline := time.After(time.Second)
+		for !condition() {
+			select {
+			case <-deadline:
+				t.Fatalf("timeout waiting for %s", what)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	status := func() agent.ContainerStatus {
+		mockAgent.RLock()
+		defer mockAgent.RUnlock()
+		return mockAgent.instances[containerID].Status
+	}
+
+	mockAgent.fail(containerID)
+	waitFor("restart", func() bool { return status() == agent.ContainerStatusRunning })
+	if expected, got := 1, registry.failing()[containerID].Failures; expected != got {
+		t.Errorf("expected %d failure, got %d", expected, got)
+	}
+
+	mockAgent.fail(containerID)
+	waitFor("parking", func() bool { return registry.failing()[containerID].Parked })
+	time.Sleep(50 * time.Millisecond)
+	if got := status(); got != agent.ContainerStatusFailed {
+		t.Errorf("expected parked container to stay %s, got %s", agent.ContainerStatusFailed, got)
+	}
+}
+
+func TestTransformerHonorsSilences(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	mockAgent := newMockAgent()
+	s := httptest.NewServer(mockAgent)
+	defer s.Close()
+
+	registry := newRegistry(nil)
+	registry.crashLoop = crashLoopPolicy{base: time.Millisecond, max: time.Millisecond, threshold: 10, window: time.Minute}
+	transformer := newTransformer(staticAgentDiscovery([]string{s.URL}), registry, 2*time.Millisecond, 1, nil)
+	defer transformer.stop()
+
+	var (
+		containerID = "crashy"
+		spec        = taskSpec{endpoint: s.URL, ContainerConfig: agent.ContainerConfig{JobName: "j", TaskName: "t"}}
+		c           = make(chan schedulingSignalWithContext, 1)
+	)
+	if err := registry.schedule(containerID, spec, c); err != nil {
+		t.Fatal(err)
+	}
+	if sig := <-c; sig.schedulingSignal != signalScheduleSuccessful {
+		t.Fatalf("schedule: %s (%s)", sig.schedulingSignal, sig.context)
+	}
+
+	status := func() agent.ContainerStatus {
+		mockAgent.RLock()
+		defer mockAgent.RUnlock()
+		return mockAgent.instances[containerID].Status
+	}
+
+	registry.annotations.set(annotationJob, "j", annotation{Note: "investigating", SilencedUntil: time.Now().Add(time.Hour)})
+	mockAgent.fail(containerID)
+	time.Sleep(50 * time.Millisecond)
+	if got := status(); got != agent.ContainerStatusFailed {
+		t.Errorf("expected silenced container to stay %s, got %s", agent.ContainerStatusFailed, got)
+	}
+	if expected, got := 1, registry.failing()[containerID].Failures; expected != got {
+		t.Errorf("expected %d failure, got %d", expected, got)
+	}
+
+	registry.annotations.clear(annotationJob, "j")
+	deadline := time.After(time.Second)
+	for status() != agent.ContainerStatusRunning {
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for restart after the silence was cleared")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestTransformerMove(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		source = newMockAgent()
+		target = newMockAgent()
+		s1     = httptest.NewServer(source)
+		s2     = httptest.NewServer(target)
+	)
+	defer s1.Close()
+	defer s2.Close()
+
+	registry := newRegistry(nil)
+	transformer := newTransformer(staticAgentDiscovery([]string{s1.URL, s2.URL}), registry, 2*time.Millisecond, 1, nil)
+	defer transformer.stop()
+
+	var (
+		containerID = "mover"
+		spec        = taskSpec{endpoint: s1.URL, ContainerConfig: agent.ContainerConfig{JobName: "j", TaskName: "t"}}
+		await       = func(c chan schedulingSignalWithContext, expected schedulingSignal) {
+			select {
+			case sig := <-c:
+				if sig.schedulingSignal != expected {
+					t.Fatalf("expected %s, got %s (%s)", expected, sig.schedulingSignal, sig.context)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for %s", expected)
+			}
+		}
+	)
+	c := make(chan schedulingSignalWithContext, 1)
+	if err := registry.schedule(containerID, spec, c); err != nil {
+		t.Fatal(err)
+	}
+	await(c, signalScheduleSuccessful)
+
+	c = make(chan schedulingSignalWithContext, 1)
+	if err := registry.move(containerID, s2.URL, c); err != nil {
+		t.Fatal(err)
+	}
+	await(c, signalMoveSuccessful)
+
+	source.RLock()
+	_, onSource := source.instances[containerID]
+	source.RUnlock()
+	if onSource {
+		t.Errorf("%s still exists on the source agent", containerID)
+	}
+	target.RLock()
+	running := target.instances[containerID].Status == agent.ContainerStatusRunning
+	target.RUnlock()
+	if !running {
+		t.Errorf("%s isn't running on the target agent", containerID)
+	}
+	registry.RLock()
+	status, spec := registry.lookup(containerID)
+	registry.RUnlock()
+	if status != registryScheduled || spec.endpoint != s2.URL {
+		t.Errorf("expected %s on %s, got %s on %s", registryScheduled, s2.URL, status, spec.endpoint)
+	}
+}
+
+func TestDiffRegistryStatesRestartPolicy(t *testing.T) {
+	for _, test := range []struct {
+		status  agent.ContainerStatus
+		policy  agent.RestartPolicy
+		restart bool
+	}{
+		{agent.ContainerStatusFailed, "", true},
+		{agent.ContainerStatusFinished, "", false},
+		{agent.ContainerStatusFailed, agent.RestartOnFailure, true},
+		{agent.ContainerStatusFinished, agent.RestartOnFailure, false},
+		{agent.ContainerStatusFailed, agent.RestartAlways, true},
+		{agent.ContainerStatusFinished, agent.RestartAlways, true},
+		{agent.ContainerStatusFailed, agent.RestartNever, false},
+		{agent.ContainerStatusFinished, agent.RestartNever, false},
+		{agent.ContainerStatusRunning, agent.RestartAlways, false},
+		{"paused", agent.RestartAlways, false}, // unknown statuses are left alone
+	} {
+		var (
+			config  = agent.ContainerConfig{JobName: "j", TaskName: "t", Restart: test.policy}
+			desired = map[string]taskSpec{"c": taskSpec{endpoint: "a", ContainerConfig: config}}
+			actual  = map[string]endpointContainerInstance{"c": endpointContainerInstance{"a", agent.ContainerInstance{ID: "c", Status: test.status, Config: config}}}
+		)
+		toSchedule, toUnschedule, toRestart := diffRegistryStates(desired, actual)
+		if len(toSchedule) > 0 || len(toUnschedule) > 0 {
+			t.Errorf("%s, %q: expected nothing to schedule or unschedule, got %v, %v", test.status, test.policy, toSchedule, toUnschedule)
+		}
+		if _, restart := toRestart["c"]; restart != test.restart {
+			t.Errorf("%s, %q: expected restart %v, got %v", test.status, test.policy, test.restart, restart)
+		}
 	}
 }
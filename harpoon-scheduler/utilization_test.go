@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/soundcloud/harpoon/harpoon-agent/lib"
+)
+
+func TestComputeUtilization(t *testing.T) {
+	var (
+		config = func(job string, memory int, cpus float64) agent.ContainerConfig {
+			return agent.ContainerConfig{JobName: job, TaskName: "t", Resources: agent.Resources{Memory: memory, CPUs: cpus}}
+		}
+		agentStates = map[string]agentState{
+			"http://eu:1": {
+				hostResources: agent.HostResources{
+					Memory: agent.TotalReserved{Total: 1000, Reserved: 500},
+					CPUs:   agent.TotalReserved{Total: 4, Reserved: 1},
+					Labels: map[string]string{agent.ClusterLabel: "eu"},
+				},
+				containerInstances: map[string]agent.ContainerInstance{
+					"a1": {ID: "a1", Status: agent.ContainerStatusRunning, Config: config("a", 300, 0.5)},
+					"b1": {ID: "b1", Status: agent.ContainerStatusRunning, Config: config("b", 200, 0.5)},
+					"b2": {ID: "b2", Status: agent.ContainerStatusFailed, Config: config("b", 200, 0.5)},
+				},
+			},
+			"http://eu:2": {
+				hostResources: agent.HostResources{
+					Memory: agent.TotalReserved{Total: 1000, Reserved: 300},
+					CPUs:   agent.TotalReserved{Total: 4, Reserved: 0.5},
+					Labels: map[string]string{agent.ClusterLabel: "eu"},
+				},
+				containerInstances: map[string]agent.ContainerInstance{
+					"a2": {ID: "a2", Status: agent.ContainerStatusRunning, Config: config("a", 300, 0.5)},
+				},
+			},
+			"http://dirty:1": {
+				dirty:         true,
+				hostResources: agent.HostResources{Memory: agent.TotalReserved{Total: 1000}},
+			},
+		}
+	)
+
+	u := computeUtilization(agentStates)
+	if want, have := (agent.TotalReserved{Total: 2000, Reserved: 800}), u.clusterMemory["eu"]; want != have {
+		t.Errorf("want eu memory %v, have %v", want, have)
+	}
+	if want, have := (agent.TotalReserved{Total: 8, Reserved: 1.5}), u.clusterCPUs["eu"]; want != have {
+		t.Errorf("want eu CPUs %v, have %v", want, have)
+	}
+	if _, ok := u.clusterMemory[""]; ok {
+		t.Errorf("want dirty agent left out, have %v", u.clusterMemory)
+	}
+	if want, have := 0.5, u.agentMemory["http://eu:1"]; want != have {
+		t.Errorf("want memory utilization %.2f, have %.2f", want, have)
+	}
+	if want, have := 0.125, u.agentCPUs["http://eu:2"]; want != have {
+		t.Errorf("want CPU utilization %.3f, have %.3f", want, have)
+	}
+	if want, have := 2, len(u.jobs); want != have {
+		t.Fatalf("want %d jobs, have %d", want, have)
+	}
+	for _, job := range u.jobs {
+		var want float64
+		switch job.labelValues[0] {
+		case "a":
+			want = 600
+		case "b":
+			want = 200 // the failed container reserves nothing
+		}
+		if want != job.memory {
+			t.Errorf("job %s: want memory %.0f, have %.0f", job.labelValues[0], want, job.memory)
+		}
+	}
+}
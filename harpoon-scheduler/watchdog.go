@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	runtimepprof "runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The scheduler, registry, and transformer communicate over unbuffered
+// channels, so a mistake in one of them can deadlock them all. The watchdog
+// periodically probes each component, i.e. sends it a message and waits for
+// the reply. A component which doesn't reply within the threshold is
+// considered stuck: the watchdog dumps all goroutine stacks to the log, and
+// reports the component as unhealthy until it replies.
+
+type watchdog struct {
+	sync.RWMutex
+	stuck map[string]time.Time // component: probed at
+	quit  chan chan struct{}
+}
+
+// newWatchdog returns a running watchdog. Each probe must return once the
+// component has processed a message.
+func newWatchdog(probes map[string]func(), interval, threshold time.Duration) *watchdog {
+	w := &watchdog{
+		stuck: map[string]time.Time{},
+		quit:  make(chan chan struct{}),
+	}
+	go w.loop(probes, interval, threshold)
+	return w
+}
+
+// unhealthy returns the components which are stuck, sorted by name.
+func (w *watchdog) unhealthy() []string {
+	w.RLock()
+	defer w.RUnlock()
+	names := make([]string, 0, len(w.stuck))
+	for name := range w.stuck {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w *watchdog) stop() {
+	q := make(chan struct{})
+	w.quit <- q
+	<-q
+}
+
+func (w *watchdog) loop(probes map[string]func(), interval, threshold time.Duration) {
+	var (
+		tick    = time.Tick(interval)
+		pending = map[string]bool{}              // probes which haven't returned
+		done    = make(chan string, len(probes)) // probes may outlive the loop
+	)
+	for {
+		select {
+		case <-tick:
+			for name, probe := range probes {
+				if pending[name] {
+					continue // still waiting on the previous probe
+				}
+				pending[name] = true
+				go func(name string, probe func(), probedAt time.Time) {
+					timeout := time.AfterFunc(threshold, func() { w.markStuck(name, probedAt, threshold) })
+					probe()
+					timeout.Stop()
+					done <- name
+				}(name, probe, time.Now())
+			}
+
+		case name := <-done:
+			delete(pending, name)
+			w.markHealthy(name)
+
+		case q := <-w.quit:
+			close(q)
+			return
+		}
+	}
+}
+
+func (w *watchdog) markStuck(name string, probedAt time.Time, threshold time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.stuck[name] = probedAt
+	incWatchdogStalls(1)
+	var buf bytes.Buffer
+	runtimepprof.Lookup("goroutine").WriteTo(&buf, 2)
+	log.Printf("watchdog: %s didn't respond within %s; goroutines:\n%s", name, threshold, buf.String())
+}
+
+func (w *watchdog) markHealthy(name string) {
+	w.Lock()
+	defer w.Unlock()
+	if probedAt, ok := w.stuck[name]; ok {
+		log.Printf("watchdog: %s responded after %s", name, time.Since(probedAt))
+		delete(w.stuck, name)
+	}
+}
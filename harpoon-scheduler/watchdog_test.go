@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+
+	var (
+		release = make(chan struct{})
+		w       = newWatchdog(map[string]func(){
+			"fine":  func() {},
+			"stuck": func() { <-release },
+		}, time.Millisecond, 20*time.Millisecond)
+	)
+	defer w.stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if expected, got := []string{"stuck"}, w.unhealthy(); !reflect.DeepEqual(expected, got) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	if got := w.unhealthy(); len(got) != 0 {
+		t.Fatalf("expected all healthy, got %v", got)
+	}
+}
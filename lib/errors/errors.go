@@ -0,0 +1,150 @@
+// Package errors defines the machine-readable codes of the error responses of
+// the harpoon agent and scheduler, and the error type both answer with, so
+// that clients and tooling can branch on the kind of an error rather than on
+// its message.
+package errors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// HTTP statuses defined in RFC 4918 and RFC 6585, but not in net/http.
+const (
+	StatusUnprocessableEntity = 422
+	StatusFailedDependency    = 424
+	StatusTooManyRequests     = 429
+)
+
+// Code classifies an error.
+type Code string
+
+// Codes of requests which are malformed, or can't be carried out as they
+// are. Retrying them doesn't help.
+const (
+	BadRequest       Code = "bad_request"       // the request couldn't be read, or has invalid parameters
+	InvalidConfig    Code = "invalid_config"    // the agent can't run the container config
+	InvalidJob       Code = "invalid_job"       // the job failed validation, or its namespace is unknown
+	Unauthorized     Code = "unauthorized"      // the client lacks the token, or isn't allowed to make the request
+	NotFound         Code = "not_found"         // the container, job, or other resource doesn't exist
+	Conflict         Code = "conflict"          // the resource is in the wrong state for the request
+	AlreadyScheduled Code = "already_scheduled" // containers of the job are already scheduled
+	QuotaExceeded    Code = "quota_exceeded"    // the job doesn't fit into its namespace's quota
+	PortConflict     Code = "port_conflict"     // ports of the container config are taken
+	ConfigConflict   Code = "config_conflict"   // a container exists with a different config
+	ContainerLimit   Code = "container_limit"   // the agent runs as many containers as it may
+	Internal         Code = "internal"          // the server failed
+)
+
+// Codes of temporary conditions. Requests may be retried later.
+const (
+	Unavailable       Code = "unavailable"        // the server is recovering or shutting down
+	RateLimited       Code = "rate_limited"       // the client sent too many requests
+	NoCapacity        Code = "no_capacity"        // no agent has room for a container
+	NoAgents          Code = "no_agents"          // no trustable agent is available, e.g. all are dirty
+	AgentFailure      Code = "agent_failure"      // an agent failed to start or stop a container, or didn't in time
+	DependenciesUnmet Code = "dependencies_unmet" // jobs the job requires aren't scheduled and healthy
+)
+
+// Temporary returns true if the code is of a temporary condition.
+func (c Code) Temporary() bool {
+	switch c {
+	case Unavailable, RateLimited, NoCapacity, NoAgents, AgentFailure, DependenciesUnmet:
+		return true
+	}
+	return false
+}
+
+// ForStatus returns the code of responses with the HTTP status which don't
+// carry a more specific one, e.g. those of older servers.
+func ForStatus(status int) Code {
+	switch {
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return Unauthorized
+	case status == http.StatusNotFound:
+		return NotFound
+	case status == http.StatusConflict:
+		return Conflict
+	case status == StatusFailedDependency:
+		return DependenciesUnmet
+	case status == StatusTooManyRequests:
+		return RateLimited
+	case status == http.StatusServiceUnavailable:
+		return Unavailable
+	case status >= 500:
+		return Internal
+	case status >= 400:
+		return BadRequest
+	}
+	return ""
+}
+
+// Error is the body of error responses, and the error clients return for
+// them. Responses with more details embed it.
+type Error struct {
+	StatusCode int    `json:"status_code"`
+	StatusText string `json:"status_text"`
+	Message    string `json:"error"`
+	Code       Code   `json:"code,omitempty"`
+}
+
+// New returns an error for a response with the HTTP status.
+func New(status int, code Code, message string) *Error {
+	return &Error{
+		StatusCode: status,
+		StatusText: statusText(status),
+		Message:    message,
+		Code:       code,
+	}
+}
+
+func statusText(status int) string {
+	switch status {
+	case StatusUnprocessableEntity:
+		return "Unprocessable Entity"
+	case StatusFailedDependency:
+		return "Failed Dependency"
+	case StatusTooManyRequests:
+		return "Too Many Requests"
+	}
+	return http.StatusText(status)
+}
+
+// Errorf returns an error for a response with the HTTP status, and a
+// formatted message.
+func Errorf(status int, code Code, format string, args ...interface{}) *Error {
+	return New(status, code, fmt.Sprintf(format, args...))
+}
+
+// Error satisfies the error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode satisfies the Coder interface.
+func (e *Error) ErrorCode() Code {
+	return e.Code
+}
+
+// Coder is implemented by errors which carry a code, like Error, and the port
+// and config conflicts of the agent.
+type Coder interface {
+	ErrorCode() Code
+}
+
+// CodeOf returns the code of the error, or the empty code if it has none.
+func CodeOf(err error) Code {
+	if c, ok := err.(Coder); ok {
+		return c.ErrorCode()
+	}
+	return ""
+}
+
+// Write writes v, an Error or a response embedding one, as the JSON body of
+// a response with the HTTP status.
+func Write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
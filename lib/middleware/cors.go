@@ -0,0 +1,60 @@
+// Package middleware holds the HTTP handler wrappers the harpoon agent and
+// scheduler share: cross-origin requests, and rate limiting.
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORS wraps a handler, allowing browser-based clients from the given origins
+// to call the API. "*" allows any origin. Preflight requests are answered
+// directly, and never reach the handler.
+func CORS(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowedOrigin(origins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func allowedOrigin(origins []string, origin string) bool {
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Origins is a flag.Value collecting the origins to allow, from repeated
+// flags, each of which may hold a comma-separated list.
+type Origins []string
+
+// String implements flag.Value.
+func (o *Origins) String() string { return strings.Join(*o, ",") }
+
+// Set implements flag.Value.
+func (o *Origins) Set(value string) error {
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			*o = append(*o, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	var (
+		reached = false
+		h       = CORS([]string{"http://dashboard.berlin"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached = true
+		}))
+	)
+
+	for _, testCase := range []struct {
+		method, origin, requestMethod string
+		expectedOrigin                string
+		expectedReached               bool
+	}{
+		{"GET", "", "", "", true},
+		{"GET", "http://evil.com", "", "", true},
+		{"GET", "http://dashboard.berlin", "", "http://dashboard.berlin", true},
+		{"OPTIONS", "http://dashboard.berlin", "POST", "http://dashboard.berlin", false},
+		{"OPTIONS", "http://evil.com", "POST", "", true},
+	} {
+		reached = false
+		r, _ := http.NewRequest(testCase.method, "/schedule", nil)
+		if testCase.origin != "" {
+			r.Header.Set("Origin", testCase.origin)
+		}
+		if testCase.requestMethod != "" {
+			r.Header.Set("Access-Control-Request-Method", testCase.requestMethod)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if expected, got := testCase.expectedOrigin, w.Header().Get("Access-Control-Allow-Origin"); expected != got {
+			t.Errorf("%s from %q: expected allowed origin %q, got %q", testCase.method, testCase.origin, expected, got)
+		}
+		if expected, got := testCase.expectedReached, reached; expected != got {
+			t.Errorf("%s from %q: expected handler reached %v, got %v", testCase.method, testCase.origin, expected, got)
+		}
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	var o Origins
+	o.Set("http://a.berlin, http://b.berlin/")
+	o.Set("http://c.berlin")
+	if expected, got := "http://a.berlin,http://b.berlin,http://c.berlin", o.String(); expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
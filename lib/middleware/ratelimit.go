@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+// RateLimiter enforces a token bucket per client, keyed by remote IP. Each
+// client may make burst requests at once, refilled at rate per second.
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	now     func() time.Time
+	buckets map[string]*bucket
+	swept   time.Time
+	sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate requests per second to every
+// client, and burst at once.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow takes a token from the client's bucket. If none is available, it
+// returns false and how long until one will be.
+func (l *RateLimiter) allow(client string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets clients whose buckets have refilled, so the map doesn't grow
+// without bound.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// RateLimit wraps a handler, limiting mutating requests per client. Reads,
+// and requests for which exempt, if not nil, returns true, are never limited.
+// A nil limiter disables limiting.
+func RateLimit(l *RateLimiter, exempt func(*http.Request) bool, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET", r.Method == "HEAD", r.Method == "OPTIONS":
+		case exempt != nil && exempt(r):
+		default:
+			if ok, wait := l.allow(remoteIP(r)); !ok {
+				w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+				errors.Write(w, errors.StatusTooManyRequests, errors.Errorf(errors.StatusTooManyRequests, errors.RateLimited, "rate limit exceeded; retry in %s", wait))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/soundcloud/harpoon/lib/errors"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var (
+		now = time.Unix(0, 0)
+		l   = NewRateLimiter(2, 3) // 2/s, burst 3
+	)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("1.2.3.4"); !ok {
+			t.Fatalf("request %d: expected allowed, got denied", i)
+		}
+	}
+	ok, wait := l.allow("1.2.3.4")
+	if ok {
+		t.Fatal("expected denied after burst, got allowed")
+	}
+	if expected, got := 500*time.Millisecond, wait; expected != got {
+		t.Errorf("expected wait %s, got %s", expected, got)
+	}
+	if ok, _ := l.allow("5.6.7.8"); !ok {
+		t.Error("expected other client allowed, got denied")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("1.2.3.4"); !ok {
+		t.Error("expected allowed after refill, got denied")
+	}
+
+	now = now.Add(time.Hour)
+	l.allow("9.9.9.9") // triggers sweep
+	if expected, got := 1, len(l.buckets); expected != got {
+		t.Errorf("expected %d bucket(s) after sweep, got %d", expected, got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := RateLimit(NewRateLimiter(1, 1), nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, testCase := range []struct {
+		method   string
+		expected int
+	}{
+		{"POST", http.StatusOK},
+		{"POST", errors.StatusTooManyRequests},
+		{"GET", http.StatusOK},
+	} {
+		r, _ := http.NewRequest(testCase.method, "/schedule", nil)
+		r.RemoteAddr = "1.2.3.4:5678"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if expected, got := testCase.expected, w.Code; expected != got {
+			t.Errorf("%d: %s: expected %d, got %d", i, testCase.method, expected, got)
+		}
+	}
+}